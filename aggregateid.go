@@ -0,0 +1,31 @@
+package eventstore
+
+import "context"
+
+// AggregateID is implemented by typed aggregate IDs, eg: uuid.UUID.
+// The storage remains string based, through String().
+type AggregateID interface {
+	String() string
+}
+
+// StringID is an AggregateID for plain string IDs
+type StringID string
+
+func (id StringID) String() string {
+	return string(id)
+}
+
+// SetAggregateID sets the ID of the aggregate from a typed ID
+func (a *RootAggregate) SetAggregateID(id AggregateID) {
+	a.ID = id.String()
+}
+
+// GetByAggregateID is the same as GetByID, for a typed ID
+func (es EventStore) GetByAggregateID(ctx context.Context, id AggregateID) (Aggregater, error) {
+	return es.GetByID(ctx, id.String())
+}
+
+// ExecByAggregateID is the same as Exec, for a typed ID
+func (es EventStore) ExecByAggregateID(ctx context.Context, id AggregateID, do func(Aggregater) (Aggregater, error), options ...SaveOption) error {
+	return es.Exec(ctx, id.String(), do, options...)
+}
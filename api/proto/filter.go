@@ -0,0 +1,79 @@
+package proto
+
+import (
+	"sort"
+
+	"github.com/quintans/eventstore/store"
+)
+
+// FromFilter converts a store filter into its protobuf message.
+// The labels are flattened into one Label per value, sorted by key, to have a stable encoding.
+// ApproximateCount is not converted, since the Store service does not count events.
+func FromFilter(filter store.Filter) *Filter {
+	return &Filter{
+		AggregateTypes: copyStrings(filter.AggregateTypes),
+		Labels:         fromLabels(filter.Labels),
+		Partitions:     filter.Partitions,
+		PartitionLow:   filter.PartitionLow,
+		PartitionHi:    filter.PartitionHi,
+		ExcludeLabels:  fromLabels(filter.ExcludeLabels),
+		UpperBound:     filter.UpperBound,
+		Projection:     int32(filter.Projection),
+		PartialResults: filter.PartialResults,
+		ExternalIds:    copyStrings(filter.ExternalIDs),
+	}
+}
+
+// ToFilter converts a protobuf filter message into a store filter, grouping the label values by key.
+// A nil message is an empty filter.
+func ToFilter(pbFilter *Filter) store.Filter {
+	if pbFilter == nil {
+		return store.Filter{}
+	}
+	filter := store.Filter{
+		AggregateTypes: copyStrings(pbFilter.AggregateTypes),
+		Labels:         toLabels(pbFilter.Labels),
+		Partitions:     pbFilter.Partitions,
+		PartitionLow:   pbFilter.PartitionLow,
+		PartitionHi:    pbFilter.PartitionHi,
+		UpperBound:     pbFilter.UpperBound,
+		Projection:     store.Projection(pbFilter.Projection),
+		PartialResults: pbFilter.PartialResults,
+	}
+	if len(pbFilter.ExcludeLabels) > 0 {
+		filter.ExcludeLabels = toLabels(pbFilter.ExcludeLabels)
+	}
+	if len(pbFilter.ExternalIds) > 0 {
+		filter.ExternalIDs = copyStrings(pbFilter.ExternalIds)
+	}
+	return filter
+}
+
+func copyStrings(values []string) []string {
+	c := make([]string, len(values))
+	copy(c, values)
+	return c
+}
+
+func fromLabels(labels store.Labels) []*Label {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pbLabels := []*Label{}
+	for _, key := range keys {
+		for _, value := range labels[key] {
+			pbLabels = append(pbLabels, &Label{Key: key, Value: value})
+		}
+	}
+	return pbLabels
+}
+
+func toLabels(pbLabels []*Label) store.Labels {
+	labels := store.Labels{}
+	for _, v := range pbLabels {
+		labels[v.Key] = append(labels[v.Key], v.Value)
+	}
+	return labels
+}
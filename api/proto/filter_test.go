@@ -0,0 +1,52 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterConversion(t *testing.T) {
+	filter := store.Filter{
+		AggregateTypes: []string{"Account", "Order"},
+		Labels:         store.Labels{"geo": {"EU", "US"}, "membership": {"prime"}},
+		Partitions:     4,
+		PartitionLow:   2,
+		PartitionHi:    3,
+	}
+	pbFilter := FromFilter(filter)
+	assert.Equal(t, []*Label{
+		{Key: "geo", Value: "EU"},
+		{Key: "geo", Value: "US"},
+		{Key: "membership", Value: "prime"},
+	}, pbFilter.Labels)
+	assert.Equal(t, filter, ToFilter(pbFilter))
+
+	assert.Equal(t, store.Filter{}, ToFilter(nil))
+}
+
+func TestFilterConversionAllFields(t *testing.T) {
+	filter := store.Filter{
+		AggregateTypes: []string{"Account"},
+		Labels:         store.Labels{"geo": {"EU"}},
+		ExcludeLabels:  store.Labels{"source": {"self", "replay"}},
+		Partitions:     2,
+		PartitionLow:   1,
+		PartitionHi:    1,
+		UpperBound:     "event-id",
+		Projection:     store.MinimalProjection,
+		PartialResults: true,
+		ExternalIDs:    []string{"ext-1", "ext-2"},
+	}
+
+	// going over the wire
+	data, err := proto.Marshal(FromFilter(filter))
+	require.NoError(t, err)
+	pbFilter := &Filter{}
+	require.NoError(t, proto.Unmarshal(data, pbFilter))
+
+	assert.Equal(t, filter, ToFilter(pbFilter))
+}
@@ -5,10 +5,15 @@ import (
 
 	"github.com/quintans/eventstore/common"
 	"github.com/quintans/faults"
+	"google.golang.org/protobuf/proto"
 )
 
 type JSONCodec struct{}
 
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
 func (JSONCodec) Encode(v interface{}) ([]byte, error) {
 	b, err := json.Marshal(v)
 	return b, faults.Wrap(err)
@@ -19,17 +24,109 @@ func (JSONCodec) Decode(data []byte, v interface{}) error {
 	return faults.Wrap(err)
 }
 
+// ProtoCodec encodes the events, and the aggregates for the snapshots, that are protobuf messages, ie, implement proto.Message,
+// reducing their size compared to JSON.
+// Since messages must not be copied, the rehydrated protobuf events are not dereferenced, unlike other events.
+type ProtoCodec struct{}
+
+func (ProtoCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (ProtoCodec) Encode(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, faults.Errorf("Unable to encode %T: not a proto.Message", v)
+	}
+	b, err := proto.Marshal(m)
+	return b, faults.Wrap(err)
+}
+
+func (ProtoCodec) Decode(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return faults.Errorf("Unable to decode into %T: not a proto.Message", v)
+	}
+	err := proto.Unmarshal(data, m)
+	return faults.Wrap(err)
+}
+
+// EncodeLabels encodes the event labels with the codec, falling back to JSONCodec if the codec is nil.
+// This is the single place where the repositories and the feeds serialize labels.
+func EncodeLabels(codec Encoder, labels map[string]interface{}) ([]byte, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	b, err := codec.Encode(labels)
+	if err != nil {
+		return nil, faults.Errorf("Unable to encode labels: %w", err)
+	}
+	return b, nil
+}
+
+// DecodeLabels decodes data into labels with the codec, falling back to JSONCodec if the codec is nil.
+// Decoded keys are added to the existing ones, so labels can be merged from more than one source.
+// Empty data is ignored.
+func DecodeLabels(codec Decoder, data []byte, labels map[string]interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	err := codec.Decode(data, &labels)
+	if err != nil {
+		return faults.Errorf("Unable to decode labels: %w", err)
+	}
+	return nil
+}
+
+// UnknownEvent holds an event whose kind the factory does not know, eg: written by a newer producer,
+// with its body as stored, so that a consumer can skip it instead of failing (see RehydrateEventOrUnknown).
+type UnknownEvent struct {
+	Kind string
+	Body []byte
+}
+
+func (e UnknownEvent) GetType() string {
+	return e.Kind
+}
+
 func RehydrateAggregate(factory Factory, decoder Decoder, upcaster Upcaster, kind string, body []byte) (Typer, error) {
-	return rehydrate(factory, decoder, upcaster, kind, body, false)
+	return rehydrate(factory, decoder, upcaster, kind, body, false, false)
 }
 
 func RehydrateEvent(factory Factory, decoder Decoder, upcaster Upcaster, kind string, body []byte) (Typer, error) {
-	return rehydrate(factory, decoder, upcaster, kind, body, true)
+	return rehydrate(factory, decoder, upcaster, kind, body, true, false)
 }
 
-func rehydrate(factory Factory, decoder Decoder, upcaster Upcaster, kind string, body []byte, dereference bool) (Typer, error) {
+// RehydrateEventOrUnknown rehydrates like RehydrateEvent but, if the factory fails to create the kind,
+// returns an UnknownEvent instead of the error.
+func RehydrateEventOrUnknown(factory Factory, decoder Decoder, upcaster Upcaster, kind string, body []byte) (Typer, error) {
+	return rehydrate(factory, decoder, upcaster, kind, body, true, true)
+}
+
+func rehydrate(factory Factory, decoder Decoder, upcaster Upcaster, kind string, body []byte, dereference, fallback bool) (Typer, error) {
+	if kind == RedactedKind {
+		e := Redacted{}
+		if err := (JSONCodec{}).Decode(body, &e); err != nil {
+			return nil, faults.Errorf("Unable to decode event %s: %w", kind, err)
+		}
+		return e, nil
+	}
+	if kind == StreamClosedKind {
+		e := StreamClosed{}
+		if err := (JSONCodec{}).Decode(body, &e); err != nil {
+			return nil, faults.Errorf("Unable to decode event %s: %w", kind, err)
+		}
+		return e, nil
+	}
+
 	e, err := factory.New(kind)
 	if err != nil {
+		if fallback {
+			return UnknownEvent{Kind: kind, Body: body}, nil
+		}
 		return nil, err
 	}
 	if len(body) > 0 {
@@ -42,7 +139,7 @@ func rehydrate(factory Factory, decoder Decoder, upcaster Upcaster, kind string,
 		e = upcaster.Upcast(e)
 	}
 
-	if dereference {
+	if _, ok := e.(proto.Message); dereference && !ok {
 		e2 := common.Dereference(e)
 		return e2.(Typer), nil
 	}
@@ -0,0 +1,42 @@
+package eventstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// NameChanged is a protobuf event, reusing a well known type as its message
+type NameChanged struct {
+	*wrapperspb.StringValue
+}
+
+func (NameChanged) GetType() string {
+	return "NameChanged"
+}
+
+type protoFactory struct{}
+
+func (protoFactory) New(kind string) (Typer, error) {
+	return &NameChanged{StringValue: &wrapperspb.StringValue{}}, nil
+}
+
+func TestProtoCodec(t *testing.T) {
+	codec := ProtoCodec{}
+	body, err := codec.Encode(&NameChanged{StringValue: wrapperspb.String("Paulo")})
+	require.NoError(t, err)
+
+	e, err := RehydrateEvent(protoFactory{}, codec, nil, "NameChanged", body)
+	require.NoError(t, err)
+	// the message is not copied
+	changed, ok := e.(*NameChanged)
+	require.True(t, ok, "expected *NameChanged, got %T", e)
+	assert.Equal(t, "Paulo", changed.GetValue())
+
+	_, err = codec.Encode(struct{ Name string }{Name: "Paulo"})
+	require.Error(t, err)
+	err = codec.Decode(body, &struct{ Name string }{})
+	require.Error(t, err)
+}
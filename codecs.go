@@ -0,0 +1,78 @@
+package eventstore
+
+// ContentTypeLabel is the label recording the content type of the codec that encoded the events of a save,
+// when there are codecs per aggregate type (see WithAggregateCodec)
+const ContentTypeLabel = "content_type"
+
+// SchemaVersionLabel is the label where the application may record the version of the schema of the events of a save,
+// eg: with eventstore.WithLabels, so that remote consumers know which schema to decode the events with
+const SchemaVersionLabel = "schema_version"
+
+// ContentTyper is implemented by the codecs that identify their encoding, eg: application/json
+type ContentTyper interface {
+	ContentType() string
+}
+
+// WithAggregateCodec sets the codec used to encode and decode the events and snapshots of the aggregate type,
+// instead of the default codec (see WithCodec), so that serialization can be migrated per bounded context.
+// If the codec implements ContentTyper, its content type is recorded in the ContentTypeLabel of the saved events,
+// and those events are decoded by the codec with that content type, even after the codec of the aggregate type changes.
+// Snapshots are always decoded by the current codec of the aggregate type.
+// Forget uses the codec of the aggregate type of the forgotten aggregate.
+func WithAggregateCodec(aggregateType string, codec Codec) EsOptions {
+	return func(r *EventStore) {
+		if r.codecs == nil {
+			r.codecs = map[string]Codec{}
+		}
+		r.codecs[aggregateType] = codec
+	}
+}
+
+// codecOf returns the codec of the aggregate type, falling back to the default codec
+func (es EventStore) codecOf(aggregateType string) Codec {
+	if c, ok := es.codecs[aggregateType]; ok {
+		return c
+	}
+	return es.codec
+}
+
+// decoderOf returns the codec that encoded the event, identified by its content type label,
+// falling back to the codec of its aggregate type
+func (es EventStore) decoderOf(e Event) Decoder {
+	contentType, _ := e.Labels[ContentTypeLabel].(string)
+	if contentType != "" {
+		if c, ok := es.codec.(ContentTyper); ok && c.ContentType() == contentType {
+			return es.codec
+		}
+		for _, codec := range es.codecs {
+			if c, ok := codec.(ContentTyper); ok && c.ContentType() == contentType {
+				return codec
+			}
+		}
+	}
+	codec := es.codecOf(e.AggregateType)
+	if _, ok := codec.(ContentTyper); ok && contentType == "" {
+		// the events encoded by this codec have the label, so this one was saved before the codec was set
+		return es.codec
+	}
+	return codec
+}
+
+// contentTypeLabels adds the content type of the codec to the labels, if there are codecs per aggregate type
+func (es EventStore) contentTypeLabels(codec Codec, labels map[string]interface{}) map[string]interface{} {
+	c, ok := codec.(ContentTyper)
+	if len(es.codecs) == 0 || !ok {
+		return labels
+	}
+	withContentType := make(map[string]interface{}, len(labels)+1)
+	for k, v := range labels {
+		withContentType[k] = v
+	}
+	withContentType[ContentTypeLabel] = c.ContentType()
+	return withContentType
+}
+
+// DecodeEvent rehydrates a stored event with the codec that encoded it (see WithAggregateCodec)
+func (es EventStore) DecodeEvent(e Event) (Typer, error) {
+	return es.rehydrateEvent(es.decoderOf(e), e.Kind, e.Body)
+}
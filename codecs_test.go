@@ -0,0 +1,150 @@
+package eventstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/quintans/faults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memRepo keeps the events in memory, without snapshots, and the idempotency keys in keys, if any
+type memRepo struct {
+	EsRepository
+
+	events []Event
+	keys   memIdempotencies
+}
+
+func (r *memRepo) SaveEvent(ctx context.Context, eRec EventRecord) (string, []Event, error) {
+	if eRec.IdempotencyTTL != nil {
+		if r.keys == nil {
+			return "", nil, ErrIdempotencyStoreUnsupported
+		}
+		if _, ok := r.keys[eRec.AggregateType+"/"+eRec.IdempotencyKey]; ok {
+			return "", nil, ErrIdempotencyKeyConflict
+		}
+		r.keys[eRec.AggregateType+"/"+eRec.IdempotencyKey] = *eRec.IdempotencyTTL
+	}
+	version := eRec.Version
+	saved := []Event{}
+	for _, d := range eRec.Details {
+		version++
+		saved = append(saved, Event{
+			// the IDs are set by the repository
+			ID:               fmt.Sprintf("%s:%d", eRec.AggregateID, version),
+			AggregateID:      eRec.AggregateID,
+			AggregateVersion: version,
+			AggregateType:    eRec.AggregateType,
+			IdempotencyKey:   eRec.IdempotencyKey,
+			Kind:             d.Kind,
+			Body:             d.Body,
+			ExternalID:       d.ExternalID,
+			Labels:           eRec.Labels,
+			CreatedAt:        eRec.CreatedAt,
+			Epoch:            eRec.Epoch,
+		})
+	}
+	for _, e := range saved {
+		if eRec.IdempotencyTTL != nil {
+			// the key is kept apart from the events
+			e.IdempotencyKey = ""
+		}
+		r.events = append(r.events, e)
+	}
+	return saved[len(saved)-1].ID, saved, nil
+}
+
+func (r *memRepo) GetSnapshot(ctx context.Context, aggregateID string) (Snapshot, error) {
+	return Snapshot{}, nil
+}
+
+func (r *memRepo) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]Event, error) {
+	events := []Event{}
+	for _, e := range r.events {
+		if int(e.AggregateVersion) > snapVersion {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// prefixCodec is a JSON codec whose output starts with a prefix
+type prefixCodec string
+
+func (c prefixCodec) Encode(v interface{}) ([]byte, error) {
+	b, err := JSONCodec{}.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(c), b...), nil
+}
+
+func (c prefixCodec) Decode(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, []byte(c)) {
+		return faults.Errorf("missing prefix %s in %s", string(c), string(data))
+	}
+	return JSONCodec{}.Decode(data[len(c):], v)
+}
+
+func (c prefixCodec) ContentType() string {
+	return "application/x-" + string(c)
+}
+
+func TestAggregateCodec(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+
+	save := func(es EventStore, by int) {
+		a, err := GivenEvents(nil, nil, newCounter())
+		require.NoError(t, err)
+		c := a.(*counter)
+		c.ID = "1"
+		c.Version = uint32(len(r.events))
+		c.Increment(by)
+		require.NoError(t, es.Save(ctx, c))
+	}
+
+	es := NewEventStore(r, 100, counterFactory{})
+	save(es, 1)
+	assert.Nil(t, r.events[0].Labels[ContentTypeLabel])
+
+	es = NewEventStore(r, 100, counterFactory{}, WithAggregateCodec("Counter", prefixCodec("v1")))
+	save(es, 2)
+	assert.Equal(t, "application/x-v1", r.events[1].Labels[ContentTypeLabel])
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, a.(*counter).Total)
+
+	// the codec changes but the events already saved still decode with the codec that encoded them
+	es = NewEventStore(r, 100, counterFactory{},
+		WithAggregateCodec("Counter", prefixCodec("v2")),
+		WithAggregateCodec("Legacy", prefixCodec("v1")),
+	)
+	save(es, 3)
+	assert.True(t, bytes.HasPrefix(r.events[2].Body, []byte("v2")))
+	a, err = es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 6, a.(*counter).Total)
+}
+
+func TestUnknownEvents(t *testing.T) {
+	e, err := RehydrateEventOrUnknown(counterFactory{}, JSONCodec{}, nil, "Incremented", []byte(`{"by":3}`))
+	require.NoError(t, err)
+	assert.Equal(t, Incremented{By: 3}, e)
+
+	stored := Event{Kind: "Decremented", Body: []byte(`{"by":1}`)}
+
+	es := NewEventStore(&memRepo{}, 100, counterFactory{})
+	_, err = es.DecodeEvent(stored)
+	require.Error(t, err)
+
+	es = NewEventStore(&memRepo{}, 100, counterFactory{}, WithUnknownEvents())
+	e, err = es.DecodeEvent(stored)
+	require.NoError(t, err)
+	assert.Equal(t, UnknownEvent{Kind: "Decremented", Body: []byte(`{"by":1}`)}, e)
+	assert.Equal(t, "Decremented", e.GetType())
+}
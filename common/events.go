@@ -17,15 +17,39 @@ const (
 	MinEventID = ""
 )
 
+// NewEventID creates an event ID that is totally ordered by creation time, aggregate ID and version.
+// Events of different aggregates created in the same millisecond are ordered by aggregate ID,
+// so no two events of different aggregates can collide,
+// and events of the same aggregate created in the same millisecond, eg: in the same save, are ordered by version.
+// Aggregate IDs that are not UUIDs are converted into a deterministic name based UUID.
 func NewEventID(createdAt time.Time, aggregateID string, version uint32) string {
-	var id uuid.UUID
-	if aggregateID != "" {
-		id, _ = uuid.Parse(aggregateID)
-	} else {
-		id = uuid.UUID{}
+	return NewEventIDWithNode(createdAt, aggregateID, version, 0)
+}
+
+// NewEventIDWithNode creates an event ID, as NewEventID, followed by the node identifier, if not zero (see eventid.EventID.StringWithNode).
+// The node only breaks ties between IDs that would otherwise be equal, so the ID order, used by the pollers, is kept.
+func NewEventIDWithNode(createdAt time.Time, aggregateID string, version uint32, node uint16) string {
+	eid := eventid.New(createdAt, AggregateUUID(aggregateID), version)
+	return eid.StringWithNode(node)
+}
+
+// MinEventIDAt returns an event ID lower than the IDs of any event created at or after t,
+// so that reading the events after it skips the ones created before t.
+func MinEventIDAt(t time.Time) string {
+	return eventid.New(t, uuid.UUID{}, 0).String()
+}
+
+// AggregateUUID returns the UUID of the aggregate ID.
+// If the aggregate ID is not a UUID, a name based UUID (SHA-1) is returned
+func AggregateUUID(aggregateID string) uuid.UUID {
+	if aggregateID == "" {
+		return uuid.UUID{}
+	}
+	id, err := uuid.Parse(aggregateID)
+	if err != nil {
+		return uuid.NewSHA1(uuid.Nil, []byte(aggregateID))
 	}
-	eid := eventid.New(createdAt, id, version)
-	return eid.String()
+	return id
 }
 
 // NewMessageID creates a message ID by concatenating eventID and count
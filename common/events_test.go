@@ -0,0 +1,117 @@
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quintans/eventstore/eventid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEventIDSameMillisecond(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+
+	type key struct {
+		aggregateID string
+		version     uint32
+	}
+	keys := []key{}
+	ids := map[string]key{}
+	for i := 0; i < 1000; i++ {
+		// mixing UUID and non UUID aggregate IDs
+		aggregateID := uuid.New().String()
+		if i%2 == 0 {
+			aggregateID = "aggregate-" + strconv.Itoa(i)
+		}
+		for v := uint32(1); v <= 3; v++ {
+			k := key{aggregateID: aggregateID, version: v}
+			id := NewEventID(now, aggregateID, v)
+			_, exists := ids[id]
+			require.False(t, exists, "collision for %s", id)
+			ids[id] = k
+			keys = append(keys, k)
+		}
+	}
+
+	// the order is stable: by aggregate and then by version
+	sort.Slice(keys, func(i, j int) bool {
+		a := AggregateUUID(keys[i].aggregateID).String()
+		b := AggregateUUID(keys[j].aggregateID).String()
+		if a == b {
+			return keys[i].version < keys[j].version
+		}
+		return a < b
+	})
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	for i, id := range sorted {
+		assert.Equal(t, keys[i], ids[id])
+	}
+}
+
+func TestNewEventIDOrderedByVersion(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	for _, aggregateID := range []string{uuid.New().String(), "aggregate"} {
+		// crossing byte boundaries of the version
+		for _, from := range []uint32{1, 254, 65534} {
+			last := NewEventID(now, aggregateID, from)
+			for v := from + 1; v < from+4; v++ {
+				id := NewEventID(now, aggregateID, v)
+				assert.Less(t, last, id, "version %d", v)
+				last = id
+			}
+		}
+	}
+}
+
+func TestNewEventIDWithNode(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	aggregateID := uuid.New().String()
+
+	plain := NewEventID(now, aggregateID, 1)
+	assert.Equal(t, plain, NewEventIDWithNode(now, aggregateID, 1, 0))
+
+	id1 := NewEventIDWithNode(now, aggregateID, 1, 1)
+	id2 := NewEventIDWithNode(now, aggregateID, 1, 2)
+	assert.NotEqual(t, id1, id2)
+	// the node is the lowest priority tie breaker
+	assert.True(t, strings.HasPrefix(id1, plain))
+	assert.Less(t, plain, id1)
+	assert.Less(t, id1, id2)
+	assert.Less(t, NewEventIDWithNode(now, aggregateID, 1, 65535), NewEventIDWithNode(now, aggregateID, 2, 1))
+	assert.Less(t, NewEventIDWithNode(now, aggregateID, 2, 65535), NewEventIDWithNode(now.Add(time.Millisecond), aggregateID, 1, 1))
+
+	node, err := eventid.Node(id2)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(2), node)
+	eid, err := eventid.Parse(id2)
+	require.NoError(t, err)
+	assert.Equal(t, plain, eid.String())
+
+	delayed, err := DelayEventID(id2, time.Second)
+	require.NoError(t, err)
+	assert.Less(t, delayed, plain)
+}
+
+func TestAggregateUUID(t *testing.T) {
+	id := uuid.New()
+	assert.Equal(t, id, AggregateUUID(id.String()))
+	assert.Equal(t, uuid.UUID{}, AggregateUUID(""))
+	assert.Equal(t, AggregateUUID("account-1"), AggregateUUID("account-1"))
+	assert.NotEqual(t, AggregateUUID("account-1"), AggregateUUID("account-2"))
+}
+
+func TestMinEventIDAt(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	lowest := MinEventIDAt(now)
+	assert.True(t, lowest < NewEventID(now, uuid.New().String(), 1))
+	assert.True(t, lowest > NewEventID(now.Add(-time.Millisecond), uuid.New().String(), 1))
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// Retry calls fn until it succeeds or the number of attempts is exhausted, doubling the wait between attempts.
+// The last error is returned if all attempts fail.
+// A value of attempts lower than 1 is treated as 1.
+func Retry(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	wait := backoff
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if i == attempts-1 {
+			break
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		wait *= 2
+	}
+	return err
+}
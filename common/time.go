@@ -0,0 +1,64 @@
+package common
+
+import (
+	"time"
+
+	"github.com/quintans/faults"
+)
+
+// DefaultTimeLayouts are the timestamp layouts of the databases, tried in order:
+// ISO 8601 with and without a zone, as in the JSON of PostgreSQL, and with a space separator, as in the MySQL binlog.
+// The zone can also be only the hours, eg: "+00", as PostgreSQL prints it.
+// The fractional seconds are optional in every layout.
+var DefaultTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// TimeParser parses the timestamps read by the feeds, eg: from the JSON of a notification or from a binlog row.
+type TimeParser struct {
+	layouts  []string
+	location *time.Location
+}
+
+type TimeParserOption func(*TimeParser)
+
+// WithTimeLayouts sets the layouts tried, in order, when parsing. Defaults to DefaultTimeLayouts.
+func WithTimeLayouts(layouts ...string) TimeParserOption {
+	return func(p *TimeParser) {
+		p.layouts = layouts
+	}
+}
+
+// WithTimeLocation sets the location of the timestamps without a zone, eg: the time zone of the database session. Defaults to UTC.
+func WithTimeLocation(location *time.Location) TimeParserOption {
+	return func(p *TimeParser) {
+		p.location = location
+	}
+}
+
+func NewTimeParser(options ...TimeParserOption) TimeParser {
+	p := TimeParser{
+		layouts:  DefaultTimeLayouts,
+		location: time.UTC,
+	}
+	for _, o := range options {
+		o(&p)
+	}
+	return p
+}
+
+// Parse parses s with the first matching layout, returning the time in UTC
+func (p TimeParser) Parse(s string) (time.Time, error) {
+	for _, layout := range p.layouts {
+		t, err := time.ParseInLocation(layout, s, p.location)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, faults.Errorf("Unable to parse the time '%s' with the layouts %v", s, p.layouts)
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeParser(t *testing.T) {
+	lisbon := time.FixedZone("WEST", 3600)
+
+	testCases := []struct {
+		name     string
+		parser   TimeParser
+		value    string
+		expected time.Time
+	}{
+		{
+			name:     "with zone",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04T10:20:30Z",
+			expected: time.Date(2021, 3, 4, 10, 20, 30, 0, time.UTC),
+		},
+		{
+			name:     "with offset",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04T10:20:30+01:00",
+			expected: time.Date(2021, 3, 4, 9, 20, 30, 0, time.UTC),
+		},
+		{
+			name:     "with hours offset",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04 10:20:30.5+01",
+			expected: time.Date(2021, 3, 4, 9, 20, 30, 500000000, time.UTC),
+		},
+		{
+			name:     "without zone",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04T10:20:30",
+			expected: time.Date(2021, 3, 4, 10, 20, 30, 0, time.UTC),
+		},
+		{
+			name:     "with fractional seconds",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04T10:20:30.123456",
+			expected: time.Date(2021, 3, 4, 10, 20, 30, 123456000, time.UTC),
+		},
+		{
+			name:     "with space separator",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04 10:20:30",
+			expected: time.Date(2021, 3, 4, 10, 20, 30, 0, time.UTC),
+		},
+		{
+			name:     "with space separator and fractional seconds",
+			parser:   NewTimeParser(),
+			value:    "2021-03-04 10:20:30.123",
+			expected: time.Date(2021, 3, 4, 10, 20, 30, 123000000, time.UTC),
+		},
+		{
+			name:     "without zone in location",
+			parser:   NewTimeParser(WithTimeLocation(lisbon)),
+			value:    "2021-03-04 10:20:30",
+			expected: time.Date(2021, 3, 4, 9, 20, 30, 0, time.UTC),
+		},
+		{
+			name:     "with zone ignores location",
+			parser:   NewTimeParser(WithTimeLocation(lisbon)),
+			value:    "2021-03-04T10:20:30Z",
+			expected: time.Date(2021, 3, 4, 10, 20, 30, 0, time.UTC),
+		},
+		{
+			name:     "custom layout",
+			parser:   NewTimeParser(WithTimeLayouts("02/01/2006 15:04")),
+			value:    "04/03/2021 10:20",
+			expected: time.Date(2021, 3, 4, 10, 20, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.parser.Parse(tc.value)
+			require.NoError(t, err)
+			assert.True(t, tc.expected.Equal(got), "expected %s, got %s", tc.expected, got)
+			assert.Equal(t, time.UTC, got.Location())
+		})
+	}
+
+	_, err := NewTimeParser().Parse("yesterday")
+	require.Error(t, err)
+}
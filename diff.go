@@ -0,0 +1,134 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/quintans/faults"
+)
+
+var ErrVersionNotFound = errors.New("aggregate version not found")
+
+// diffIgnoredFields are the bookkeeping fields of RootAggregate, that change on every event or stream epoch
+var diffIgnoredFields = map[string]bool{
+	"version":        true,
+	"events_counter": true,
+	"epoch":          true,
+}
+
+// FieldChange is a change of a field between two states of an aggregate.
+// From is nil for added fields and To is nil for removed fields.
+type FieldChange struct {
+	// Path of the field, eg: owner.address.city or items[2]
+	Path string
+	From interface{}
+	To   interface{}
+}
+
+// GetByIDAtVersion rehydrates the aggregate as it was at the given version, replaying its events from the start, ignoring snapshots.
+// If the aggregate never had that version, ErrVersionNotFound is returned.
+func (es EventStore) GetByIDAtVersion(ctx context.Context, aggregateID string, version uint32) (Aggregater, error) {
+	release, err := es.acquireLoad(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	events, err := es.store.GetAggregateEvents(ctx, aggregateID, -1)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for k, e := range events {
+		if e.AggregateVersion > version {
+			events = events[:k]
+			break
+		}
+		found = found || e.AggregateVersion == version
+	}
+	if !found {
+		return nil, faults.Errorf("Unable to get aggregate '%s' at version %d: %w", aggregateID, version, ErrVersionNotFound)
+	}
+	return es.replay(aggregateID, nil, events)
+}
+
+// DiffVersions returns the fields of the aggregate state that changed between two versions, sorted by path.
+// The states are compared through their JSON representation, so only the exported fields are considered,
+// and the bookkeeping fields, like the version, are ignored.
+// If any of the versions does not exist, ErrVersionNotFound is returned.
+func (es EventStore) DiffVersions(ctx context.Context, aggregateID string, from, to uint32) ([]FieldChange, error) {
+	before, err := es.stateAtVersion(ctx, aggregateID, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := es.stateAtVersion(ctx, aggregateID, to)
+	if err != nil {
+		return nil, err
+	}
+	for k := range diffIgnoredFields {
+		delete(before, k)
+		delete(after, k)
+	}
+
+	changes := []FieldChange{}
+	diffValues("", before, after, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func (es EventStore) stateAtVersion(ctx context.Context, aggregateID string, version uint32) (map[string]interface{}, error) {
+	a, err := es.GetByIDAtVersion(ctx, aggregateID, version)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, faults.Errorf("Unable to marshal aggregate '%s' at version %d: %w", aggregateID, version, err)
+	}
+	state := map[string]interface{}{}
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, faults.Errorf("Unable to unmarshal aggregate '%s' at version %d: %w", aggregateID, version, err)
+	}
+	return state, nil
+}
+
+func diffValues(path string, from, to interface{}, changes *[]FieldChange) {
+	switch f := from.(type) {
+	case map[string]interface{}:
+		if t, ok := to.(map[string]interface{}); ok {
+			for k, v := range f {
+				diffValues(joinPath(path, k), v, t[k], changes)
+			}
+			for k, v := range t {
+				if _, ok := f[k]; !ok {
+					diffValues(joinPath(path, k), nil, v, changes)
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if t, ok := to.([]interface{}); ok && len(f) == len(t) {
+			for k := range f {
+				diffValues(fmt.Sprintf("%s[%d]", path, k), f[k], t[k], changes)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, FieldChange{Path: path, From: from, To: to})
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
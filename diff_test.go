@@ -0,0 +1,58 @@
+package eventstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffValues(t *testing.T) {
+	from := map[string]interface{}{
+		"name":  "a",
+		"same":  float64(1),
+		"gone":  true,
+		"inner": map[string]interface{}{"x": float64(1), "y": "b"},
+		"list":  []interface{}{"a", "b"},
+		"grown": []interface{}{"a"},
+	}
+	to := map[string]interface{}{
+		"name":  "b",
+		"same":  float64(1),
+		"added": "c",
+		"inner": map[string]interface{}{"x": float64(2), "y": "b"},
+		"list":  []interface{}{"a", "c"},
+		"grown": []interface{}{"a", "b"},
+	}
+	changes := []FieldChange{}
+	diffValues("", from, to, &changes)
+	assert.ElementsMatch(t, []FieldChange{
+		{Path: "name", From: "a", To: "b"},
+		{Path: "gone", From: true},
+		{Path: "added", To: "c"},
+		{Path: "inner.x", From: float64(1), To: float64(2)},
+		{Path: "list[1]", From: "b", To: "c"},
+		{Path: "grown", From: []interface{}{"a"}, To: []interface{}{"a", "b"}},
+	}, changes)
+
+	changes = []FieldChange{}
+	diffValues("", from, from, &changes)
+	assert.Empty(t, changes)
+}
+
+func TestDiffVersionsIgnoresEpoch(t *testing.T) {
+	ctx := context.Background()
+	es := NewEventStore(&memRepo{}, 100, counterFactory{}, WithSnapshotStore(memSnapshots{}))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c))
+	_, err := es.CloseStream(ctx, "1")
+	require.NoError(t, err)
+
+	changes, err := es.DiffVersions(ctx, "1", 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []FieldChange{{Path: "total", From: float64(1), To: float64(0)}}, changes)
+}
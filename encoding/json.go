@@ -21,10 +21,15 @@ func (m Json) MarshalJSON() ([]byte, error) {
 }
 
 // UnmarshalJSON sets *m to a copy of data.
+// A JSON null is unmarshalled to nil.
 func (m *Json) UnmarshalJSON(data []byte) error {
 	if m == nil {
 		return faults.New("common.Json: UnmarshalJSON on nil pointer")
 	}
+	if string(data) == "null" {
+		*m = nil
+		return nil
+	}
 	*m = append((*m)[0:0], data...)
 	return nil
 }
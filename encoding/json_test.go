@@ -0,0 +1,23 @@
+package encoding
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type TestJson struct {
+	Labels Json `json:"labels"`
+}
+
+func TestJsonUnmarshalNull(t *testing.T) {
+	test := TestJson{}
+	err := json.Unmarshal([]byte(`{"labels":null}`), &test)
+	require.NoError(t, err)
+	require.Nil(t, test.Labels)
+
+	err = json.Unmarshal([]byte(`{"labels":{"geo":"EU"}}`), &test)
+	require.NoError(t, err)
+	require.Equal(t, `{"geo":"EU"}`, test.Labels.String())
+}
@@ -0,0 +1,130 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quintans/faults"
+)
+
+var ErrEpochNotSupported = errors.New("aggregate does not support stream epochs")
+
+// Epocher is implemented by aggregates that support closing their stream (see CloseStream), like the ones embedding RootAggregate
+type Epocher interface {
+	GetEpoch() uint32
+	SetEpoch(uint32)
+}
+
+func (a RootAggregate) GetEpoch() uint32 {
+	return a.Epoch
+}
+
+func (a *RootAggregate) SetEpoch(epoch uint32) {
+	a.Epoch = epoch
+}
+
+// StreamClosedKind is the kind of the StreamClosed events
+const StreamClosedKind = "eventstore.StreamClosed"
+
+// StreamClosed is the event appended by CloseStream, the first of the new epoch.
+// Like Redacted, it is always encoded as JSON and rehydrated without the factory,
+// so aggregates and projections receive it like any other event and should ignore it if they do not care.
+type StreamClosed struct {
+	Epoch uint32 `json:"epoch"`
+}
+
+func (StreamClosed) GetType() string {
+	return StreamClosedKind
+}
+
+// CloseStream closes the current event stream of the aggregate and starts a new epoch, returning it.
+// A StreamClosed event is saved with the new epoch, that every event saved after it also carries (see Event.Epoch),
+// so that the epoch is read back from the events, even without snapshots.
+// The state of the aggregate is then snapshotted at that event, bootstrapping the new epoch,
+// so that GetByID does not replay the events of older epochs.
+// Without that snapshot, the events of older epochs are still skipped, and the aggregate only has the state of the new epoch.
+// The events of older epochs are kept and can still be read for audit.
+// The versions keep increasing across epochs.
+func (es EventStore) CloseStream(ctx context.Context, aggregateID string) (uint32, error) {
+	aggregate, err := es.GetByID(ctx, aggregateID)
+	if err != nil {
+		return 0, err
+	}
+	epocher, ok := aggregate.(Epocher)
+	if !ok {
+		return 0, faults.Errorf("Unable to close stream of aggregate '%s' with type '%s': %w", aggregateID, aggregate.GetType(), ErrEpochNotSupported)
+	}
+	closed := StreamClosed{Epoch: epocher.GetEpoch() + 1}
+	body, err := JSONCodec{}.Encode(closed)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if now.Before(aggregate.UpdatedAt()) {
+		now = aggregate.UpdatedAt()
+	}
+	rec := EventRecord{
+		AggregateID:   aggregate.GetID(),
+		Version:       aggregate.GetVersion(),
+		AggregateType: aggregate.GetType(),
+		Labels:        es.mergeLabels(nil),
+		CreatedAt:     now,
+		NodeID:        es.nodeID,
+		Epoch:         closed.Epoch,
+		Details: []EventRecordDetail{
+			{Kind: StreamClosedKind, Body: body},
+		},
+	}
+	id, saved, err := es.saveEvent(ctx, rec)
+	if err != nil {
+		return 0, faults.Errorf("Unable to close stream of aggregate '%s': %w", aggregateID, err)
+	}
+	es.handlePostCommit(ctx, saved)
+
+	last := saved[len(saved)-1]
+	aggregate.ApplyChangeFromHistory(EventMetadata{AggregateVersion: last.AggregateVersion, CreatedAt: last.CreatedAt}, closed)
+	epocher.SetEpoch(closed.Epoch)
+
+	// the stream is already closed, so a failed snapshot only means that the older epochs are still replayed
+	body, err = es.codecOf(aggregate.GetType()).Encode(aggregate)
+	if err != nil {
+		return closed.Epoch, es.snapshotFailed(faults.Errorf("Failed to serialize snapshot of aggregate '%s': %w", aggregateID, err))
+	}
+	snap := Snapshot{
+		ID:               id,
+		AggregateID:      aggregateID,
+		AggregateVersion: aggregate.GetVersion(),
+		AggregateType:    aggregate.GetType(),
+		Body:             body,
+		CreatedAt:        time.Now().UTC(),
+	}
+	err = es.saveSnapshot(ctx, snap)
+	if err != nil {
+		return closed.Epoch, es.snapshotFailed(faults.Errorf("Unable to save the snapshot closing the stream of aggregate '%s': %w", aggregateID, err))
+	}
+	return closed.Epoch, nil
+}
+
+// currentEpoch returns the events of the last epoch
+func currentEpoch(events []Event) []Event {
+	if len(events) == 0 {
+		return events
+	}
+	last := events[len(events)-1].Epoch
+	for k, e := range events {
+		if e.Epoch == last {
+			return events[k:]
+		}
+	}
+	return events
+}
+
+// epochOf returns the epoch of the aggregate, or zero if it does not support epochs
+func epochOf(aggregate Aggregater) uint32 {
+	if epocher, ok := aggregate.(Epocher); ok {
+		return epocher.GetEpoch()
+	}
+	return 0
+}
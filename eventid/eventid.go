@@ -17,12 +17,21 @@ const (
 	TimestampSize = 6
 	UuidSize      = 16
 	VersionSize   = 3
+
+	// NodeSize is the size of the optional node identifier appended to the event ID
+	NodeSize = 2
+	// EncodedStringSizeWithNode is the size of an encoded event ID with a node identifier.
+	// Its first EncodedStringSize characters are the same as the ones of the event ID without node.
+	EncodedStringSizeWithNode = 44
 )
 
 var (
-	ErrInvalidStringSize = errors.New("String size should be 40")
+	ErrInvalidStringSize = errors.New("String size should be 40 or 44")
 )
 
+// EventID is composed by the timestamp (millisecond precision), aggregate ID and aggregate version, in this order.
+// This guarantees a total order between events, even if they were created in the same millisecond:
+// events of the same aggregate are ordered by version and events of different aggregates by aggregate ID.
 type EventID [EncodingSize]byte
 
 func New(instant time.Time, aggregateID uuid.UUID, version uint32) EventID {
@@ -39,8 +48,23 @@ func (e EventID) String() string {
 	return encoding.Marshal(e[:])
 }
 
+// StringWithNode encodes the event ID followed by the node identifier, used as the lowest priority tie breaker,
+// so that IDs generated by different nodes, eg: regions, for the same aggregate, version and millisecond, never collide.
+// Since the node is appended, the order between IDs of different nodes is still the order of their common part.
+// Node zero means no node and the result is the same as String.
+func (e EventID) StringWithNode(node uint16) string {
+	if node == 0 {
+		return e.String()
+	}
+	b := make([]byte, EncodingSize+NodeSize)
+	copy(b, e[:])
+	copy(b[EncodingSize:], encoding.I16tob(node))
+	return encoding.Marshal(b)
+}
+
+// Parse decodes an encoded event ID, with or without node identifier, discarding the node
 func Parse(encoded string) (EventID, error) {
-	if len(encoded) != EncodedStringSize {
+	if len(encoded) != EncodedStringSize && len(encoded) != EncodedStringSizeWithNode {
 		return EventID{}, faults.Errorf("%w: %s", ErrInvalidStringSize, encoded)
 	}
 	a, err := encoding.Unmarshal(encoded)
@@ -60,6 +84,21 @@ func Parse(encoded string) (EventID, error) {
 	return eid, nil
 }
 
+// Node returns the node identifier of an encoded event ID, or zero if it has none
+func Node(encoded string) (uint16, error) {
+	if len(encoded) == EncodedStringSize {
+		return 0, nil
+	}
+	if len(encoded) != EncodedStringSizeWithNode {
+		return 0, faults.Errorf("%w: %s", ErrInvalidStringSize, encoded)
+	}
+	a, err := encoding.Unmarshal(encoded)
+	if err != nil {
+		return 0, err
+	}
+	return encoding.Btoi16(a[EncodingSize : EncodingSize+NodeSize]), nil
+}
+
 func (e EventID) Time() time.Time {
 	b := make([]byte, 8)
 	copy(b[2:], e[:TimestampSize])
@@ -8,11 +8,35 @@ import (
 	"github.com/quintans/eventstore/common"
 	"github.com/quintans/eventstore/encoding"
 	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
 )
 
+// TombstoneKind is the kind of the event emitted when all the events of an expired aggregate are purged,
+// so that projections can drop the entity.
+const TombstoneKind = "Tombstone"
+
 var (
 	ErrConcurrentModification = errors.New("concurrent modification")
-	ErrUnknownAggregateID     = errors.New("unknown aggregate ID")
+	// ErrIdempotencyKeyConflict is returned when saving with an idempotency key already used for the same aggregate type,
+	// even by a concurrent save, making the pre check with HasIdempotencyKey unnecessary.
+	ErrIdempotencyKeyConflict = errors.New("idempotency key conflict")
+	ErrAggregateNotFound      = errors.New("aggregate not found")
+	ErrEventNotFound          = errors.New("event not found")
+	// Deprecated: use ErrAggregateNotFound
+	ErrUnknownAggregateID    = ErrAggregateNotFound
+	ErrBodyTooLarge          = errors.New("event body too large")
+	ErrAggregateTypeMismatch = errors.New("aggregate type mismatch")
+	// ErrSnapshotEventMissing is returned when saving a snapshot whose event, with the same ID, does not exist,
+	// on stores where snapshots have a foreign key to the events.
+	ErrSnapshotEventMissing = errors.New("snapshot event missing")
+	// ErrSnapshotAggregateMismatch is returned when rehydrating an aggregate from the snapshot of another aggregate (see GetByIDFromSnapshot)
+	ErrSnapshotAggregateMismatch = errors.New("snapshot aggregate mismatch")
+	// ErrExternalIDConflict is returned when saving an event with an external ID that was already saved (see WithExternalIDs)
+	ErrExternalIDConflict = errors.New("external ID conflict")
+	// ErrTooManyEvents is returned when saving more events than allowed in a single save (see WithMaxEventsPerSave)
+	ErrTooManyEvents = errors.New("too many events")
+	// ErrIdempotencyStoreUnsupported is returned when saving a record with an IdempotencyTTL in a repository without an idempotency store
+	ErrIdempotencyStoreUnsupported = errors.New("idempotency store unsupported")
 )
 
 type Factory interface {
@@ -60,14 +84,37 @@ type Event struct {
 	Kind             string
 	Body             encoding.Base64
 	IdempotencyKey   string
-	Labels           map[string]interface{}
-	CreatedAt        time.Time
+	// ExternalID is the identity of the event in an external system (see WithExternalIDs)
+	ExternalID string
+	Labels     map[string]interface{}
+	CreatedAt  time.Time
+	// Epoch is the stream epoch of the aggregate when the event was saved (see EventStore.CloseStream)
+	Epoch uint32
 }
 
 func (e Event) IsZero() bool {
 	return e.ID == ""
 }
 
+// DecodeMap decodes the JSON body into a generic map, without requiring the event type to be registered.
+// This is useful for tooling that handles events for which it does not have the Go types.
+func (e Event) DecodeMap() (map[string]interface{}, error) {
+	return e.DecodeMapWith(JSONCodec{})
+}
+
+// DecodeMapWith decodes the body into a generic map, using the decoder of the codec used to encode the events.
+func (e Event) DecodeMapWith(decoder Decoder) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	if len(e.Body) == 0 {
+		return m, nil
+	}
+	err := decoder.Decode(e.Body, &m)
+	if err != nil {
+		return nil, faults.Errorf("Unable to decode event '%s' of kind '%s' into a map: %w", e.ID, e.Kind, err)
+	}
+	return m, nil
+}
+
 type Snapshot struct {
 	ID               string
 	AggregateID      string
@@ -77,15 +124,54 @@ type Snapshot struct {
 	CreatedAt        time.Time
 }
 
-type EsRepository interface {
-	SaveEvent(ctx context.Context, eRec EventRecord) (id string, version uint32, err error)
+// SnapshotMeta is the metadata of a snapshot.
+// Exists is false if the aggregate has no snapshot.
+type SnapshotMeta struct {
+	Exists           bool
+	AggregateVersion uint32
+	CreatedAt        time.Time
+}
+
+// SnapshotStore stores the snapshots of the aggregates.
+// By default the snapshots are kept by the EsRepository, but they can be moved to another datastore (see WithSnapshotStore).
+type SnapshotStore interface {
 	GetSnapshot(ctx context.Context, aggregateID string) (Snapshot, error)
+	// SaveSnapshot saves the snapshot identified by the ID of the last event it includes.
+	// It is only called after that event is committed, so that a foreign key from the snapshots to the events always holds.
 	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+}
+
+// SnapshotMetaReader is implemented by snapshot stores able to read the metadata of a snapshot without its body
+type SnapshotMetaReader interface {
+	GetSnapshotMeta(ctx context.Context, aggregateID string) (SnapshotMeta, error)
+}
+
+// IdempotencyStore reads the idempotency keys kept apart from the events, eg: in a dedicated table with expiry,
+// so that their uniqueness check does not grow with the events and the keys can expire (see WithIdempotencyStore).
+// The keys are recorded by the EsRepository, in the save transaction (see EventRecord.IdempotencyTTL).
+type IdempotencyStore interface {
+	// HasIdempotencyKey tells if the key is recorded and did not expire
+	HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error)
+}
+
+type EsRepository interface {
+	SnapshotStore
+	// SaveEvent saves the events of the record, returning the ID of the last saved record, that the snapshots reference,
+	// and the events as they were persisted, eg: with the IDs and creation time set by the store
+	SaveEvent(ctx context.Context, eRec EventRecord) (id string, events []Event, err error)
+	// GetSnapshotMeta returns the metadata of the latest snapshot, without reading its body
+	GetSnapshotMeta(ctx context.Context, aggregateID string) (SnapshotMeta, error)
 	GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]Event, error)
 	HasIdempotencyKey(ctx context.Context, aggregateID, idempotencyKey string) (bool, error)
 	Forget(ctx context.Context, request ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error
 }
 
+// ConsistentReader is implemented by repositories able to read the latest snapshot and the events after it in one call,
+// eg: in the same transaction, so that both reads see the same point in time.
+type ConsistentReader interface {
+	GetSnapshotAndEvents(ctx context.Context, aggregateID string) (Snapshot, []Event, error)
+}
+
 type EventRecord struct {
 	AggregateID    string
 	Version        uint32
@@ -93,18 +179,39 @@ type EventRecord struct {
 	IdempotencyKey string
 	Labels         map[string]interface{}
 	CreatedAt      time.Time
+	// ExpiresAt is the time after which the events can be purged. Zero means never.
+	ExpiresAt time.Time
+	// NodeID is appended to the generated event IDs (see common.NewEventIDWithNode). Zero means no node.
+	NodeID uint16
+	// ExpectedVersion, if not nil, is the version the stored aggregate must have for the save to happen (see WithExpectedVersion)
+	ExpectedVersion *uint32
+	// Epoch is the stream epoch of the aggregate (see EventStore.CloseStream), stored with every event of the record
+	Epoch uint32
+	// IdempotencyTTL, if not nil, makes the repository record the idempotency key in its idempotency store, instead of the events,
+	// in the save transaction, expiring after the duration, or never if zero (see WithIdempotencyStore).
+	// If the key is already recorded, and did not expire, the save fails with ErrIdempotencyKeyConflict.
+	// Repositories without an idempotency store fail the save with ErrIdempotencyStoreUnsupported.
+	IdempotencyTTL *time.Duration
 	Details        []EventRecordDetail
 }
 
 type EventRecordDetail struct {
 	Kind string
 	Body []byte
+	// ExternalID is the identity of the event in an external system. Empty means none.
+	ExternalID string
 }
 
 type Options struct {
 	IdempotencyKey string
 	// Labels tags the event. eg: {"geo": "EU"}
 	Labels map[string]interface{}
+	// TTL is how long the events are kept, for ephemeral streams. Zero means forever.
+	TTL time.Duration
+	// ExternalIDs are the identities of the events in an external system, one per event of the save, in order
+	ExternalIDs []string
+	// ExpectedVersion is the version the stored aggregate must have. Nil means it is not checked.
+	ExpectedVersion *uint32
 }
 
 type SaveOption func(*Options)
@@ -121,6 +228,36 @@ func WithLabels(labels map[string]interface{}) SaveOption {
 	}
 }
 
+// WithTTL makes the saved events expire after ttl, so that they can be purged by stores supporting expiry, eg: PostgreSQL.
+// When all the events of an aggregate are purged, a tombstone event (see TombstoneKind) is emitted.
+func WithTTL(ttl time.Duration) SaveOption {
+	return func(o *Options) {
+		o.TTL = ttl
+	}
+}
+
+// WithExternalIDs saves the events with the stable IDs they have in an external system, one per event of the save, in order,
+// eg: when ingesting the events of another system, keeping the correlation with it.
+// Unlike the idempotency key, that identifies a command, the external ID identifies each event.
+// Stores with an unique index on the external IDs reject an external ID that was already saved with ErrExternalIDConflict,
+// so that the ingestion can skip it.
+func WithExternalIDs(ids ...string) SaveOption {
+	return func(o *Options) {
+		o.ExternalIDs = ids
+	}
+}
+
+// WithExpectedVersion fails the save with ErrConcurrentModification if the aggregate is not at version,
+// eg: the version a client read before issuing the command, so that the conflict is detected before writing anything,
+// instead of relying on the unique index violation reported by the database.
+// Version zero expects the aggregate to have no events.
+// Stores supporting it, eg: PostgreSQL, also check the stored version, in the transaction of the save.
+func WithExpectedVersion(version uint32) SaveOption {
+	return func(o *Options) {
+		o.ExpectedVersion = &version
+	}
+}
+
 type EventStorer interface {
 	GetByID(ctx context.Context, aggregateID string) (Aggregater, error)
 	Save(ctx context.Context, aggregate Aggregater, options ...SaveOption) error
@@ -145,22 +282,223 @@ func WithUpcaster(upcaster Upcaster) EsOptions {
 	}
 }
 
+// WithMaxBodySize rejects saving events whose encoded body is larger than size bytes.
+// A value of zero, the default, disables the check.
+func WithMaxBodySize(size int) EsOptions {
+	return func(r *EventStore) {
+		r.maxBodySize = size
+	}
+}
+
+// WithSnapshotErrorHandler hands the snapshot failures of Save to fn, instead of returning them.
+// Since the events are already saved when the snapshot is written, a save failing only on the snapshot is a success for the caller,
+// and fn allows alerting or retrying, eg: on the next save, so that a transient failure does not go unnoticed.
+func WithSnapshotErrorHandler(fn func(error)) EsOptions {
+	return func(r *EventStore) {
+		r.onSnapshotError = fn
+	}
+}
+
+// WithMaxEventsPerSave rejects saving more than max events of an aggregate at once, eg: from a pathological batch command,
+// since they would be written in a single oversized transaction.
+// A value of zero, the default, disables the check.
+func WithMaxEventsPerSave(max int) EsOptions {
+	return func(r *EventStore) {
+		r.maxEventsPerSave = max
+	}
+}
+
+// WithChunkedSaves makes the saves exceeding WithMaxEventsPerSave write the events in sequential transactions,
+// of at most the max events each, with contiguous versions, instead of failing with ErrTooManyEvents.
+// A save is then no longer atomic: the events of a chunk are visible, to readers and feeds, before the next chunk is written,
+// and if a chunk fails, the previous ones stay saved. The aggregate is then left untouched, at the version before the save,
+// so that saving it again fails with ErrConcurrentModification, instead of saving the chunks again, and it must be reloaded.
+// The idempotency key and the expected version only apply to the first chunk.
+func WithChunkedSaves() EsOptions {
+	return func(r *EventStore) {
+		r.chunkedSaves = true
+	}
+}
+
+// WithDefaultLabels sets the labels applied to every saved event.
+// They are merged with the labels of each save, with the latter taking precedence on key conflicts.
+func WithDefaultLabels(labels map[string]interface{}) EsOptions {
+	return func(r *EventStore) {
+		r.defaultLabels = labels
+	}
+}
+
+// PostCommitHandler handles an event after it was committed to the event store
+type PostCommitHandler func(ctx context.Context, e Event) error
+
+// WithPostCommitHandlers registers handlers that are synchronously called, in the same process,
+// with the saved events after the events are committed.
+// A handler error is logged and does not fail the save.
+func WithPostCommitHandlers(handlers ...PostCommitHandler) EsOptions {
+	return func(r *EventStore) {
+		r.postCommitHandlers = append(r.postCommitHandlers, handlers...)
+	}
+}
+
+// WithKindNamer sets how the kind of the events is stored. By default it is the event type.
+func WithKindNamer(namer KindNamer) EsOptions {
+	return func(r *EventStore) {
+		r.kindNamer = namer
+	}
+}
+
+// ConcurrencyConflictHandler is called every time a save fails due to a concurrent modification
+type ConcurrencyConflictHandler func(ctx context.Context, aggregateType, aggregateID string)
+
+// WithConcurrencyConflictHandler registers a handler that is called on every concurrency conflict,
+// before the error is returned to the caller, so that even the retried conflicts can be measured, eg: to spot hot aggregates.
+func WithConcurrencyConflictHandler(handler ConcurrencyConflictHandler) EsOptions {
+	return func(r *EventStore) {
+		r.onConcurrencyConflict = handler
+	}
+}
+
+// WithSnapshotOnly makes the aggregates of the given types behave as last-write-wins documents:
+// a snapshot is written on every save, so that loading them never needs to replay events older than the last save.
+// The events are still written, keeping the event log (and the feeds) intact.
+// If the events of such aggregates are ever removed, rebuilding a past version from the event log is no longer possible.
+func WithSnapshotOnly(aggregateTypes ...string) EsOptions {
+	return func(r *EventStore) {
+		if r.snapshotOnly == nil {
+			r.snapshotOnly = map[string]bool{}
+		}
+		for _, t := range aggregateTypes {
+			r.snapshotOnly[t] = true
+		}
+	}
+}
+
+// OnReplay is called on every aggregate load with the number of events replayed on top of the snapshot, if any.
+// Tombstones are not counted, since they are not applied to the aggregate.
+type OnReplay func(aggregateType string, eventsReplayed int)
+
+// WithOnReplay registers a hook that is called on every load, by GetByID, with the number of events replayed on top of the snapshot.
+// This helps tuning the snapshot threshold: many replayed events means the threshold is too high for the read frequency.
+func WithOnReplay(fn OnReplay) EsOptions {
+	return func(r *EventStore) {
+		r.onReplay = fn
+	}
+}
+
+// OnSnapshot is called after every snapshot write with the size of the serialized aggregate, the write duration and the write error, if any
+type OnSnapshot func(aggregateType string, size int, took time.Duration, err error)
+
+// WithOnSnapshot registers a hook that is called on every snapshot write, by Save and CloseStream.
+// This surfaces aggregates whose snapshots grew too large, a sign that they should be split, and snapshot write latency regressions.
+func WithOnSnapshot(fn OnSnapshot) EsOptions {
+	return func(r *EventStore) {
+		r.onSnapshot = fn
+	}
+}
+
+// WithValidator validates the encoded body of every event before saving.
+// If any event of a save is invalid, none is saved and the validator error is returned.
+func WithValidator(validator Validator) EsOptions {
+	return func(r *EventStore) {
+		r.validator = validator
+	}
+}
+
+// WithNodeID appends the node identifier, eg: of the region, to the IDs of the saved events,
+// so that, in an active-active deployment, IDs generated independently by each region never collide.
+// The node is the lowest priority tie breaker, so IDs remain ordered by creation time, aggregate ID and version,
+// and the partition of an event, based on the aggregate ID, is not affected.
+// Feeds of the stores of each region can be merged by sorting the events by ID,
+// and the events of the same aggregate and version, but different nodes, are concurrent writes that must be reconciled by the consumer.
+// Zero, the default, means no node.
+func WithNodeID(id uint16) EsOptions {
+	return func(r *EventStore) {
+		r.nodeID = id
+	}
+}
+
+// WithMaxConcurrentLoads bounds the number of aggregates being loaded at the same time, by GetByID and GetByIDFromSnapshot,
+// queuing the excess callers until a load finishes or their context is done.
+// This protects the database from bursts of loads, eg: projection rebuilds. Saves are not affected.
+func WithMaxConcurrentLoads(n int) EsOptions {
+	return func(r *EventStore) {
+		if n > 0 {
+			r.loads = make(chan struct{}, n)
+		}
+	}
+}
+
 // EventStore represents the event store
 type EventStore struct {
-	store             EsRepository
-	snapshotThreshold uint32
-	upcaster          Upcaster
-	factory           Factory
-	codec             Codec
+	store EsRepository
+	// snapshots is the snapshot store, when not kept by store
+	snapshots        SnapshotStore
+	idempotencies    IdempotencyStore
+	idempotencyTTL   time.Duration
+	snapshotStrategy SnapshotStrategy
+	upcaster         Upcaster
+	factory          Factory
+	codec            Codec
+	// codecs are the codecs per aggregate type
+	codecs             map[string]Codec
+	postCommitHandlers []PostCommitHandler
+	maxBodySize        int
+	maxEventsPerSave   int
+	chunkedSaves       bool
+	defaultLabels      map[string]interface{}
+	// onConcurrencyConflict is called on every concurrency conflict
+	onConcurrencyConflict ConcurrencyConflictHandler
+	kindNamer             KindNamer
+	// snapshotOnly holds the aggregate types that are snapshotted on every save
+	snapshotOnly map[string]bool
+	onReplay     OnReplay
+	onSnapshot   OnSnapshot
+	// onSnapshotError handles the snapshot failures of Save
+	onSnapshotError func(error)
+	validator       Validator
+	nodeID          uint16
+	// unknownEvents rehydrates the events of unknown kinds as UnknownEvent
+	unknownEvents bool
+	// loads is a semaphore bounding the concurrent aggregate loads
+	loads chan struct{}
+}
+
+// WithUnknownEvents rehydrates the events of kinds unknown to the factory as UnknownEvent, instead of failing,
+// so that, during a rolling upgrade of the producers, a new event kind does not halt the consumers.
+// Aggregates receive them too, in ApplyChangeFromHistory, and should ignore them.
+func WithUnknownEvents() EsOptions {
+	return func(r *EventStore) {
+		r.unknownEvents = true
+	}
+}
+
+// WithSnapshotStore keeps the snapshots in snapshots, eg: a key value store, instead of the EsRepository.
+// GetByID then reads the snapshot from snapshots and the events after it from the EsRepository,
+// in separate reads, since they cannot share a transaction.
+func WithSnapshotStore(snapshots SnapshotStore) EsOptions {
+	return func(r *EventStore) {
+		r.snapshots = snapshots
+	}
+}
+
+// WithIdempotencyStore keeps the idempotency keys in idempotencies, expiring after ttl, or never if zero, instead of the events.
+// The EsRepository records the keys in the save transaction, so idempotencies must read them from the database of the events,
+// eg: postgresql.IdempotencyStore with postgresql.EsRepository.
+func WithIdempotencyStore(idempotencies IdempotencyStore, ttl time.Duration) EsOptions {
+	return func(r *EventStore) {
+		r.idempotencies = idempotencies
+		r.idempotencyTTL = ttl
+	}
 }
 
-// NewEventStore creates a new instance of ESPostgreSQL
+// NewEventStore creates a new instance of ESPostgreSQL.
+// The aggregates are snapshotted every snapshotThreshold events, unless another strategy is set with WithSnapshotStrategy.
 func NewEventStore(repo EsRepository, snapshotThreshold uint32, factory Factory, options ...EsOptions) EventStore {
 	es := EventStore{
-		store:             repo,
-		snapshotThreshold: snapshotThreshold,
-		factory:           factory,
-		codec:             JSONCodec{},
+		store:            repo,
+		snapshotStrategy: CountStrategy{Threshold: snapshotThreshold},
+		factory:          factory,
+		codec:            JSONCodec{},
 	}
 	for _, v := range options {
 		v(&es)
@@ -169,16 +507,13 @@ func NewEventStore(repo EsRepository, snapshotThreshold uint32, factory Factory,
 }
 
 // Exec loads the aggregate from the event store and handles it to the handler function, saving the returning Aggregater in the event store.
-// If no aggregate is found for the provided ID the error ErrUnknownAggregateID is returned.
+// If no aggregate is found for the provided ID the error ErrAggregateNotFound is returned.
 // If the handler function returns nil for the Aggregater or an error, the save action is ignored.
 func (es EventStore) Exec(ctx context.Context, id string, do func(Aggregater) (Aggregater, error), options ...SaveOption) error {
 	a, err := es.GetByID(ctx, id)
 	if err != nil {
 		return err
 	}
-	if a == nil {
-		return ErrUnknownAggregateID
-	}
 	a, err = do(a)
 	if err != nil {
 		return err
@@ -190,8 +525,55 @@ func (es EventStore) Exec(ctx context.Context, id string, do func(Aggregater) (A
 	return es.Save(ctx, a, options...)
 }
 
+// SaveWithRetry loads the aggregate, mutates it and saves it, reloading and mutating it again,
+// up to maxRetries times, while the save fails with ErrConcurrentModification.
+// load, if not nil, is called with every loaded aggregate, before mutate, eg: to check preconditions.
+// Errors other than ErrConcurrentModification, including the ones returned by load and mutate, are returned without retrying.
+func (es EventStore) SaveWithRetry(
+	ctx context.Context,
+	aggregateID string,
+	load func(Aggregater) error,
+	mutate func(Aggregater) error,
+	maxRetries int,
+	options ...SaveOption,
+) error {
+	for attempt := 0; ; attempt++ {
+		a, err := es.GetByID(ctx, aggregateID)
+		if err != nil {
+			return err
+		}
+		if load != nil {
+			if err := load(a); err != nil {
+				return err
+			}
+		}
+		if err := mutate(a); err != nil {
+			return err
+		}
+		err = es.Save(ctx, a, options...)
+		if err == nil || !errors.Is(err, ErrConcurrentModification) {
+			return err
+		}
+		if attempt >= maxRetries {
+			return faults.Errorf("Unable to save aggregate '%s' after %d retries: %w", aggregateID, maxRetries, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return faults.Wrap(err)
+		}
+	}
+}
+
+// GetByID rehydrates the aggregate from its snapshot and events.
+// If there is neither a snapshot nor events for the aggregate, ErrAggregateNotFound is returned.
+// If the type of the rehydrated aggregate does not match the stored aggregate type, ErrAggregateTypeMismatch is returned.
 func (es EventStore) GetByID(ctx context.Context, aggregateID string) (Aggregater, error) {
-	snap, err := es.store.GetSnapshot(ctx, aggregateID)
+	release, err := es.acquireLoad(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	snap, events, err := es.getSnapshotAndEvents(ctx, aggregateID)
 	if err != nil {
 		return nil, err
 	}
@@ -202,19 +584,81 @@ func (es EventStore) GetByID(ctx context.Context, aggregateID string) (Aggregate
 			return nil, err
 		}
 		aggregate = a.(Aggregater)
+		if aggregate.GetType() != snap.AggregateType {
+			return nil, faults.Errorf("Snapshot of aggregate '%s' has type '%s' but was rehydrated as '%s': %w", aggregateID, snap.AggregateType, aggregate.GetType(), ErrAggregateTypeMismatch)
+		}
 	}
 
-	var events []Event
-	if snap.AggregateID != "" {
-		events, err = es.store.GetAggregateEvents(ctx, aggregateID, int(snap.AggregateVersion))
-	} else {
-		events, err = es.store.GetAggregateEvents(ctx, aggregateID, -1)
+	return es.replay(aggregateID, aggregate, events)
+}
+
+// GetByIDFromSnapshot rehydrates the aggregate from a snapshot provided by the caller, eg: from a cache,
+// reading only the events after it, skipping the snapshot read.
+// The snapshot body is decoded into aggregate or, if nil, into a new aggregate created by the factory.
+// An empty snapshot means there is no snapshot, and all the events are replayed.
+// The caller is responsible for the freshness of the snapshot: the events after it are always read from the store.
+func (es EventStore) GetByIDFromSnapshot(ctx context.Context, aggregateID string, cachedSnapshot Snapshot, aggregate Aggregater) (Aggregater, error) {
+	if cachedSnapshot.AggregateID != "" && cachedSnapshot.AggregateID != aggregateID {
+		return nil, faults.Errorf("Snapshot of aggregate '%s' can not rehydrate aggregate '%s': %w", cachedSnapshot.AggregateID, aggregateID, ErrSnapshotAggregateMismatch)
+	}
+
+	release, err := es.acquireLoad(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if len(cachedSnapshot.Body) != 0 {
+		if aggregate == nil {
+			a, err := es.RehydrateAggregate(cachedSnapshot.AggregateType, cachedSnapshot.Body)
+			if err != nil {
+				return nil, err
+			}
+			aggregate = a.(Aggregater)
+		} else {
+			err := es.codecOf(cachedSnapshot.AggregateType).Decode(cachedSnapshot.Body, aggregate)
+			if err != nil {
+				return nil, faults.Errorf("Unable to decode the snapshot of aggregate '%s': %w", aggregateID, err)
+			}
+		}
+		if aggregate.GetType() != cachedSnapshot.AggregateType {
+			return nil, faults.Errorf("Snapshot of aggregate '%s' has type '%s' but was rehydrated as '%s': %w", aggregateID, cachedSnapshot.AggregateType, aggregate.GetType(), ErrAggregateTypeMismatch)
+		}
+	}
+
+	snapVersion := -1
+	if cachedSnapshot.AggregateID != "" {
+		snapVersion = int(cachedSnapshot.AggregateVersion)
 	}
+	events, err := es.store.GetAggregateEvents(ctx, aggregateID, snapVersion)
 	if err != nil {
 		return nil, err
 	}
+	return es.replay(aggregateID, aggregate, events)
+}
 
+// acquireLoad waits for a free load slot, if loads are bounded, returning the function to release it
+func (es EventStore) acquireLoad(ctx context.Context) (func(), error) {
+	if es.loads == nil {
+		return func() {}, nil
+	}
+	select {
+	case es.loads <- struct{}{}:
+		return func() { <-es.loads }, nil
+	case <-ctx.Done():
+		return nil, faults.Errorf("Unable to acquire a slot to load an aggregate: %w", ctx.Err())
+	}
+}
+
+// replay applies the events on top of the aggregate, creating it if nil.
+// The events of epochs before the last one are skipped, since the stream was closed after them (see CloseStream).
+func (es EventStore) replay(aggregateID string, aggregate Aggregater, events []Event) (Aggregater, error) {
+	events = currentEpoch(events)
+	replayed := 0
 	for _, v := range events {
+		if v.Kind == TombstoneKind {
+			continue
+		}
 		if aggregate == nil {
 			a, err := es.RehydrateAggregate(v.AggregateType, nil)
 			if err != nil {
@@ -222,40 +666,135 @@ func (es EventStore) GetByID(ctx context.Context, aggregateID string) (Aggregate
 			}
 			aggregate = a.(Aggregater)
 		}
+		if aggregate.GetType() != v.AggregateType {
+			return nil, faults.Errorf("Event '%s' of aggregate '%s' has type '%s' but the aggregate has type '%s': %w", v.ID, aggregateID, v.AggregateType, aggregate.GetType(), ErrAggregateTypeMismatch)
+		}
+		// the epoch is read back from the events, so it survives missing snapshots
+		if epocher, ok := aggregate.(Epocher); ok && v.Epoch > epocher.GetEpoch() {
+			epocher.SetEpoch(v.Epoch)
+		}
 		m := EventMetadata{
 			AggregateVersion: v.AggregateVersion,
 			CreatedAt:        v.CreatedAt,
 		}
-		e, err := es.RehydrateEvent(v.Kind, v.Body)
+		e, err := es.DecodeEvent(v)
 		if err != nil {
 			return nil, err
 		}
 		aggregate.ApplyChangeFromHistory(m, e)
+		replayed++
+	}
+	if aggregate == nil {
+		return nil, faults.Errorf("Unable to get aggregate '%s': %w", aggregateID, ErrAggregateNotFound)
+	}
+	if es.onReplay != nil {
+		es.onReplay(aggregate.GetType(), replayed)
 	}
 
 	return aggregate, nil
 }
 
+func (es EventStore) getSnapshotAndEvents(ctx context.Context, aggregateID string) (Snapshot, []Event, error) {
+	if r, ok := es.store.(ConsistentReader); ok && es.snapshots == nil {
+		return r.GetSnapshotAndEvents(ctx, aggregateID)
+	}
+
+	snap, err := es.snapshotStore().GetSnapshot(ctx, aggregateID)
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+
+	var events []Event
+	if snap.AggregateID != "" {
+		events, err = es.store.GetAggregateEvents(ctx, aggregateID, int(snap.AggregateVersion))
+	} else {
+		events, err = es.store.GetAggregateEvents(ctx, aggregateID, -1)
+	}
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	return snap, events, nil
+}
+
+// GetSnapshotMeta returns the metadata of the latest snapshot of the aggregate, from the snapshot store in use (see WithSnapshotStore).
+// If that store is not a SnapshotMetaReader, the metadata is taken from the whole snapshot.
+func (es EventStore) GetSnapshotMeta(ctx context.Context, aggregateID string) (SnapshotMeta, error) {
+	snapshots := es.snapshotStore()
+	if r, ok := snapshots.(SnapshotMetaReader); ok {
+		return r.GetSnapshotMeta(ctx, aggregateID)
+	}
+
+	snap, err := snapshots.GetSnapshot(ctx, aggregateID)
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+	if snap.AggregateID == "" {
+		return SnapshotMeta{}, nil
+	}
+	return SnapshotMeta{
+		Exists:           true,
+		AggregateVersion: snap.AggregateVersion,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+func (es EventStore) snapshotStore() SnapshotStore {
+	if es.snapshots != nil {
+		return es.snapshots
+	}
+	return es.store
+}
+
 func (es EventStore) RehydrateAggregate(kind string, body []byte) (Typer, error) {
-	return RehydrateAggregate(es.factory, es.codec, es.upcaster, kind, body)
+	return RehydrateAggregate(es.factory, es.codecOf(kind), es.upcaster, kind, body)
 }
 
 func (es EventStore) RehydrateEvent(kind string, body []byte) (Typer, error) {
-	return RehydrateEvent(es.factory, es.codec, es.upcaster, kind, body)
+	return es.rehydrateEvent(es.codec, kind, body)
+}
+
+func (es EventStore) rehydrateEvent(decoder Decoder, kind string, body []byte) (Typer, error) {
+	if es.unknownEvents {
+		return RehydrateEventOrUnknown(es.factory, decoder, es.upcaster, kind, body)
+	}
+	return RehydrateEvent(es.factory, decoder, es.upcaster, kind, body)
 }
 
-// Save saves the events of the aggregater into the event store
-func (es EventStore) Save(ctx context.Context, aggregate Aggregater, options ...SaveOption) (err error) {
+// Save saves the events of the aggregater into the event store.
+// All the events of a save share the same creation time and have consecutive versions,
+// and since the event ID breaks the time ties by aggregate ID and then by version,
+// the IDs of the events of a single save sort in version order, ie, the order in which they were applied.
+func (es EventStore) Save(ctx context.Context, aggregate Aggregater, options ...SaveOption) error {
+	_, err := es.SaveWithToken(ctx, aggregate, options...)
+	return err
+}
+
+// SaveWithToken saves like Save and returns the ID of the last saved event, empty if there was nothing to save,
+// as a consistency token that a reader can wait for on the projection side (see projection.Watermark.WaitForEventID),
+// to read its own writes.
+func (es EventStore) SaveWithToken(ctx context.Context, aggregate Aggregater, options ...SaveOption) (string, error) {
 	events := aggregate.GetEvents()
 	eventsLen := len(events)
 	if eventsLen == 0 {
-		return nil
+		return "", nil
 	}
 
 	opts := Options{}
 	for _, fn := range options {
 		fn(&opts)
 	}
+	if len(opts.ExternalIDs) > 0 && len(opts.ExternalIDs) != eventsLen {
+		return "", faults.Errorf("Unable to save aggregate '%s': %d external IDs for %d events", aggregate.GetID(), len(opts.ExternalIDs), eventsLen)
+	}
+	if opts.ExpectedVersion != nil && *opts.ExpectedVersion != aggregate.GetVersion() {
+		if es.onConcurrencyConflict != nil {
+			es.onConcurrencyConflict(ctx, aggregate.GetType(), aggregate.GetID())
+		}
+		return "", faults.Errorf("Unable to save aggregate '%s' at version %d, expecting version %d: %w", aggregate.GetID(), aggregate.GetVersion(), *opts.ExpectedVersion, ErrConcurrentModification)
+	}
+	if es.maxEventsPerSave > 0 && eventsLen > es.maxEventsPerSave && !es.chunkedSaves {
+		return "", faults.Errorf("Unable to save %d events of aggregate '%s', exceeding the limit of %d: %w", eventsLen, aggregate.GetID(), es.maxEventsPerSave, ErrTooManyEvents)
+	}
 
 	now := time.Now().UTC()
 	// we only need millisecond precision
@@ -268,89 +807,245 @@ func (es EventStore) Save(ctx context.Context, aggregate Aggregater, options ...
 	}
 
 	tName := aggregate.GetType()
+	codec := es.codecOf(tName)
 	details := make([]EventRecordDetail, eventsLen)
 	for i := 0; i < eventsLen; i++ {
 		e := events[i]
-		body, err := es.codec.Encode(e)
+		body, err := codec.Encode(e)
 		if err != nil {
-			return err
+			return "", err
+		}
+		kind := es.kindOf(e)
+		if es.maxBodySize > 0 && len(body) > es.maxBodySize {
+			return "", faults.Errorf("event %s has %d bytes, exceeding the limit of %d bytes: %w", kind, len(body), es.maxBodySize, ErrBodyTooLarge)
+		}
+		if es.validator != nil {
+			err = es.validator.Validate(kind, body)
+			if err != nil {
+				return "", faults.Errorf("Unable to save aggregate '%s': %w", aggregate.GetID(), err)
+			}
 		}
 		details[i] = EventRecordDetail{
-			Kind: e.GetType(),
+			Kind: kind,
 			Body: body,
 		}
+		if len(opts.ExternalIDs) > 0 {
+			details[i].ExternalID = opts.ExternalIDs[i]
+		}
 	}
 
 	rec := EventRecord{
-		AggregateID:    aggregate.GetID(),
-		Version:        aggregate.GetVersion(),
-		AggregateType:  tName,
-		IdempotencyKey: opts.IdempotencyKey,
-		Labels:         opts.Labels,
-		CreatedAt:      now,
-		Details:        details,
+		AggregateID:     aggregate.GetID(),
+		Version:         aggregate.GetVersion(),
+		AggregateType:   tName,
+		IdempotencyKey:  opts.IdempotencyKey,
+		Labels:          es.contentTypeLabels(codec, es.mergeLabels(opts.Labels)),
+		CreatedAt:       now,
+		NodeID:          es.nodeID,
+		ExpectedVersion: opts.ExpectedVersion,
+		Epoch:           epochOf(aggregate),
+		Details:         details,
+	}
+	if opts.TTL > 0 {
+		rec.ExpiresAt = now.Add(opts.TTL)
 	}
 
-	id, lastVersion, err := es.store.SaveEvent(ctx, rec)
+	id, err := es.saveChunks(ctx, aggregate, rec)
 	if err != nil {
+		return "", err
+	}
+	// the events were saved, so a failing snapshot must not leave them pending, to be saved again
+	aggregate.ClearEvents()
+
+	if es.shouldSnapshot(aggregate, eventsLen) {
+		// The snapshot must only be written after the events are committed, since it references the last event.
+		// If this is ever made asynchronous, beware that aggregate holds a reference and not a copy.
+		body, err := codec.Encode(aggregate)
+		if err != nil {
+			return id, es.snapshotFailed(faults.Errorf("Failed to create serialize snapshot: %w", err))
+		}
+
+		snap := Snapshot{
+			ID:               id,
+			AggregateID:      aggregate.GetID(),
+			AggregateVersion: aggregate.GetVersion(),
+			AggregateType:    aggregate.GetType(),
+			Body:             body,
+			CreatedAt:        time.Now().UTC(),
+		}
+
+		err = es.saveSnapshot(ctx, snap)
+		if err != nil {
+			return id, es.snapshotFailed(faults.Errorf("Unable to save the snapshot of aggregate '%s' at version %d: %w", snap.AggregateID, snap.AggregateVersion, err))
+		}
+	}
+
+	return id, nil
+}
+
+// snapshotFailed hands the snapshot error, of a save whose events were saved, to the snapshot error handler, if any,
+// returning the error to be returned by the save
+func (es EventStore) snapshotFailed(err error) error {
+	if es.onSnapshotError == nil {
 		return err
 	}
-	aggregate.SetVersion(lastVersion)
+	es.onSnapshotError(err)
+	return nil
+}
 
-	newCounter := aggregate.GetEventsCounter()
-	oldCounter := newCounter - uint32(eventsLen)
-	if newCounter > es.snapshotThreshold-1 {
-		// TODO this could be done asynchronously. Beware that aggregate holds a reference and not a copy.
-		mod := oldCounter % es.snapshotThreshold
-		delta := newCounter - (oldCounter - mod)
-		if delta >= es.snapshotThreshold {
-			body, err := es.codec.Encode(aggregate)
-			if err != nil {
-				return faults.Errorf("Failed to create serialize snapshot: %w", err)
+// saveChunks saves the record, split in chunks of at most the max events per save if chunked saves are enabled,
+// returning the ID of the last saved event
+func (es EventStore) saveChunks(ctx context.Context, aggregate Aggregater, rec EventRecord) (string, error) {
+	chunks := [][]EventRecordDetail{rec.Details}
+	if es.chunkedSaves && es.maxEventsPerSave > 0 && len(rec.Details) > es.maxEventsPerSave {
+		chunks = nil
+		for i := 0; i < len(rec.Details); i += es.maxEventsPerSave {
+			end := i + es.maxEventsPerSave
+			if end > len(rec.Details) {
+				end = len(rec.Details)
 			}
+			chunks = append(chunks, rec.Details[i:end])
+		}
+	}
 
-			snap := Snapshot{
-				ID:               id,
-				AggregateID:      aggregate.GetID(),
-				AggregateVersion: aggregate.GetVersion(),
-				AggregateType:    aggregate.GetType(),
-				Body:             body,
-				CreatedAt:        time.Now().UTC(),
+	var id string
+	// the aggregate version only moves once every chunk is saved, so that a failed save is not retried on top of the saved chunks
+	version := aggregate.GetVersion()
+	for k, details := range chunks {
+		chunk := rec
+		chunk.Version = version
+		chunk.Details = details
+		if k > 0 {
+			chunk.IdempotencyKey = ""
+			chunk.ExpectedVersion = nil
+		}
+		cid, saved, err := es.saveEvent(ctx, chunk)
+		if err != nil {
+			if es.onConcurrencyConflict != nil && errors.Is(err, ErrConcurrentModification) {
+				es.onConcurrencyConflict(ctx, rec.AggregateType, rec.AggregateID)
+			}
+			if k > 0 {
+				return "", faults.Errorf("Unable to save chunk %d of %d of aggregate '%s', saved up to version %d, the aggregate must be reloaded: %w", k+1, len(chunks), rec.AggregateID, chunk.Version, err)
 			}
+			return "", err
+		}
+		version = saved[len(saved)-1].AggregateVersion
+		es.handlePostCommit(ctx, saved)
+		id = cid
+	}
+	aggregate.SetVersion(version)
+	return id, nil
+}
+
+// saveEvent saves the record in the EsRepository, that keeps its idempotency key in the idempotency store, if any
+func (es EventStore) saveEvent(ctx context.Context, rec EventRecord) (string, []Event, error) {
+	if es.idempotencies != nil && rec.IdempotencyKey != "" {
+		ttl := es.idempotencyTTL
+		rec.IdempotencyTTL = &ttl
+	}
+	return es.store.SaveEvent(ctx, rec)
+}
+
+// saveSnapshot saves the snapshot in the snapshot store, reporting it to the OnSnapshot hook
+func (es EventStore) saveSnapshot(ctx context.Context, snap Snapshot) error {
+	start := time.Now()
+	err := es.snapshotStore().SaveSnapshot(ctx, snap)
+	if es.onSnapshot != nil {
+		es.onSnapshot(snap.AggregateType, len(snap.Body), time.Since(start), err)
+	}
+	return err
+}
+
+func (es EventStore) shouldSnapshot(aggregate Aggregater, eventsLen int) bool {
+	if es.snapshotOnly[aggregate.GetType()] {
+		return true
+	}
+	return es.snapshotStrategy.ShouldSnapshot(aggregate, eventsLen)
+}
+
+func (es EventStore) kindOf(e Typer) string {
+	if es.kindNamer != nil {
+		return es.kindNamer(e)
+	}
+	return e.GetType()
+}
 
-			err = es.store.SaveSnapshot(ctx, snap)
+func (es EventStore) mergeLabels(labels map[string]interface{}) map[string]interface{} {
+	if len(es.defaultLabels) == 0 {
+		return labels
+	}
+
+	merged := make(map[string]interface{}, len(es.defaultLabels)+len(labels))
+	for k, v := range es.defaultLabels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// handlePostCommit calls the post commit handlers with the events, as they were persisted
+func (es EventStore) handlePostCommit(ctx context.Context, events []Event) {
+	for _, e := range events {
+		for _, h := range es.postCommitHandlers {
+			err := h(ctx, e)
 			if err != nil {
-				return err
+				log.WithError(err).
+					WithField("event", e.ID).
+					Error("Failure handling committed event")
 			}
 		}
 	}
-
-	aggregate.ClearEvents()
-	return nil
 }
 
 func (es EventStore) HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error) {
+	if es.idempotencies != nil {
+		return es.idempotencies.HasIdempotencyKey(ctx, aggregateType, idempotencyKey)
+	}
 	return es.store.HasIdempotencyKey(ctx, aggregateType, idempotencyKey)
 }
 
 type ForgetRequest struct {
 	AggregateID string
 	EventKind   string
+	// Mark appends a Redacted event to the aggregate, after erasing, so that replaying projections
+	// can tell erased values from values set to empty
+	Mark bool
+}
+
+// RedactedKind is the kind of the Redacted events
+const RedactedKind = "eventstore.Redacted"
+
+// Redacted is the event appended by Forget, when requested, marking that the values of the events of EventKind,
+// before it in the stream, were erased.
+// It is always encoded as JSON and rehydrated without the factory, so aggregates and projections receive it like any other event
+// and should ignore it if they do not care.
+type Redacted struct {
+	EventKind string `json:"event_kind"`
+}
+
+func (Redacted) GetType() string {
+	return RedactedKind
 }
 
 func (es EventStore) Forget(ctx context.Context, request ForgetRequest, forget func(interface{}) interface{}) error {
+	codec, err := es.forgetCodec(ctx, request.AggregateID)
+	if err != nil {
+		return err
+	}
 	fun := func(kind string, body []byte) ([]byte, error) {
 		e, err := es.factory.New(kind)
 		if err != nil {
 			return nil, err
 		}
-		err = es.codec.Decode(body, e)
+		err = codec.Decode(body, e)
 		if err != nil {
 			return nil, err
 		}
 		e2 := common.Dereference(e)
 		e2 = forget(e2)
-		body, err = es.codec.Encode(e2)
+		body, err = codec.Encode(e2)
 		if err != nil {
 			return nil, err
 		}
@@ -358,5 +1053,60 @@ func (es EventStore) Forget(ctx context.Context, request ForgetRequest, forget f
 		return body, nil
 	}
 
-	return es.store.Forget(ctx, request, fun)
+	err = es.store.Forget(ctx, request, fun)
+	if err != nil || !request.Mark {
+		return err
+	}
+	return es.markRedacted(ctx, request)
+}
+
+// forgetCodec returns the codec of the aggregate type of the aggregate, read from its events, if there are codecs per aggregate type
+func (es EventStore) forgetCodec(ctx context.Context, aggregateID string) (Codec, error) {
+	if len(es.codecs) == 0 {
+		return es.codec, nil
+	}
+	events, err := es.store.GetAggregateEvents(ctx, aggregateID, -1)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get the aggregate type of '%s': %w", aggregateID, err)
+	}
+	if len(events) == 0 {
+		return es.codec, nil
+	}
+	return es.codecOf(events[0].AggregateType), nil
+}
+
+// markRedacted appends a Redacted event to the aggregate.
+// Since Forget can be called again, a failed mark is fixed by retrying the whole Forget.
+func (es EventStore) markRedacted(ctx context.Context, request ForgetRequest) error {
+	aggregate, err := es.GetByID(ctx, request.AggregateID)
+	if err != nil {
+		return faults.Errorf("Unable to mark aggregate '%s' as redacted: %w", request.AggregateID, err)
+	}
+	body, err := JSONCodec{}.Encode(Redacted{EventKind: request.EventKind})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if now.Before(aggregate.UpdatedAt()) {
+		now = aggregate.UpdatedAt()
+	}
+	rec := EventRecord{
+		AggregateID:   aggregate.GetID(),
+		Version:       aggregate.GetVersion(),
+		AggregateType: aggregate.GetType(),
+		Labels:        es.mergeLabels(nil),
+		CreatedAt:     now,
+		NodeID:        es.nodeID,
+		Epoch:         epochOf(aggregate),
+		Details: []EventRecordDetail{
+			{Kind: RedactedKind, Body: body},
+		},
+	}
+	_, saved, err := es.saveEvent(ctx, rec)
+	if err != nil {
+		return faults.Errorf("Unable to mark aggregate '%s' as redacted: %w", request.AggregateID, err)
+	}
+	es.handlePostCommit(ctx, saved)
+	return nil
 }
@@ -0,0 +1,697 @@
+package eventstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowRepo records the maximum number of concurrent snapshot reads
+type slowRepo struct {
+	EsRepository
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (r *slowRepo) GetSnapshot(ctx context.Context, aggregateID string) (Snapshot, error) {
+	r.mu.Lock()
+	r.inFlight++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	r.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+	return Snapshot{}, nil
+}
+
+func (r *slowRepo) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]Event, error) {
+	return nil, nil
+}
+
+func TestMaxConcurrentLoads(t *testing.T) {
+	r := &slowRepo{}
+	es := NewEventStore(r, 10, nil, WithMaxConcurrentLoads(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := es.GetByID(context.Background(), "1")
+			assert.True(t, errors.Is(err, ErrAggregateNotFound), "expected aggregate not found, got %v", err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, r.maxInFlight)
+
+	// a queued caller gives up when its context is done
+	es.loads <- struct{}{}
+	es.loads <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := es.GetByID(ctx, "1")
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+
+	// the cached snapshot is only decoded after acquiring a slot
+	_, err = es.GetByIDFromSnapshot(ctx, "1", Snapshot{AggregateID: "1", AggregateType: "Counter", Body: []byte(`not decoded`)}, newCounter())
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+}
+
+type memSnapshots map[string]Snapshot
+
+func (m memSnapshots) GetSnapshot(ctx context.Context, aggregateID string) (Snapshot, error) {
+	return m[aggregateID], nil
+}
+
+func (m memSnapshots) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	m[snapshot.AggregateID] = snapshot
+	return nil
+}
+
+// gauge is an aggregate of another type than counter
+type gauge struct {
+	RootAggregate
+}
+
+func newGauge() *gauge {
+	g := &gauge{}
+	g.RootAggregate = NewRootAggregate(g)
+	return g
+}
+
+func (gauge) GetType() string {
+	return "Gauge"
+}
+
+func (*gauge) HandleEvent(event Eventer) {}
+
+func TestAggregateTypeMismatch(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	es := NewEventStore(r, 100, counterFactory{})
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+
+	// loading the events of a counter into a gauge
+	_, err := es.GetByIDFromSnapshot(ctx, "1", Snapshot{}, newGauge())
+	require.True(t, errors.Is(err, ErrAggregateTypeMismatch), "expected aggregate type mismatch, got %v", err)
+
+	// decoding the snapshot of a counter into a gauge
+	snap := Snapshot{AggregateID: "1", AggregateVersion: 2, AggregateType: "Counter", Body: []byte(`{"id":"1","total":3}`)}
+	_, err = es.GetByIDFromSnapshot(ctx, "1", snap, newGauge())
+	require.True(t, errors.Is(err, ErrAggregateTypeMismatch), "expected aggregate type mismatch, got %v", err)
+
+	// the matching aggregate loads
+	a, err := es.GetByIDFromSnapshot(ctx, "1", Snapshot{}, newCounter())
+	require.NoError(t, err)
+	assert.Equal(t, 3, a.(*counter).Total)
+
+	// an event of another type in the stream of the aggregate
+	other := r.events[len(r.events)-1]
+	other.ID = "other"
+	other.AggregateType = "Gauge"
+	other.AggregateVersion++
+	r.events = append(r.events, other)
+	_, err = es.GetByID(ctx, "1")
+	require.True(t, errors.Is(err, ErrAggregateTypeMismatch), "expected aggregate type mismatch, got %v", err)
+}
+
+func TestOnReplayIgnoresTombstones(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	es := NewEventStore(r, 100, counterFactory{})
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+
+	tombstone := r.events[len(r.events)-1]
+	tombstone.ID = "tombstone"
+	tombstone.Kind = TombstoneKind
+	tombstone.Body = nil
+	tombstone.AggregateVersion++
+	r.events = append(r.events, tombstone)
+
+	var replayed int
+	es = NewEventStore(r, 100, counterFactory{}, WithOnReplay(func(aggregateType string, events int) {
+		replayed = events
+	}))
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, a.(*counter).Total)
+	assert.Equal(t, 2, replayed)
+}
+
+func TestSnapshotStore(t *testing.T) {
+	ctx := context.Background()
+	// memRepo does not save snapshots
+	r := &memRepo{}
+	snapshots := memSnapshots{}
+	es := NewEventStore(r, 2, counterFactory{}, WithSnapshotStore(snapshots))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	require.Contains(t, snapshots, "1")
+	assert.Equal(t, uint32(2), snapshots["1"].AggregateVersion)
+
+	c.Increment(3)
+	require.NoError(t, es.Save(ctx, c))
+
+	var replayed int
+	es = NewEventStore(r, 2, counterFactory{}, WithSnapshotStore(snapshots), WithOnReplay(func(aggregateType string, events int) {
+		replayed = events
+	}))
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 6, a.(*counter).Total)
+	// only the event after the snapshot
+	assert.Equal(t, 1, replayed)
+
+	// the metadata comes from the snapshot store, not the repository
+	meta, err := es.GetSnapshotMeta(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, meta.Exists)
+	assert.Equal(t, uint32(2), meta.AggregateVersion)
+
+	meta, err = es.GetSnapshotMeta(ctx, "2")
+	require.NoError(t, err)
+	assert.False(t, meta.Exists)
+}
+
+func TestOnSnapshot(t *testing.T) {
+	ctx := context.Background()
+	snapshots := memSnapshots{}
+	type metric struct {
+		aggregateType string
+		size          int
+	}
+	metrics := []metric{}
+	es := NewEventStore(&memRepo{}, 2, counterFactory{}, WithSnapshotStore(snapshots), WithOnSnapshot(func(aggregateType string, size int, took time.Duration, err error) {
+		assert.NoError(t, err)
+		assert.True(t, took >= 0)
+		metrics = append(metrics, metric{aggregateType, size})
+	}))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c))
+	// below the threshold
+	assert.Empty(t, metrics)
+
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	require.Len(t, metrics, 1)
+	assert.Equal(t, metric{"Counter", len(snapshots["1"].Body)}, metrics[0])
+	assert.NotZero(t, metrics[0].size)
+}
+
+// memIdempotencies holds the idempotency keys recorded by memRepo, with their TTL
+type memIdempotencies map[string]time.Duration
+
+func (m memIdempotencies) HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error) {
+	_, ok := m[aggregateType+"/"+idempotencyKey]
+	return ok, nil
+}
+
+// conflictingRepo fails every save with a concurrent modification
+type conflictingRepo struct {
+	memRepo
+}
+
+func (r *conflictingRepo) SaveEvent(ctx context.Context, eRec EventRecord) (string, []Event, error) {
+	return "", nil, ErrConcurrentModification
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	keys := memIdempotencies{}
+	r := &memRepo{keys: keys}
+	es := NewEventStore(r, 100, counterFactory{}, WithIdempotencyStore(keys, time.Hour))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c, WithIdempotencyKey("K1")))
+	assert.Equal(t, time.Hour, keys["Counter/K1"])
+	// the key is not kept with the events
+	require.Len(t, r.events, 1)
+	assert.Empty(t, r.events[0].IdempotencyKey)
+
+	ok, err := es.HasIdempotencyKey(ctx, "Counter", "K1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	c.Increment(2)
+	err = es.Save(ctx, c, WithIdempotencyKey("K1"))
+	require.True(t, errors.Is(err, ErrIdempotencyKeyConflict), "expected idempotency key conflict, got %v", err)
+	assert.Len(t, r.events, 1)
+
+	// the key is recorded by the repository, in the save, so a failed save does not record it
+	es = NewEventStore(&conflictingRepo{memRepo{keys: keys}}, 100, counterFactory{}, WithIdempotencyStore(keys, time.Hour))
+	err = es.Save(ctx, c, WithIdempotencyKey("K2"))
+	require.True(t, errors.Is(err, ErrConcurrentModification), "expected concurrent modification, got %v", err)
+	assert.NotContains(t, keys, "Counter/K2")
+
+	// a repository without an idempotency store refuses the key, instead of keeping it with the events
+	es = NewEventStore(&memRepo{}, 100, counterFactory{}, WithIdempotencyStore(keys, time.Hour))
+	err = es.Save(ctx, c, WithIdempotencyKey("K3"))
+	require.True(t, errors.Is(err, ErrIdempotencyStoreUnsupported), "expected idempotency store unsupported, got %v", err)
+}
+
+func TestWaitForVersion(t *testing.T) {
+	ctx := context.Background()
+	snapshots := memSnapshots{}
+	// memRepo is not a VersionReader, so the version is read from the snapshot and the events after it
+	es := NewEventStore(&memRepo{}, 2, counterFactory{}, WithSnapshotStore(snapshots))
+
+	version, err := es.CurrentVersion(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), version)
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	c.Increment(3)
+	require.NoError(t, es.Save(ctx, c))
+	require.Equal(t, uint32(2), snapshots["1"].AggregateVersion)
+
+	version, err = es.CurrentVersion(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), version)
+
+	require.NoError(t, es.WaitForVersion(ctx, "1", 3, time.Second))
+	err = es.WaitForVersion(ctx, "1", 4, 100*time.Millisecond)
+	require.True(t, errors.Is(err, ErrVersionTimeout), "expected version timeout, got %v", err)
+}
+
+func TestExternalIDs(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	es := NewEventStore(r, 100, counterFactory{})
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	err := es.Save(ctx, c, WithExternalIDs("ext-1"))
+	require.Error(t, err)
+
+	require.NoError(t, es.Save(ctx, c, WithExternalIDs("ext-1", "ext-2")))
+	require.Len(t, r.events, 2)
+	assert.Equal(t, "ext-1", r.events[0].ExternalID)
+	assert.Equal(t, "ext-2", r.events[1].ExternalID)
+}
+
+func TestPostCommitHandlers(t *testing.T) {
+	ctx := context.Background()
+	keys := memIdempotencies{}
+	r := &memRepo{keys: keys}
+	handled := []Event{}
+	es := NewEventStore(r, 100, counterFactory{},
+		WithIdempotencyStore(keys, time.Hour),
+		WithPostCommitHandlers(func(ctx context.Context, e Event) error {
+			handled = append(handled, e)
+			return nil
+		}),
+	)
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c, WithExternalIDs("ext-1", "ext-2"), WithIdempotencyKey("K1")))
+
+	// the handlers get the events as they were persisted
+	require.Len(t, handled, 2)
+	for i, e := range handled {
+		assert.Equal(t, r.events[i].ID, e.ID)
+		assert.Equal(t, r.events[i].AggregateVersion, e.AggregateVersion)
+		assert.Equal(t, r.events[i].ExternalID, e.ExternalID)
+		// with the key kept in the idempotency store
+		assert.Equal(t, "K1", e.IdempotencyKey)
+	}
+	assert.Equal(t, "ext-2", handled[1].ExternalID)
+}
+
+func TestCloseStreamWithoutSnapshots(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	snapshots := memSnapshots{}
+	es := NewEventStore(r, 100, counterFactory{}, WithSnapshotStore(snapshots))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c))
+
+	epoch, err := es.CloseStream(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), epoch)
+	// the epoch is saved with the event closing the stream, that bootstraps the snapshot
+	require.Len(t, r.events, 2)
+	assert.Equal(t, StreamClosedKind, r.events[1].Kind)
+	assert.Equal(t, uint32(1), r.events[1].Epoch)
+	assert.Equal(t, r.events[1].ID, snapshots["1"].ID)
+	assert.Equal(t, uint32(2), snapshots["1"].AggregateVersion)
+
+	// without the snapshots, the epoch is read back from the events and the events of the older epochs are not replayed
+	var replayed int
+	es = NewEventStore(r, 100, counterFactory{}, WithOnReplay(func(aggregateType string, events int) {
+		replayed = events
+	}))
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	c = a.(*counter)
+	assert.Equal(t, uint32(1), c.GetEpoch())
+	assert.Equal(t, uint32(2), c.GetVersion())
+	assert.Equal(t, 0, c.Total)
+	assert.Equal(t, 1, replayed)
+
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	assert.Equal(t, uint32(1), r.events[2].Epoch)
+	a, err = es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	c = a.(*counter)
+	assert.Equal(t, uint32(1), c.GetEpoch())
+	assert.Equal(t, uint32(3), c.GetVersion())
+	assert.Equal(t, 2, c.Total)
+	assert.Equal(t, 2, replayed)
+}
+
+func TestExpectedVersion(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	conflicts := 0
+	es := NewEventStore(r, 100, counterFactory{}, WithConcurrencyConflictHandler(func(ctx context.Context, aggregateType, aggregateID string) {
+		conflicts++
+	}))
+
+	// no events exist yet
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	err := es.Save(ctx, c, WithExpectedVersion(1))
+	require.True(t, errors.Is(err, ErrConcurrentModification), "expected concurrent modification, got %v", err)
+	assert.Empty(t, r.events)
+	assert.Equal(t, 1, conflicts)
+	require.NoError(t, es.Save(ctx, c, WithExpectedVersion(0)))
+
+	c.Increment(2)
+	err = es.Save(ctx, c, WithExpectedVersion(0))
+	require.True(t, errors.Is(err, ErrConcurrentModification), "expected concurrent modification, got %v", err)
+	require.NoError(t, es.Save(ctx, c, WithExpectedVersion(1)))
+	assert.Len(t, r.events, 2)
+}
+
+// forgettingRepo erases the events of memRepo
+type forgettingRepo struct {
+	memRepo
+}
+
+func (r *forgettingRepo) Forget(ctx context.Context, request ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	for k, e := range r.events {
+		if e.AggregateID != request.AggregateID || e.Kind != request.EventKind {
+			continue
+		}
+		body, err := forget(e.Kind, e.Body)
+		if err != nil {
+			return err
+		}
+		r.events[k].Body = body
+	}
+	return nil
+}
+
+func TestForgetMark(t *testing.T) {
+	ctx := context.Background()
+	r := &forgettingRepo{}
+	es := NewEventStore(r, 100, counterFactory{})
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+
+	erase := func(e interface{}) interface{} {
+		return Incremented{}
+	}
+	require.NoError(t, es.Forget(ctx, ForgetRequest{AggregateID: "1", EventKind: "Incremented"}, erase))
+	require.Len(t, r.events, 2)
+
+	require.NoError(t, es.Forget(ctx, ForgetRequest{AggregateID: "1", EventKind: "Incremented", Mark: true}, erase))
+	require.Len(t, r.events, 3)
+	e, err := es.DecodeEvent(r.events[2])
+	require.NoError(t, err)
+	assert.Equal(t, Redacted{EventKind: "Incremented"}, e)
+
+	// the aggregates receive the marker like any other event
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, a.(*counter).Total)
+	assert.Equal(t, uint32(3), a.GetVersion())
+}
+
+func TestForgetAggregateCodec(t *testing.T) {
+	ctx := context.Background()
+	r := &forgettingRepo{}
+	es := NewEventStore(r, 100, counterFactory{}, WithAggregateCodec("Counter", prefixCodec("v1")))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c))
+
+	erase := func(e interface{}) interface{} {
+		return Incremented{}
+	}
+	require.NoError(t, es.Forget(ctx, ForgetRequest{AggregateID: "1", EventKind: "Incremented"}, erase))
+	assert.True(t, bytes.HasPrefix(r.events[0].Body, []byte("v1")))
+
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, a.(*counter).Total)
+}
+
+// chunkingRepo records the number of events of each save
+type chunkingRepo struct {
+	memRepo
+
+	saves []int
+}
+
+func (r *chunkingRepo) SaveEvent(ctx context.Context, eRec EventRecord) (string, []Event, error) {
+	r.saves = append(r.saves, len(eRec.Details))
+	return r.memRepo.SaveEvent(ctx, eRec)
+}
+
+func TestMaxEventsPerSave(t *testing.T) {
+	ctx := context.Background()
+	r := &chunkingRepo{}
+	es := NewEventStore(r, 100, counterFactory{}, WithMaxEventsPerSave(2))
+
+	c := newCounter()
+	c.ID = "1"
+	for i := 1; i <= 5; i++ {
+		c.Increment(i)
+	}
+	err := es.Save(ctx, c)
+	require.True(t, errors.Is(err, ErrTooManyEvents), "expected too many events, got %v", err)
+	assert.Empty(t, r.saves)
+
+	es = NewEventStore(r, 100, counterFactory{}, WithMaxEventsPerSave(2), WithChunkedSaves())
+	require.NoError(t, es.Save(ctx, c, WithIdempotencyKey("batch-1")))
+	assert.Equal(t, []int{2, 2, 1}, r.saves)
+	assert.Equal(t, uint32(5), c.GetVersion())
+	require.Len(t, r.events, 5)
+	for k, e := range r.events {
+		assert.Equal(t, uint32(k+1), e.AggregateVersion)
+	}
+	// the idempotency key is only recorded once
+	assert.Equal(t, "batch-1", r.events[0].IdempotencyKey)
+	assert.Empty(t, r.events[2].IdempotencyKey)
+}
+
+// failingChunkRepo fails the second save and rejects the saves that do not follow the last saved version
+type failingChunkRepo struct {
+	chunkingRepo
+}
+
+func (r *failingChunkRepo) SaveEvent(ctx context.Context, eRec EventRecord) (string, []Event, error) {
+	if len(r.saves) == 1 {
+		r.saves = append(r.saves, len(eRec.Details))
+		return "", nil, errors.New("connection reset")
+	}
+	if int(eRec.Version) != len(r.events) {
+		return "", nil, ErrConcurrentModification
+	}
+	return r.chunkingRepo.SaveEvent(ctx, eRec)
+}
+
+func TestChunkedSaveFailure(t *testing.T) {
+	ctx := context.Background()
+	r := &failingChunkRepo{}
+	es := NewEventStore(r, 100, counterFactory{}, WithMaxEventsPerSave(2), WithChunkedSaves())
+
+	c := newCounter()
+	c.ID = "1"
+	for i := 1; i <= 5; i++ {
+		c.Increment(i)
+	}
+	err := es.Save(ctx, c)
+	require.Error(t, err)
+	assert.Equal(t, []int{2, 2}, r.saves)
+	require.Len(t, r.events, 2)
+	// the first chunk is saved but the aggregate is left untouched
+	assert.Equal(t, uint32(0), c.GetVersion())
+	assert.Len(t, c.GetEvents(), 5)
+
+	// saving again does not duplicate the saved chunk
+	err = es.Save(ctx, c)
+	require.True(t, errors.Is(err, ErrConcurrentModification), "expected concurrent modification, got %v", err)
+	assert.Len(t, r.events, 2)
+
+	a, err := es.GetByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), a.GetVersion())
+	assert.Equal(t, 3, a.(*counter).Total)
+}
+
+// failingSnapshots fails every snapshot write
+type failingSnapshots struct {
+	memSnapshots
+}
+
+func (failingSnapshots) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	return errors.New("snapshot store unavailable")
+}
+
+func TestSnapshotErrorHandler(t *testing.T) {
+	ctx := context.Background()
+
+	// a snapshot is written once the threshold is reached
+	snapshots := memSnapshots{}
+	es := NewEventStore(&memRepo{}, 3, counterFactory{}, WithSnapshotStore(snapshots))
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	assert.Empty(t, snapshots)
+	c.Increment(3)
+	require.NoError(t, es.Save(ctx, c))
+	require.Contains(t, snapshots, "1")
+	assert.Equal(t, uint32(3), snapshots["1"].AggregateVersion)
+
+	// without a handler, the failure is returned, but the events were saved
+	r := &memRepo{}
+	es = NewEventStore(r, 1, counterFactory{}, WithSnapshotStore(failingSnapshots{}))
+	c = newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.Error(t, es.Save(ctx, c))
+	assert.Len(t, r.events, 1)
+	assert.Empty(t, c.GetEvents())
+
+	errs := []error{}
+	es = NewEventStore(r, 1, counterFactory{}, WithSnapshotStore(failingSnapshots{}), WithSnapshotErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	assert.Len(t, r.events, 2)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "snapshot store unavailable")
+}
+
+func TestMaxBodySize(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	// the encoded body of Incremented{By: 1} has 8 bytes
+	es := NewEventStore(r, 100, counterFactory{}, WithMaxBodySize(8))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c))
+	require.Len(t, r.events, 1)
+
+	c.Increment(100)
+	err := es.Save(ctx, c)
+	require.True(t, errors.Is(err, ErrBodyTooLarge), "expected body too large, got %v", err)
+	assert.Len(t, r.events, 1)
+
+	// without the limit, the body is saved
+	es = NewEventStore(r, 100, counterFactory{})
+	require.NoError(t, es.Save(ctx, c))
+	assert.Len(t, r.events, 2)
+}
+
+func TestDefaultLabels(t *testing.T) {
+	ctx := context.Background()
+	r := &memRepo{}
+	defaults := map[string]interface{}{"service": "counter", "region": "eu"}
+	es := NewEventStore(r, 100, counterFactory{}, WithDefaultLabels(defaults))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	require.NoError(t, es.Save(ctx, c))
+	require.Len(t, r.events, 1)
+	assert.Equal(t, map[string]interface{}{"service": "counter", "region": "eu"}, r.events[0].Labels)
+
+	// the labels of the save take precedence
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c, WithLabels(map[string]interface{}{"region": "us", "command": "increment"})))
+	require.Len(t, r.events, 2)
+	assert.Equal(t, map[string]interface{}{"service": "counter", "region": "us", "command": "increment"}, r.events[1].Labels)
+	// the default labels are not changed by the merge
+	assert.Equal(t, map[string]interface{}{"service": "counter", "region": "eu"}, defaults)
+}
+
+func TestDecodeMap(t *testing.T) {
+	// the kind does not need to be known
+	e := Event{ID: "1", Kind: "Unknown", Body: []byte(`{"name":"Paulo","amount":10,"tags":["a"]}`)}
+	m, err := e.DecodeMap()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "Paulo", "amount": float64(10), "tags": []interface{}{"a"}}, m)
+
+	m, err = Event{ID: "2", Kind: "Unknown"}.DecodeMap()
+	require.NoError(t, err)
+	assert.Empty(t, m)
+
+	_, err = Event{ID: "3", Kind: "Unknown", Body: []byte(`[1]`)}.DecodeMap()
+	require.Error(t, err)
+
+	// with the codec that encoded the body
+	e = Event{ID: "4", Kind: "Unknown", Body: []byte(`xml{"name":"Paulo"}`)}
+	m, err = e.DecodeMapWith(prefixCodec("xml"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "Paulo"}, m)
+}
@@ -0,0 +1,44 @@
+package eventstore
+
+import (
+	"time"
+
+	"github.com/quintans/faults"
+)
+
+// GivenEvents puts the aggregate in the state of a history of events, without a store,
+// to test command handlers in the given/when/then style:
+//
+//	acc, err := GivenEvents(factory, nil, NewAccount(), AccountCreated{...}, MoneyDeposited{...})
+//	acc.Withdraw(10)
+//	// assert acc.GetEvents()
+//
+// If factory is not nil, every event goes through a JSON round trip and is rehydrated by the factory and upcaster,
+// like it would be when loaded from the store, otherwise the events are applied as they are.
+// The events get the versions following the current version of the aggregate.
+// The returned aggregate has no pending events.
+func GivenEvents(factory Factory, upcaster Upcaster, aggregate Aggregater, events ...Eventer) (Aggregater, error) {
+	codec := JSONCodec{}
+	now := time.Now().UTC()
+	version := aggregate.GetVersion()
+	for _, e := range events {
+		if factory != nil {
+			body, err := codec.Encode(e)
+			if err != nil {
+				return nil, faults.Errorf("Unable to encode given event %s: %w", e.GetType(), err)
+			}
+			t, err := RehydrateEvent(factory, codec, upcaster, e.GetType(), body)
+			if err != nil {
+				return nil, err
+			}
+			e = t.(Eventer)
+		}
+		version++
+		aggregate.ApplyChangeFromHistory(EventMetadata{
+			AggregateVersion: version,
+			CreatedAt:        now,
+		}, e)
+	}
+	aggregate.ClearEvents()
+	return aggregate, nil
+}
@@ -0,0 +1,98 @@
+package eventstore
+
+import (
+	"testing"
+
+	"github.com/quintans/faults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Incremented struct {
+	By int `json:"by"`
+}
+
+func (Incremented) GetType() string {
+	return "Incremented"
+}
+
+// IncrementedV2 is what Incremented is upcasted to
+type IncrementedV2 struct {
+	Delta int
+}
+
+func (IncrementedV2) GetType() string {
+	return "IncrementedV2"
+}
+
+type counter struct {
+	RootAggregate
+	Total int `json:"total"`
+}
+
+func newCounter() *counter {
+	c := &counter{}
+	c.RootAggregate = NewRootAggregate(c)
+	return c
+}
+
+func (c counter) GetType() string {
+	return "Counter"
+}
+
+func (c *counter) Increment(by int) {
+	c.ApplyChange(Incremented{By: by})
+}
+
+func (c *counter) HandleEvent(event Eventer) {
+	switch t := event.(type) {
+	case Incremented:
+		c.Total += t.By
+	case IncrementedV2:
+		c.Total += t.Delta
+	}
+}
+
+type counterFactory struct{}
+
+func (counterFactory) New(kind string) (Typer, error) {
+	switch kind {
+	case "Counter":
+		return newCounter(), nil
+	case "Incremented":
+		return &Incremented{}, nil
+	}
+	return nil, faults.Errorf("Unknown kind: %s", kind)
+}
+
+type counterUpcaster struct{}
+
+func (counterUpcaster) Upcast(t Typer) Typer {
+	if e, ok := t.(*Incremented); ok {
+		return &IncrementedV2{Delta: e.By}
+	}
+	return t
+}
+
+func TestGivenEvents(t *testing.T) {
+	a, err := GivenEvents(nil, nil, newCounter(), Incremented{By: 1}, Incremented{By: 2})
+	require.NoError(t, err)
+	c := a.(*counter)
+	assert.Equal(t, 3, c.Total)
+	assert.Equal(t, uint32(2), c.GetVersion())
+	assert.Empty(t, c.GetEvents())
+
+	// when
+	c.Increment(4)
+	// then
+	assert.Equal(t, []Eventer{Incremented{By: 4}}, c.GetEvents())
+	assert.Equal(t, 7, c.Total)
+
+	// rehydrated and upcasted like when loaded from the store
+	a, err = GivenEvents(counterFactory{}, counterUpcaster{}, newCounter(), Incremented{By: 5})
+	require.NoError(t, err)
+	assert.Equal(t, 5, a.(*counter).Total)
+
+	_, err = GivenEvents(counterFactory{}, nil, newCounter(), IncrementedV2{Delta: 1})
+	require.Error(t, err)
+}
@@ -0,0 +1,36 @@
+package eventstore
+
+import "strings"
+
+const namespaceSeparator = "."
+
+// KindNamer returns the kind under which an event is stored
+type KindNamer func(e Typer) string
+
+// NamespaceKinds prefixes the type of the events with the namespace, eg: account.Created,
+// avoiding collisions between events of different bounded contexts sharing the same store.
+// The factory should be wrapped with NewNamespacedFactory, so that the stored kinds are resolved.
+func NamespaceKinds(namespace string) KindNamer {
+	return func(e Typer) string {
+		return namespace + namespaceSeparator + e.GetType()
+	}
+}
+
+// NamespacedFactory resolves kinds prefixed with a namespace (see NamespaceKinds),
+// delegating the bare kind to the wrapped factory.
+// Kinds without the namespace, like the ones stored before namespacing, are delegated as they are.
+type NamespacedFactory struct {
+	prefix  string
+	factory Factory
+}
+
+func NewNamespacedFactory(namespace string, factory Factory) NamespacedFactory {
+	return NamespacedFactory{
+		prefix:  namespace + namespaceSeparator,
+		factory: factory,
+	}
+}
+
+func (f NamespacedFactory) New(kind string) (Typer, error) {
+	return f.factory.New(strings.TrimPrefix(kind, f.prefix))
+}
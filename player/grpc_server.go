@@ -4,22 +4,32 @@ import (
 	"context"
 	"encoding/json"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
 	_ "github.com/lib/pq"
+	"github.com/quintans/eventstore"
 	pb "github.com/quintans/eventstore/api/proto"
-	"github.com/quintans/eventstore/store"
 	"github.com/quintans/faults"
 	"google.golang.org/grpc"
 )
 
+var _ pb.StoreServer = (*GrpcServer)(nil)
+
+// GrpcServer exposes a Repository as the proto Store service
 type GrpcServer struct {
 	store Repository
 }
 
+// NewStoreServer adapts the repository to the proto Store service.
+// NewStoreClientRepository does the opposite, so that a Repository is served and consumed with the same mapping.
+func NewStoreServer(repo Repository) *GrpcServer {
+	return &GrpcServer{store: repo}
+}
+
 func (s *GrpcServer) GetLastEventID(ctx context.Context, r *pb.GetLastEventIDRequest) (*pb.GetLastEventIDReply, error) {
-	filter := pbFilterToFilter(r.GetFilter())
+	filter := pb.ToFilter(r.GetFilter())
 	eID, err := s.store.GetLastEventID(ctx, time.Duration(r.TrailingLag)*time.Millisecond, filter)
 	if err != nil {
 		return nil, err
@@ -28,59 +38,71 @@ func (s *GrpcServer) GetLastEventID(ctx context.Context, r *pb.GetLastEventIDReq
 }
 
 func (s *GrpcServer) GetEvents(ctx context.Context, r *pb.GetEventsRequest) (*pb.GetEventsReply, error) {
-	filter := pbFilterToFilter(r.GetFilter())
+	filter := pb.ToFilter(r.GetFilter())
 	events, err := s.store.GetEvents(ctx, r.GetAfterEventId(), int(r.GetLimit()), time.Duration(r.TrailingLag)*time.Millisecond, filter)
-	if err != nil {
+	// a reply can not carry both, so the events read before the failure are returned
+	// and the next call, after the last of them, returns the error
+	if err != nil && !(filter.PartialResults && len(events) > 0) {
 		return nil, err
 	}
 	pbEvents := make([]*pb.Event, len(events))
 	for k, v := range events {
-		createdAt, err := ptypes.TimestampProto(v.CreatedAt)
+		pbEvents[k], err = toProtoEvent(v)
 		if err != nil {
-			return nil, faults.Errorf("could convert timestamp to proto: %w", err)
-		}
-		labels, err := json.Marshal(v.Labels)
-		if err != nil {
-			return nil, faults.Errorf("Unable marshal labels: %w", err)
-		}
-		pbEvents[k] = &pb.Event{
-			Id:               v.ID,
-			AggregateId:      v.AggregateID,
-			AggregateIdHash:  v.AggregateIDHash,
-			AggregateVersion: v.AggregateVersion,
-			AggregateType:    v.AggregateType,
-			Kind:             v.Kind,
-			Body:             v.Body,
-			IdempotencyKey:   v.IdempotencyKey,
-			Labels:           string(labels),
-			CreatedAt:        createdAt,
+			return nil, err
 		}
 	}
 	return &pb.GetEventsReply{Events: pbEvents}, nil
 }
 
-func pbFilterToFilter(pbFilter *pb.Filter) store.Filter {
-	types := make([]string, len(pbFilter.AggregateTypes))
-	for k, v := range pbFilter.AggregateTypes {
-		types[k] = v
+func toProtoEvent(e eventstore.Event) (*pb.Event, error) {
+	createdAt, err := ptypes.TimestampProto(e.CreatedAt)
+	if err != nil {
+		return nil, faults.Errorf("could convert timestamp to proto: %w", err)
 	}
-	labels := store.Labels{}
-	for _, v := range pbFilter.Labels {
-		values := labels[v.Key]
-		if values == nil {
-			values = []string{v.Value}
-		} else {
-			values = append(values, v.Value)
-		}
-		labels[v.Key] = values
+	labels, err := json.Marshal(e.Labels)
+	if err != nil {
+		return nil, faults.Errorf("Unable marshal labels: %w", err)
 	}
-	return store.Filter{
-		AggregateTypes: types,
-		Labels:         labels,
-		Partitions:     pbFilter.Partitions,
-		PartitionLow:   pbFilter.PartitionLow,
-		PartitionHi:    pbFilter.PartitionHi,
+	return &pb.Event{
+		Id:               e.ID,
+		AggregateId:      e.AggregateID,
+		AggregateIdHash:  e.AggregateIDHash,
+		AggregateVersion: e.AggregateVersion,
+		AggregateType:    e.AggregateType,
+		Kind:             e.Kind,
+		Body:             e.Body,
+		IdempotencyKey:   e.IdempotencyKey,
+		Labels:           string(labels),
+		CreatedAt:        createdAt,
+		ContentType:      contentType(e.Labels),
+		SchemaVersion:    schemaVersion(e.Labels),
+		ExternalId:       e.ExternalID,
+		Epoch:            e.Epoch,
+		ResumeToken:      e.ResumeToken,
+	}, nil
+}
+
+// contentType returns the content type of the event body, empty if unknown (see eventstore.WithAggregateCodec)
+func contentType(labels map[string]interface{}) string {
+	ct, _ := labels[eventstore.ContentTypeLabel].(string)
+	return ct
+}
+
+// schemaVersion returns the schema version of the event body, zero if unknown
+func schemaVersion(labels map[string]interface{}) uint32 {
+	switch v := labels[eventstore.SchemaVersionLabel].(type) {
+	case string:
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err == nil {
+			return uint32(n)
+		}
+	case float64:
+		return uint32(v)
+	case int:
+		return uint32(v)
 	}
+	return 0
 }
 
 func StartGrpcServer(ctx context.Context, address string, repo Repository) error {
@@ -89,7 +111,7 @@ func StartGrpcServer(ctx context.Context, address string, repo Repository) error
 		return faults.Errorf("failed to listen: %w", err)
 	}
 	s := grpc.NewServer()
-	pb.RegisterStoreServer(s, &GrpcServer{store: repo})
+	pb.RegisterStoreServer(s, NewStoreServer(repo))
 
 	go func() {
 		<-ctx.Done()
@@ -0,0 +1,50 @@
+package player
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventSchemaLabels(t *testing.T) {
+	labels := map[string]interface{}{
+		eventstore.ContentTypeLabel:   "application/json",
+		eventstore.SchemaVersionLabel: "2",
+	}
+	assert.Equal(t, "application/json", contentType(labels))
+	assert.Equal(t, uint32(2), schemaVersion(labels))
+
+	// decoded from JSON
+	assert.Equal(t, uint32(3), schemaVersion(map[string]interface{}{eventstore.SchemaVersionLabel: float64(3)}))
+	assert.Equal(t, "", contentType(nil))
+	assert.Equal(t, uint32(0), schemaVersion(nil))
+}
+
+func TestStoreBridge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	repo := MockRepo{events: []eventstore.Event{
+		{ID: "A", AggregateID: "1", AggregateIDHash: 7, AggregateVersion: 1, AggregateType: "Account", Kind: "Created", Body: []byte(`{}`), Labels: map[string]interface{}{"geo": "EU"}, CreatedAt: now},
+		{ID: "B", AggregateID: "1", AggregateIDHash: 7, AggregateVersion: 2, AggregateType: "Account", Kind: "Deposited", Body: []byte(`{}`), IdempotencyKey: "k", Labels: map[string]interface{}{eventstore.ContentTypeLabel: "application/json"}, CreatedAt: now},
+	}}
+	bridge := NewStoreClientRepository(NewLocalStoreClient(NewStoreServer(repo)))
+
+	for _, after := range []string{"", "A"} {
+		expected, err := repo.GetEvents(ctx, after, 10, 0, store.Filter{})
+		require.NoError(t, err)
+		events, err := bridge.GetEvents(ctx, after, 10, 0, store.Filter{})
+		require.NoError(t, err)
+		assert.Equal(t, expected, events)
+	}
+
+	expected, err := repo.GetLastEventID(ctx, 0, store.Filter{})
+	require.NoError(t, err)
+	last, err := bridge.GetLastEventID(ctx, 0, store.Filter{})
+	require.NoError(t, err)
+	assert.Equal(t, expected, last)
+}
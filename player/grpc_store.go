@@ -33,15 +33,7 @@ func (c GrpcRepository) GetLastEventID(ctx context.Context, trailingLag time.Dur
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	pbFilter := filterToPbFilter(filter)
-	r, err := cli.GetLastEventID(ctx, &pb.GetLastEventIDRequest{
-		TrailingLag: trailingLag.Milliseconds(),
-		Filter:      pbFilter,
-	})
-	if err != nil {
-		return "", faults.Errorf("could not get last event id: %w", err)
-	}
-	return r.EventId, nil
+	return NewStoreClientRepository(cli).GetLastEventID(ctx, trailingLag, filter)
 }
 
 func (c GrpcRepository) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
@@ -51,15 +43,49 @@ func (c GrpcRepository) GetEvents(ctx context.Context, afterEventID string, limi
 	}
 	defer conn.Close()
 
-	pbFilter := filterToPbFilter(filter)
-
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	r, err := cli.GetEvents(ctx, &pb.GetEventsRequest{
+	return NewStoreClientRepository(cli).GetEvents(ctx, afterEventID, limit, trailingLag, filter)
+}
+
+func (c GrpcRepository) dial() (pb.StoreClient, *grpc.ClientConn, error) {
+	conn, err := grpc.Dial(c.address, grpc.WithInsecure())
+	if err != nil {
+		return nil, nil, faults.Errorf("did not connect: %w", err)
+	}
+	return pb.NewStoreClient(conn), conn, nil
+}
+
+// StoreClientRepository is a Repository reading the events from a proto Store service
+type StoreClientRepository struct {
+	cli pb.StoreClient
+}
+
+// NewStoreClientRepository adapts the client of the proto Store service to a Repository,
+// either a remote one or, with NewLocalStoreClient, one in the same process.
+func NewStoreClientRepository(cli pb.StoreClient) StoreClientRepository {
+	return StoreClientRepository{
+		cli: cli,
+	}
+}
+
+func (c StoreClientRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	r, err := c.cli.GetLastEventID(ctx, &pb.GetLastEventIDRequest{
+		TrailingLag: trailingLag.Milliseconds(),
+		Filter:      pb.FromFilter(filter),
+	})
+	if err != nil {
+		return "", faults.Errorf("could not get last event id: %w", err)
+	}
+	return r.EventId, nil
+}
+
+func (c StoreClientRepository) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	r, err := c.cli.GetEvents(ctx, &pb.GetEventsRequest{
 		AfterEventId: afterEventID,
 		Limit:        int32(limit),
 		TrailingLag:  trailingLag.Milliseconds(),
-		Filter:       pbFilter,
+		Filter:       pb.FromFilter(filter),
 	})
 	if err != nil {
 		return nil, faults.Errorf("could not get events: %w", err)
@@ -67,57 +93,64 @@ func (c GrpcRepository) GetEvents(ctx context.Context, afterEventID string, limi
 
 	events := make([]eventstore.Event, len(r.Events))
 	for k, v := range r.Events {
-		createdAt, err := tsToTime(v.CreatedAt)
-		if err != nil {
-			return nil, faults.Errorf("could convert timestamp to time: %w", err)
-		}
-		labels := map[string]interface{}{}
-		err = json.Unmarshal([]byte(v.Labels), &labels)
+		events[k], err = fromProtoEvent(v)
 		if err != nil {
-			return nil, faults.Errorf("Unable unmarshal labels to map: %w", err)
-		}
-		events[k] = eventstore.Event{
-			ID:               v.Id,
-			AggregateID:      v.AggregateId,
-			AggregateIDHash:  v.AggregateIdHash,
-			AggregateVersion: v.AggregateVersion,
-			AggregateType:    v.AggregateType,
-			Kind:             v.Kind,
-			Body:             v.Body,
-			IdempotencyKey:   v.IdempotencyKey,
-			Labels:           labels,
-			CreatedAt:        *createdAt,
+			return nil, err
 		}
 	}
 	return events, nil
 }
 
-func filterToPbFilter(filter store.Filter) *pb.Filter {
-	types := make([]string, len(filter.AggregateTypes))
-	for k, v := range filter.AggregateTypes {
-		types[k] = v
+func fromProtoEvent(e *pb.Event) (eventstore.Event, error) {
+	createdAt, err := tsToTime(e.CreatedAt)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("could convert timestamp to time: %w", err)
 	}
-	labels := []*pb.Label{}
-	for key, v := range filter.Labels {
-		for _, value := range v {
-			labels = append(labels, &pb.Label{Key: key, Value: value})
-		}
+	labels := map[string]interface{}{}
+	err = json.Unmarshal([]byte(e.Labels), &labels)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable unmarshal labels to map: %w", err)
 	}
-	return &pb.Filter{
-		AggregateTypes: types,
-		Labels:         labels,
-		Partitions:     filter.Partitions,
-		PartitionLow:   filter.PartitionLow,
-		PartitionHi:    filter.PartitionHi,
+	// so that eventstore.EventStore.DecodeEvent picks the codec that encoded the body
+	if e.ContentType != "" {
+		labels[eventstore.ContentTypeLabel] = e.ContentType
 	}
+	return eventstore.Event{
+		ID:               e.Id,
+		AggregateID:      e.AggregateId,
+		AggregateIDHash:  e.AggregateIdHash,
+		AggregateVersion: e.AggregateVersion,
+		AggregateType:    e.AggregateType,
+		Kind:             e.Kind,
+		Body:             e.Body,
+		IdempotencyKey:   e.IdempotencyKey,
+		ExternalID:       e.ExternalId,
+		Labels:           labels,
+		CreatedAt:        *createdAt,
+		Epoch:            e.Epoch,
+		ResumeToken:      e.ResumeToken,
+	}, nil
 }
 
-func (c GrpcRepository) dial() (pb.StoreClient, *grpc.ClientConn, error) {
-	conn, err := grpc.Dial(c.address, grpc.WithInsecure())
-	if err != nil {
-		return nil, nil, faults.Errorf("did not connect: %w", err)
-	}
-	return pb.NewStoreClient(conn), conn, nil
+var _ pb.StoreClient = localStoreClient{}
+
+// localStoreClient calls a proto Store service in the same process
+type localStoreClient struct {
+	srv pb.StoreServer
+}
+
+// NewLocalStoreClient returns a client calling the service directly, without the network,
+// so that an in process Repository goes through the same mapping as a remote one.
+func NewLocalStoreClient(srv pb.StoreServer) pb.StoreClient {
+	return localStoreClient{srv: srv}
+}
+
+func (c localStoreClient) GetLastEventID(ctx context.Context, in *pb.GetLastEventIDRequest, opts ...grpc.CallOption) (*pb.GetLastEventIDReply, error) {
+	return c.srv.GetLastEventID(ctx, in)
+}
+
+func (c localStoreClient) GetEvents(ctx context.Context, in *pb.GetEventsRequest, opts ...grpc.CallOption) (*pb.GetEventsReply, error) {
+	return c.srv.GetEvents(ctx, in)
 }
 
 func tsToTime(ts *timestamp.Timestamp) (*time.Time, error) {
@@ -2,9 +2,11 @@ package player
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
 	"github.com/quintans/eventstore/store"
 	"github.com/quintans/faults"
 )
@@ -32,6 +34,9 @@ const (
 
 type EventHandlerFunc func(ctx context.Context, e eventstore.Event) error
 
+// BatchHandler handles, in order, the events of an aggregate found in a batch
+type BatchHandler func(ctx context.Context, aggregateID string, events []eventstore.Event) error
+
 type Cancel func()
 
 type Option func(*Player)
@@ -139,12 +144,121 @@ func (p Player) ReplayFromUntil(ctx context.Context, handler EventHandlerFunc, a
 					return "", faults.Wrap(err)
 				}
 			}
-			afterEventID = evt.ID
-			if evt.ID >= untilEventID {
-				return evt.ID, nil
+			afterEventID = store.EventPosition(evt)
+			if untilEventID != "" && afterEventID >= untilEventID {
+				return afterEventID, nil
 			}
 		}
 		loop = len(events) != 0
 	}
 	return afterEventID, nil
 }
+
+// ParallelReplay replays the events with one reader per partition, from 1 to partitions, running concurrently,
+// to speed up the rebuild of projections that handle each aggregate independently.
+// The events of an aggregate are always in the same partition, so they are handled in order,
+// but the events of different partitions are handled concurrently, so handler must be safe for concurrent use.
+// It returns the last event ID handled by each partition, in partition order, or the first error, that stops all the readers.
+func (p Player) ParallelReplay(ctx context.Context, partitions uint32, handler EventHandlerFunc, filters ...store.FilterOption) ([]string, error) {
+	if partitions <= 1 {
+		last, err := p.Replay(ctx, handler, "", filters...)
+		if err != nil {
+			return nil, err
+		}
+		return []string{last}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lasts := make([]string, partitions)
+	errs := make(chan error, partitions)
+	var wg sync.WaitGroup
+	for i := uint32(1); i <= partitions; i++ {
+		wg.Add(1)
+		go func(partition uint32) {
+			defer wg.Done()
+			fs := append(append([]store.FilterOption{}, filters...), store.WithPartitions(partitions, partition, partition))
+			last, err := p.Replay(ctx, handler, "", fs...)
+			if err != nil {
+				errs <- faults.Errorf("Unable to replay partition %d: %w", partition, err)
+				cancel()
+				return
+			}
+			lasts[partition-1] = last
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return lasts, nil
+}
+
+// GetEventsInTimeRange returns the events created in the time range [from, to), that match the filter.
+// Since the event ID starts with the creation time, the range is translated into an event ID range, keeping the query on the primary key.
+// Combined with the partition filter, it allows parallel workers to each process a partition range of a time window, eg: for reconciliation jobs.
+func (p Player) GetEventsInTimeRange(ctx context.Context, from, to time.Time, filter store.Filter) ([]eventstore.Event, error) {
+	// no event has the zero aggregate ID and version, so these IDs are lower than the ones of any event created at that time
+	afterEventID := common.NewEventID(from, "", 0)
+	untilEventID := common.NewEventID(to, "", 0)
+	result := []eventstore.Event{}
+	for {
+		events, err := p.store.GetEvents(ctx, afterEventID, p.batchSize, p.trailingLag, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			return result, nil
+		}
+		for _, evt := range events {
+			if evt.ID >= untilEventID {
+				return result, nil
+			}
+			if p.customFilter == nil || p.customFilter(evt) {
+				result = append(result, evt)
+			}
+		}
+		afterEventID = store.EventPosition(events[len(events)-1])
+	}
+}
+
+// ReplayByAggregate replays the events, grouping the events of each fetched batch by aggregate, preserving their order.
+// The returned event ID only advances after all the groups of a batch are successfully handled.
+func (p Player) ReplayByAggregate(ctx context.Context, handler BatchHandler, afterEventID string, filters ...store.FilterOption) (string, error) {
+	filter := store.Filter{}
+	for _, f := range filters {
+		f(&filter)
+	}
+	for {
+		events, err := p.store.GetEvents(ctx, afterEventID, p.batchSize, p.trailingLag, filter)
+		if err != nil {
+			return "", err
+		}
+		if len(events) == 0 {
+			return afterEventID, nil
+		}
+
+		ids := []string{}
+		groups := map[string][]eventstore.Event{}
+		for _, evt := range events {
+			if p.customFilter != nil && !p.customFilter(evt) {
+				continue
+			}
+			group, ok := groups[evt.AggregateID]
+			if !ok {
+				ids = append(ids, evt.AggregateID)
+			}
+			groups[evt.AggregateID] = append(group, evt)
+		}
+		for _, id := range ids {
+			err := handler(ctx, id, groups[id])
+			if err != nil {
+				return "", faults.Wrap(err)
+			}
+		}
+		afterEventID = store.EventPosition(events[len(events)-1])
+	}
+}
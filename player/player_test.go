@@ -0,0 +1,182 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	repo := MockRepo{
+		events: []eventstore.Event{
+			{ID: "A", AggregateID: "1", AggregateVersion: 1},
+			{ID: "B", AggregateID: "2", AggregateVersion: 1},
+			{ID: "C", AggregateID: "1", AggregateVersion: 2},
+		},
+	}
+	p := New(repo, WithBatchSize(2))
+
+	ids := []string{}
+	handler := func(ctx context.Context, e eventstore.Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	}
+
+	// without an until event, all the events are replayed
+	last, err := p.Replay(context.Background(), handler, "")
+	require.NoError(t, err)
+	assert.Equal(t, "C", last)
+	assert.Equal(t, []string{"A", "B", "C"}, ids)
+
+	ids = []string{}
+	last, err = p.ReplayUntil(context.Background(), handler, "B")
+	require.NoError(t, err)
+	assert.Equal(t, "B", last)
+	assert.Equal(t, []string{"A", "B"}, ids)
+}
+
+func TestReplayByAggregate(t *testing.T) {
+	repo := MockRepo{
+		events: []eventstore.Event{
+			{ID: "A", AggregateID: "1", AggregateVersion: 1},
+			{ID: "B", AggregateID: "2", AggregateVersion: 1},
+			{ID: "C", AggregateID: "1", AggregateVersion: 2},
+			{ID: "D", AggregateID: "3", AggregateVersion: 1},
+			{ID: "E", AggregateID: "1", AggregateVersion: 3},
+		},
+	}
+	p := New(repo, WithBatchSize(3))
+
+	type group struct {
+		aggregateID string
+		ids         []string
+	}
+	groups := []group{}
+	handler := func(ctx context.Context, aggregateID string, events []eventstore.Event) error {
+		g := group{aggregateID: aggregateID}
+		for _, e := range events {
+			g.ids = append(g.ids, e.ID)
+		}
+		groups = append(groups, g)
+		return nil
+	}
+
+	last, err := p.ReplayByAggregate(context.Background(), handler, "")
+	require.NoError(t, err)
+	assert.Equal(t, "E", last)
+	assert.Equal(t, []group{
+		{aggregateID: "1", ids: []string{"A", "C"}},
+		{aggregateID: "2", ids: []string{"B"}},
+		{aggregateID: "3", ids: []string{"D"}},
+		{aggregateID: "1", ids: []string{"E"}},
+	}, groups)
+
+	// a failing group does not advance the position
+	errFail := errors.New("fail")
+	last, err = p.ReplayByAggregate(context.Background(), func(ctx context.Context, aggregateID string, events []eventstore.Event) error {
+		if aggregateID == "2" {
+			return errFail
+		}
+		return nil
+	}, "")
+	require.True(t, errors.Is(err, errFail), "expected fail, got %v", err)
+	assert.Equal(t, "", last)
+}
+
+func TestGetEventsInTimeRange(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	events := []eventstore.Event{}
+	for k, d := range []time.Duration{-2 * time.Hour, -time.Hour, -time.Hour, -30 * time.Minute, 0, time.Minute} {
+		id := strconv.Itoa(k)
+		createdAt := now.Add(d)
+		events = append(events, eventstore.Event{
+			ID:               common.NewEventID(createdAt, id, 1),
+			AggregateID:      id,
+			AggregateIDHash:  uint32(k),
+			AggregateVersion: 1,
+			CreatedAt:        createdAt,
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	p := New(MockRepo{events: events}, WithBatchSize(2))
+
+	found, err := p.GetEventsInTimeRange(context.Background(), now.Add(-time.Hour), now, store.Filter{})
+	require.NoError(t, err)
+	ids := aggregateIDs(found)
+	sort.Strings(ids)
+	assert.Equal(t, []string{"1", "2", "3"}, ids)
+}
+
+func aggregateIDs(events []eventstore.Event) []string {
+	ids := make([]string, len(events))
+	for k, e := range events {
+		ids[k] = e.AggregateID
+	}
+	return ids
+}
+
+// partitionedRepo filters the events of a single partition by the aggregate ID hash
+type partitionedRepo struct {
+	MockRepo
+}
+
+func (r partitionedRepo) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	result := []eventstore.Event{}
+	for _, v := range r.events {
+		if v.ID <= afterEventID || (filter.Partitions > 1 && v.AggregateIDHash%filter.Partitions != filter.PartitionLow-1) {
+			continue
+		}
+		result = append(result, v)
+		if len(result) == limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func TestParallelReplay(t *testing.T) {
+	repo := partitionedRepo{MockRepo{
+		events: []eventstore.Event{
+			{ID: "A", AggregateID: "1", AggregateIDHash: 1, AggregateVersion: 1},
+			{ID: "B", AggregateID: "2", AggregateIDHash: 2, AggregateVersion: 1},
+			{ID: "C", AggregateID: "1", AggregateIDHash: 1, AggregateVersion: 2},
+			{ID: "D", AggregateID: "3", AggregateIDHash: 3, AggregateVersion: 1},
+			{ID: "E", AggregateID: "1", AggregateIDHash: 1, AggregateVersion: 3},
+		},
+	}}
+	p := New(repo, WithBatchSize(2))
+
+	var mu sync.Mutex
+	handled := map[string][]uint32{}
+	lasts, err := p.ParallelReplay(context.Background(), 2, func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[e.AggregateID] = append(handled[e.AggregateID], e.AggregateVersion)
+		return nil
+	})
+	require.NoError(t, err)
+	// partition 1 has the even hashes
+	assert.Equal(t, []string{"B", "E"}, lasts)
+	assert.Equal(t, map[string][]uint32{"1": {1, 2, 3}, "2": {1}, "3": {1}}, handled)
+
+	errFail := errors.New("fail")
+	_, err = p.ParallelReplay(context.Background(), 2, func(ctx context.Context, e eventstore.Event) error {
+		if e.ID == "D" {
+			return errFail
+		}
+		return nil
+	})
+	require.True(t, errors.Is(err, errFail), "expected fail, got %v", err)
+}
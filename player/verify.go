@@ -0,0 +1,115 @@
+package player
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/store"
+)
+
+type OrderingIssueKind int
+
+const (
+	// CreatedAtOutOfOrder means that an event was created before a previous event (by ID), beyond the trailing lag
+	CreatedAtOutOfOrder OrderingIssueKind = iota + 1
+	// VersionGap means that the versions of an aggregate are not contiguous
+	VersionGap
+)
+
+func (k OrderingIssueKind) String() string {
+	switch k {
+	case CreatedAtOutOfOrder:
+		return "CreatedAtOutOfOrder"
+	case VersionGap:
+		return "VersionGap"
+	}
+	return fmt.Sprintf("OrderingIssueKind(%d)", int(k))
+}
+
+// OrderingIssue describes a place in the store where the events are not properly ordered
+type OrderingIssue struct {
+	Kind        OrderingIssueKind
+	EventID     string
+	AggregateID string
+	// PreviousEventID is the event against which the event was compared
+	PreviousEventID string
+	Description     string
+}
+
+type aggregateState struct {
+	eventID string
+	version uint32
+}
+
+// VerifyOrdering scans the events in the store, reporting every place where the created_at ordering disagrees
+// with the ID ordering beyond the trailing lag, or where the versions of an aggregate are not contiguous.
+// This is an offline integrity check to catch clock skews or ID generation bugs.
+//
+// Aggregate versions can only be checked if the filter selects all the events of an aggregate.
+func (p Player) VerifyOrdering(ctx context.Context, filter store.Filter) ([]OrderingIssue, error) {
+	issues := []OrderingIssue{}
+	aggregates := map[string]aggregateState{}
+	var maxCreatedAt time.Time
+	var maxCreatedAtID string
+	afterEventID := common.MinEventID
+	for {
+		events, err := p.store.GetEvents(ctx, afterEventID, p.batchSize, 0, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			return issues, nil
+		}
+
+		for _, e := range events {
+			if e.CreatedAt.Add(p.trailingLag).Before(maxCreatedAt) {
+				issues = append(issues, OrderingIssue{
+					Kind:            CreatedAtOutOfOrder,
+					EventID:         e.ID,
+					AggregateID:     e.AggregateID,
+					PreviousEventID: maxCreatedAtID,
+					Description:     fmt.Sprintf("created at %s, before %s, beyond the trailing lag of %s", e.CreatedAt, maxCreatedAt, p.trailingLag),
+				})
+			}
+			if e.CreatedAt.After(maxCreatedAt) {
+				maxCreatedAt = e.CreatedAt
+				maxCreatedAtID = e.ID
+			}
+
+			last, ok := aggregates[e.AggregateID]
+			if ok && e.AggregateVersion != last.version+1 && !sameVersion(last, e.ID, e.AggregateVersion) {
+				issues = append(issues, OrderingIssue{
+					Kind:            VersionGap,
+					EventID:         e.ID,
+					AggregateID:     e.AggregateID,
+					PreviousEventID: last.eventID,
+					Description:     fmt.Sprintf("version %d follows version %d", e.AggregateVersion, last.version),
+				})
+			}
+			aggregates[e.AggregateID] = aggregateState{
+				eventID: e.ID,
+				version: e.AggregateVersion,
+			}
+
+			afterEventID = store.EventPosition(e)
+		}
+	}
+}
+
+// sameVersion checks if the event belongs to the same stored record as the last one (eg: MongoDB stores all the events of a save in one document, sharing the version)
+func sameVersion(last aggregateState, eventID string, version uint32) bool {
+	if last.version != version {
+		return false
+	}
+	lastID, _, err := common.SplitMessageID(last.eventID)
+	if err != nil {
+		return false
+	}
+	id, _, err := common.SplitMessageID(eventID)
+	if err != nil {
+		return false
+	}
+	return lastID == id
+}
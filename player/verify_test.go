@@ -0,0 +1,79 @@
+package player
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockRepo struct {
+	events []eventstore.Event
+}
+
+func (r MockRepo) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	if len(r.events) == 0 {
+		return "", nil
+	}
+	return r.events[len(r.events)-1].ID, nil
+}
+
+func (r MockRepo) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	result := []eventstore.Event{}
+	for _, v := range r.events {
+		if v.ID > afterEventID {
+			result = append(result, v)
+			if len(result) == limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestVerifyOrdering(t *testing.T) {
+	now := time.Now()
+	repo := MockRepo{
+		events: []eventstore.Event{
+			{ID: "A", AggregateID: "1", AggregateVersion: 1, CreatedAt: now},
+			{ID: "B", AggregateID: "2", AggregateVersion: 1, CreatedAt: now.Add(time.Second)},
+			{ID: "C", AggregateID: "1", AggregateVersion: 2, CreatedAt: now.Add(time.Second + 100*time.Millisecond)},
+			{ID: "D", AggregateID: "2", AggregateVersion: 3, CreatedAt: now.Add(2 * time.Second)},
+			{ID: "E", AggregateID: "1", AggregateVersion: 3, CreatedAt: now.Add(time.Second)},
+		},
+	}
+	p := New(repo, WithBatchSize(2), WithTrailingLag(500*time.Millisecond))
+
+	issues, err := p.VerifyOrdering(context.Background(), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, issues, 2)
+
+	assert.Equal(t, VersionGap, issues[0].Kind)
+	assert.Equal(t, "D", issues[0].EventID)
+	assert.Equal(t, "B", issues[0].PreviousEventID)
+
+	assert.Equal(t, CreatedAtOutOfOrder, issues[1].Kind)
+	assert.Equal(t, "E", issues[1].EventID)
+	assert.Equal(t, "D", issues[1].PreviousEventID)
+}
+
+func TestVerifyOrderingSameDocument(t *testing.T) {
+	now := time.Now()
+	repo := MockRepo{
+		events: []eventstore.Event{
+			{ID: common.NewMessageID("A", 0), AggregateID: "1", AggregateVersion: 1, CreatedAt: now},
+			{ID: common.NewMessageID("A", 1), AggregateID: "1", AggregateVersion: 1, CreatedAt: now},
+			{ID: common.NewMessageID("B", 0), AggregateID: "1", AggregateVersion: 2, CreatedAt: now},
+		},
+	}
+	p := New(repo)
+
+	issues, err := p.VerifyOrdering(context.Background(), store.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+}
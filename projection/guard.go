@@ -0,0 +1,36 @@
+package projection
+
+import (
+	"database/sql"
+
+	"github.com/quintans/faults"
+)
+
+// Guard records, in the projection's own transaction, the last applied event ID for the projection name,
+// returning false if the event ID is not strictly greater than the last one recorded.
+// This makes the projection writes exactly-once against its own store, even under at-least-once delivery.
+//
+// It targets PostgreSQL and expects the following table:
+//
+//	CREATE TABLE IF NOT EXISTS projection_offsets(
+//		name VARCHAR (100) PRIMARY KEY,
+//		last_event_id VARCHAR (50) NOT NULL
+//	);
+func Guard(tx *sql.Tx, name, eventID string) (apply bool, err error) {
+	// a single statement, so that concurrent guards of a projection without an offset yet are serialized by the primary key,
+	// and an older event never moves the offset backwards
+	res, err := tx.Exec(
+		`INSERT INTO projection_offsets (name, last_event_id) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET last_event_id = excluded.last_event_id
+		WHERE projection_offsets.last_event_id < excluded.last_event_id`,
+		name, eventID)
+	if err != nil {
+		return false, faults.Errorf("Unable to set the last event ID for projection '%s': %w", name, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, faults.Errorf("Unable to set the last event ID for projection '%s': %w", name, err)
+	}
+
+	return affected == 1, nil
+}
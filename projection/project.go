@@ -0,0 +1,184 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+const (
+	// DerivedAggregateType is the default aggregate type of the derived events saved by Project
+	DerivedAggregateType = "Derived"
+	// SourceEventIDLabel is the label of a derived event holding the ID of the source event it was mapped from
+	SourceEventIDLabel = "source_event_id"
+	// SourceAggregateIDLabel is the label of a derived event holding the aggregate ID of the source event it was mapped from
+	SourceAggregateIDLabel = "source_aggregate_id"
+)
+
+// EventMapper maps a source event into zero or more derived events
+type EventMapper func(e eventstore.Event) ([]eventstore.Eventer, error)
+
+// ProjectTarget is the event store receiving the derived events, eg: eventstore.EventStore
+type ProjectTarget interface {
+	Save(ctx context.Context, aggregate eventstore.Aggregater, options ...eventstore.SaveOption) error
+	// CurrentVersion returns the current version of the aggregate, zero if it does not exist
+	CurrentVersion(ctx context.Context, aggregateID string) (uint32, error)
+}
+
+var _ ProjectTarget = (*eventstore.EventStore)(nil)
+
+type projectOptions struct {
+	aggregateType string
+	batchSize     int
+	resume        store.ChangeLister
+	filters       []store.FilterOption
+}
+
+type ProjectOption func(*projectOptions)
+
+// WithDerivedAggregateType sets the aggregate type of the derived events. Defaults to DerivedAggregateType.
+func WithDerivedAggregateType(aggregateType string) ProjectOption {
+	return func(o *projectOptions) {
+		o.aggregateType = aggregateType
+	}
+}
+
+// WithProjectBatchSize sets how many source events are read at a time
+func WithProjectBatchSize(size int) ProjectOption {
+	return func(o *projectOptions) {
+		o.batchSize = size
+	}
+}
+
+// WithProjectResume resumes the projection after the last source event with derived events in the target,
+// read from the repository of the target, so that an interrupted projection does not map all the source events again.
+// Since the derived streams are identified by the source event IDs, the position is saved with the derived events, in the same transaction.
+// The derived streams are listed once, at the start, with store.ChangeLister.
+func WithProjectResume(target store.ChangeLister) ProjectOption {
+	return func(o *projectOptions) {
+		o.resume = target
+	}
+}
+
+// WithProjectFilter restricts the source events
+func WithProjectFilter(filters ...store.FilterOption) ProjectOption {
+	return func(o *projectOptions) {
+		o.filters = append(o.filters, filters...)
+	}
+}
+
+// Project replays the source events, maps each one into derived events and saves them to the target,
+// building an event sourced read model, as opposed to a state projection.
+//
+// The derived events of a source event are saved as a new stream, with the ID of the source event as aggregate ID,
+// labeled with SourceEventIDLabel and SourceAggregateIDLabel.
+// Saving the same source event twice is therefore rejected by the target, and ignored if the stream exists,
+// so the projection can be repeated, and with WithProjectResume it resumes after the last projected source event.
+// It returns the ID of the last processed source event.
+func Project(ctx context.Context, source player.Repository, target ProjectTarget, mapper EventMapper, options ...ProjectOption) (string, error) {
+	opts := projectOptions{
+		aggregateType: DerivedAggregateType,
+	}
+	for _, o := range options {
+		o(&opts)
+	}
+
+	afterEventID := ""
+	if opts.resume != nil {
+		refs, err := opts.resume.ChangedAggregates(ctx, time.Time{}, store.Filter{AggregateTypes: []string{opts.aggregateType}})
+		if err != nil {
+			return "", faults.Errorf("Unable to get the last projected source event of '%s': %w", opts.aggregateType, err)
+		}
+		for _, ref := range refs {
+			if ref.AggregateID > afterEventID {
+				afterEventID = ref.AggregateID
+			}
+		}
+	}
+
+	p := player.New(source, player.WithBatchSize(opts.batchSize))
+	last, err := p.Replay(ctx, func(ctx context.Context, e eventstore.Event) error {
+		events, err := mapper(e)
+		if err != nil {
+			return faults.Errorf("Unable to map event '%s': %w", e.ID, err)
+		}
+		if len(events) > 0 {
+			derived := &derivedStream{
+				id:            e.ID,
+				aggregateType: opts.aggregateType,
+				events:        events,
+				updatedAt:     e.CreatedAt,
+			}
+			err = target.Save(ctx, derived, eventstore.WithLabels(map[string]interface{}{
+				SourceEventIDLabel:     e.ID,
+				SourceAggregateIDLabel: e.AggregateID,
+			}))
+			if err != nil && !(errors.Is(err, eventstore.ErrConcurrentModification) && projected(ctx, target, e.ID)) {
+				return faults.Errorf("Unable to save the events derived from '%s': %w", e.ID, err)
+			}
+		}
+		return nil
+	}, afterEventID, opts.filters...)
+	if err != nil {
+		return "", err
+	}
+	return last, nil
+}
+
+// projected tells if the stream derived from the source event already exists, so that a failed save was a repeated projection
+func projected(ctx context.Context, target ProjectTarget, sourceEventID string) bool {
+	version, err := target.CurrentVersion(ctx, sourceEventID)
+	return err == nil && version > 0
+}
+
+var _ eventstore.Aggregater = (*derivedStream)(nil)
+
+// derivedStream is the aggregate holding the events derived from a source event
+type derivedStream struct {
+	id            string
+	aggregateType string
+	version       uint32
+	events        []eventstore.Eventer
+	updatedAt     time.Time
+}
+
+func (d *derivedStream) GetType() string {
+	return d.aggregateType
+}
+
+func (d *derivedStream) GetID() string {
+	return d.id
+}
+
+func (d *derivedStream) GetVersion() uint32 {
+	return d.version
+}
+
+func (d *derivedStream) SetVersion(version uint32) {
+	d.version = version
+}
+
+func (d *derivedStream) GetEventsCounter() uint32 {
+	return uint32(len(d.events))
+}
+
+func (d *derivedStream) GetEvents() []eventstore.Eventer {
+	return d.events
+}
+
+func (d *derivedStream) ClearEvents() {
+	d.events = nil
+}
+
+func (d *derivedStream) ApplyChangeFromHistory(m eventstore.EventMetadata, event eventstore.Eventer) {
+	d.version = m.AggregateVersion
+}
+
+func (d *derivedStream) UpdatedAt() time.Time {
+	return d.updatedAt
+}
@@ -0,0 +1,159 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockSource struct {
+	events []eventstore.Event
+}
+
+func (r MockSource) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	return r.events[len(r.events)-1].ID, nil
+}
+
+func (r MockSource) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	result := []eventstore.Event{}
+	for _, v := range r.events {
+		if v.ID > afterEventID {
+			result = append(result, v)
+			if len(result) == limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+type savedStream struct {
+	aggregateType string
+	kinds         []string
+	labels        map[string]interface{}
+}
+
+type MockTarget struct {
+	streams map[string]savedStream
+	saves   int
+	// conflicts fails the saves of the streams, as if some other event had the same ID
+	conflicts map[string]bool
+}
+
+func (t *MockTarget) Save(ctx context.Context, aggregate eventstore.Aggregater, options ...eventstore.SaveOption) error {
+	t.saves++
+	if _, ok := t.streams[aggregate.GetID()]; ok || t.conflicts[aggregate.GetID()] {
+		return eventstore.ErrConcurrentModification
+	}
+	opts := eventstore.Options{}
+	for _, o := range options {
+		o(&opts)
+	}
+	kinds := []string{}
+	for _, e := range aggregate.GetEvents() {
+		kinds = append(kinds, e.GetType())
+	}
+	t.streams[aggregate.GetID()] = savedStream{
+		aggregateType: aggregate.GetType(),
+		kinds:         kinds,
+		labels:        opts.Labels,
+	}
+	aggregate.SetVersion(uint32(len(kinds)))
+	aggregate.ClearEvents()
+	return nil
+}
+
+func (t *MockTarget) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	return uint32(len(t.streams[aggregateID].kinds)), nil
+}
+
+func (t *MockTarget) ChangedAggregates(ctx context.Context, since time.Time, filter store.Filter) ([]store.AggregateRef, error) {
+	refs := []store.AggregateRef{}
+	for id, s := range t.streams {
+		if s.aggregateType == filter.AggregateTypes[0] {
+			refs = append(refs, store.AggregateRef{AggregateID: id, AggregateType: s.aggregateType, Version: uint32(len(s.kinds))})
+		}
+	}
+	return refs, nil
+}
+
+type Derived struct {
+	Kind string
+}
+
+func (d Derived) GetType() string {
+	return d.Kind
+}
+
+func TestProject(t *testing.T) {
+	ctx := context.Background()
+	source := MockSource{events: []eventstore.Event{
+		{ID: "A", AggregateID: "1", Kind: "Created"},
+		{ID: "B", AggregateID: "1", Kind: "Touched"},
+		{ID: "C", AggregateID: "2", Kind: "Created"},
+		{ID: "D", AggregateID: "1", Kind: "Deleted"},
+	}}
+	target := &MockTarget{streams: map[string]savedStream{}}
+
+	errFail := errors.New("fail")
+	failAt := "D"
+	mapper := func(e eventstore.Event) ([]eventstore.Eventer, error) {
+		if e.ID == failAt {
+			return nil, errFail
+		}
+		switch e.Kind {
+		case "Created":
+			return []eventstore.Eventer{Derived{"Opened"}, Derived{"Counted"}}, nil
+		case "Deleted":
+			return []eventstore.Eventer{Derived{"Closed"}}, nil
+		}
+		return nil, nil
+	}
+
+	_, err := Project(ctx, source, target, mapper, WithProjectResume(target), WithProjectBatchSize(2))
+	require.True(t, errors.Is(err, errFail), "expected fail, got %v", err)
+	require.Len(t, target.streams, 2)
+	assert.Equal(t, savedStream{
+		aggregateType: DerivedAggregateType,
+		kinds:         []string{"Opened", "Counted"},
+		labels:        map[string]interface{}{SourceEventIDLabel: "A", SourceAggregateIDLabel: "1"},
+	}, target.streams["A"])
+	assert.Equal(t, []string{"Opened", "Counted"}, target.streams["C"].kinds)
+
+	// resumes after the last projected source event
+	failAt = ""
+	target.saves = 0
+	last, err := Project(ctx, source, target, mapper, WithProjectResume(target))
+	require.NoError(t, err)
+	assert.Equal(t, "D", last)
+	assert.Equal(t, 1, target.saves)
+	assert.Equal(t, []string{"Closed"}, target.streams["D"].kinds)
+
+	// without checkpoints, the already projected events are ignored
+	target.saves = 0
+	_, err = Project(ctx, source, target, mapper, WithDerivedAggregateType("Other"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, target.saves)
+	assert.Len(t, target.streams, 3)
+}
+
+func TestProjectConflict(t *testing.T) {
+	ctx := context.Background()
+	source := MockSource{events: []eventstore.Event{
+		{ID: "A", AggregateID: "1", Kind: "Created"},
+	}}
+	// the derived stream does not exist, so the conflict is not a repeated projection
+	target := &MockTarget{streams: map[string]savedStream{}, conflicts: map[string]bool{"A": true}}
+	mapper := func(e eventstore.Event) ([]eventstore.Eventer, error) {
+		return []eventstore.Eventer{Derived{"Opened"}}, nil
+	}
+
+	_, err := Project(ctx, source, target, mapper)
+	require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+}
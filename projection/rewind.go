@@ -0,0 +1,31 @@
+package projection
+
+import (
+	"context"
+
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+// ErrRewindAhead is the same error as store.ErrRewindAhead, returned by the pollers too
+var ErrRewindAhead = store.ErrRewindAhead
+
+// RewindResumeToken resets the resume token of a stream to an earlier token, so that the events after it are reprocessed.
+// The tokens are compared by the feed that produced them, since their order is not always the byte order, eg: MySQL binlog positions.
+// The consumer of the stream must be stopped while rewinding (eg: through a Rebuilder), and restarted afterwards.
+// If the target is ahead of the current token, ErrRewindAhead is returned.
+func RewindResumeToken(ctx context.Context, resumer StreamResumer, feed store.ResumeTokener, resume StreamResume, toToken string) error {
+	key := resume.String()
+	current, err := resumer.GetStreamResumeToken(ctx, key)
+	if err != nil {
+		return faults.Errorf("Unable to get the resume token for '%s': %w", key, err)
+	}
+	if feed.CompareResumeTokens([]byte(toToken), []byte(current)) > 0 {
+		return faults.Errorf("Unable to rewind '%s' to '%s', after the current token '%s': %w", key, toToken, current, ErrRewindAhead)
+	}
+	err = resumer.SetStreamResumeToken(ctx, key, toToken)
+	if err != nil {
+		return faults.Errorf("Unable to rewind the resume token for '%s' to '%s': %w", key, toToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockResumer struct {
+	tokens map[string]string
+}
+
+func (r *MockResumer) GetStreamResumeToken(ctx context.Context, key string) (string, error) {
+	return r.tokens[key], nil
+}
+
+func (r *MockResumer) SetStreamResumeToken(ctx context.Context, key string, token string) error {
+	r.tokens[key] = token
+	return nil
+}
+
+// numberPosition is a position whose order is not the byte order of its token, eg: 9 < 10
+type numberPosition int
+
+func (p numberPosition) Compare(other store.Position) int {
+	o := other.(numberPosition)
+	switch {
+	case p < o:
+		return -1
+	case p > o:
+		return 1
+	}
+	return 0
+}
+
+func (p numberPosition) String() string {
+	return strconv.Itoa(int(p))
+}
+
+func (p numberPosition) Bytes() []byte {
+	return []byte(p.String())
+}
+
+type MockTokener struct{}
+
+func (MockTokener) ResumeTokenKind() string {
+	return "number"
+}
+
+func (MockTokener) CompareResumeTokens(a, b []byte) int {
+	return store.CompareResumeTokens(func(token []byte) (store.Position, error) {
+		n, err := strconv.Atoi(string(token))
+		return numberPosition(n), err
+	}, a, b)
+}
+
+func TestRewindResumeToken(t *testing.T) {
+	ctx := context.Background()
+	resume := StreamResume{Topic: "accounts", Stream: "balance"}
+	resumer := &MockResumer{tokens: map[string]string{resume.String(): "10"}}
+
+	// "9" is after "10" byte by byte
+	err := RewindResumeToken(ctx, resumer, MockTokener{}, resume, "9")
+	require.NoError(t, err)
+	assert.Equal(t, "9", resumer.tokens[resume.String()])
+
+	err = RewindResumeToken(ctx, resumer, MockTokener{}, resume, "10")
+	require.True(t, errors.Is(err, ErrRewindAhead), "expected rewind ahead, got %v", err)
+	assert.True(t, errors.Is(err, store.ErrRewindAhead))
+	assert.Equal(t, "9", resumer.tokens[resume.String()])
+}
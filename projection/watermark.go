@@ -0,0 +1,88 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/faults"
+)
+
+// ErrWaitTimeout is returned when the projection did not reach the awaited event in time
+var ErrWaitTimeout = errors.New("timed out waiting for the projection")
+
+// Watermark tracks the ID of the last event processed by a projection,
+// so that a client can wait for the projection to catch up with its own writes (see eventstore.EventStore.SaveWithToken).
+//
+// Since event IDs are ordered, an awaited ID is reached when an equal or greater ID was processed.
+// A projection consuming partitions concurrently should have a watermark per partition.
+type Watermark struct {
+	mu      sync.Mutex
+	eventID string
+	changed chan struct{}
+}
+
+// NewWatermark creates a watermark at eventID, eg: the last checkpoint of the projection
+func NewWatermark(eventID string) *Watermark {
+	return &Watermark{
+		eventID: eventID,
+		changed: make(chan struct{}),
+	}
+}
+
+// EventID returns the ID of the last processed event
+func (w *Watermark) EventID() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.eventID
+}
+
+// Advance records that the event was processed, waking up the waiters. Older IDs are ignored.
+func (w *Watermark) Advance(eventID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if eventID <= w.eventID {
+		return
+	}
+	w.eventID = eventID
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// Handler decorates a projection handler, advancing the watermark after every successfully handled event
+func (w *Watermark) Handler(handler EventHandlerFunc) EventHandlerFunc {
+	return func(ctx context.Context, e eventstore.Event) error {
+		err := handler(ctx, e)
+		if err != nil {
+			return err
+		}
+		w.Advance(e.ID)
+		return nil
+	}
+}
+
+// WaitForEventID blocks until the projection processed the event with eventID, or a later one.
+// It returns ErrWaitTimeout if that does not happen within timeout, or the context error if the context is done.
+func (w *Watermark) WaitForEventID(ctx context.Context, eventID string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		w.mu.Lock()
+		reached := eventID <= w.eventID
+		changed := w.changed
+		w.mu.Unlock()
+		if reached {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return faults.Errorf("Unable to reach event '%s' (at '%s'): %w", eventID, w.EventID(), ErrWaitTimeout)
+		case <-ctx.Done():
+			return faults.Wrap(ctx.Err())
+		}
+	}
+}
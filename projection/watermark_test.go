@@ -0,0 +1,48 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatermark(t *testing.T) {
+	ctx := context.Background()
+	w := NewWatermark("A")
+
+	// already processed
+	require.NoError(t, w.WaitForEventID(ctx, "A", time.Millisecond))
+
+	err := w.WaitForEventID(ctx, "C", 10*time.Millisecond)
+	require.True(t, errors.Is(err, ErrWaitTimeout), "expected timeout, got %v", err)
+
+	handler := w.Handler(func(ctx context.Context, e eventstore.Event) error {
+		if e.ID == "X" {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		handler(ctx, eventstore.Event{ID: "B"})
+		time.Sleep(10 * time.Millisecond)
+		handler(ctx, eventstore.Event{ID: "D"})
+	}()
+	require.NoError(t, w.WaitForEventID(ctx, "C", time.Second))
+	assert.Equal(t, "D", w.EventID())
+
+	// failed and older events do not move the watermark
+	require.Error(t, handler(ctx, eventstore.Event{ID: "X"}))
+	w.Advance("B")
+	assert.Equal(t, "D", w.EventID())
+
+	ctx2, cancel := context.WithCancel(ctx)
+	cancel()
+	err = w.WaitForEventID(ctx2, "E", time.Second)
+	require.True(t, errors.Is(err, context.Canceled), "expected canceled, got %v", err)
+}
@@ -0,0 +1,71 @@
+package eventstore
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/quintans/faults"
+)
+
+var (
+	// ErrUnknownKind is returned by the Registry when creating a kind that was not registered
+	ErrUnknownKind = errors.New("unknown kind")
+	// ErrDuplicateKind is returned when registering a type whose kind was already registered
+	ErrDuplicateKind = errors.New("duplicate kind")
+)
+
+var _ Factory = (*Registry)(nil)
+
+// Registry is a Factory creating the registered event types by their kind, the one returned by GetType(),
+// replacing a hand written switch over every event kind, eg:
+//
+//	r := NewRegistry()
+//	err := r.Register(AccountCreated{}, MoneyDeposited{}, MoneyWithdrawn{})
+//
+// Like any factory, New returns a pointer to a new zero value, whether the type was registered by value or by pointer.
+// Aggregates built with a constructor, eg: to set up their RootAggregate, should still be created by a factory
+// delegating the event kinds to the registry.
+type Registry struct {
+	types map[string]reflect.Type
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		types: map[string]reflect.Type{},
+	}
+}
+
+// Register registers the types of the instances, usually zero values, under their kind.
+// Registering a kind twice, or a type whose pointer does not implement Typer, fails and registers none of the types.
+func (r *Registry) Register(types ...Typer) error {
+	kinds := map[string]reflect.Type{}
+	for _, t := range types {
+		typ := reflect.TypeOf(t)
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		instance, ok := reflect.New(typ).Interface().(Typer)
+		if !ok {
+			return faults.Errorf("Unable to register type %s: its pointer does not implement Typer", typ)
+		}
+		kind := instance.GetType()
+		_, registered := r.types[kind]
+		_, repeated := kinds[kind]
+		if registered || repeated {
+			return faults.Errorf("Unable to register type %s as '%s': %w", typ, kind, ErrDuplicateKind)
+		}
+		kinds[kind] = typ
+	}
+	for k, v := range kinds {
+		r.types[k] = v
+	}
+	return nil
+}
+
+func (r *Registry) New(kind string) (Typer, error) {
+	typ, ok := r.types[kind]
+	if !ok {
+		return nil, faults.Errorf("Unable to create kind '%s': %w", kind, ErrUnknownKind)
+	}
+	return reflect.New(typ).Interface().(Typer), nil
+}
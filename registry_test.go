@@ -0,0 +1,45 @@
+package eventstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register(Incremented{}, &IncrementedV2{}))
+
+	e, err := r.New("Incremented")
+	require.NoError(t, err)
+	assert.Equal(t, &Incremented{}, e)
+	e, err = r.New("IncrementedV2")
+	require.NoError(t, err)
+	assert.Equal(t, &IncrementedV2{}, e)
+
+	_, err = r.New("Decremented")
+	require.True(t, errors.Is(err, ErrUnknownKind), "expected unknown kind, got %v", err)
+
+	err = r.Register(&Incremented{})
+	require.True(t, errors.Is(err, ErrDuplicateKind), "expected duplicate kind, got %v", err)
+}
+
+func TestRegistryRehydrate(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register(Incremented{}))
+
+	e, err := RehydrateEvent(r, JSONCodec{}, nil, "Incremented", []byte(`{"by":3}`))
+	require.NoError(t, err)
+	assert.Equal(t, Incremented{By: 3}, e)
+}
+
+func TestRegistryDuplicateInSameCall(t *testing.T) {
+	r := NewRegistry()
+	err := r.Register(IncrementedV2{}, Incremented{}, &Incremented{})
+	require.True(t, errors.Is(err, ErrDuplicateKind), "expected duplicate kind, got %v", err)
+	// nothing was registered
+	_, err = r.New("IncrementedV2")
+	require.True(t, errors.Is(err, ErrUnknownKind), "expected unknown kind, got %v", err)
+}
@@ -32,6 +32,8 @@ type RootAggregate struct {
 	ID            string `json:"id,omitempty"`
 	Version       uint32 `json:"version,omitempty"`
 	EventsCounter uint32 `json:"events_counter,omitempty"`
+	// Epoch is the current stream epoch (see EventStore.CloseStream)
+	Epoch uint32 `json:"epoch,omitempty"`
 
 	events       []Eventer
 	eventHandler EventHandler
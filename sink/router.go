@@ -0,0 +1,147 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/faults"
+)
+
+var ErrNoRoute = errors.New("no route for event")
+
+// RouteFunc returns the route key of an event
+type RouteFunc func(e eventstore.Event) string
+
+// ByAggregateType routes events by aggregate type
+func ByAggregateType(e eventstore.Event) string {
+	return e.AggregateType
+}
+
+// ByKind routes events by event kind
+func ByKind(e eventstore.Event) string {
+	return e.Kind
+}
+
+type RouterOption func(*Router)
+
+// WithRouteFunc sets how the route key is extracted from the event. Default is ByAggregateType
+func WithRouteFunc(fn RouteFunc) RouterOption {
+	return func(r *Router) {
+		r.routeFunc = fn
+	}
+}
+
+// WithDropUnrouted silently drops events without a route, instead of failing with ErrNoRoute
+func WithDropUnrouted() RouterOption {
+	return func(r *Router) {
+		r.dropUnrouted = true
+	}
+}
+
+// WithResumeTokenCompare sets the function used to compare resume tokens. Default is bytes.Compare
+func WithResumeTokenCompare(compare func(a, b []byte) int) RouterOption {
+	return func(r *Router) {
+		r.compare = compare
+	}
+}
+
+// Router is a Sinker that forwards each event to one of several sinks, depending on its route key,
+// allowing a single feed to serve many destinations.
+//
+// Every destination resumes independently:
+// the feed restarts from the least advanced destination and the events already delivered to a destination are skipped.
+type Router struct {
+	routes       map[string]Sinker
+	routeFunc    RouteFunc
+	dropUnrouted bool
+	compare      func(a, b []byte) int
+
+	mu sync.Mutex
+	// lastTokens holds, per route, the highest resume token found in the destination when resuming
+	lastTokens map[string][]byte
+}
+
+// NewRouter creates a Router for the routes, where the map key is the route key
+func NewRouter(routes map[string]Sinker, options ...RouterOption) *Router {
+	r := &Router{
+		routes:     routes,
+		routeFunc:  ByAggregateType,
+		compare:    bytes.Compare,
+		lastTokens: map[string][]byte{},
+	}
+	for _, o := range options {
+		o(r)
+	}
+	return r
+}
+
+// Sink forwards the event to the destination of its route, unless the destination already has it
+func (r *Router) Sink(ctx context.Context, e eventstore.Event) error {
+	key := r.routeFunc(e)
+	sinker, ok := r.routes[key]
+	if !ok {
+		if r.dropUnrouted {
+			return nil
+		}
+		return faults.Errorf("Unable to sink event ID '%s' with route '%s': %w", e.ID, key, ErrNoRoute)
+	}
+
+	r.mu.Lock()
+	last := r.lastTokens[key]
+	r.mu.Unlock()
+	if last != nil && len(e.ResumeToken) > 0 && r.compare(e.ResumeToken, last) <= 0 {
+		return nil
+	}
+
+	return sinker.Sink(ctx, e)
+}
+
+// LastMessage returns the least advanced last message, of all destinations, for the partition.
+// If any destination has no message, nil is returned.
+func (r *Router) LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lowest *eventstore.Event
+	missing := false
+	for key, sinker := range r.routes {
+		msg, err := sinker.LastMessage(ctx, partition)
+		if err != nil {
+			return nil, faults.Errorf("Unable to get the last message for route '%s': %w", key, err)
+		}
+		if msg == nil || len(msg.ResumeToken) == 0 {
+			missing = true
+			continue
+		}
+		if last := r.lastTokens[key]; last == nil || r.compare(msg.ResumeToken, last) > 0 {
+			r.lastTokens[key] = msg.ResumeToken
+		}
+		if lowest == nil || r.compare(msg.ResumeToken, lowest.ResumeToken) < 0 {
+			lowest = msg
+		}
+	}
+	if missing {
+		return nil, nil
+	}
+	return lowest, nil
+}
+
+// Flush flushes all the destinations that buffer events
+func (r *Router) Flush(ctx context.Context) error {
+	for key, sinker := range r.routes {
+		if err := Flush(ctx, sinker); err != nil {
+			return faults.Errorf("Unable to flush route '%s': %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Close closes all the destinations
+func (r *Router) Close() {
+	for _, sinker := range r.routes {
+		sinker.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/quintans/eventstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memSink struct {
+	events []eventstore.Event
+}
+
+func (s *memSink) Sink(ctx context.Context, e eventstore.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memSink) LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error) {
+	if len(s.events) == 0 {
+		return nil, nil
+	}
+	e := s.events[len(s.events)-1]
+	return &e, nil
+}
+
+func (s *memSink) Close() {}
+
+func event(id, aggregateType string) eventstore.Event {
+	return eventstore.Event{ID: id, AggregateType: aggregateType, ResumeToken: []byte(id)}
+}
+
+func TestRouterRoutes(t *testing.T) {
+	ctx := context.Background()
+	accounts := &memSink{}
+	orders := &memSink{}
+	r := NewRouter(map[string]Sinker{"Account": accounts, "Order": orders})
+
+	require.NoError(t, r.Sink(ctx, event("A", "Account")))
+	require.NoError(t, r.Sink(ctx, event("B", "Order")))
+	require.NoError(t, r.Sink(ctx, event("C", "Account")))
+
+	err := r.Sink(ctx, event("D", "Unknown"))
+	require.True(t, errors.Is(err, ErrNoRoute), "expected no route, got %v", err)
+
+	assert.Equal(t, []eventstore.Event{event("A", "Account"), event("C", "Account")}, accounts.events)
+	assert.Equal(t, []eventstore.Event{event("B", "Order")}, orders.events)
+
+	r = NewRouter(map[string]Sinker{"Account": accounts}, WithDropUnrouted())
+	require.NoError(t, r.Sink(ctx, event("E", "Unknown")))
+}
+
+func TestRouterResumesPerDestination(t *testing.T) {
+	ctx := context.Background()
+	accounts := &memSink{events: []eventstore.Event{event("A", "Account"), event("D", "Account")}}
+	orders := &memSink{events: []eventstore.Event{event("B", "Order")}}
+	r := NewRouter(map[string]Sinker{"Account": accounts, "Order": orders})
+
+	last, err := r.LastMessage(ctx, 0)
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, "B", last.ID)
+
+	// the feed replays everything after the least advanced destination
+	for _, e := range []eventstore.Event{event("C", "Order"), event("D", "Account"), event("E", "Account")} {
+		require.NoError(t, r.Sink(ctx, e))
+	}
+
+	assert.Equal(t, []string{"A", "D", "E"}, ids(accounts.events))
+	assert.Equal(t, []string{"B", "C"}, ids(orders.events))
+
+	// a destination without messages forces the feed to start from the beginning
+	r = NewRouter(map[string]Sinker{"Account": accounts, "Order": &memSink{}})
+	last, err = r.LastMessage(ctx, 0)
+	require.NoError(t, err)
+	assert.Nil(t, last)
+}
+
+func ids(events []eventstore.Event) []string {
+	s := make([]string, len(events))
+	for k, v := range events {
+		s[k] = v.ID
+	}
+	return s
+}
+
+type flushSink struct {
+	memSink
+	flushed int
+}
+
+func (s *flushSink) Flush(ctx context.Context) error {
+	s.flushed++
+	return nil
+}
+
+func TestRouterFlush(t *testing.T) {
+	accounts := &flushSink{}
+	r := NewRouter(map[string]Sinker{"Account": accounts, "Order": &memSink{}})
+
+	require.NoError(t, Flush(context.Background(), r))
+	assert.Equal(t, 1, accounts.flushed)
+}
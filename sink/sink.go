@@ -11,3 +11,60 @@ type Sinker interface {
 	LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error)
 	Close()
 }
+
+// Flusher is implemented by sinkers that buffer events, eg: batching producers.
+// The feeds call Flush on return, so that the buffered events are not lost on a graceful shutdown.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush flushes the sinker if it implements Flusher
+func Flush(ctx context.Context, sinker Sinker) error {
+	if f, ok := sinker.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// SinkerFunc is an adapter to allow the use of ordinary functions as Sinkers.
+// Since it has no way to know the last message, the feed starts from the beginning,
+// unless a lookup is attached with WithLastMessage.
+type SinkerFunc func(ctx context.Context, e eventstore.Event) error
+
+// Sink calls f(ctx, e)
+func (f SinkerFunc) Sink(ctx context.Context, e eventstore.Event) error {
+	return f(ctx, e)
+}
+
+// LastMessage returns no message
+func (f SinkerFunc) LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error) {
+	return nil, nil
+}
+
+func (f SinkerFunc) Close() {}
+
+// LastMessageFunc returns the last message sent to a partition
+type LastMessageFunc func(ctx context.Context, partition uint32) (*eventstore.Event, error)
+
+// WithLastMessage returns a Sinker that uses lastMessage to lookup the last message sent
+func (f SinkerFunc) WithLastMessage(lastMessage LastMessageFunc) Sinker {
+	return funcSinker{
+		sink:        f,
+		lastMessage: lastMessage,
+	}
+}
+
+type funcSinker struct {
+	sink        SinkerFunc
+	lastMessage LastMessageFunc
+}
+
+func (s funcSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	return s.sink(ctx, e)
+}
+
+func (s funcSinker) LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error) {
+	return s.lastMessage(ctx, partition)
+}
+
+func (s funcSinker) Close() {}
@@ -0,0 +1,86 @@
+package eventstore
+
+import (
+	"sync"
+	"time"
+)
+
+// SnapshotStrategy decides, after the events of an aggregate are saved, if a snapshot of the aggregate is written
+type SnapshotStrategy interface {
+	// ShouldSnapshot is called with the aggregate, after applying the saved events, and the number of saved events
+	ShouldSnapshot(aggregate Aggregater, eventsAppended int) bool
+}
+
+// SnapshotStrategyFunc is a function implementing SnapshotStrategy
+type SnapshotStrategyFunc func(aggregate Aggregater, eventsAppended int) bool
+
+func (f SnapshotStrategyFunc) ShouldSnapshot(aggregate Aggregater, eventsAppended int) bool {
+	return f(aggregate, eventsAppended)
+}
+
+// WithSnapshotStrategy replaces the CountStrategy built from the threshold given to NewEventStore.
+// The aggregate types of WithSnapshotOnly are still snapshotted on every save.
+func WithSnapshotStrategy(strategy SnapshotStrategy) EsOptions {
+	return func(r *EventStore) {
+		r.snapshotStrategy = strategy
+	}
+}
+
+// CountStrategy snapshots every Threshold events, ie: when a save crosses a multiple of Threshold of the aggregate events counter.
+// A zero Threshold never snapshots.
+type CountStrategy struct {
+	Threshold uint32
+}
+
+func (s CountStrategy) ShouldSnapshot(aggregate Aggregater, eventsAppended int) bool {
+	if s.Threshold == 0 {
+		return false
+	}
+	newCounter := aggregate.GetEventsCounter()
+	oldCounter := newCounter - uint32(eventsAppended)
+	return newCounter/s.Threshold > oldCounter/s.Threshold
+}
+
+// TimeStrategy snapshots an aggregate when at least the interval elapsed since its last snapshot.
+// The time of the last snapshots are kept in memory, per instance of the strategy,
+// so the first save of an aggregate, by a process, is always snapshotted.
+// Only the aggregates snapshotted during the last interval are kept.
+type TimeStrategy struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	snapshots map[string]time.Time
+	pruned    time.Time
+}
+
+func NewTimeStrategy(interval time.Duration) *TimeStrategy {
+	return &TimeStrategy{
+		interval:  interval,
+		now:       time.Now,
+		snapshots: map[string]time.Time{},
+	}
+}
+
+func (s *TimeStrategy) ShouldSnapshot(aggregate Aggregater, eventsAppended int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.pruned) >= s.interval {
+		// an aggregate snapshotted longer than the interval ago is snapshotted on the next save, as if it was never snapshotted
+		for k, v := range s.snapshots {
+			if now.Sub(v) >= s.interval {
+				delete(s.snapshots, k)
+			}
+		}
+		s.pruned = now
+	}
+
+	last, ok := s.snapshots[aggregate.GetID()]
+	if ok && now.Sub(last) < s.interval {
+		return false
+	}
+	s.snapshots[aggregate.GetID()] = now
+	return true
+}
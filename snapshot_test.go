@@ -0,0 +1,90 @@
+package eventstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountStrategy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		counter  uint32
+		appended int
+		expected bool
+	}{
+		{name: "below the threshold", counter: 2, appended: 2, expected: false},
+		{name: "reaching the threshold", counter: 3, appended: 1, expected: true},
+		{name: "after the threshold", counter: 4, appended: 1, expected: false},
+		{name: "crossing the threshold", counter: 7, appended: 3, expected: true},
+		{name: "crossing many thresholds", counter: 10, appended: 9, expected: true},
+	}
+	strategy := CountStrategy{Threshold: 3}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCounter()
+			c.EventsCounter = tc.counter
+			assert.Equal(t, tc.expected, strategy.ShouldSnapshot(c, tc.appended))
+		})
+	}
+
+	c := newCounter()
+	c.EventsCounter = 100
+	assert.False(t, CountStrategy{}.ShouldSnapshot(c, 100))
+}
+
+func TestTimeStrategy(t *testing.T) {
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	strategy := NewTimeStrategy(time.Minute)
+	strategy.now = func() time.Time {
+		return now
+	}
+
+	c1 := newCounter()
+	c1.ID = "1"
+	c2 := newCounter()
+	c2.ID = "2"
+
+	// the first save is snapshotted
+	assert.True(t, strategy.ShouldSnapshot(c1, 1))
+	assert.False(t, strategy.ShouldSnapshot(c1, 1))
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, strategy.ShouldSnapshot(c2, 1))
+	assert.False(t, strategy.ShouldSnapshot(c1, 1))
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, strategy.ShouldSnapshot(c1, 1))
+	assert.False(t, strategy.ShouldSnapshot(c2, 1))
+
+	// only the aggregates snapshotted during the last interval are kept
+	now = now.Add(time.Hour)
+	assert.True(t, strategy.ShouldSnapshot(c1, 1))
+	assert.Len(t, strategy.snapshots, 1)
+}
+
+func TestWithSnapshotStrategy(t *testing.T) {
+	ctx := context.Background()
+	snapshots := memSnapshots{}
+	appended := []int{}
+	es := NewEventStore(&memRepo{}, 2, counterFactory{}, WithSnapshotStore(snapshots), WithSnapshotStrategy(SnapshotStrategyFunc(func(aggregate Aggregater, eventsAppended int) bool {
+		appended = append(appended, eventsAppended)
+		return aggregate.(*counter).Total > 10
+	})))
+
+	c := newCounter()
+	c.ID = "1"
+	c.Increment(1)
+	c.Increment(2)
+	require.NoError(t, es.Save(ctx, c))
+	// the threshold is replaced by the strategy
+	assert.Empty(t, snapshots)
+
+	c.Increment(10)
+	require.NoError(t, es.Save(ctx, c))
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, []int{2, 1}, appended)
+}
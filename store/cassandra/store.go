@@ -0,0 +1,524 @@
+// Package cassandra keeps the events in Apache Cassandra, or ScyllaDB, for stores that need to scale horizontally.
+//
+// The events of an aggregate are a partition, ordered by version, so the aggregates are spread over the cluster
+// and are loaded by reading a single partition.
+// Since there is no global order of the events, the repository does not implement player.Repository,
+// nor the queries spanning all the aggregates, store.Counter and store.ChangeLister,
+// and the events should be fed to the consumers with change data capture, eg: the CDC log of ScyllaDB.
+package cassandra
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
+)
+
+// Schema returns the statements creating the events, snapshots, idempotency keys and external IDs tables in keyspace.
+// Cassandra only executes one statement at a time, so they are returned apart.
+func Schema(keyspace string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.events(
+			aggregate_id text,
+			aggregate_version int,
+			id text,
+			aggregate_id_hash bigint,
+			aggregate_type text,
+			kind text,
+			body blob,
+			idempotency_key text,
+			labels blob,
+			created_at timestamp,
+			external_id text,
+			epoch int,
+			PRIMARY KEY (aggregate_id, aggregate_version)
+		) WITH CLUSTERING ORDER BY (aggregate_version ASC)`, keyspace),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.snapshots(
+			aggregate_id text,
+			aggregate_version int,
+			id text,
+			aggregate_type text,
+			body blob,
+			created_at timestamp,
+			PRIMARY KEY (aggregate_id, aggregate_version)
+		) WITH CLUSTERING ORDER BY (aggregate_version DESC)`, keyspace),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.idempotency_keys(
+			aggregate_type text,
+			idempotency_key text,
+			aggregate_id text,
+			PRIMARY KEY ((aggregate_type, idempotency_key))
+		)`, keyspace),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.external_ids(
+			external_id text,
+			aggregate_id text,
+			aggregate_version int,
+			PRIMARY KEY (external_id)
+		)`, keyspace),
+	}
+}
+
+var (
+	_ eventstore.EsRepository  = (*EsRepository)(nil)
+	_ eventstore.VersionReader = (*EsRepository)(nil)
+	_ store.CreationReader     = (*EsRepository)(nil)
+	_ store.ExternalIDReader   = (*EsRepository)(nil)
+)
+
+type StoreOption func(*EsRepository)
+
+// WithLabelCodec sets the codec used to serialize the event labels. Defaults to eventstore.JSONCodec.
+func WithLabelCodec(codec eventstore.Codec) StoreOption {
+	return func(r *EsRepository) {
+		r.labelCodec = codec
+	}
+}
+
+// EsRepository keeps the events in Cassandra, partitioned by aggregate ID.
+//
+// Cassandra has no transactions, so the uniqueness of the versions is enforced by a lightweight transaction,
+// a conditional batch inserting all the events of a save IF NOT EXISTS, that is only applied if none of the versions exists.
+// The idempotency keys live in their own table, partitioned by key, so they are recorded by a separate lightweight transaction,
+// before the events, and removed if the events are not saved.
+// The external IDs are kept unique the same way, in a table partitioned by external ID.
+// Since those are not atomic with the events, a save interrupted between them, eg: by a crash, leaves the key or external ID
+// recorded without its events, failing later saves with ErrIdempotencyKeyConflict, or ErrExternalIDConflict,
+// and GetByExternalID with ErrEventNotFound.
+// Such rows are told apart by the aggregate they reference not having the event with that key or external ID,
+// and can be deleted, with the same conditions of forgetIdempotencyKey and forgetExternalID, once no save of that aggregate is in flight.
+//
+// The rows written by lightweight transactions are only changed by lightweight transactions, eg: Forget,
+// since mixing them with plain writes on the same row is unsafe.
+type EsRepository struct {
+	session    *gocql.Session
+	keyspace   string
+	labelCodec eventstore.Codec
+}
+
+// NewStore creates a repository on the tables of keyspace (see InstallSchema).
+// The consistency of the reads and writes is the one configured in the session, eg: gocql.Quorum,
+// and the lightweight transactions use its serial consistency.
+func NewStore(session *gocql.Session, keyspace string, options ...StoreOption) *EsRepository {
+	r := &EsRepository{
+		session:    session,
+		keyspace:   keyspace,
+		labelCodec: eventstore.JSONCodec{},
+	}
+	for _, o := range options {
+		o(r)
+	}
+	return r
+}
+
+// InstallSchema creates the tables, if they do not exist. The keyspace must exist.
+func (r *EsRepository) InstallSchema(ctx context.Context) error {
+	for _, stmt := range Schema(r.keyspace) {
+		if err := r.session.Query(stmt).WithContext(ctx).Exec(); err != nil {
+			return faults.Errorf("Unable to install the events schema: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *EsRepository) table(name string) string {
+	return r.keyspace + "." + name
+}
+
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, []eventstore.Event, error) {
+	if eRec.IdempotencyTTL != nil {
+		return "", nil, faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyStoreUnsupported)
+	}
+	labels, err := eventstore.EncodeLabels(r.labelCodec, eRec.Labels)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if eRec.IdempotencyKey != "" {
+		err = r.recordIdempotencyKey(ctx, eRec)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	// the external IDs recorded so far, removed with the idempotency key if the save fails
+	externalIDs := []string{}
+	undo := func() {
+		if eRec.IdempotencyKey != "" {
+			r.forgetIdempotencyKey(eRec)
+		}
+		for _, externalID := range externalIDs {
+			r.forgetExternalID(eRec.AggregateID, externalID)
+		}
+	}
+
+	hash := common.Hash(eRec.AggregateID)
+	version := eRec.Version
+	events := make([]eventstore.Event, 0, len(eRec.Details))
+	batch := r.session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	for _, e := range eRec.Details {
+		version++
+		id := common.NewEventIDWithNode(eRec.CreatedAt, eRec.AggregateID, version, eRec.NodeID)
+		if e.ExternalID != "" {
+			err = r.recordExternalID(ctx, eRec.AggregateID, version, e.ExternalID)
+			if err != nil {
+				undo()
+				return "", nil, err
+			}
+			externalIDs = append(externalIDs, e.ExternalID)
+		}
+		batch.Query(
+			`INSERT INTO `+r.table("events")+` (aggregate_id, aggregate_version, id, aggregate_id_hash, aggregate_type, kind, body, idempotency_key, labels, created_at, external_id, epoch)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+			eRec.AggregateID, int(version), id, int64(hash), eRec.AggregateType, e.Kind, e.Body, eRec.IdempotencyKey, labels, eRec.CreatedAt.UTC(), e.ExternalID, int(eRec.Epoch),
+		)
+		events = append(events, eventstore.Event{
+			ID:               id,
+			AggregateID:      eRec.AggregateID,
+			AggregateIDHash:  hash,
+			AggregateVersion: version,
+			AggregateType:    eRec.AggregateType,
+			Kind:             e.Kind,
+			Body:             e.Body,
+			IdempotencyKey:   eRec.IdempotencyKey,
+			ExternalID:       e.ExternalID,
+			Labels:           eRec.Labels,
+			CreatedAt:        eRec.CreatedAt.UTC(),
+			Epoch:            eRec.Epoch,
+		})
+	}
+	applied, iter, err := r.session.MapExecuteBatchCAS(batch, map[string]interface{}{})
+	if iter != nil {
+		iter.Close()
+	}
+	if err == nil && !applied {
+		err = faults.Errorf("Unable to save aggregate '%s' at version %d: %w", eRec.AggregateID, eRec.Version, eventstore.ErrConcurrentModification)
+	} else if err != nil {
+		err = faults.Errorf("Unable to insert the events of aggregate '%s': %w", eRec.AggregateID, err)
+	}
+	if err != nil {
+		undo()
+		return "", nil, err
+	}
+
+	return events[len(events)-1].ID, events, nil
+}
+
+// recordIdempotencyKey inserts the key, failing with ErrIdempotencyKeyConflict if it exists, even if inserted by a concurrent save
+func (r *EsRepository) recordIdempotencyKey(ctx context.Context, eRec eventstore.EventRecord) error {
+	applied, err := r.session.Query(
+		`INSERT INTO `+r.table("idempotency_keys")+` (aggregate_type, idempotency_key, aggregate_id) VALUES (?, ?, ?) IF NOT EXISTS`,
+		eRec.AggregateType, eRec.IdempotencyKey, eRec.AggregateID,
+	).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return faults.Errorf("Unable to record idempotency key '%s' of aggregate '%s': %w", eRec.IdempotencyKey, eRec.AggregateID, err)
+	}
+	if !applied {
+		return faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyKeyConflict)
+	}
+	return nil
+}
+
+// forgetIdempotencyKey removes the key recorded by a failed save.
+// It is conditional, as the insert, since mixing lightweight transactions with plain writes on the same row is unsafe.
+func (r *EsRepository) forgetIdempotencyKey(eRec eventstore.EventRecord) {
+	// the save context may be the reason of the failure
+	_, err := r.session.Query(
+		`DELETE FROM `+r.table("idempotency_keys")+` WHERE aggregate_type = ? AND idempotency_key = ? IF aggregate_id = ?`,
+		eRec.AggregateType, eRec.IdempotencyKey, eRec.AggregateID,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.WithError(err).Errorf("Unable to forget idempotency key '%s' of the failed save of aggregate '%s'", eRec.IdempotencyKey, eRec.AggregateID)
+	}
+}
+
+// recordExternalID inserts the external ID, failing with ErrExternalIDConflict if it exists, even if inserted by a concurrent save
+func (r *EsRepository) recordExternalID(ctx context.Context, aggregateID string, version uint32, externalID string) error {
+	applied, err := r.session.Query(
+		`INSERT INTO `+r.table("external_ids")+` (external_id, aggregate_id, aggregate_version) VALUES (?, ?, ?) IF NOT EXISTS`,
+		externalID, aggregateID, int(version),
+	).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return faults.Errorf("Unable to record external ID '%s' of aggregate '%s': %w", externalID, aggregateID, err)
+	}
+	if !applied {
+		return faults.Errorf("Unable to save aggregate '%s' with external ID '%s': %w", aggregateID, externalID, eventstore.ErrExternalIDConflict)
+	}
+	return nil
+}
+
+// forgetExternalID removes the external ID recorded by a failed save, conditionally, as forgetIdempotencyKey
+func (r *EsRepository) forgetExternalID(aggregateID, externalID string) {
+	_, err := r.session.Query(
+		`DELETE FROM `+r.table("external_ids")+` WHERE external_id = ? IF aggregate_id = ?`,
+		externalID, aggregateID,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.WithError(err).Errorf("Unable to forget external ID '%s' of the failed save of aggregate '%s'", externalID, aggregateID)
+	}
+}
+
+// GetByExternalID looks up the aggregate version of the external ID and reads the event from the aggregate partition.
+// An external ID recorded by a save whose events are not yet, or were not, inserted is not found.
+func (r *EsRepository) GetByExternalID(ctx context.Context, externalID string) (eventstore.Event, error) {
+	var (
+		aggregateID string
+		version     int
+	)
+	err := r.session.Query(
+		`SELECT aggregate_id, aggregate_version FROM `+r.table("external_ids")+` WHERE external_id = ?`,
+		externalID,
+	).WithContext(ctx).Scan(&aggregateID, &version)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, eventstore.ErrEventNotFound)
+		}
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, err)
+	}
+
+	events, err := r.queryEvents(ctx,
+		`SELECT `+eventColumns+` FROM `+r.table("events")+` WHERE aggregate_id = ? AND aggregate_version = ?`,
+		aggregateID, version,
+	)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, err)
+	}
+	if len(events) == 0 || events[0].ExternalID != externalID {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, eventstore.ErrEventNotFound)
+	}
+	return events[0], nil
+}
+
+func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventstore.Snapshot, error) {
+	snap := eventstore.Snapshot{}
+	var version int
+	err := r.session.Query(
+		`SELECT id, aggregate_id, aggregate_version, aggregate_type, body, created_at FROM `+r.table("snapshots")+` WHERE aggregate_id = ? LIMIT 1`,
+		aggregateID,
+	).WithContext(ctx).Scan(&snap.ID, &snap.AggregateID, &version, &snap.AggregateType, &snap.Body, &snap.CreatedAt)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return eventstore.Snapshot{}, nil
+		}
+		return eventstore.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+	snap.AggregateVersion = uint32(version)
+	return snap, nil
+}
+
+func (r *EsRepository) GetSnapshotMeta(ctx context.Context, aggregateID string) (eventstore.SnapshotMeta, error) {
+	meta := eventstore.SnapshotMeta{}
+	var version int
+	err := r.session.Query(
+		`SELECT aggregate_version, created_at FROM `+r.table("snapshots")+` WHERE aggregate_id = ? LIMIT 1`,
+		aggregateID,
+	).WithContext(ctx).Scan(&version, &meta.CreatedAt)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return eventstore.SnapshotMeta{}, nil
+		}
+		return eventstore.SnapshotMeta{}, faults.Errorf("Unable to get snapshot metadata for aggregate '%s': %w", aggregateID, err)
+	}
+	meta.Exists = true
+	meta.AggregateVersion = uint32(version)
+	return meta, nil
+}
+
+// SaveSnapshot persists the snapshot keyed by the aggregate version.
+// Since the latest snapshot is the one with the highest version, saving an older snapshot never replaces a newer one,
+// making the snapshots monotonic. Saving the same snapshot again replaces it.
+// As there are no foreign keys, the event of the snapshot is checked before writing it.
+func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Snapshot) error {
+	var eventID string
+	err := r.session.Query(
+		`SELECT id FROM `+r.table("events")+` WHERE aggregate_id = ? AND aggregate_version = ?`,
+		snapshot.AggregateID, int(snapshot.AggregateVersion),
+	).WithContext(ctx).Scan(&eventID)
+	if err != nil && err != gocql.ErrNotFound {
+		return faults.Errorf("Unable to check the event of snapshot '%s' of aggregate '%s': %w", snapshot.ID, snapshot.AggregateID, err)
+	}
+	if eventID != snapshot.ID {
+		return faults.Errorf("Unable to save snapshot '%s' of aggregate '%s': %w", snapshot.ID, snapshot.AggregateID, eventstore.ErrSnapshotEventMissing)
+	}
+
+	err = r.session.Query(
+		`INSERT INTO `+r.table("snapshots")+` (aggregate_id, aggregate_version, id, aggregate_type, body, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		snapshot.AggregateID, int(snapshot.AggregateVersion), snapshot.ID, snapshot.AggregateType, snapshot.Body, snapshot.CreatedAt.UTC(),
+	).WithContext(ctx).Exec()
+	if err != nil {
+		return faults.Errorf("Unable to save snapshot '%s' of aggregate '%s': %w", snapshot.ID, snapshot.AggregateID, err)
+	}
+	return nil
+}
+
+func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventstore.Event, error) {
+	events, err := r.queryEvents(ctx,
+		`SELECT `+eventColumns+` FROM `+r.table("events")+` WHERE aggregate_id = ? AND aggregate_version > ?`,
+		aggregateID, snapVersion,
+	)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+	}
+	return events, nil
+}
+
+func (r *EsRepository) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	var version int
+	err := r.session.Query(
+		`SELECT aggregate_version FROM `+r.table("events")+` WHERE aggregate_id = ? ORDER BY aggregate_version DESC LIMIT 1`,
+		aggregateID,
+	).WithContext(ctx).Scan(&version)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		return 0, faults.Errorf("Unable to get the current version of aggregate '%s': %w", aggregateID, err)
+	}
+	return uint32(version), nil
+}
+
+func (r *EsRepository) GetCreationEvent(ctx context.Context, aggregateID string) (eventstore.Event, error) {
+	events, err := r.queryEvents(ctx,
+		`SELECT `+eventColumns+` FROM `+r.table("events")+` WHERE aggregate_id = ? AND aggregate_version = 1`,
+		aggregateID,
+	)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, eventstore.ErrAggregateNotFound)
+	}
+	return events[0], nil
+}
+
+func (r *EsRepository) HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error) {
+	var aggregateID string
+	err := r.session.Query(
+		`SELECT aggregate_id FROM `+r.table("idempotency_keys")+` WHERE aggregate_type = ? AND idempotency_key = ?`,
+		aggregateType, idempotencyKey,
+	).WithContext(ctx).Scan(&aggregateID)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return false, nil
+		}
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key: %w", err)
+	}
+	return true, nil
+}
+
+// Forget erases the events of the kind, and the snapshots, of the aggregate.
+// The events are read from the aggregate partition and filtered by kind in the client, avoiding ALLOW FILTERING.
+func (r *EsRepository) Forget(ctx context.Context, request eventstore.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
+
+	// Forget events
+	events, err := r.GetAggregateEvents(ctx, request.AggregateID, -1)
+	if err != nil {
+		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
+	}
+
+	for _, evt := range events {
+		if evt.Kind != request.EventKind {
+			continue
+		}
+		body, err := forget(evt.Kind, evt.Body)
+		if err != nil {
+			return err
+		}
+		// the events are inserted by a lightweight transaction, so they are updated by one
+		applied, err := r.session.Query(
+			`UPDATE `+r.table("events")+` SET body = ? WHERE aggregate_id = ? AND aggregate_version = ? IF id = ?`,
+			body, evt.AggregateID, int(evt.AggregateVersion), evt.ID,
+		).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return faults.Errorf("Unable to forget event ID %s: %w", evt.ID, err)
+		}
+		if !applied {
+			return faults.Errorf("Unable to forget event ID %s: %w", evt.ID, eventstore.ErrEventNotFound)
+		}
+	}
+
+	// forget snapshots
+	iter := r.session.Query(
+		`SELECT aggregate_version, aggregate_type, body FROM `+r.table("snapshots")+` WHERE aggregate_id = ?`,
+		request.AggregateID,
+	).WithContext(ctx).Iter()
+	type snapshot struct {
+		version       int
+		aggregateType string
+		body          []byte
+	}
+	snaps := []snapshot{}
+	snap := snapshot{}
+	for iter.Scan(&snap.version, &snap.aggregateType, &snap.body) {
+		snaps = append(snaps, snap)
+		snap = snapshot{}
+	}
+	if err := iter.Close(); err != nil {
+		return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
+	}
+
+	for _, snap := range snaps {
+		body, err := forget(snap.aggregateType, snap.body)
+		if err != nil {
+			return err
+		}
+		err = r.session.Query(
+			`UPDATE `+r.table("snapshots")+` SET body = ? WHERE aggregate_id = ? AND aggregate_version = ?`,
+			body, request.AggregateID, snap.version,
+		).WithContext(ctx).Exec()
+		if err != nil {
+			return faults.Errorf("Unable to forget snapshot of aggregate '%s' at version %d: %w", request.AggregateID, snap.version, err)
+		}
+	}
+
+	return nil
+}
+
+const eventColumns = "id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at, external_id, epoch"
+
+func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...interface{}) ([]eventstore.Event, error) {
+	iter := r.session.Query(query, args...).WithContext(ctx).Iter()
+	// on failure, the events read so far are also returned
+	events := []eventstore.Event{}
+	var (
+		id, aggregateID, aggregateType, kind, idempotencyKey, externalID string
+		hash                                                             int64
+		version, epoch                                                   int
+		body, labels                                                     []byte
+		createdAt                                                        time.Time
+	)
+	for iter.Scan(&id, &aggregateID, &hash, &version, &aggregateType, &kind, &body, &idempotencyKey, &labels, &createdAt, &externalID, &epoch) {
+		m := map[string]interface{}{}
+		err := eventstore.DecodeLabels(r.labelCodec, labels, m)
+		if err != nil {
+			iter.Close()
+			return events, faults.Errorf("Unable to unmarshal labels of event '%s' to map: %w", id, err)
+		}
+
+		events = append(events, eventstore.Event{
+			ID:               id,
+			AggregateID:      aggregateID,
+			AggregateIDHash:  uint32(hash),
+			AggregateVersion: uint32(version),
+			AggregateType:    aggregateType,
+			Kind:             kind,
+			Body:             body,
+			IdempotencyKey:   idempotencyKey,
+			ExternalID:       externalID,
+			Labels:           m,
+			CreatedAt:        createdAt,
+			Epoch:            uint32(epoch),
+		})
+		// the scanned slices are not reused, since they are held by the events
+		body, labels = nil, nil
+	}
+	if err := iter.Close(); err != nil {
+		return events, faults.Errorf("Unable to iterate events: %w", err)
+	}
+	return events, nil
+}
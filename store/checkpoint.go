@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+	"github.com/quintans/faults"
+)
+
+// CheckpointStore persists the resume token of a feed per partition range,
+// so that the feed can resume without asking the sink for its last message.
+type CheckpointStore interface {
+	// GetCheckpoint returns the last saved resume token, or nil if there is none
+	GetCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32) ([]byte, error)
+	SaveCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error
+}
+
+// TxCheckpointStore is a CheckpointStore that can save a checkpoint in a transaction on its database
+type TxCheckpointStore interface {
+	CheckpointStore
+	SaveCheckpointTx(ctx context.Context, tx *sql.Tx, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error
+}
+
+// TxSinker is a sinker writing the events to a database, eg: a read model,
+// that calls fn in the transaction writing the event, so that both are committed, or rolled back, together
+type TxSinker interface {
+	sink.Sinker
+	SinkTx(ctx context.Context, e eventstore.Event, fn func(tx *sql.Tx) error) error
+}
+
+var _ sink.Sinker = (*CheckpointSinker)(nil)
+
+// CheckpointSinker decorates a sinker that is unable to return its last message, eg: a fire-and-forget HTTP endpoint.
+// The resume token of every event is saved with the event, and LastMessage returns the saved resume token, whatever the partition of the range.
+// If the sinker is a TxSinker and the checkpoints a TxCheckpointStore, on the same database, the checkpoint is saved in the transaction of the event.
+// Otherwise the checkpoint is saved after the event is successfully sunk,
+// so an event can be sunk again after a failure in between, and the sinker must handle duplicates.
+type CheckpointSinker struct {
+	sink.Sinker
+	checkpoints   CheckpointStore
+	feedName      string
+	partitionsLow uint32
+	partitionsHi  uint32
+}
+
+// NewCheckpointSinker wraps the sinker, keeping the checkpoints of the feed with name, for the given partition range,
+// which must be the same as the one of the feed.
+func NewCheckpointSinker(sinker sink.Sinker, checkpoints CheckpointStore, feedName string, partitionsLow, partitionsHi uint32) *CheckpointSinker {
+	return &CheckpointSinker{
+		Sinker:        sinker,
+		checkpoints:   checkpoints,
+		feedName:      feedName,
+		partitionsLow: partitionsLow,
+		partitionsHi:  partitionsHi,
+	}
+}
+
+func (c *CheckpointSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	if len(e.ResumeToken) == 0 {
+		return c.Sinker.Sink(ctx, e)
+	}
+
+	txSinker, ok := c.Sinker.(TxSinker)
+	txCheckpoints, okTx := c.checkpoints.(TxCheckpointStore)
+	if ok && okTx {
+		return txSinker.SinkTx(ctx, e, func(tx *sql.Tx) error {
+			err := txCheckpoints.SaveCheckpointTx(ctx, tx, c.feedName, c.partitionsLow, c.partitionsHi, e.ResumeToken)
+			if err != nil {
+				return faults.Errorf("Unable to save checkpoint of feed '%s' for event '%s': %w", c.feedName, e.ID, err)
+			}
+			return nil
+		})
+	}
+
+	err := c.Sinker.Sink(ctx, e)
+	if err != nil {
+		return err
+	}
+	err = c.checkpoints.SaveCheckpoint(ctx, c.feedName, c.partitionsLow, c.partitionsHi, e.ResumeToken)
+	if err != nil {
+		return faults.Errorf("Unable to save checkpoint of feed '%s' for event '%s': %w", c.feedName, e.ID, err)
+	}
+	return nil
+}
+
+// LastMessage returns an event holding only the resume token of the checkpoint
+func (c *CheckpointSinker) LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error) {
+	token, err := c.checkpoints.GetCheckpoint(ctx, c.feedName, c.partitionsLow, c.partitionsHi)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get checkpoint of feed '%s': %w", c.feedName, err)
+	}
+	if token == nil {
+		return nil, nil
+	}
+	return &eventstore.Event{ResumeToken: token}, nil
+}
+
+// Flush flushes the decorated sinker
+func (c *CheckpointSinker) Flush(ctx context.Context) error {
+	return sink.Flush(ctx, c.Sinker)
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memCheckpoints map[string][]byte
+
+func (m memCheckpoints) GetCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32) ([]byte, error) {
+	return m[FeedLockName(feedName, partitionLow, partitionHi)], nil
+}
+
+func (m memCheckpoints) SaveCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error {
+	m[FeedLockName(feedName, partitionLow, partitionHi)] = resumeToken
+	return nil
+}
+
+func TestCheckpointSinker(t *testing.T) {
+	ctx := context.Background()
+	checkpoints := memCheckpoints{}
+	errFail := errors.New("fail")
+	sinker := NewCheckpointSinker(sink.SinkerFunc(func(ctx context.Context, e eventstore.Event) error {
+		if e.ID == "C" {
+			return errFail
+		}
+		return nil
+	}), checkpoints, "accounts", 1, 2)
+
+	pos, err := LastPositionInSink(ctx, sinker, 1, 2, ParseEventIDPosition)
+	require.NoError(t, err)
+	assert.Nil(t, pos)
+
+	for _, id := range []string{"A", "B", "C"} {
+		err = sinker.Sink(ctx, eventstore.Event{ID: id, ResumeToken: []byte(id)})
+	}
+	require.True(t, errors.Is(err, errFail), "expected fail, got %v", err)
+
+	// the failed event did not move the checkpoint
+	pos, err = LastPositionInSink(ctx, sinker, 1, 2, ParseEventIDPosition)
+	require.NoError(t, err)
+	assert.Equal(t, EventIDPosition("B"), pos)
+
+	// other partition ranges are independent
+	other := NewCheckpointSinker(sinker.Sinker, checkpoints, "accounts", 3, 4)
+	pos, err = LastPositionInSink(ctx, other, 3, 4, ParseEventIDPosition)
+	require.NoError(t, err)
+	assert.Nil(t, pos)
+}
+
+// memTxCheckpoints only saves the checkpoints in a transaction
+type memTxCheckpoints struct {
+	memCheckpoints
+	fail bool
+}
+
+func (m *memTxCheckpoints) SaveCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error {
+	return errors.New("saved outside of the transaction")
+}
+
+func (m *memTxCheckpoints) SaveCheckpointTx(ctx context.Context, tx *sql.Tx, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error {
+	if m.fail {
+		return errors.New("fail")
+	}
+	return m.memCheckpoints.SaveCheckpoint(ctx, feedName, partitionLow, partitionHi, resumeToken)
+}
+
+// memTxSinker only keeps the events whose transaction succeeded
+type memTxSinker struct {
+	committed []string
+}
+
+func (s *memTxSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	s.committed = append(s.committed, e.ID)
+	return nil
+}
+
+func (s *memTxSinker) LastMessage(ctx context.Context, partition uint32) (*eventstore.Event, error) {
+	return nil, nil
+}
+
+func (s *memTxSinker) Close() {}
+
+func (s *memTxSinker) SinkTx(ctx context.Context, e eventstore.Event, fn func(tx *sql.Tx) error) error {
+	if err := fn(nil); err != nil {
+		return err
+	}
+	s.committed = append(s.committed, e.ID)
+	return nil
+}
+
+func TestCheckpointSinkerTx(t *testing.T) {
+	ctx := context.Background()
+	checkpoints := &memTxCheckpoints{memCheckpoints: memCheckpoints{}}
+	sinker := &memTxSinker{}
+	checkpointSinker := NewCheckpointSinker(sinker, checkpoints, "accounts", 1, 2)
+
+	require.NoError(t, checkpointSinker.Sink(ctx, eventstore.Event{ID: "A", ResumeToken: []byte("A")}))
+
+	// a failed checkpoint rolls back the event
+	checkpoints.fail = true
+	require.Error(t, checkpointSinker.Sink(ctx, eventstore.Event{ID: "B", ResumeToken: []byte("B")}))
+
+	assert.Equal(t, []string{"A"}, sinker.committed)
+	pos, err := LastPositionInSink(ctx, checkpointSinker, 1, 2, ParseEventIDPosition)
+	require.NoError(t, err)
+	assert.Equal(t, EventIDPosition("A"), pos)
+}
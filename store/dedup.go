@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/sink"
+)
+
+// Boundary returns the ID of the document holding the event, eg: for MongoDB, where all the events of a save are in the same document,
+// the message ID (see common.NewMessageID) without the event index.
+// Events that are not part of a multi event document are their own boundary.
+// Feeds resuming after a restart always resume from a boundary.
+func Boundary(eventID string) string {
+	docID, _, err := common.SplitMessageID(eventID)
+	if err != nil || docID == "" {
+		return eventID
+	}
+	return docID
+}
+
+var _ sink.Sinker = (*DedupSinker)(nil)
+
+// DedupSinker decorates a sinker, skipping the events that a feed delivers again after being restarted,
+// eg: the MongoDB feed resumes from the start of the last document, redelivering the events of that document that were already sunk.
+// It remembers the boundaries (see Boundary) of the last window documents that were completely sunk,
+// skipping whole documents, and the index of the last sunk event of the current document,
+// so that the memory and the cost of the check depend on the number of documents and not on the number of events.
+type DedupSinker struct {
+	sink.Sinker
+	window    int
+	done      []string
+	next      int
+	seen      map[string]struct{}
+	current   string
+	lastIndex uint8
+}
+
+// NewDedupSinker wraps the sinker, remembering the last window completed documents
+func NewDedupSinker(sinker sink.Sinker, window int) *DedupSinker {
+	if window < 1 {
+		window = 1
+	}
+	return &DedupSinker{
+		Sinker: sinker,
+		window: window,
+		done:   make([]string, window),
+		seen:   map[string]struct{}{},
+	}
+}
+
+func (d *DedupSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	boundary, index, err := common.SplitMessageID(e.ID)
+	if err != nil || boundary == "" {
+		boundary, index = e.ID, 0
+	}
+	if _, ok := d.seen[boundary]; ok {
+		return nil
+	}
+	if boundary == d.current && index <= d.lastIndex {
+		return nil
+	}
+
+	err = d.Sinker.Sink(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	if boundary != d.current {
+		d.complete(d.current)
+		d.current = boundary
+	}
+	d.lastIndex = index
+	return nil
+}
+
+// complete remembers the boundary of a completely sunk document, forgetting the oldest one if the window is full
+func (d *DedupSinker) complete(boundary string) {
+	if boundary == "" {
+		return
+	}
+	if old := d.done[d.next]; old != "" {
+		delete(d.seen, old)
+	}
+	d.done[d.next] = boundary
+	d.seen[boundary] = struct{}{}
+	d.next = (d.next + 1) % d.window
+}
+
+// Flush flushes the decorated sinker
+func (d *DedupSinker) Flush(ctx context.Context) error {
+	return sink.Flush(ctx, d.Sinker)
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoundary(t *testing.T) {
+	assert.Equal(t, "doc", Boundary(common.NewMessageID("doc", 3)))
+	assert.Equal(t, "event", Boundary("event"))
+}
+
+func TestDedupSinker(t *testing.T) {
+	ctx := context.Background()
+	sunk := []string{}
+	sinker := NewDedupSinker(sink.SinkerFunc(func(ctx context.Context, e eventstore.Event) error {
+		sunk = append(sunk, e.ID)
+		return nil
+	}), 2)
+
+	feed := func(ids ...string) {
+		for _, id := range ids {
+			require.NoError(t, sinker.Sink(ctx, eventstore.Event{ID: id}))
+		}
+	}
+	a0, a1 := common.NewMessageID("A", 0), common.NewMessageID("A", 1)
+	b0, b1 := common.NewMessageID("B", 0), common.NewMessageID("B", 1)
+	c0 := common.NewMessageID("C", 0)
+
+	feed(a0, a1, b0)
+	// restart from the boundary of B, after replaying A
+	feed(a0, a1, b0, b1, c0)
+	assert.Equal(t, []string{a0, a1, b0, b1, c0}, sunk)
+
+	// A falls out of the window of 2 completed documents once C completes
+	feed("D")
+	sunk = sunk[:0]
+	feed(b0, b1, c0, "D", "E")
+	assert.Equal(t, []string{"E"}, sunk)
+	feed(a0)
+	assert.Equal(t, []string{"E", a0}, sunk)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"time"
 
 	"github.com/quintans/eventstore/sink"
 	"github.com/quintans/faults"
@@ -44,6 +45,24 @@ func (f *Forwarder) Cancel() {
 	f.sinker.Close()
 }
 
+// flushTimeout bounds the time spent flushing a sinker when a feed returns
+const flushTimeout = 10 * time.Second
+
+// FlushSink flushes the sinker, if it buffers events, returning err if not nil, or else the flush error.
+// Feeds call it on return, with a fresh context, since the feed context is usually already done on shutdown.
+func FlushSink(sinker sink.Sinker, err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if errFlush := sink.Flush(ctx, sinker); errFlush != nil {
+		if err != nil {
+			log.WithError(errFlush).Error("Unable to flush sinker")
+			return err
+		}
+		return faults.Errorf("Unable to flush sinker: %w", errFlush)
+	}
+	return err
+}
+
 // LastEventIDInSink retrieves the highest event ID and resume token found in the partition range
 func LastEventIDInSink(ctx context.Context, sinker sink.Sinker, partitionLow, partitionHi uint32, forEach func(resumeToken []byte) error) error {
 	if partitionLow == 0 {
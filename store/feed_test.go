@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferedSink struct {
+	sink.SinkerFunc
+	buffer  []string
+	flushed []string
+	err     error
+}
+
+func (s *bufferedSink) Flush(ctx context.Context) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.flushed = append(s.flushed, s.buffer...)
+	s.buffer = nil
+	return nil
+}
+
+func TestFlushSink(t *testing.T) {
+	buffered := &bufferedSink{}
+	buffered.SinkerFunc = func(ctx context.Context, e eventstore.Event) error {
+		buffered.buffer = append(buffered.buffer, e.ID)
+		return nil
+	}
+	// wrappers must not hide the flusher
+	sinker := NewPauser().Wrap(buffered)
+	require.NoError(t, sinker.Sink(context.Background(), eventstore.Event{ID: "A"}))
+
+	errFeed := errors.New("feed")
+	err := FlushSink(sinker, errFeed)
+	assert.Equal(t, errFeed, err)
+	assert.Equal(t, []string{"A"}, buffered.flushed)
+
+	errFlush := errors.New("flush")
+	buffered.err = errFlush
+	err = FlushSink(sinker, nil)
+	require.True(t, errors.Is(err, errFlush), "expected flush error, got %v", err)
+}
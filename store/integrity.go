@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/faults"
+)
+
+// IntegrityProblemKind is the category of an integrity problem
+type IntegrityProblemKind string
+
+const (
+	// OrphanSnapshot is a snapshot referencing a missing event, eg: after the foreign key was dropped and the events compacted
+	OrphanSnapshot IntegrityProblemKind = "orphan_snapshot"
+	// VersionGap is a missing version before a stored event of an aggregate, including before its first stored event.
+	// Missing versions covered by a snapshot, eg: after a compaction, or by purged events, are not gaps.
+	VersionGap IntegrityProblemKind = "version_gap"
+	// DuplicateIdempotencyKey is an idempotency key used by more than one aggregate of the same type
+	DuplicateIdempotencyKey IntegrityProblemKind = "duplicate_idempotency_key"
+)
+
+// IntegrityProblem is a problem found by an integrity check, eg: postgresql.EsRepository.CheckIntegrity.
+// ID is the snapshot ID for OrphanSnapshot, the ID of the event after the gap for VersionGap and the idempotency key for DuplicateIdempotencyKey.
+type IntegrityProblem struct {
+	Kind        IntegrityProblemKind
+	AggregateID string
+	ID          string
+}
+
+// IntegrityReport counts the problems found by an integrity check per category
+type IntegrityReport struct {
+	OrphanSnapshots          int
+	VersionGaps              int
+	DuplicateIdempotencyKeys int
+	// RepairedSnapshots is the number of orphan snapshots deleted (see WithRepair)
+	RepairedSnapshots int64
+}
+
+// HasProblems tells if any problem was found
+func (r IntegrityReport) HasProblems() bool {
+	return r.OrphanSnapshots > 0 || r.VersionGaps > 0 || r.DuplicateIdempotencyKeys > 0
+}
+
+// IntegrityCheck is how an integrity check runs, set by the IntegrityOptions
+type IntegrityCheck struct {
+	Repair    bool
+	OnProblem func(IntegrityProblem)
+}
+
+type IntegrityOption func(*IntegrityCheck)
+
+// WithRepair deletes the orphan snapshots after checking.
+// The aggregates are then rebuilt from their events, the snapshots being written again on the next saves.
+func WithRepair() IntegrityOption {
+	return func(c *IntegrityCheck) {
+		c.Repair = true
+	}
+}
+
+// WithIntegrityProblemHandler calls fn for every problem found, as the rows are read, eg: to log them
+func WithIntegrityProblemHandler(fn func(IntegrityProblem)) IntegrityOption {
+	return func(c *IntegrityCheck) {
+		c.OnProblem = fn
+	}
+}
+
+// NewIntegrityCheck applies the options
+func NewIntegrityCheck(options ...IntegrityOption) IntegrityCheck {
+	check := IntegrityCheck{}
+	for _, o := range options {
+		o(&check)
+	}
+	return check
+}
+
+// ScanIntegrityProblems reads the aggregate ID and the ID of the problems returned by query, returning how many there are
+func ScanIntegrityProblems(ctx context.Context, db *sql.DB, check IntegrityCheck, kind IntegrityProblemKind, query string) (int, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, faults.Errorf("Unable to check the %s problems: %w", kind, err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		p := IntegrityProblem{Kind: kind}
+		if err := rows.Scan(&p.AggregateID, &p.ID); err != nil {
+			return 0, faults.Errorf("Unable to scan the %s problem: %w", kind, err)
+		}
+		count++
+		if check.OnProblem != nil {
+			check.OnProblem(p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, faults.Errorf("Unable to iterate the %s problems: %w", kind, err)
+	}
+	return count, nil
+}
+
+// VersionGapQuery returns the query of the VersionGap problems of the SQL stores, with the events and snapshots tables,
+// where expiring is the condition of the events that can be purged, eg: "expires_at IS NOT NULL", or "FALSE".
+// A gap before the first stored event of an aggregate is not reported if that event is a tombstone, or can be purged,
+// since the events before it may have been purged.
+func VersionGapQuery(expiring string) string {
+	return `SELECT aggregate_id, id FROM (
+		SELECT aggregate_id, id, kind, aggregate_version, ` + expiring + ` AS expiring,
+			aggregate_version - COALESCE(LAG(aggregate_version) OVER (PARTITION BY aggregate_id ORDER BY aggregate_version), 0) AS step,
+			ROW_NUMBER() OVER (PARTITION BY aggregate_id ORDER BY aggregate_version) AS n
+		FROM events
+	) v
+	WHERE step > 1
+	AND NOT (n = 1 AND (kind = '` + eventstore.TombstoneKind + `' OR expiring))
+	AND NOT EXISTS (SELECT 1 FROM snapshots s WHERE s.aggregate_id = v.aggregate_id AND s.aggregate_version >= v.aggregate_version - 1)`
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/quintans/eventstore/sink"
+	"github.com/quintans/eventstore/worker"
+	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrFeedLocked = errors.New("feed is locked by another instance")
+
+// FeedLockName returns the lock name for a feed and partition range
+func FeedLockName(name string, partitionsLow, partitionsHi uint32) string {
+	return fmt.Sprintf("%s:%d-%d", name, partitionsLow, partitionsHi)
+}
+
+type LockedFeederOption func(*LockedFeeder)
+
+// WithLockRetry makes the feeder wait for the lock, trying again at every interval, instead of failing with ErrFeedLocked
+func WithLockRetry(interval time.Duration) LockedFeederOption {
+	return func(f *LockedFeeder) {
+		f.retry = interval
+	}
+}
+
+// LockedFeeder only feeds while holding the lock, preventing duplicate instances of the same feed,
+// eg: during rolling deploys, from sinking the same events twice.
+// The lock should be named after the feed and its partition range (see FeedLockName).
+type LockedFeeder struct {
+	feeder Feeder
+	locker worker.Locker
+	retry  time.Duration
+}
+
+func NewLockedFeeder(feeder Feeder, locker worker.Locker, options ...LockedFeederOption) LockedFeeder {
+	f := LockedFeeder{
+		feeder: feeder,
+		locker: locker,
+	}
+	for _, o := range options {
+		o(&f)
+	}
+	return f
+}
+
+// Feed acquires the lock and then feeds the sinker until the context is done or the lock is lost.
+// If the lock is held by another instance, ErrFeedLocked is returned, unless a retry interval was set.
+func (f LockedFeeder) Feed(ctx context.Context, sinker sink.Sinker) error {
+	release, err := f.acquire(ctx)
+	if err != nil || release == nil {
+		return err
+	}
+	defer func() {
+		if err := f.locker.Unlock(context.Background()); err != nil {
+			log.WithError(err).Error("Unable to release the feed lock")
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-release:
+			log.Warn("Feed lock was lost. Stopping feed.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return f.feeder.Feed(ctx, sinker)
+}
+
+func (f LockedFeeder) acquire(ctx context.Context) (chan struct{}, error) {
+	for {
+		release, err := f.locker.Lock(ctx)
+		if err != nil {
+			return nil, faults.Errorf("Unable to acquire the feed lock: %w", err)
+		}
+		if release != nil {
+			return release, nil
+		}
+		if f.retry <= 0 {
+			return nil, faults.Wrap(ErrFeedLocked)
+		}
+
+		t := time.NewTimer(f.retry)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memLocker struct {
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func (l *memLocker) Lock(context.Context) (chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != nil {
+		return nil, nil
+	}
+	l.done = make(chan struct{})
+	return l.done, nil
+}
+
+func (l *memLocker) Unlock(context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+	return nil
+}
+
+type feederFunc func(ctx context.Context, sinker sink.Sinker) error
+
+func (f feederFunc) Feed(ctx context.Context, sinker sink.Sinker) error {
+	return f(ctx, sinker)
+}
+
+func TestLockedFeeder(t *testing.T) {
+	locker := &memLocker{}
+	started := make(chan struct{})
+	feeder := feederFunc(func(ctx context.Context, sinker sink.Sinker) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewLockedFeeder(feeder, locker).Feed(ctx, nil)
+	}()
+	<-started
+
+	// a duplicate instance exits
+	err := NewLockedFeeder(feeder, locker).Feed(context.Background(), nil)
+	require.True(t, errors.Is(err, ErrFeedLocked), "expected feed locked, got %v", err)
+
+	// a duplicate instance with retry waits for the lock
+	started2 := make(chan struct{})
+	feeder2 := feederFunc(func(ctx context.Context, sinker sink.Sinker) error {
+		close(started2)
+		return nil
+	})
+	done2 := make(chan error)
+	go func() {
+		done2 <- NewLockedFeeder(feeder2, locker, WithLockRetry(10*time.Millisecond)).Feed(context.Background(), nil)
+	}()
+	select {
+	case <-started2:
+		t.Fatal("duplicate feed started while locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+	select {
+	case <-started2:
+	case <-time.After(time.Second):
+		t.Fatal("waiting feed did not start after the lock was released")
+	}
+	require.NoError(t, <-done2)
+	assert.Equal(t, "accounts:1-2", FeedLockName("accounts", 1, 2))
+}
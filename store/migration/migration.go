@@ -0,0 +1,157 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrUnsupportedMigration is returned when the events of the source can not be stored by the target
+var ErrUnsupportedMigration = errors.New("unsupported migration")
+
+// DocumentStore is implemented by the stores that keep the events of a save in one document, eg: MongoDB.
+// The events of a document share the aggregate version and have message IDs (see common.NewMessageID),
+// so they can only be migrated into another document store.
+type DocumentStore interface {
+	StoresDocuments() bool
+}
+
+// Importer inserts events verbatim, preserving their IDs, versions and creation times.
+// Importing an event that already exists must be ignored.
+type Importer interface {
+	ImportEvents(ctx context.Context, events []eventstore.Event) error
+}
+
+// Target is the store receiving the events
+type Target interface {
+	Importer
+	GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error)
+}
+
+// OnProgress is called after every copied batch
+type OnProgress func(copied int, lastEventID string)
+
+type Option func(*Migrator)
+
+func WithBatchSize(size int) Option {
+	return func(m *Migrator) {
+		if size > 0 {
+			m.batchSize = size
+		}
+	}
+}
+
+func WithProgress(fn OnProgress) Option {
+	return func(m *Migrator) {
+		m.progress = fn
+	}
+}
+
+func WithFilter(filter store.Filter) Option {
+	return func(m *Migrator) {
+		m.filter = filter
+	}
+}
+
+// Migrator copies all the events from one store to another, eg: from PostgreSQL to MongoDB.
+//
+// The copy resumes after the last event in the target, and since importing existing events is ignored,
+// an interrupted migration can be safely repeated.
+// The source store should not receive new events while migrating, or the migration should be repeated after the writes stop.
+// A document store (see DocumentStore) can only be migrated into another document store.
+type Migrator struct {
+	source    player.Repository
+	target    Target
+	batchSize int
+	progress  OnProgress
+	filter    store.Filter
+}
+
+func New(source player.Repository, target Target, options ...Option) Migrator {
+	m := Migrator{
+		source:    source,
+		target:    target,
+		batchSize: 100,
+	}
+	for _, o := range options {
+		o(&m)
+	}
+	return m
+}
+
+// Run copies the events and returns how many were copied
+func (m Migrator) Run(ctx context.Context) (int, error) {
+	if storesDocuments(m.source) && !storesDocuments(m.target) {
+		return 0, faults.Errorf("Unable to migrate the events of a document store into a store of single events: %w", ErrUnsupportedMigration)
+	}
+
+	afterEventID, err := m.target.GetLastEventID(ctx, 0, m.filter)
+	if err != nil {
+		return 0, faults.Errorf("Unable to get the last event ID of the migration target: %w", err)
+	}
+
+	log.Infof("Migrating events after '%s'", afterEventID)
+	copied := 0
+	batchSize := m.batchSize
+	for {
+		events, err := m.source.GetEvents(ctx, afterEventID, batchSize, 0, m.filter)
+		if err != nil {
+			return copied, faults.Errorf("Unable to get the events to migrate after '%s': %w", afterEventID, err)
+		}
+		if len(events) == 0 {
+			return copied, nil
+		}
+		if len(events) >= batchSize {
+			whole := wholeDocuments(events)
+			if len(whole) == 0 {
+				// a document larger than the batch is read again with a larger batch
+				batchSize *= 2
+				continue
+			}
+			events = whole
+		}
+		batchSize = m.batchSize
+
+		err = m.target.ImportEvents(ctx, events)
+		if err != nil {
+			return copied, faults.Errorf("Unable to import events after '%s': %w", afterEventID, err)
+		}
+
+		afterEventID = store.EventPosition(events[len(events)-1])
+		copied += len(events)
+		if m.progress != nil {
+			m.progress(copied, afterEventID)
+		}
+	}
+}
+
+func storesDocuments(s interface{}) bool {
+	d, ok := s.(DocumentStore)
+	return ok && d.StoresDocuments()
+}
+
+// wholeDocuments holds back the trailing events that may belong to a document (eg: MongoDB) that continues in the next batch,
+// so that a document is never split between imports, since the events of an imported document are ignored afterwards.
+// If all the events belong to the same document, none is returned.
+func wholeDocuments(events []eventstore.Event) []eventstore.Event {
+	last := events[len(events)-1].ID
+	docID, _, err := common.SplitMessageID(last)
+	if err != nil || docID == last {
+		// not a message ID
+		return events
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		id, _, err := common.SplitMessageID(events[i].ID)
+		if err != nil || id != docID {
+			return events[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockSource struct {
+	events []eventstore.Event
+}
+
+func (r MockSource) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	return r.events[len(r.events)-1].ID, nil
+}
+
+func (r MockSource) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	result := []eventstore.Event{}
+	for _, v := range r.events {
+		if v.ID > afterEventID {
+			result = append(result, v)
+			if len(result) == limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+type MockTarget struct {
+	events  map[string]eventstore.Event
+	batches [][]string
+	failAt  int
+}
+
+func (r *MockTarget) ImportEvents(ctx context.Context, events []eventstore.Event) error {
+	if r.failAt > 0 && len(r.batches) == r.failAt {
+		r.failAt = 0
+		return errors.New("interrupted")
+	}
+	ids := []string{}
+	for _, e := range events {
+		r.events[e.ID] = e
+		ids = append(ids, e.ID)
+	}
+	r.batches = append(r.batches, ids)
+	return nil
+}
+
+func (r *MockTarget) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	last := ""
+	for k := range r.events {
+		if k > last {
+			last = k
+		}
+	}
+	return last, nil
+}
+
+func (r *MockTarget) ids() []string {
+	ids := []string{}
+	for k := range r.events {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestMigrateResumes(t *testing.T) {
+	source := MockSource{}
+	for _, id := range []string{"A", "B", "C", "D", "E"} {
+		source.events = append(source.events, eventstore.Event{ID: id, AggregateID: "1"})
+	}
+	target := &MockTarget{events: map[string]eventstore.Event{}, failAt: 1}
+
+	progress := []string{}
+	m := New(source, target, WithBatchSize(2), WithProgress(func(copied int, lastEventID string) {
+		progress = append(progress, lastEventID)
+	}))
+	copied, err := m.Run(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, 2, copied)
+
+	copied, err = m.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, copied)
+	assert.Equal(t, []string{"A", "B", "C", "D", "E"}, target.ids())
+	assert.Equal(t, []string{"B", "D", "E"}, progress)
+}
+
+func TestMigrateDoesNotSplitDocuments(t *testing.T) {
+	source := MockSource{
+		events: []eventstore.Event{
+			{ID: common.NewMessageID("A", 0)},
+			{ID: common.NewMessageID("B", 0)},
+			{ID: common.NewMessageID("B", 1)},
+			{ID: common.NewMessageID("C", 0)},
+		},
+	}
+	target := &MockTarget{events: map[string]eventstore.Event{}}
+
+	copied, err := New(source, target, WithBatchSize(2)).Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, copied)
+	// the document B fills the batch, so it is read again with the following events
+	assert.Equal(t, [][]string{
+		{common.NewMessageID("A", 0)},
+		{common.NewMessageID("B", 0), common.NewMessageID("B", 1), common.NewMessageID("C", 0)},
+	}, target.batches)
+}
+
+// MockDocumentSource is a source with the events of a save in one document, eg: MongoDB
+type MockDocumentSource struct {
+	MockSource
+}
+
+func (r MockDocumentSource) StoresDocuments() bool {
+	return true
+}
+
+type MockDocumentTarget struct {
+	MockTarget
+}
+
+func (r *MockDocumentTarget) StoresDocuments() bool {
+	return true
+}
+
+func TestMigrateDocumentsIntoSingleEvents(t *testing.T) {
+	source := MockDocumentSource{MockSource{
+		events: []eventstore.Event{
+			{ID: common.NewMessageID("A", 0)},
+			{ID: common.NewMessageID("A", 1)},
+		},
+	}}
+	target := &MockTarget{events: map[string]eventstore.Event{}}
+
+	copied, err := New(source, target).Run(context.Background())
+	require.True(t, errors.Is(err, ErrUnsupportedMigration), "expected unsupported migration, got %v", err)
+	assert.Equal(t, 0, copied)
+	assert.Empty(t, target.batches)
+}
+
+func TestMigrateDocumentLargerThanBatch(t *testing.T) {
+	source := MockDocumentSource{MockSource{
+		events: []eventstore.Event{
+			{ID: common.NewMessageID("A", 0)},
+			{ID: common.NewMessageID("A", 1)},
+			{ID: common.NewMessageID("A", 2)},
+			{ID: common.NewMessageID("B", 0)},
+		},
+	}}
+	target := &MockDocumentTarget{MockTarget{events: map[string]eventstore.Event{}}}
+
+	copied, err := New(source, target, WithBatchSize(2)).Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, copied)
+	assert.Equal(t, [][]string{
+		{common.NewMessageID("A", 0), common.NewMessageID("A", 1), common.NewMessageID("A", 2)},
+		{common.NewMessageID("B", 0)},
+	}, target.batches)
+}
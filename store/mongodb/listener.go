@@ -1,7 +1,6 @@
 package mongodb
 
 import (
-	"bytes"
 	"context"
 	"time"
 
@@ -24,8 +23,25 @@ type Feed struct {
 	partitions       uint32
 	partitionsLow    uint32
 	partitionsHi     uint32
+	progress         store.PartitionProgress
+	maxAwaitTime     time.Duration
+	heartbeat        Heartbeat
+	connectTimeout   time.Duration
+	connectAttempts  int
+	connectBackoff   time.Duration
 }
 
+// Heartbeat is called periodically while the feed is running, even if there are no events,
+// to allow housekeeping like health updates or metrics.
+type Heartbeat func(ctx context.Context)
+
+const (
+	// defaultMaxAwaitTime is the MongoDB default for change streams
+	defaultMaxAwaitTime        = time.Second
+	defaultFeedConnectAttempts = 3
+	defaultFeedConnectBackoff  = time.Second
+)
+
 type FeedOption func(*Feed)
 
 func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FeedOption {
@@ -45,11 +61,55 @@ func WithFeedEventsCollection(eventsCollection string) FeedOption {
 	}
 }
 
+// WithPartitionProgress reports, at every interval, the last event forwarded for the partition range
+func WithPartitionProgress(interval time.Duration, fn store.OnPartitionProgress) FeedOption {
+	return func(p *Feed) {
+		p.progress = store.PartitionProgress{Interval: interval, Callback: fn}
+	}
+}
+
+// WithMaxAwaitTime sets the maximum time that the server waits for new events before answering the change stream,
+// allowing a dead connection to be detected faster.
+// It is also the period of the heartbeat, defaulting to 1 second.
+func WithMaxAwaitTime(d time.Duration) FeedOption {
+	return func(p *Feed) {
+		p.maxAwaitTime = d
+	}
+}
+
+// WithHeartbeat sets the function called at every max await time (see WithMaxAwaitTime), with or without events.
+// It is called from a different goroutine than the one sinking the events.
+func WithHeartbeat(fn Heartbeat) FeedOption {
+	return func(p *Feed) {
+		p.heartbeat = fn
+	}
+}
+
+// WithFeedConnectTimeout sets the timeout of each attempt to connect to MongoDB. Defaults to 10 seconds.
+func WithFeedConnectTimeout(d time.Duration) FeedOption {
+	return func(p *Feed) {
+		p.connectTimeout = d
+	}
+}
+
+// WithFeedConnectRetry sets how many times connecting and opening the change stream is attempted,
+// doubling the backoff between each attempt, before the feed gives up.
+// Defaults to 3 attempts with a backoff of 1 second.
+func WithFeedConnectRetry(attempts int, backoff time.Duration) FeedOption {
+	return func(p *Feed) {
+		p.connectAttempts = attempts
+		p.connectBackoff = backoff
+	}
+}
+
 func NewFeed(connString, database string, opts ...FeedOption) (Feed, error) {
 	m := Feed{
 		dbName:           database,
 		connString:       connString,
 		eventsCollection: "events",
+		connectTimeout:   defaultConnectTimeout,
+		connectAttempts:  defaultFeedConnectAttempts,
+		connectBackoff:   defaultFeedConnectBackoff,
 	}
 
 	for _, o := range opts {
@@ -62,21 +122,41 @@ type ChangeEvent struct {
 	FullDocument Event `bson:"fullDocument,omitempty"`
 }
 
-func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
-	var lastResumeToken []byte
-	err := store.LastEventIDInSink(ctx, sinker, m.partitionsLow, m.partitionsHi, func(resumeToken []byte) error {
-		if bytes.Compare(resumeToken, lastResumeToken) > 0 {
-			lastResumeToken = resumeToken
-		}
-		return nil
-	})
+func (m Feed) ResumeTokenKind() string {
+	return store.ResumeTokenMongo
+}
+
+func (m Feed) CompareResumeTokens(a, b []byte) int {
+	return store.CompareResumeTokens(store.ParseBytesPosition, a, b)
+}
+
+func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) (err error) {
+	defer func(sinker sink.Sinker) {
+		err = store.FlushSink(sinker, err)
+	}(sinker)
+
+	pos, err := store.LastPositionInSink(ctx, sinker, m.partitionsLow, m.partitionsHi, store.ParseBytesPosition)
 	if err != nil {
 		return err
 	}
+	var lastResumeToken []byte
+	if pos != nil {
+		lastResumeToken = pos.Bytes()
+	}
+
+	sinker = m.progress.Wrap(ctx, sinker, m.partitionsLow, m.partitionsHi)
 
-	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
-	client, err := mongo.Connect(ctx2, options.Client().ApplyURI(m.connString))
-	cancel()
+	var client *mongo.Client
+	err = common.Retry(ctx, m.connectAttempts, m.connectBackoff, func() error {
+		ctx2, cancel := context.WithTimeout(ctx, m.connectTimeout)
+		defer cancel()
+		var er error
+		client, er = mongo.Connect(ctx2, options.Client().ApplyURI(m.connString))
+		if er != nil {
+			log.WithError(er).Warn("Unable to connect to MongoDB")
+		}
+		return er
+	})
 	if err != nil {
 		return faults.Errorf("Unable to connect to '%s': %w", m.connString, err)
 	}
@@ -95,22 +175,37 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	pipeline := mongo.Pipeline{matchPipeline}
 
 	eventsCollection := client.Database(m.dbName).Collection(m.eventsCollection)
-	var eventsStream *mongo.ChangeStream
+	streamOpts := options.ChangeStream()
+	if m.maxAwaitTime > 0 {
+		streamOpts.SetMaxAwaitTime(m.maxAwaitTime)
+	}
 	if len(lastResumeToken) != 0 {
 		log.Infof("Starting feeding (partitions: [%d-%d]) from '%X'", m.partitionsLow, m.partitionsHi, lastResumeToken)
-		eventsStream, err = eventsCollection.Watch(ctx, pipeline, options.ChangeStream().SetResumeAfter(bson.Raw(lastResumeToken)))
-		if err != nil {
-			return faults.Wrap(err)
-		}
+		streamOpts.SetResumeAfter(bson.Raw(lastResumeToken))
 	} else {
 		log.Infof("Starting feeding (partitions: [%d-%d]) from the beginning", m.partitionsLow, m.partitionsHi)
-		eventsStream, err = eventsCollection.Watch(ctx, pipeline, options.ChangeStream().SetStartAtOperationTime(&primitive.Timestamp{}))
-		if err != nil {
-			return faults.Wrap(err)
+		streamOpts.SetStartAtOperationTime(&primitive.Timestamp{})
+	}
+	var eventsStream *mongo.ChangeStream
+	err = common.Retry(ctx, m.connectAttempts, m.connectBackoff, func() error {
+		var er error
+		eventsStream, er = eventsCollection.Watch(ctx, pipeline, streamOpts)
+		if er != nil {
+			log.WithError(er).Warn("Unable to open the change stream")
 		}
+		return er
+	})
+	if err != nil {
+		return faults.Errorf("Unable to watch the change stream: %w", err)
 	}
 	defer eventsStream.Close(ctx)
 
+	if m.heartbeat != nil {
+		ctx2, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go m.beat(ctx2)
+	}
+
 	for eventsStream.Next(ctx) {
 		var data ChangeEvent
 		if err := eventsStream.Decode(&data); err != nil {
@@ -124,6 +219,7 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 				lastResumeToken = []byte(eventsStream.ResumeToken())
 			}
 			event := eventstore.Event{
+				// the events of a document share the same boundary (see store.Boundary and store.DedupSinker)
 				ID: common.NewMessageID(eventDoc.ID, uint8(k)),
 				// the resume token should be from the last fully completed sinked doc, because it may fail midway.
 				// We should use the last eventID to filter out the ones that were successfully sent.
@@ -134,6 +230,7 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 				AggregateType:    eventDoc.AggregateType,
 				Kind:             d.Kind,
 				Body:             d.Body,
+				ExternalID:       d.ExternalID,
 				IdempotencyKey:   eventDoc.IdempotencyKey,
 				Labels:           eventDoc.Labels,
 				CreatedAt:        eventDoc.CreatedAt,
@@ -144,5 +241,25 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 			}
 		}
 	}
+	if err := eventsStream.Err(); err != nil && ctx.Err() == nil {
+		return faults.Errorf("Error while watching the change stream: %w", err)
+	}
 	return nil
 }
+
+func (m Feed) beat(ctx context.Context) {
+	period := m.maxAwaitTime
+	if period <= 0 {
+		period = defaultMaxAwaitTime
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.heartbeat(ctx)
+		}
+	}
+}
@@ -19,6 +19,7 @@ const (
 	mongoUniqueViolation       = 11000
 	defaultEventsCollection    = "events"
 	defaultSnapshotsCollection = "snapshots"
+	defaultConnectTimeout      = 10 * time.Second
 )
 
 // Event is the event data stored in the database
@@ -32,11 +33,13 @@ type Event struct {
 	IdempotencyKey   string        `bson:"idempotency_key,omitempty"`
 	Labels           bson.M        `bson:"labels,omitempty"`
 	CreatedAt        time.Time     `bson:"created_at,omitempty"`
+	Epoch            uint32        `bson:"epoch,omitempty"`
 }
 
 type EventDetail struct {
-	Kind string `bson:"kind,omitempty"`
-	Body []byte `bson:"body,omitempty"`
+	Kind       string `bson:"kind,omitempty"`
+	Body       []byte `bson:"body,omitempty"`
+	ExternalID string `bson:"external_id,omitempty"`
 }
 
 type Snapshot struct {
@@ -48,7 +51,10 @@ type Snapshot struct {
 	CreatedAt        time.Time `bson:"created_at,omitempty"`
 }
 
-var _ eventstore.EsRepository = (*EsRepository)(nil)
+var (
+	_ eventstore.EsRepository  = (*EsRepository)(nil)
+	_ eventstore.VersionReader = (*EsRepository)(nil)
+)
 
 type StoreOption func(*EsRepository)
 
@@ -72,35 +78,78 @@ func WithSnapshotsCollection(snapshotsCollection string) StoreOption {
 	}
 }
 
+// WithConnectTimeout sets the timeout for each connection attempt. Defaults to 10 seconds.
+func WithConnectTimeout(timeout time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.connectTimeout = timeout
+	}
+}
+
+// WithUniqueViolation sets how the errors of the database driver are recognized as unique violations.
+// Defaults to recognizing the errors of the mongo driver driver.
+func WithUniqueViolation(detector store.UniqueViolationDetector) StoreOption {
+	return func(r *EsRepository) {
+		r.uniqueViolation = detector
+	}
+}
+
+// WithConnectRetry retries connecting to the database up to attempts times,
+// doubling the backoff between each attempt, before giving up.
+func WithConnectRetry(attempts int, backoff time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.connectAttempts = attempts
+		r.connectBackoff = backoff
+	}
+}
+
 type EsRepository struct {
 	dbName                  string
 	client                  *mongo.Client
 	projectorFactory        ProjectorFactory
 	eventsCollectionName    string
 	snapshotsCollectionName string
+	connectTimeout          time.Duration
+	connectAttempts         int
+	connectBackoff          time.Duration
+	uniqueViolation         store.UniqueViolationDetector
 }
 
 // NewStore creates a new instance of MongoEsRepository
 func NewStore(connString, database string, opts ...StoreOption) (*EsRepository, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connString))
-	if err != nil {
-		return nil, faults.Wrap(err)
-	}
-
 	r := &EsRepository{
 		dbName:                  database,
-		client:                  client,
 		eventsCollectionName:    defaultEventsCollection,
 		snapshotsCollectionName: defaultSnapshotsCollection,
+		connectTimeout:          defaultConnectTimeout,
+		uniqueViolation:         IsUniqueViolation,
 	}
 
 	for _, o := range opts {
 		o(r)
 	}
 
+	err := common.Retry(context.Background(), r.connectAttempts, r.connectBackoff, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), r.connectTimeout)
+		defer cancel()
+
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(connString))
+		if err != nil {
+			return faults.Wrap(err)
+		}
+		if r.connectAttempts > 0 {
+			err = client.Ping(ctx, nil)
+			if err != nil {
+				client.Disconnect(context.Background())
+				return faults.Wrap(err)
+			}
+		}
+		r.client = client
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return r, nil
 }
 
@@ -120,20 +169,24 @@ func (r *EsRepository) snapshotCollection() *mongo.Collection {
 	return r.collection(r.snapshotsCollectionName)
 }
 
-func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, uint32, error) {
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, []eventstore.Event, error) {
+	if eRec.IdempotencyTTL != nil {
+		return "", nil, faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyStoreUnsupported)
+	}
 	if len(eRec.Details) == 0 {
-		return "", 0, faults.New("No events to be saved")
+		return "", nil, faults.New("No events to be saved")
 	}
 	details := make([]EventDetail, 0, len(eRec.Details))
 	for _, e := range eRec.Details {
 		details = append(details, EventDetail{
-			Kind: e.Kind,
-			Body: e.Body,
+			Kind:       e.Kind,
+			Body:       e.Body,
+			ExternalID: e.ExternalID,
 		})
 	}
 
 	version := eRec.Version + 1
-	id := common.NewEventID(eRec.CreatedAt, eRec.AggregateID, version)
+	id := common.NewEventIDWithNode(eRec.CreatedAt, eRec.AggregateID, version, eRec.NodeID)
 	doc := Event{
 		ID:               id,
 		AggregateID:      eRec.AggregateID,
@@ -144,30 +197,38 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecor
 		Labels:           eRec.Labels,
 		CreatedAt:        eRec.CreatedAt,
 		AggregateIDHash:  common.Hash(eRec.AggregateID),
+		Epoch:            eRec.Epoch,
+	}
+
+	// the events as they are read back, one per detail of the document (see queryEvents)
+	events := make([]eventstore.Event, 0, len(doc.Details))
+	for k, d := range doc.Details {
+		events = append(events, eventstore.Event{
+			ID:               common.NewMessageID(doc.ID, uint8(k)),
+			AggregateID:      doc.AggregateID,
+			AggregateIDHash:  doc.AggregateIDHash,
+			AggregateVersion: doc.AggregateVersion,
+			AggregateType:    doc.AggregateType,
+			IdempotencyKey:   doc.IdempotencyKey,
+			Kind:             d.Kind,
+			Body:             d.Body,
+			ExternalID:       d.ExternalID,
+			Labels:           doc.Labels,
+			CreatedAt:        doc.CreatedAt,
+			Epoch:            doc.Epoch,
+		})
 	}
 
 	var err error
 	if r.projectorFactory != nil {
-		r.withTx(ctx, func(mCtx mongo.SessionContext) (interface{}, error) {
+		err = r.withTx(ctx, func(mCtx mongo.SessionContext) (interface{}, error) {
 			res, err := r.eventsCollection().InsertOne(mCtx, doc)
 			if err != nil {
 				return nil, faults.Wrap(err)
 			}
 
 			projector := r.projectorFactory(mCtx)
-			for _, d := range doc.Details {
-				evt := eventstore.Event{
-					ID:               doc.ID,
-					AggregateID:      doc.AggregateID,
-					AggregateIDHash:  doc.AggregateIDHash,
-					AggregateVersion: doc.AggregateVersion,
-					AggregateType:    doc.AggregateType,
-					IdempotencyKey:   doc.IdempotencyKey,
-					Kind:             d.Kind,
-					Body:             d.Body,
-					Labels:           doc.Labels,
-					CreatedAt:        doc.CreatedAt,
-				}
+			for _, evt := range events {
 				projector.Project(evt)
 			}
 
@@ -177,17 +238,72 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecor
 		_, err = r.eventsCollection().InsertOne(ctx, doc)
 	}
 	if err != nil {
-		if isMongoDup(err) {
-			return "", 0, eventstore.ErrConcurrentModification
+		if r.uniqueViolation(err) {
+			return "", nil, r.dupError(ctx, eRec)
 		}
-		return "", 0, faults.Errorf("Unable to insert event: %w", err)
+		return "", nil, faults.Errorf("Unable to insert event: %w", err)
 	}
 
-	return id, version, nil
+	return id, events, nil
+}
+
+// StoresDocuments tells that the events of a save are kept in one document, sharing the aggregate version (see migration.DocumentStore)
+func (r *EsRepository) StoresDocuments() bool {
+	return true
+}
+
+// ImportEvents inserts the events verbatim, preserving their IDs, versions and creation times.
+// Consecutive events with message IDs of the same document are grouped back into that document,
+// so the events of a document must not be split between calls.
+// Documents that already exist are ignored, so that an interrupted import can be safely repeated.
+func (r *EsRepository) ImportEvents(ctx context.Context, events []eventstore.Event) error {
+	var doc *Event
+	insert := func() error {
+		if doc == nil {
+			return nil
+		}
+		_, err := r.eventsCollection().InsertOne(ctx, doc)
+		if err != nil && !r.uniqueViolation(err) {
+			return faults.Errorf("Unable to import event '%s': %w", doc.ID, err)
+		}
+		return nil
+	}
 
+	for _, e := range events {
+		id, _, err := common.SplitMessageID(e.ID)
+		if err != nil {
+			return faults.Wrap(err)
+		}
+		detail := EventDetail{
+			Kind:       e.Kind,
+			Body:       e.Body,
+			ExternalID: e.ExternalID,
+		}
+		if doc != nil && doc.ID == id {
+			doc.Details = append(doc.Details, detail)
+			continue
+		}
+		if err := insert(); err != nil {
+			return err
+		}
+		doc = &Event{
+			ID:               id,
+			AggregateID:      e.AggregateID,
+			AggregateIDHash:  common.Hash(e.AggregateID),
+			AggregateVersion: e.AggregateVersion,
+			AggregateType:    e.AggregateType,
+			Details:          []EventDetail{detail},
+			IdempotencyKey:   e.IdempotencyKey,
+			Labels:           e.Labels,
+			CreatedAt:        e.CreatedAt,
+			Epoch:            e.Epoch,
+		}
+	}
+	return insert()
 }
 
-func isMongoDup(err error) bool {
+// IsUniqueViolation tells if err is a duplicate key error reported by the mongo driver
+func IsUniqueViolation(err error) bool {
 	var e mongo.WriteException
 	if errors.As(err, &e) {
 		for _, we := range e.WriteErrors {
@@ -199,6 +315,44 @@ func isMongoDup(err error) bool {
 	return false
 }
 
+// dupError tells apart which unique index the save violated:
+// if the idempotency key is already taken the save is a duplicate request, otherwise it is a version conflict.
+// The check is done after the failed insert, so that concurrent saves with the same key are detected atomically by the unique index.
+func (r *EsRepository) dupError(ctx context.Context, eRec eventstore.EventRecord) error {
+	if eRec.IdempotencyKey != "" {
+		found, err := r.HasIdempotencyKey(ctx, eRec.AggregateType, eRec.IdempotencyKey)
+		if err == nil && found {
+			return faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyKeyConflict)
+		}
+	}
+	for _, e := range eRec.Details {
+		if e.ExternalID == "" {
+			continue
+		}
+		_, err := r.GetByExternalID(ctx, e.ExternalID)
+		if err == nil {
+			return faults.Errorf("Unable to save aggregate '%s' with external ID '%s': %w", eRec.AggregateID, e.ExternalID, eventstore.ErrExternalIDConflict)
+		}
+	}
+	return eventstore.ErrConcurrentModification
+}
+
+// GetByExternalID returns the event with the external ID.
+// Since the events of a save share a document, the document is found by the external ID of one of its details.
+func (r *EsRepository) GetByExternalID(ctx context.Context, externalID string) (eventstore.Event, error) {
+	filter := bson.D{{"details.external_id", externalID}}
+	events, _, _, err := r.queryEvents(ctx, filter, options.Find().SetLimit(1), "", 0)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, err)
+	}
+	for _, e := range events {
+		if e.ExternalID == externalID {
+			return e, nil
+		}
+	}
+	return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, eventstore.ErrEventNotFound)
+}
+
 func (r *EsRepository) withTx(ctx context.Context, callback func(mongo.SessionContext) (interface{}, error)) (err error) {
 	session, err := r.client.StartSession()
 	if err != nil {
@@ -234,6 +388,26 @@ func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eve
 	}, nil
 }
 
+func (r *EsRepository) GetSnapshotMeta(ctx context.Context, aggregateID string) (eventstore.SnapshotMeta, error) {
+	snap := Snapshot{}
+	opts := options.FindOne()
+	opts.SetSort(bson.D{{"aggregate_version", -1}})
+	opts.SetProjection(bson.D{{"aggregate_version", 1}, {"created_at", 1}})
+	if err := r.snapshotCollection().FindOne(ctx, bson.D{{"aggregate_id", aggregateID}}, opts).Decode(&snap); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return eventstore.SnapshotMeta{}, nil
+		}
+		return eventstore.SnapshotMeta{}, faults.Errorf("Unable to get snapshot metadata for aggregate '%s': %w", aggregateID, err)
+	}
+	return eventstore.SnapshotMeta{
+		Exists:           true,
+		AggregateVersion: snap.AggregateVersion,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+// SaveSnapshot persists the snapshot unless the aggregate already has a snapshot at the same or at a newer version.
+// Saving the same snapshot again replaces it.
 func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Snapshot) error {
 	snap := Snapshot{
 		ID:               snapshot.ID,
@@ -243,9 +417,29 @@ func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Sna
 		Body:             snapshot.Body,
 		CreatedAt:        snapshot.CreatedAt,
 	}
-	_, err := r.snapshotCollection().InsertOne(ctx, snap)
-
-	return faults.Wrap(err)
+	// the check and the write run in one transaction, so that the check sees the snapshots committed before the write.
+	// Two writers of different snapshots may still both pass the check and both be kept, but GetSnapshot always reads the newest
+	err := r.withTx(ctx, func(mCtx mongo.SessionContext) (interface{}, error) {
+		newer, err := r.snapshotCollection().CountDocuments(mCtx, bson.D{
+			{"aggregate_id", snap.AggregateID},
+			{"_id", bson.D{{"$ne", snap.ID}}},
+			{"aggregate_version", bson.D{{"$gte", snap.AggregateVersion}}},
+		}, options.Count().SetLimit(1))
+		if err != nil {
+			return nil, faults.Errorf("Unable to check the snapshots of aggregate '%s': %w", snap.AggregateID, err)
+		}
+		if newer > 0 {
+			return nil, nil
+		}
+		// replacing a snapshot of the same event
+		opts := options.Replace().SetUpsert(true)
+		_, err = r.snapshotCollection().ReplaceOne(mCtx, bson.D{{"_id", snap.ID}}, snap, opts)
+		return nil, faults.Wrap(err)
+	})
+	if err != nil {
+		return faults.Errorf("Unable to save the snapshot of aggregate '%s': %w", snap.AggregateID, err)
+	}
+	return nil
 }
 
 func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventstore.Event, error) {
@@ -267,6 +461,35 @@ func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID strin
 	return events, nil
 }
 
+// CurrentVersion returns the version of the last document of the aggregate, or zero if it has none
+func (r *EsRepository) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	filter := bson.D{{"aggregate_id", aggregateID}}
+	opts := options.FindOne().SetSort(bson.D{{"aggregate_version", -1}}).SetProjection(bson.D{{"aggregate_version", 1}})
+	evt := Event{}
+	if err := r.eventsCollection().FindOne(ctx, filter, opts).Decode(&evt); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, faults.Errorf("Unable to get the current version of aggregate '%s': %w", aggregateID, err)
+	}
+	return evt.AggregateVersion, nil
+}
+
+// GetCreationEvent returns the first event of the first document of the aggregate,
+// since the events saved together share the document and the version.
+func (r *EsRepository) GetCreationEvent(ctx context.Context, aggregateID string) (eventstore.Event, error) {
+	filter := bson.D{{"aggregate_id", aggregateID}}
+	opts := options.Find().SetSort(bson.D{{"aggregate_version", 1}}).SetLimit(1)
+	events, _, _, err := r.queryEvents(ctx, filter, opts, "", 0)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, eventstore.ErrAggregateNotFound)
+	}
+	return events[0], nil
+}
+
 func (r *EsRepository) HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error) {
 	filter := bson.D{{"aggregate_type", aggregateType}, {"idempotency_key", idempotencyKey}}
 	opts := options.FindOne().SetProjection(bson.D{{"_id", 1}})
@@ -374,6 +597,80 @@ func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Dura
 	return evt.ID, nil
 }
 
+// CountEvents counts the events matching the filter.
+// With filter.ApproximateCount and no conditions, the estimate of the collection metadata is returned instead,
+// which counts the saves and not the events, since the events of a save are kept in the same document.
+func (r *EsRepository) CountEvents(ctx context.Context, filter store.Filter) (int64, error) {
+	if filter.ApproximateCount && !filter.HasConditions() {
+		count, err := r.eventsCollection().EstimatedDocumentCount(ctx)
+		if err != nil {
+			return 0, faults.Errorf("Unable to estimate the number of events: %w", err)
+		}
+		return count, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{"$match", buildFilter(filter, bson.D{})}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"count", bson.D{{"$sum", bson.D{{"$size", "$details"}}}}},
+		}}},
+	}
+	cursor, err := r.eventsCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, faults.Errorf("Unable to count events for filter %+v: %w", filter, err)
+	}
+	defer cursor.Close(ctx)
+
+	result := struct {
+		Count int64 `bson:"count"`
+	}{}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return 0, faults.Errorf("Unable to decode the count of events: %w", err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, faults.Errorf("Unable to count events for filter %+v: %w", filter, err)
+	}
+	return result.Count, nil
+}
+
+func (r *EsRepository) ChangedAggregates(ctx context.Context, since time.Time, filter store.Filter) ([]store.AggregateRef, error) {
+	flt := buildFilter(filter, bson.D{{"created_at", bson.D{{"$gte", since.UTC()}}}})
+	pipeline := mongo.Pipeline{
+		{{"$match", flt}},
+		{{"$group", bson.D{
+			{"_id", "$aggregate_id"},
+			{"aggregate_type", bson.D{{"$first", "$aggregate_type"}}},
+			{"version", bson.D{{"$max", "$aggregate_version"}}},
+		}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+	}
+	cursor, err := r.eventsCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get the aggregates changed since %s for filter %+v: %w", since, filter, err)
+	}
+	defer cursor.Close(ctx)
+
+	refs := []store.AggregateRef{}
+	for cursor.Next(ctx) {
+		ref := struct {
+			AggregateID   string `bson:"_id"`
+			AggregateType string `bson:"aggregate_type"`
+			Version       uint32 `bson:"version"`
+		}{}
+		if err := cursor.Decode(&ref); err != nil {
+			return nil, faults.Errorf("Unable to decode the changed aggregate: %w", err)
+		}
+		refs = append(refs, store.AggregateRef(ref))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, faults.Errorf("Unable to get the aggregates changed since %s for filter %+v: %w", since, filter, err)
+	}
+	return refs, nil
+}
+
 func (r *EsRepository) GetEvents(ctx context.Context, afterMessageID string, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
 	eventID, count, err := common.SplitMessageID(afterMessageID)
 	if err != nil {
@@ -381,7 +678,8 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterMessageID string, bat
 	}
 
 	var records []eventstore.Event
-	for len(records) < batchSize {
+	// with no batch size, all the events are read in a single pass
+	for batchSize <= 0 || len(records) < batchSize {
 		// since we have to consider the count, the query starts with the eventID
 		flt := bson.D{
 			{"_id", bson.D{{"$gte", eventID}}},
@@ -399,10 +697,25 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterMessageID string, bat
 		} else {
 			opts.SetBatchSize(-1)
 		}
+		if filter.Projection == store.MinimalProjection {
+			opts.SetProjection(bson.D{
+				{"_id", 1},
+				{"aggregate_id", 1},
+				{"aggregate_version", 1},
+				{"details", 1},
+				{"created_at", 1},
+			})
+		}
 
 		rows, lastEventID, lastCount, err := r.queryEvents(ctx, flt, opts, eventID, count)
 		if err != nil {
-			return nil, faults.Errorf("Unable to get events after '%s' for filter %+v: %w", eventID, filter, err)
+			err = faults.Errorf("Unable to get events after '%s' for filter %+v: %w", eventID, filter, err)
+			// the events of the previous passes were read, so they are returned too
+			records = append(records, rows...)
+			if filter.PartialResults && len(records) > 0 {
+				return records, err
+			}
+			return nil, err
 		}
 		if len(rows) == 0 {
 			return records, nil
@@ -410,17 +723,35 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterMessageID string, bat
 
 		eventID = lastEventID
 		count = lastCount
-		records = append(rows)
+		records = append(records, rows...)
+		if batchSize <= 0 {
+			break
+		}
 	}
 
 	return records, nil
 }
 
 func buildFilter(filter store.Filter, flt bson.D) bson.D {
+	if filter.UpperBound != "" {
+		// the events of a save share the document, so a bound in the middle of a document includes the whole document
+		upperBound, _, err := common.SplitMessageID(filter.UpperBound)
+		if err != nil {
+			upperBound = filter.UpperBound
+		}
+		// wrapped, since the queries may already have a condition on _id
+		flt = append(flt, bson.E{"$and", bson.A{bson.D{{"_id", bson.D{{"$lte", upperBound}}}}}})
+	}
+
 	if len(filter.AggregateTypes) > 0 {
 		flt = append(flt, bson.E{"aggregate_type", bson.D{{"$in", filter.AggregateTypes}}})
 	}
 
+	// the events of a save share the document, so the other events of a matching document are also returned
+	if len(filter.ExternalIDs) > 0 {
+		flt = append(flt, bson.E{"details.external_id", bson.D{{"$in", filter.ExternalIDs}}})
+	}
+
 	if filter.Partitions > 1 {
 		flt = append(flt, partitionFilter("aggregate_id_hash", filter.Partitions, filter.PartitionLow, filter.PartitionHi))
 	}
@@ -430,6 +761,11 @@ func buildFilter(filter store.Filter, flt bson.D) bson.D {
 			flt = append(flt, bson.E{"labels." + k, bson.D{{"$in", v}}})
 		}
 	}
+
+	// $nin also matches the events without the label
+	for k, v := range filter.ExcludeLabels {
+		flt = append(flt, bson.E{"labels." + k, bson.D{{"$nin", v}}})
+	}
 	return flt
 }
 
@@ -484,9 +820,20 @@ func (r *EsRepository) queryEvents(ctx context.Context, filter bson.D, opts *opt
 		return nil, "", 0, faults.Wrap(err)
 	}
 
+	defer cursor.Close(ctx)
+	// on failure, the events decoded so far are also returned
 	evts := []Event{}
-	if err = cursor.All(ctx, &evts); err != nil {
-		return nil, "", 0, faults.Wrap(err)
+	var errDecode error
+	for cursor.Next(ctx) {
+		evt := Event{}
+		if err := cursor.Decode(&evt); err != nil {
+			errDecode = faults.Errorf("Unable to decode event document: %w", err)
+			break
+		}
+		evts = append(evts, evt)
+	}
+	if errDecode == nil && cursor.Err() != nil {
+		errDecode = faults.Wrap(cursor.Err())
 	}
 
 	events := []eventstore.Event{}
@@ -507,13 +854,15 @@ func (r *EsRepository) queryEvents(ctx context.Context, filter bson.D, opts *opt
 					AggregateType:    v.AggregateType,
 					Kind:             d.Kind,
 					Body:             d.Body,
+					ExternalID:       d.ExternalID,
 					IdempotencyKey:   v.IdempotencyKey,
 					Labels:           v.Labels,
 					CreatedAt:        v.CreatedAt,
+					Epoch:            v.Epoch,
 				})
 			}
 		}
 	}
 
-	return events, lastEventID, lastCount, nil
+	return events, lastEventID, lastCount, errDecode
 }
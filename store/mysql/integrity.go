@@ -0,0 +1,50 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+// CheckIntegrity finds the snapshots referencing missing events, the aggregates with version gaps and the idempotency keys used by more than one aggregate.
+// It is an offline tool, for operators to run after incidents or migrations, since it scans the whole tables.
+// The problems are streamed from the database, instead of being loaded, so that the check runs on stores of any size.
+// The version gaps are found with window functions, requiring MySQL 8 or MariaDB 10.2.
+func (r *EsRepository) CheckIntegrity(ctx context.Context, options ...store.IntegrityOption) (store.IntegrityReport, error) {
+	check := store.NewIntegrityCheck(options...)
+
+	report := store.IntegrityReport{}
+	var err error
+	report.OrphanSnapshots, err = store.ScanIntegrityProblems(ctx, r.db.DB, check, store.OrphanSnapshot,
+		`SELECT s.aggregate_id, s.id FROM snapshots s
+		WHERE NOT EXISTS (SELECT 1 FROM events e WHERE e.id = s.id)`)
+	if err != nil {
+		return store.IntegrityReport{}, err
+	}
+	// the events do not expire in MySQL, so they are never purged
+	report.VersionGaps, err = store.ScanIntegrityProblems(ctx, r.db.DB, check, store.VersionGap, store.VersionGapQuery("FALSE"))
+	if err != nil {
+		return store.IntegrityReport{}, err
+	}
+	report.DuplicateIdempotencyKeys, err = store.ScanIntegrityProblems(ctx, r.db.DB, check, store.DuplicateIdempotencyKey,
+		`SELECT MIN(aggregate_id), idempotency_key FROM events
+		WHERE idempotency_key IS NOT NULL
+		GROUP BY aggregate_type, idempotency_key HAVING COUNT(DISTINCT aggregate_id) > 1`)
+	if err != nil {
+		return store.IntegrityReport{}, err
+	}
+
+	if check.Repair && report.OrphanSnapshots > 0 {
+		res, err := r.db.ExecContext(ctx, `DELETE FROM snapshots WHERE NOT EXISTS (SELECT 1 FROM events e WHERE e.id = snapshots.id)`)
+		if err != nil {
+			return report, faults.Errorf("Unable to delete the orphan snapshots: %w", err)
+		}
+		report.RepairedSnapshots, err = res.RowsAffected()
+		if err != nil {
+			return report, faults.Wrap(err)
+		}
+	}
+
+	return report, nil
+}
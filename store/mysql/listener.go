@@ -2,7 +2,6 @@ package mysql
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"runtime/debug"
 	"strconv"
@@ -30,6 +29,9 @@ type Feed struct {
 	partitionsLow uint32
 	partitionsHi  uint32
 	flavour       string
+	progress      store.PartitionProgress
+	labelCodec    eventstore.Codec
+	timeParser    common.TimeParser
 }
 
 type FeedOption func(*FeedOptions)
@@ -40,6 +42,9 @@ type FeedOptions struct {
 	partitionsLow uint32
 	partitionsHi  uint32
 	flavour       string
+	progress      store.PartitionProgress
+	labelCodec    eventstore.Codec
+	timeParser    common.TimeParser
 }
 
 func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FeedOption {
@@ -64,6 +69,29 @@ func WithFlavour(flavour string) FeedOption {
 	}
 }
 
+// WithPartitionProgress reports, at every interval, the last event forwarded for the partition range
+func WithPartitionProgress(interval time.Duration, fn store.OnPartitionProgress) FeedOption {
+	return func(p *FeedOptions) {
+		p.progress = store.PartitionProgress{Interval: interval, Callback: fn}
+	}
+}
+
+// WithFeedLabelCodec sets the codec used to deserialize the labels of the events.
+// It must match the one used by the store. Defaults to eventstore.JSONCodec.
+func WithFeedLabelCodec(codec eventstore.Codec) FeedOption {
+	return func(p *FeedOptions) {
+		p.labelCodec = codec
+	}
+}
+
+// WithFeedTimeParser sets how the creation time of the events is parsed,
+// eg: if the database time zone is not UTC. Defaults to common.NewTimeParser().
+func WithFeedTimeParser(parser common.TimeParser) FeedOption {
+	return func(p *FeedOptions) {
+		p.timeParser = parser
+	}
+}
+
 type DBConfig struct {
 	Database string
 	Host     string
@@ -76,6 +104,8 @@ func NewFeed(config DBConfig, opts ...FeedOption) Feed {
 	options := FeedOptions{
 		eventsTable: "events",
 		flavour:     "mariadb",
+		labelCodec:  eventstore.JSONCodec{},
+		timeParser:  common.NewTimeParser(),
 	}
 	for _, o := range opts {
 		o(&options)
@@ -88,26 +118,37 @@ func NewFeed(config DBConfig, opts ...FeedOption) Feed {
 		partitionsLow: options.partitionsLow,
 		partitionsHi:  options.partitionsHi,
 		flavour:       options.flavour,
+		progress:      options.progress,
+		labelCodec:    options.labelCodec,
+		timeParser:    options.timeParser,
 	}
 }
 
-func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
-	var lastResumePosition mysql.Position
-	var lastResumeToken []byte
-	err := store.LastEventIDInSink(ctx, sinker, m.partitionsLow, m.partitionsHi, func(resumeToken []byte) error {
-		p, err := parse(string(resumeToken))
-		if err != nil {
-			return faults.Wrap(err)
-		}
-		if p.Compare(lastResumePosition) > 0 {
-			lastResumePosition = p
-			lastResumeToken = resumeToken
-		}
-		return nil
-	})
+func (m Feed) ResumeTokenKind() string {
+	return store.ResumeTokenBinlog
+}
+
+func (m Feed) CompareResumeTokens(a, b []byte) int {
+	return store.CompareResumeTokens(ParseBinlogPosition, a, b)
+}
+
+func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) (err error) {
+	defer func(sinker sink.Sinker) {
+		err = store.FlushSink(sinker, err)
+	}(sinker)
+
+	pos, err := store.LastPositionInSink(ctx, sinker, m.partitionsLow, m.partitionsHi, ParseBinlogPosition)
 	if err != nil {
 		return err
 	}
+	var lastResumePosition mysql.Position
+	var lastResumeToken []byte
+	if pos != nil {
+		lastResumePosition = mysql.Position(pos.(BinlogPosition))
+		lastResumeToken = pos.Bytes()
+	}
+
+	sinker = m.progress.Wrap(ctx, sinker, m.partitionsLow, m.partitionsHi)
 
 	cfg := canal.NewDefaultConfig()
 	cfg.Addr = fmt.Sprintf("%s:%d", m.config.Host, m.config.Port)
@@ -136,6 +177,8 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 		partitions:      m.partitions,
 		partitionsLow:   m.partitionsLow,
 		partitionsHi:    m.partitionsHi,
+		labelCodec:      m.labelCodec,
+		timeParser:      m.timeParser,
 	})
 
 	if lastResumePosition.Name == "" {
@@ -155,6 +198,38 @@ func (m Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	return nil
 }
 
+// BinlogPosition is a store.Position based on the MySQL binlog position
+type BinlogPosition mysql.Position
+
+// ParseBinlogPosition is a store.PositionParser for binlog positions
+func ParseBinlogPosition(token []byte) (store.Position, error) {
+	p, err := parse(string(token))
+	if err != nil {
+		return nil, err
+	}
+	return BinlogPosition(p), nil
+}
+
+func (p BinlogPosition) Compare(other store.Position) int {
+	o, ok := other.(BinlogPosition)
+	if !ok {
+		o2, err := ParseBinlogPosition(other.Bytes())
+		if err != nil {
+			return 1
+		}
+		o = o2.(BinlogPosition)
+	}
+	return mysql.Position(p).Compare(mysql.Position(o))
+}
+
+func (p BinlogPosition) String() string {
+	return string(p.Bytes())
+}
+
+func (p BinlogPosition) Bytes() []byte {
+	return format(mysql.Position(p))
+}
+
 func parse(lastResumeToken string) (mysql.Position, error) {
 	if len(lastResumeToken) == 0 {
 		return mysql.Position{}, nil
@@ -186,6 +261,8 @@ type binlogHandler struct {
 	partitions              uint32
 	partitionsLow           uint32
 	partitionsHi            uint32
+	labelCodec              eventstore.Decoder
+	timeParser              common.TimeParser
 }
 
 func (h *binlogHandler) OnRow(e *canal.RowsEvent) error {
@@ -215,6 +292,14 @@ func (h *binlogHandler) OnRow(e *canal.RowsEvent) error {
 				return nil
 			}
 		}
+		labels, err := r.getAsLabels("labels", h.labelCodec)
+		if err != nil {
+			return faults.Errorf("Unable to decode labels of event '%s': %w", r.getAsString("id"), err)
+		}
+		createdAt, err := r.getAsTime("created_at", h.timeParser)
+		if err != nil {
+			return faults.Errorf("Unable to parse the creation time of event '%s': %w", r.getAsString("id"), err)
+		}
 		h.events = append(h.events, eventstore.Event{
 			ID:               r.getAsString("id"),
 			AggregateID:      r.getAsString("aggregate_id"),
@@ -224,8 +309,9 @@ func (h *binlogHandler) OnRow(e *canal.RowsEvent) error {
 			Kind:             r.getAsString("kind"),
 			Body:             r.getAsBytes("body"),
 			IdempotencyKey:   r.getAsString("idempotency_key"),
-			Labels:           r.getAsMap("labels"),
-			CreatedAt:        r.getAsTimeDate("created_at"),
+			ExternalID:       r.getAsString("external_id"),
+			Labels:           labels,
+			CreatedAt:        createdAt,
 		})
 	}
 
@@ -242,19 +328,28 @@ func (r *rec) getAsBytes(colName string) []byte {
 }
 
 func (r *rec) getAsString(colName string) string {
-	if o := r.find(colName); o != nil {
-		return o.(string)
+	switch o := r.find(colName).(type) {
+	case string:
+		return o
+	case []byte:
+		return string(o)
 	}
 	return ""
 }
 
-func (r *rec) getAsTimeDate(colName string) time.Time {
-	if o := r.find(colName); o != nil {
-		t, _ := time.Parse("2006-01-02 15:04:05", o.(string))
-
-		return t
+func (r *rec) getAsTime(colName string, parser common.TimeParser) (time.Time, error) {
+	switch o := r.find(colName).(type) {
+	case time.Time:
+		return o.UTC(), nil
+	case string:
+		return parser.Parse(o)
+	case []byte:
+		return parser.Parse(string(o))
+	case nil:
+		return time.Time{}, faults.Errorf("Missing column '%s'", colName)
+	default:
+		return time.Time{}, faults.Errorf("Unexpected type %T of column '%s'", o, colName)
 	}
-	return time.Time{}
 }
 
 func (r *rec) getAsUint32(colName string) uint32 {
@@ -264,13 +359,16 @@ func (r *rec) getAsUint32(colName string) uint32 {
 	return 0
 }
 
-func (r *rec) getAsMap(colName string) map[string]interface{} {
-	if o := r.find(colName); o != nil {
-		m := map[string]interface{}{}
-		json.Unmarshal(o.([]byte), &m)
-		return m
+func (r *rec) getAsLabels(colName string, codec eventstore.Decoder) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	var err error
+	switch o := r.find(colName).(type) {
+	case []byte:
+		err = eventstore.DecodeLabels(codec, o, m)
+	case string:
+		err = eventstore.DecodeLabels(codec, []byte(o), m)
 	}
-	return nil
+	return m, err
 }
 
 func (r *rec) find(colName string) interface{} {
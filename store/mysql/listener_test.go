@@ -0,0 +1,29 @@
+package mysql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore/common"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAsTime(t *testing.T) {
+	parser := common.NewTimeParser()
+	r := &rec{
+		row:  []interface{}{"2021-03-04 05:06:07.123", 3},
+		cols: []schema.TableColumn{{Name: "created_at"}, {Name: "aggregate_version"}},
+	}
+
+	createdAt, err := r.getAsTime("created_at", parser)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 3, 4, 5, 6, 7, 123000000, time.UTC), createdAt)
+
+	_, err = r.getAsTime("updated_at", parser)
+	require.Error(t, err)
+
+	_, err = r.getAsTime("aggregate_version", parser)
+	require.Error(t, err)
+}
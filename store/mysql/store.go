@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -21,6 +21,7 @@ import (
 const (
 	driverName      = "mysql"
 	uniqueViolation = 1062
+	fkViolation     = 1452
 )
 
 // Event is the event data stored in the database
@@ -35,6 +36,8 @@ type Event struct {
 	IdempotencyKey   NilString `db:"idempotency_key"`
 	Labels           []byte    `db:"labels"`
 	CreatedAt        time.Time `db:"created_at"`
+	ExternalID       NilString `db:"external_id"`
+	Epoch            uint32    `db:"epoch"`
 }
 
 // NilString converts nil to empty string
@@ -65,7 +68,10 @@ type Snapshot struct {
 	CreatedAt        time.Time `db:"created_at,omitempty"`
 }
 
-var _ eventstore.EsRepository = (*EsRepository)(nil)
+var (
+	_ eventstore.EsRepository  = (*EsRepository)(nil)
+	_ eventstore.VersionReader = (*EsRepository)(nil)
+)
 
 type StoreOption func(*EsRepository)
 
@@ -77,9 +83,51 @@ func ProjectorFactoryOption(fn ProjectorFactory) StoreOption {
 	}
 }
 
+// WithConnectRetry makes the store ping the database on creation, retrying up to attempts times,
+// doubling the backoff between each attempt, before giving up.
+func WithConnectRetry(attempts int, backoff time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.connectAttempts = attempts
+		r.connectBackoff = backoff
+	}
+}
+
+// WithUniqueViolation sets how the errors of the database driver are recognized as unique violations.
+// Defaults to recognizing the errors of the go-sql-driver/mysql driver.
+func WithUniqueViolation(detector store.UniqueViolationDetector) StoreOption {
+	return func(r *EsRepository) {
+		r.uniqueViolation = detector
+	}
+}
+
+// QueryLogger receives the SQL, and its arguments, of the queries built from filters
+type QueryLogger func(sql string, args []interface{})
+
+// WithQueryLogger calls logger with the SQL and arguments of GetEvents and GetLastEventID, before executing them,
+// to help diagnosing filters. It is disabled by default, since the arguments may hold sensitive data.
+func WithQueryLogger(logger QueryLogger) StoreOption {
+	return func(r *EsRepository) {
+		r.queryLogger = logger
+	}
+}
+
+// WithLabelCodec sets the codec used to serialize the event labels. Defaults to eventstore.JSONCodec.
+// Since the labels are stored in a JSON column, the codec must still produce JSON.
+// The feeds reading these events must be configured with the same codec.
+func WithLabelCodec(codec eventstore.Codec) StoreOption {
+	return func(r *EsRepository) {
+		r.labelCodec = codec
+	}
+}
+
 type EsRepository struct {
 	db               *sqlx.DB
 	projectorFactory ProjectorFactory
+	connectAttempts  int
+	connectBackoff   time.Duration
+	labelCodec       eventstore.Codec
+	queryLogger      QueryLogger
+	uniqueViolation  store.UniqueViolationDetector
 }
 
 func NewStore(connString string, options ...StoreOption) (*EsRepository, error) {
@@ -90,20 +138,34 @@ func NewStore(connString string, options ...StoreOption) (*EsRepository, error)
 
 	dbx := sqlx.NewDb(db, driverName)
 	r := &EsRepository{
-		db: dbx,
+		db:              dbx,
+		labelCodec:      eventstore.JSONCodec{},
+		uniqueViolation: IsUniqueViolation,
 	}
 
 	for _, o := range options {
 		o(r)
 	}
 
+	if r.connectAttempts > 0 {
+		err = common.Retry(context.Background(), r.connectAttempts, r.connectBackoff, func() error {
+			return db.Ping()
+		})
+		if err != nil {
+			return nil, faults.Errorf("Unable to connect to the database: %w", err)
+		}
+	}
+
 	return r, nil
 }
 
-func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, uint32, error) {
-	labels, err := json.Marshal(eRec.Labels)
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, []eventstore.Event, error) {
+	if eRec.IdempotencyTTL != nil {
+		return "", nil, faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyStoreUnsupported)
+	}
+	labels, err := eventstore.EncodeLabels(r.labelCodec, eRec.Labels)
 	if err != nil {
-		return "", 0, faults.Wrap(err)
+		return "", nil, err
 	}
 
 	var idempotencyKey *string
@@ -111,52 +173,67 @@ func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecor
 		idempotencyKey = &eRec.IdempotencyKey
 	}
 
-	version := eRec.Version
-	var id string
+	// the external ID column is only required when saving external IDs
+	columns := "id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at, aggregate_id_hash, epoch"
+	params := "?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?"
+	withExternalIDs := hasExternalIDs(eRec)
+	if withExternalIDs {
+		columns += ", external_id"
+		params += ", ?"
+	}
+
+	var events []eventstore.Event
 	err = r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		version := eRec.Version
+		events = make([]eventstore.Event, 0, len(eRec.Details))
 		var projector store.Projector
 		if r.projectorFactory != nil {
 			projector = r.projectorFactory(tx)
 		}
 		for _, e := range eRec.Details {
 			version++
-			id = common.NewEventID(eRec.CreatedAt, eRec.AggregateID, version)
+			id := common.NewEventIDWithNode(eRec.CreatedAt, eRec.AggregateID, version, eRec.NodeID)
 			hash := common.Hash(eRec.AggregateID)
-			_, err = tx.ExecContext(ctx,
-				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at, aggregate_id_hash)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				id, eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, labels, eRec.CreatedAt, int32ring(hash))
+			values := []interface{}{id, eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, labels, eRec.CreatedAt, int32ring(hash), eRec.Epoch}
+			if withExternalIDs {
+				values = append(values, nilIfEmpty(e.ExternalID))
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO events (`+columns+`) VALUES (`+params+`)`, values...)
 
 			if err != nil {
-				if isDup(err) {
-					return eventstore.ErrConcurrentModification
+				if r.uniqueViolation(err) {
+					return r.dupError(ctx, eRec)
 				}
 				return faults.Errorf("Unable to insert event: %w", err)
 			}
 
+			evt := eventstore.Event{
+				ID:               id,
+				AggregateID:      eRec.AggregateID,
+				AggregateIDHash:  hash,
+				AggregateVersion: version,
+				AggregateType:    eRec.AggregateType,
+				Kind:             e.Kind,
+				Body:             e.Body,
+				IdempotencyKey:   eRec.IdempotencyKey,
+				ExternalID:       e.ExternalID,
+				Labels:           eRec.Labels,
+				CreatedAt:        eRec.CreatedAt,
+				Epoch:            eRec.Epoch,
+			}
 			if projector != nil {
-				evt := eventstore.Event{
-					ID:               id,
-					AggregateID:      eRec.AggregateID,
-					AggregateIDHash:  hash,
-					AggregateVersion: version,
-					AggregateType:    eRec.AggregateType,
-					Kind:             e.Kind,
-					Body:             e.Body,
-					Labels:           eRec.Labels,
-					CreatedAt:        eRec.CreatedAt,
-				}
 				projector.Project(evt)
 			}
+			events = append(events, evt)
 		}
 
 		return nil
 	})
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
 
-	return id, version, nil
+	return events[len(events)-1].ID, events, nil
 }
 
 func int32ring(x uint32) int32 {
@@ -170,9 +247,65 @@ func int32ring(x uint32) int32 {
 	return h
 }
 
-func isDup(err error) bool {
+// IsUniqueViolation tells if err is a unique violation reported by the go-sql-driver/mysql driver
+func IsUniqueViolation(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == uniqueViolation
+}
+
+func isFKViolation(err error) bool {
 	me, ok := err.(*mysql.MySQLError)
-	return ok && me.Number == uniqueViolation
+	return ok && me.Number == fkViolation
+}
+
+// dupError tells apart which unique index the save violated:
+// if the idempotency key is already taken the save is a duplicate request, otherwise it is a version conflict.
+// The check is done after the failed insert, so that concurrent saves with the same key are detected atomically by the unique index.
+func (r *EsRepository) dupError(ctx context.Context, eRec eventstore.EventRecord) error {
+	if eRec.IdempotencyKey != "" {
+		found, err := r.HasIdempotencyKey(ctx, eRec.AggregateType, eRec.IdempotencyKey)
+		if err == nil && found {
+			return faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyKeyConflict)
+		}
+	}
+	for _, e := range eRec.Details {
+		if e.ExternalID == "" {
+			continue
+		}
+		_, err := r.GetByExternalID(ctx, e.ExternalID)
+		if err == nil {
+			return faults.Errorf("Unable to save aggregate '%s' with external ID '%s': %w", eRec.AggregateID, e.ExternalID, eventstore.ErrExternalIDConflict)
+		}
+	}
+	return eventstore.ErrConcurrentModification
+}
+
+// hasExternalIDs tells if any of the events of the record has an external ID
+func hasExternalIDs(eRec eventstore.EventRecord) bool {
+	for _, e := range eRec.Details {
+		if e.ExternalID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (r *EsRepository) GetByExternalID(ctx context.Context, externalID string) (eventstore.Event, error) {
+	events, err := r.queryEvents(ctx, "SELECT * FROM events WHERE external_id = ?", externalID)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, eventstore.ErrEventNotFound)
+	}
+	return events[0], nil
 }
 
 func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventstore.Snapshot, error) {
@@ -193,6 +326,23 @@ func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eve
 	}, nil
 }
 
+func (r *EsRepository) GetSnapshotMeta(ctx context.Context, aggregateID string) (eventstore.SnapshotMeta, error) {
+	snap := Snapshot{}
+	if err := r.db.GetContext(ctx, &snap, "SELECT aggregate_version, created_at FROM snapshots WHERE aggregate_id = ? ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return eventstore.SnapshotMeta{}, nil
+		}
+		return eventstore.SnapshotMeta{}, faults.Errorf("Unable to get snapshot metadata for aggregate '%s': %w", aggregateID, err)
+	}
+	return eventstore.SnapshotMeta{
+		Exists:           true,
+		AggregateVersion: snap.AggregateVersion,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+// SaveSnapshot persists the snapshot unless the aggregate already has a snapshot at the same or at a newer version,
+// making the snapshot writes monotonic. Saving the same snapshot again replaces it.
 func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Snapshot) error {
 	s := Snapshot{
 		ID:               snapshot.ID,
@@ -202,11 +352,94 @@ func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Sna
 		Body:             snapshot.Body,
 		CreatedAt:        snapshot.CreatedAt,
 	}
-	_, err := r.db.NamedExecContext(ctx,
+	// serialize the snapshot writers of the same aggregate by a named lock, held until the commit,
+	// since the events that could be locked instead may be gone after a compaction
+	err := r.withNamedLock(ctx, snapshotLockName(s.AggregateID), func(conn *sql.Conn) error {
+		return r.withConnTx(ctx, conn, func(c context.Context, tx *sql.Tx) error {
+			return r.saveSnapshot(c, tx, s)
+		})
+	})
+	if err != nil {
+		if isFKViolation(err) {
+			return faults.Errorf("Unable to save snapshot '%s' of aggregate '%s': %w", s.ID, s.AggregateID, eventstore.ErrSnapshotEventMissing)
+		}
+		return faults.Wrap(err)
+	}
+	return nil
+}
+
+// saveSnapshot inserts the snapshot, unless a newer one exists
+func (r *EsRepository) saveSnapshot(c context.Context, tx *sql.Tx, s Snapshot) error {
+	var newer bool
+	err := tx.QueryRowContext(c,
+		`SELECT EXISTS(SELECT 1 FROM snapshots WHERE aggregate_id = ? AND id <> ? AND aggregate_version >= ?)`,
+		s.AggregateID, s.ID, s.AggregateVersion,
+	).Scan(&newer)
+	if err != nil {
+		return faults.Errorf("Unable to check the snapshots of aggregate '%s': %w", s.AggregateID, err)
+	}
+	if newer {
+		return nil
+	}
+	_, err = tx.ExecContext(c,
 		`INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
-	     VALUES (:id, :aggregate_id, :aggregate_version, :aggregate_type, :body, :created_at)`, s)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE body = VALUES(body), created_at = VALUES(created_at)`,
+		s.ID, s.AggregateID, s.AggregateVersion, s.AggregateType, s.Body, s.CreatedAt,
+	)
+	return err
+}
+
+// snapshotLockTimeout is how long, in seconds, a snapshot writer waits for the writer of the same aggregate
+const snapshotLockTimeout = 10
+
+// snapshotLockName returns the name of the lock of the snapshots of the aggregate, within the 64 characters allowed by MySQL.
+// Aggregates sharing a hash share the lock, only serializing their snapshot writers.
+func snapshotLockName(aggregateID string) string {
+	return fmt.Sprintf("eventstore.snapshots.%d", common.Hash(aggregateID))
+}
+
+// withNamedLock runs fn on a connection holding the named lock, released after fn returns, eg: after a commit
+func (r *EsRepository) withNamedLock(ctx context.Context, name string, fn func(*sql.Conn) error) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, snapshotLockTimeout).Scan(&locked)
+	if err != nil {
+		return faults.Errorf("Unable to acquire lock '%s': %w", name, err)
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return faults.Errorf("Unable to acquire lock '%s' within %d seconds", name, snapshotLockTimeout)
+	}
+	defer func() {
+		// the save context may be done.
+		// If the release fails the session is likely broken, and MySQL releases the lock when it ends.
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+	}()
+
+	return fn(conn)
+}
 
-	return faults.Wrap(err)
+// DropSnapshotForeignKey drops the foreign keys from the snapshots table to the events table.
+// Use it on deployments that compact the events, where the event referenced by a snapshot may be gone.
+func (r *EsRepository) DropSnapshotForeignKey(ctx context.Context) error {
+	names := []string{}
+	err := r.db.SelectContext(ctx, &names, `SELECT CONSTRAINT_NAME FROM information_schema.TABLE_CONSTRAINTS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'snapshots' AND CONSTRAINT_TYPE = 'FOREIGN KEY'`)
+	if err != nil {
+		return faults.Errorf("Unable to list the snapshot foreign keys: %w", err)
+	}
+	for _, name := range names {
+		_, err = r.db.ExecContext(ctx, "ALTER TABLE snapshots DROP FOREIGN KEY `"+name+"`")
+		if err != nil {
+			return faults.Errorf("Unable to drop the snapshot foreign key '%s': %w", name, err)
+		}
+	}
+	return nil
 }
 
 func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventstore.Event, error) {
@@ -227,8 +460,37 @@ func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID strin
 	return events, nil
 }
 
-func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) (err error) {
-	tx, err := r.db.BeginTx(ctx, nil)
+func (r *EsRepository) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	var version uint32
+	err := r.db.GetContext(ctx, &version, "SELECT COALESCE(MAX(aggregate_version), 0) FROM events WHERE aggregate_id = ?", aggregateID)
+	if err != nil {
+		return 0, faults.Errorf("Unable to get the current version of aggregate '%s': %w", aggregateID, err)
+	}
+	return version, nil
+}
+
+func (r *EsRepository) GetCreationEvent(ctx context.Context, aggregateID string) (eventstore.Event, error) {
+	events, err := r.queryEvents(ctx, "SELECT * FROM events e WHERE e.aggregate_id = ? AND e.aggregate_version = 1", aggregateID)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, eventstore.ErrAggregateNotFound)
+	}
+	return events[0], nil
+}
+
+func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) error {
+	return r.withConnTx(ctx, r.db, fn)
+}
+
+// txBeginner is a *sql.DB or a *sql.Conn
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func (r *EsRepository) withConnTx(ctx context.Context, conn txBeginner, fn func(context.Context, *sql.Tx) error) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		return faults.Wrap(err)
 	}
@@ -302,16 +564,17 @@ func (r *EsRepository) Forget(ctx context.Context, request eventstore.ForgetRequ
 
 func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
 	var query bytes.Buffer
-	query.WriteString("SELECT * FROM events ")
+	query.WriteString("SELECT id FROM events WHERE 1 = 1 ")
 	args := []interface{}{}
 	if trailingLag != time.Duration(0) {
 		safetyMargin := time.Now().UTC().Add(-trailingLag)
 		args = append(args, safetyMargin)
-		query.WriteString("created_at <= ? ")
+		query.WriteString("AND created_at <= ? ")
 	}
 	args = buildFilter(filter, &query, args)
 	query.WriteString(" ORDER BY id DESC LIMIT 1")
 	var eventID string
+	r.logQuery(query.String(), args)
 	if err := r.db.GetContext(ctx, &eventID, query.String(), args...); err != nil {
 		if err != sql.ErrNoRows {
 			return "", faults.Errorf("Unable to get the last event ID: %w", err)
@@ -322,9 +585,10 @@ func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Dura
 
 func (r *EsRepository) GetEvents(ctx context.Context, afterEventID string, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
 	var records []eventstore.Event
-	for len(records) < batchSize {
+	// with no batch size, all the events are read in a single pass
+	for batchSize <= 0 || len(records) < batchSize {
 		var query bytes.Buffer
-		query.WriteString("SELECT * FROM events WHERE id > ? ")
+		query.WriteString("SELECT " + selectColumns(filter.Projection) + " FROM events WHERE id > ? ")
 		args := []interface{}{afterEventID}
 		if trailingLag != time.Duration(0) {
 			safetyMargin := time.Now().UTC().Add(-trailingLag)
@@ -335,24 +599,95 @@ func (r *EsRepository) GetEvents(ctx context.Context, afterEventID string, batch
 		query.WriteString(" ORDER BY id ASC")
 		if batchSize > 0 {
 			query.WriteString(" LIMIT ")
-			query.WriteString(strconv.Itoa(batchSize))
+			query.WriteString(strconv.Itoa(batchSize - len(records)))
 		}
 
+		r.logQuery(query.String(), args)
 		rows, err := r.queryEvents(ctx, query.String(), args...)
 		if err != nil {
-			return nil, faults.Errorf("Unable to get events after '%s' for filter %+v: %w", afterEventID, filter, err)
+			err = faults.Errorf("Unable to get events after '%s' for filter %+v: %w", afterEventID, filter, err)
+			// the events of the previous passes were read, so they are returned too
+			records = append(records, rows...)
+			if filter.PartialResults && len(records) > 0 {
+				return records, err
+			}
+			return nil, err
 		}
 		if len(rows) == 0 {
 			return records, nil
 		}
 
 		afterEventID = rows[len(rows)-1].ID
-		records = append(rows)
+		records = append(records, rows...)
+		if batchSize <= 0 {
+			break
+		}
 	}
 	return records, nil
 }
 
+// CountEvents counts the events matching the filter.
+// With filter.ApproximateCount and no conditions, the estimate of the table statistics is returned instead.
+func (r *EsRepository) CountEvents(ctx context.Context, filter store.Filter) (int64, error) {
+	var count int64
+	if filter.ApproximateCount && !filter.HasConditions() {
+		err := r.db.GetContext(ctx, &count, "SELECT COALESCE(TABLE_ROWS, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'events'")
+		if err != nil {
+			return 0, faults.Errorf("Unable to estimate the number of events: %w", err)
+		}
+		return count, nil
+	}
+
+	var query bytes.Buffer
+	query.WriteString("SELECT count(*) FROM events WHERE 1 = 1 ")
+	args := buildFilter(filter, &query, []interface{}{})
+	r.logQuery(query.String(), args)
+	if err := r.db.GetContext(ctx, &count, query.String(), args...); err != nil {
+		return 0, faults.Errorf("Unable to count events for filter %+v: %w", filter, err)
+	}
+	return count, nil
+}
+
+func (r *EsRepository) ChangedAggregates(ctx context.Context, since time.Time, filter store.Filter) ([]store.AggregateRef, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT aggregate_id, aggregate_type, MAX(aggregate_version) AS version FROM events WHERE created_at >= ? ")
+	args := buildFilter(filter, &query, []interface{}{since.UTC()})
+	query.WriteString(" GROUP BY aggregate_id, aggregate_type ORDER BY aggregate_id")
+	r.logQuery(query.String(), args)
+
+	refs := []aggregateRef{}
+	if err := r.db.SelectContext(ctx, &refs, query.String(), args...); err != nil {
+		return nil, faults.Errorf("Unable to get the aggregates changed since %s for filter %+v: %w", since, filter, err)
+	}
+	return toAggregateRefs(refs), nil
+}
+
+type aggregateRef struct {
+	AggregateID   string `db:"aggregate_id"`
+	AggregateType string `db:"aggregate_type"`
+	Version       uint32 `db:"version"`
+}
+
+func toAggregateRefs(refs []aggregateRef) []store.AggregateRef {
+	result := make([]store.AggregateRef, len(refs))
+	for k, v := range refs {
+		result[k] = store.AggregateRef(v)
+	}
+	return result
+}
+
+func (r *EsRepository) logQuery(query string, args []interface{}) {
+	if r.queryLogger != nil {
+		r.queryLogger(query, args)
+	}
+}
+
 func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) []interface{} {
+	if filter.UpperBound != "" {
+		args = append(args, filter.UpperBound)
+		query.WriteString(" AND id <= ?")
+	}
+
 	if len(filter.AggregateTypes) > 0 {
 		query.WriteString(" AND (")
 		for k, v := range filter.AggregateTypes {
@@ -365,6 +700,13 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 		query.WriteString(")")
 	}
 
+	if len(filter.ExternalIDs) > 0 {
+		query.WriteString(" AND external_id IN (?" + strings.Repeat(", ?", len(filter.ExternalIDs)-1) + ")")
+		for _, v := range filter.ExternalIDs {
+			args = append(args, v)
+		}
+	}
+
 	if filter.Partitions > 1 {
 		if filter.PartitionLow == filter.PartitionHi {
 			args = append(args, filter.Partitions, filter.PartitionLow-1)
@@ -389,9 +731,25 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 			}
 		}
 	}
+
+	for k, values := range filter.ExcludeLabels {
+		for _, v := range values {
+			args = append(args, fmt.Sprintf(`$."%s"`, k), v)
+			// events without labels are kept
+			query.WriteString(" AND NOT COALESCE(JSON_UNQUOTE(JSON_EXTRACT(labels, ?)) = ?, FALSE)")
+		}
+	}
 	return args
 }
 
+// selectColumns returns the columns to select for the projection
+func selectColumns(p store.Projection) string {
+	if p == store.MinimalProjection {
+		return "id, aggregate_id, aggregate_version, kind, body, created_at"
+	}
+	return "*"
+}
+
 func escape(s string) string {
 	return strings.ReplaceAll(s, "'", "''")
 }
@@ -404,17 +762,19 @@ func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...in
 		}
 		return nil, faults.Errorf("Unable to query events: %w", err)
 	}
+	defer rows.Close()
+	// on failure, the events read so far are also returned
 	events := []eventstore.Event{}
 	for rows.Next() {
 		pg := Event{}
 		err := rows.StructScan(&pg)
 		if err != nil {
-			return nil, faults.Errorf("Unable to scan to struct: %w", err)
+			return events, faults.Errorf("Unable to scan to struct: %w", err)
 		}
 		labels := map[string]interface{}{}
-		err = json.Unmarshal(pg.Labels, &labels)
+		err = eventstore.DecodeLabels(r.labelCodec, pg.Labels, labels)
 		if err != nil {
-			return nil, faults.Errorf("Unable to unmarshal labels to map: %w", err)
+			return events, faults.Errorf("Unable to unmarshal labels of event '%s' to map: %w", pg.ID, err)
 		}
 
 		events = append(events, eventstore.Event{
@@ -425,9 +785,15 @@ func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...in
 			AggregateType:    pg.AggregateType,
 			Kind:             pg.Kind,
 			Body:             pg.Body,
+			IdempotencyKey:   string(pg.IdempotencyKey),
+			ExternalID:       string(pg.ExternalID),
 			Labels:           labels,
 			CreatedAt:        pg.CreatedAt,
+			Epoch:            pg.Epoch,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		return events, faults.Errorf("Unable to iterate events: %w", err)
+	}
 	return events, nil
 }
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+)
+
+// Pauser pauses and resumes the forwarding of events to a sinker.
+// While paused, the sinking blocks, stalling the feed without tearing down the source connection,
+// so that resuming continues from where it stopped.
+type Pauser struct {
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+func NewPauser() *Pauser {
+	return &Pauser{}
+}
+
+// Pause stops the forwarding of events. Events being sinked are not interrupted.
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resume == nil {
+		p.resume = make(chan struct{})
+	}
+}
+
+// Resume restarts the forwarding of events
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+	}
+}
+
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resume != nil
+}
+
+// Wait blocks while paused or until the context is done
+func (p *Pauser) Wait(ctx context.Context) error {
+	p.mu.Lock()
+	resume := p.resume
+	p.mu.Unlock()
+	if resume == nil {
+		return nil
+	}
+
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wrap returns a sinker that waits while paused, before sinking
+func (p *Pauser) Wrap(sinker sink.Sinker) sink.Sinker {
+	return pausableSinker{
+		Sinker: sinker,
+		pauser: p,
+	}
+}
+
+type pausableSinker struct {
+	sink.Sinker
+	pauser *Pauser
+}
+
+func (s pausableSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	if err := s.pauser.Wait(ctx); err != nil {
+		return err
+	}
+	return s.Sinker.Sink(ctx, e)
+}
+
+func (s pausableSinker) Flush(ctx context.Context) error {
+	return sink.Flush(ctx, s.Sinker)
+}
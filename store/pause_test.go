@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauser(t *testing.T) {
+	sinked := make(chan string, 10)
+	p := NewPauser()
+	sinker := p.Wrap(sink.SinkerFunc(func(ctx context.Context, e eventstore.Event) error {
+		sinked <- e.ID
+		return nil
+	}))
+
+	ctx := context.Background()
+	require.NoError(t, sinker.Sink(ctx, eventstore.Event{ID: "A"}))
+	assert.Equal(t, "A", <-sinked)
+
+	p.Pause()
+	assert.True(t, p.Paused())
+	go sinker.Sink(ctx, eventstore.Event{ID: "B"})
+	select {
+	case <-sinked:
+		t.Fatal("event was sinked while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p.Resume()
+	assert.False(t, p.Paused())
+	select {
+	case id := <-sinked:
+		assert.Equal(t, "B", id)
+	case <-time.After(time.Second):
+		t.Fatal("event was not sinked after resuming")
+	}
+
+	p.Pause()
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err := sinker.Sink(ctx, eventstore.Event{ID: "C"})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,93 @@
+package poller
+
+import (
+	"context"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+)
+
+// Ack resolves, with nil or an error, when an event is handled asynchronously.
+type Ack <-chan error
+
+// Acked returns an already resolved Ack
+func Acked(err error) Ack {
+	ch := make(chan error, 1)
+	ch <- err
+	return ch
+}
+
+// AckHandlerFunc starts handling the event, eg: in a goroutine pool, returning an Ack that resolves when the handling is done
+type AckHandlerFunc func(ctx context.Context, e eventstore.Event) Ack
+
+type pendingAck struct {
+	eventID string
+	ack     Ack
+}
+
+// PollWithAck polls the events, handing them to an asynchronous handler, with up to WithMaxInFlight events waiting for their ack.
+// The position only advances over events whose ack, and the acks of all the events before them, resolved without error,
+// so that concurrent handling preserves the at least once delivery.
+// On a failed ack, the events are fetched again from the last position.
+func (p Poller) PollWithAck(ctx context.Context, startOption player.StartOption, handler AckHandlerFunc) error {
+	afterEventID, err := p.startAt(ctx, startOption)
+	if err != nil {
+		return err
+	}
+	handler = p.recoveringAck(handler)
+	return p.poll(ctx, afterEventID, func(ctx context.Context, afterEventID string, filters ...store.FilterOption) (string, error) {
+		return p.replayWithAck(ctx, handler, afterEventID, filters...)
+	})
+}
+
+func (p Poller) replayWithAck(ctx context.Context, handler AckHandlerFunc, afterEventID string, filters ...store.FilterOption) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slots := make(chan struct{}, p.maxInFlight)
+	pending := make(chan pendingAck, p.maxInFlight)
+	acked := afterEventID
+	var errAck error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// acks are collected in order, so that the position never skips an unresolved event
+		for pa := range pending {
+			if errAck == nil {
+				select {
+				case err := <-pa.ack:
+					if err != nil {
+						errAck = err
+						cancel()
+					} else {
+						acked = pa.eventID
+					}
+				case <-ctx.Done():
+					errAck = ctx.Err()
+				}
+			}
+			<-slots
+		}
+	}()
+
+	eid, err := p.play.Replay(ctx, func(ctx context.Context, e eventstore.Event) error {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		pending <- pendingAck{eventID: store.EventPosition(e), ack: handler(ctx, e)}
+		return nil
+	}, afterEventID, filters...)
+	close(pending)
+	<-done
+
+	if errAck != nil {
+		return acked, errAck
+	}
+	if err != nil {
+		return acked, err
+	}
+	return eid, nil
+}
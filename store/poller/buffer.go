@@ -3,11 +3,19 @@ package poller
 import (
 	"container/list"
 	"context"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/quintans/eventstore"
 	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+var (
+	ErrRewindAhead       = store.ErrRewindAhead
+	ErrRewindOutOfBuffer = errors.New("rewind target is no longer in the buffer")
 )
 
 // Buffer manager a list of events.
@@ -21,19 +29,55 @@ type Buffer struct {
 	poller    Poller
 	wait      chan struct{}
 	drainer   *Consumer
+	maxBuffer int
+	// stalled signals that the buffer is full and waiting for the slowest consumer to move forward
+	stalled bool
+	// tail is the position of the slowest consumer on the last trim, empty if a consumer did not consume any event yet
+	tail string
+	// idle pauses the poller while there are no consumers, if not nil
+	idle *store.Pauser
+}
+
+type BufferOption func(*Buffer)
+
+// WithMaxBuffer limits the number of events buffered ahead of the slowest consumer.
+// When the limit is reached, the buffer stops pulling events from the poller, applying backpressure,
+// instead of growing the memory.
+// The trade-off is that a stalled slow consumer throttles all the other consumers.
+func WithMaxBuffer(n int) BufferOption {
+	return func(b *Buffer) {
+		b.maxBuffer = n
+	}
+}
+
+// WithPauseWhenIdle stops the poller from querying the store while there are no consumers attached,
+// resuming when a consumer attaches.
+func WithPauseWhenIdle() BufferOption {
+	return func(b *Buffer) {
+		b.idle = store.NewPauser()
+	}
 }
 
 func NewBufferedPoller(r player.Repository, options ...Option) *Buffer {
 	return NewBuffer(New(r, options...))
 }
 
-func NewBuffer(p Poller) *Buffer {
+func NewBuffer(p Poller, options ...BufferOption) *Buffer {
 	b := &Buffer{
 		events:    list.New(),
 		consumers: list.New(),
 		eventsCh:  make(chan eventstore.Event, 1),
 		poller:    p,
 	}
+	for _, o := range options {
+		o(b)
+	}
+	if b.idle != nil {
+		b.idle.Pause()
+		// in addition to the pauser of the poller, if any, without changing the pausers of the copies of the poller
+		pausers := b.poller.pausers
+		b.poller.pausers = append(pausers[:len(pausers):len(pausers)], b.idle)
+	}
 	// when there are no other consumers, the drainer consumer kicks in to move the events forward
 	b.drainer = b.NewConsumer("__drainer__", func(ctx context.Context, e eventstore.Event) error {
 		return nil
@@ -68,6 +112,8 @@ func (b *Buffer) next(e *list.Element) (*list.Element, chan struct{}) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	b.trim()
+
 	var n *list.Element
 	if e == nil {
 		n = b.events.Front()
@@ -75,7 +121,7 @@ func (b *Buffer) next(e *list.Element) (*list.Element, chan struct{}) {
 		n = e.Next()
 	}
 
-	if n == nil {
+	if n == nil && !b.isFull() {
 		select {
 		case evt := <-b.eventsCh:
 			n = b.pushEvent(evt)
@@ -89,6 +135,11 @@ func (b *Buffer) next(e *list.Element) (*list.Element, chan struct{}) {
 		}
 
 		b.wait = make(chan struct{})
+		if b.isFull() {
+			// wait for the slowest consumer to move forward
+			b.stalled = true
+			return nil, b.wait
+		}
 		// wait for an available event
 		go func() {
 			evt := <-b.eventsCh
@@ -99,27 +150,59 @@ func (b *Buffer) next(e *list.Element) (*list.Element, chan struct{}) {
 		}()
 	}
 
+	return n, b.wait
+}
+
+// trim removes the events already consumed by all the consumers,
+// waking the consumers stalled by a full buffer if it is no longer full
+func (b *Buffer) trim() {
 	// tail event
 	tail := ""
 	for e := b.consumers.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*Consumer)
 		eID := v.EventID()
+		if eID == "" {
+			// this consumer did not consume any event yet, so it still needs all the events
+			tail = ""
+			break
+		}
 		if tail == "" || eID < tail {
 			tail = eID
 		}
 	}
+	b.tail = tail
 
-	// trim buffer
-	for e := b.events.Front(); e != nil; e = e.Next() {
-		evt := e.Value.(eventstore.Event)
-		if evt.ID < tail {
-			b.events.Remove(e)
-		} else {
-			break
+	if tail != "" {
+		var next *list.Element
+		for e := b.events.Front(); e != nil; e = next {
+			next = e.Next()
+			evt := e.Value.(eventstore.Event)
+			if store.EventPosition(evt) < tail {
+				b.events.Remove(e)
+			} else {
+				break
+			}
 		}
 	}
 
-	return n, b.wait
+	if b.stalled && !b.isFull() {
+		b.stalled = false
+		close(b.wait)
+		b.wait = nil
+	}
+}
+
+// isFull checks if the events ahead of the slowest consumer reached the maximum
+func (b *Buffer) isFull() bool {
+	if b.maxBuffer <= 0 {
+		return false
+	}
+	ahead := b.events.Len()
+	// the last event consumed by the slowest consumer is kept, to move to the next one
+	if front := b.events.Front(); front != nil && b.tail != "" && store.EventPosition(front.Value.(eventstore.Event)) <= b.tail {
+		ahead--
+	}
+	return ahead >= b.maxBuffer
 }
 
 func (b *Buffer) pushEvent(evt eventstore.Event) *list.Element {
@@ -128,6 +211,7 @@ func (b *Buffer) pushEvent(evt eventstore.Event) *list.Element {
 		close(b.wait)
 	}
 	b.wait = nil
+	b.stalled = false
 	return e
 }
 
@@ -137,6 +221,7 @@ func (b *Buffer) NewConsumer(name string, handler player.EventHandlerFunc, aggre
 		handler:         handler,
 		buffer:          b,
 		aggregateFilter: aggregateFilter,
+		rewound:         make(chan struct{}, 1),
 	}
 	return consu
 }
@@ -159,6 +244,9 @@ func (b *Buffer) register(consu *Consumer) {
 	if first {
 		go b.drainer.Stop()
 	}
+	if b.idle != nil && consu != b.drainer {
+		b.idle.Resume()
+	}
 }
 
 func (b *Buffer) seek(consu *Consumer, startAt string) {
@@ -175,7 +263,7 @@ func (b *Buffer) seek(consu *Consumer, startAt string) {
 	if startAt != "" {
 		for elem := e; elem != nil; elem = elem.Next() {
 			evt := elem.Value.(eventstore.Event)
-			if evt.ID >= startAt {
+			if store.EventPosition(evt) >= startAt {
 				e = elem
 				break
 			}
@@ -184,6 +272,42 @@ func (b *Buffer) seek(consu *Consumer, startAt string) {
 	consu.fifo = e
 }
 
+func (b *Buffer) rewind(consu *Consumer, toEventID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	consu.mu.Lock()
+	defer consu.mu.Unlock()
+
+	if consu.fifo == nil {
+		return faults.Errorf("Unable to rewind consumer '%s' to '%s' since it did not consume any event: %w", consu.name, toEventID, ErrRewindAhead)
+	}
+	current := store.EventPosition(consu.fifo.Value.(eventstore.Event))
+	if toEventID > current {
+		return faults.Errorf("Unable to rewind consumer '%s' to '%s', after the current position '%s': %w", consu.name, toEventID, current, ErrRewindAhead)
+	}
+
+	// the last event that is not after the target
+	var target *list.Element
+	for elem := b.events.Front(); elem != nil; elem = elem.Next() {
+		if store.EventPosition(elem.Value.(eventstore.Event)) > toEventID {
+			break
+		}
+		target = elem
+	}
+	if target == nil {
+		return faults.Errorf("Unable to rewind consumer '%s' to '%s': %w", consu.name, toEventID, ErrRewindOutOfBuffer)
+	}
+
+	consu.fifo = target
+	consu.generation++
+	select {
+	case consu.rewound <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
 func (b *Buffer) unregister(consu *Consumer) {
 	b.mu.Lock()
 
@@ -192,9 +316,16 @@ func (b *Buffer) unregister(consu *Consumer) {
 		consu.consumer = nil
 	}
 	last := b.consumers.Len() == 0
+	if !last {
+		// the removed consumer may be the slowest one
+		b.trim()
+	}
 	b.mu.Unlock()
 
 	if last {
+		if b.idle != nil {
+			b.idle.Pause()
+		}
 		go b.drainer.Start()
 	}
 }
@@ -208,6 +339,9 @@ type Consumer struct {
 	quit            chan struct{}
 	consumer        *list.Element
 	aggregateFilter []string
+	// generation is incremented on every rewind, so that an event being handled does not override the rewound position
+	generation uint64
+	rewound    chan struct{}
 }
 
 func (c *Consumer) Name() string {
@@ -222,7 +356,7 @@ func (c *Consumer) EventID() string {
 		return ""
 	}
 	e := c.fifo.Value.(eventstore.Event)
-	return e.ID
+	return store.EventPosition(e)
 }
 
 func (c *Consumer) Attach() {
@@ -252,26 +386,42 @@ func (c *Consumer) Resume(startAt string) {
 	c.mu.Unlock()
 
 	for {
-		e, wait := c.buffer.next(c.fifo)
+		c.mu.Lock()
+		fifo := c.fifo
+		generation := c.generation
+		c.mu.Unlock()
+
+		e, wait := c.buffer.next(fifo)
 		// it is only nil when closing
 		if e == nil {
 			select {
 			case <-wait:
+			case <-c.rewound:
 			case <-quit:
 				return
 			}
 		} else {
 			evt := e.Value.(eventstore.Event)
-			if evt.ID > startAt && allowEvent(evt, c.aggregateFilter) {
+			if store.EventPosition(evt) > startAt && allowEvent(evt, c.aggregateFilter) {
 				c.handler(context.Background(), evt)
 			}
 			c.mu.Lock()
-			c.fifo = e
+			if c.generation == generation {
+				c.fifo = e
+			}
 			c.mu.Unlock()
 		}
 	}
 }
 
+// Rewind moves the consumer back, so that the events after toEventID are handled again.
+// The target cannot be ahead of the current position and must still be in the buffer,
+// otherwise ErrRewindAhead or ErrRewindOutOfBuffer is returned.
+// Events before the start position of Resume are never handled.
+func (c *Consumer) Rewind(ctx context.Context, toEventID string) error {
+	return c.buffer.rewind(c, toEventID)
+}
+
 // Stop stops collecting
 func (c *Consumer) Stop() {
 	c.buffer.unregister(c)
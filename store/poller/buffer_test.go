@@ -2,6 +2,8 @@ package poller
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -458,3 +460,325 @@ func TestRestartConsumer(t *testing.T) {
 	assert.Equal(t, []string{"C", "D", "E", "F", "G", "H", "I", "J", "K", "L"}, firstIDs, "First IDs: %s", firstIDs)
 	assert.Equal(t, []string{"A", "B", "C", "D", "J", "K", "L"}, secondIDs, "Second IDs: %s", secondIDs)
 }
+
+func TestBufferWithMaxBuffer(t *testing.T) {
+	t.Parallel()
+
+	const maxBuffer = 5
+	const total = 50
+	b := NewBuffer(New(NewMockRepo()), WithMaxBuffer(maxBuffer))
+
+	var mu sync.Mutex
+	fastIDs := []string{}
+	fast := b.NewConsumer("fast", func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		fastIDs = append(fastIDs, e.ID)
+		return nil
+	})
+	go fast.Start()
+
+	release := make(chan struct{})
+	stalled := b.NewConsumer("stalled", func(ctx context.Context, e eventstore.Event) error {
+		<-release
+		return nil
+	})
+	go stalled.Start()
+
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < total; i++ {
+			b.eventsCh <- eventstore.Event{ID: fmt.Sprintf("%03d", i), AggregateID: "1", AggregateType: "Test"}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	b.mu.Lock()
+	size := b.events.Len()
+	b.mu.Unlock()
+	assert.Equal(t, maxBuffer, size, "buffer size")
+	mu.Lock()
+	assert.Len(t, fastIDs, maxBuffer, "fast consumer should be throttled")
+	mu.Unlock()
+
+	close(release)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(fastIDs) == total
+	}, time.Second, 10*time.Millisecond)
+
+	fast.Stop()
+	stalled.Stop()
+}
+
+func TestBufferWithMaxBufferAfterConsumed(t *testing.T) {
+	t.Parallel()
+
+	const maxBuffer = 5
+	const total = 50
+	b := NewBuffer(New(NewMockRepo()), WithMaxBuffer(maxBuffer))
+
+	var mu sync.Mutex
+	fastIDs := []string{}
+	fast := b.NewConsumer("fast", func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		fastIDs = append(fastIDs, e.ID)
+		return nil
+	})
+	go fast.Start()
+
+	// consumes the first 2 events and stalls on the third
+	release := make(chan struct{})
+	stalled := b.NewConsumer("stalled", func(ctx context.Context, e eventstore.Event) error {
+		if e.ID >= "002" {
+			<-release
+		}
+		return nil
+	})
+	go stalled.Start()
+
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < total; i++ {
+			b.eventsCh <- eventstore.Event{ID: fmt.Sprintf("%03d", i), AggregateID: "1", AggregateType: "Test"}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// the last event consumed by the stalled consumer is kept, followed by the events ahead of it
+	b.mu.Lock()
+	size := b.events.Len()
+	b.mu.Unlock()
+	assert.Equal(t, maxBuffer+1, size, "buffer size")
+	mu.Lock()
+	assert.Len(t, fastIDs, 2+maxBuffer, "fast consumer should be throttled")
+	mu.Unlock()
+
+	close(release)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(fastIDs) == total
+	}, time.Second, 10*time.Millisecond)
+
+	fast.Stop()
+	stalled.Stop()
+}
+
+func TestBufferStopStalledConsumer(t *testing.T) {
+	t.Parallel()
+
+	const maxBuffer = 5
+	const total = 50
+	b := NewBuffer(New(NewMockRepo()), WithMaxBuffer(maxBuffer))
+
+	var mu sync.Mutex
+	fastIDs := []string{}
+	fast := b.NewConsumer("fast", func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		fastIDs = append(fastIDs, e.ID)
+		return nil
+	})
+	go fast.Start()
+
+	// never consumes its first event, so it has no position
+	release := make(chan struct{})
+	defer close(release)
+	stalled := b.NewConsumer("stalled", func(ctx context.Context, e eventstore.Event) error {
+		<-release
+		return nil
+	})
+	go stalled.Start()
+
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < total; i++ {
+			b.eventsCh <- eventstore.Event{ID: fmt.Sprintf("%03d", i), AggregateID: "1", AggregateType: "Test"}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	assert.Len(t, fastIDs, maxBuffer, "fast consumer should be throttled")
+	mu.Unlock()
+
+	// the remaining consumer moves forward without the stalled one
+	stalled.Stop()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(fastIDs) == total
+	}, time.Second, 10*time.Millisecond)
+
+	b.mu.Lock()
+	size := b.events.Len()
+	b.mu.Unlock()
+	assert.Equal(t, 1, size, "buffer size")
+
+	fast.Stop()
+}
+
+func TestConsumerRewind(t *testing.T) {
+	t.Parallel()
+
+	b := NewBuffer(New(NewMockRepo()))
+
+	var mu sync.Mutex
+	ids := []string{}
+	consumer := b.NewConsumer("consumer", func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, e.ID)
+		return nil
+	})
+	go consumer.Start()
+
+	// holds the events in the buffer
+	release := make(chan struct{})
+	defer close(release)
+	pin := b.NewConsumer("pin", func(ctx context.Context, e eventstore.Event) error {
+		<-release
+		return nil
+	})
+	go pin.Start()
+
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			b.eventsCh <- eventstore.Event{ID: fmt.Sprintf("%03d", i), AggregateID: "1", AggregateType: "Test"}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ids) == 5
+	}, time.Second, 10*time.Millisecond)
+
+	ctx := context.Background()
+	err := consumer.Rewind(ctx, "005")
+	require.True(t, errors.Is(err, ErrRewindAhead), "expected rewind ahead, got %v", err)
+
+	err = consumer.Rewind(ctx, "002")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ids) == 7
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []string{"000", "001", "002", "003", "004", "003", "004"}, ids)
+	mu.Unlock()
+}
+
+// countingRepo counts the event queries
+type countingRepo struct {
+	*MockRepo
+	mu      sync.Mutex
+	queries int
+}
+
+func (r *countingRepo) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	r.mu.Lock()
+	r.queries++
+	r.mu.Unlock()
+	return r.MockRepo.GetEvents(ctx, afterEventID, limit, trailingLag, filter)
+}
+
+func (r *countingRepo) Queries() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries
+}
+
+func TestBufferPauseWhenIdle(t *testing.T) {
+	t.Parallel()
+
+	r := &countingRepo{MockRepo: NewMockRepo()}
+	b := NewBuffer(New(r, WithPollInterval(10*time.Millisecond)), WithPauseWhenIdle())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Start(ctx, pollInterval, "")
+
+	// no consumers yet
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, r.Queries())
+
+	var mu sync.Mutex
+	ids := []string{}
+	consumer := b.NewConsumer("consumer", func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, e.ID)
+		return nil
+	})
+	go consumer.Start()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ids) == len(events1)
+	}, time.Second, 10*time.Millisecond)
+	assert.Greater(t, r.Queries(), 0)
+
+	consumer.Stop()
+	// an in flight poll may still complete
+	time.Sleep(50 * time.Millisecond)
+	stopped := r.Queries()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, stopped, r.Queries(), "polling should stop without consumers")
+
+	// polling resumes when a consumer attaches
+	other := b.NewConsumer("other", func(ctx context.Context, e eventstore.Event) error {
+		return nil
+	})
+	go other.Start()
+	require.Eventually(t, func() bool {
+		return r.Queries() > stopped
+	}, time.Second, 10*time.Millisecond)
+	other.Stop()
+}
+
+func TestBufferPauseWhenIdleKeepsPauser(t *testing.T) {
+	t.Parallel()
+
+	r := &countingRepo{MockRepo: NewMockRepo()}
+	pauser := store.NewPauser()
+	pauser.Pause()
+	b := NewBuffer(New(r, WithPollInterval(10*time.Millisecond), WithPauser(pauser)), WithPauseWhenIdle())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Start(ctx, pollInterval, "")
+
+	consumer := b.NewConsumer("consumer", func(ctx context.Context, e eventstore.Event) error {
+		return nil
+	})
+	go consumer.Start()
+	defer consumer.Stop()
+
+	// a consumer attached but the pauser of the poller is still paused
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, r.Queries())
+
+	pauser.Resume()
+	require.Eventually(t, func() bool {
+		return r.Queries() > 0
+	}, time.Second, 10*time.Millisecond)
+}
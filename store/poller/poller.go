@@ -1,14 +1,16 @@
 package poller
 
 import (
-	"bytes"
 	"context"
 	"time"
 
 	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
 	"github.com/quintans/eventstore/player"
 	"github.com/quintans/eventstore/sink"
 	"github.com/quintans/eventstore/store"
+	"github.com/quintans/eventstore/worker"
+	"github.com/quintans/faults"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,6 +18,19 @@ const (
 	maxWait = time.Minute
 )
 
+// DeliveryGuarantee defines when the position of the poller advances, relative to the handling of an event
+type DeliveryGuarantee int
+
+const (
+	// AtLeastOnce advances the position after the event is successfully handled.
+	// If the handler fails, the events are fetched again, from the last position, and redelivered.
+	AtLeastOnce DeliveryGuarantee = iota
+	// AtMostOnce advances the position before the event is handled.
+	// If the handler fails, the event is never redelivered.
+	// This suits consumers that prefer losing an event over handling it twice, eg: live metric counters.
+	AtMostOnce
+)
+
 type Poller struct {
 	store        player.Repository
 	pollInterval time.Duration
@@ -25,9 +40,21 @@ type Poller struct {
 	trailingLag    time.Duration
 	aggregateTypes []string
 	labels         store.Labels
-	partitions     uint32
-	partitionsLow  uint32
-	partitionsHi   uint32
+	excludeLabels  store.Labels
+	upperBound     string
+	// pausers stop the polling while any of them is paused
+	pausers       []*store.Pauser
+	partitions    uint32
+	partitionsLow uint32
+	partitionsHi  uint32
+	progress      store.PartitionProgress
+	guarantee     DeliveryGuarantee
+	maxInFlight   int
+	maxFailures   int
+	recover       bool
+	deadLetter    DeadLetterFunc
+	maxAge        time.Duration
+	batchHandler  player.BatchHandler
 }
 
 type Option func(*Poller)
@@ -60,6 +87,58 @@ func WithPartitions(partitions, partitionsLow, partitionsHi uint32) Option {
 	}
 }
 
+// WithPartitionProgress reports, at every interval, the last event fed for the partition range
+func WithPartitionProgress(interval time.Duration, fn store.OnPartitionProgress) Option {
+	return func(p *Poller) {
+		p.progress = store.PartitionProgress{Interval: interval, Callback: fn}
+	}
+}
+
+// WithDeliveryGuarantee sets the delivery guarantee of Poll and Feed. Default is AtLeastOnce.
+// Events grouped by aggregate (see WithGroupByAggregate) are always delivered at least once.
+func WithDeliveryGuarantee(guarantee DeliveryGuarantee) Option {
+	return func(p *Poller) {
+		p.guarantee = guarantee
+	}
+}
+
+// WithMaxInFlight sets the maximum number of events, handled by PollWithAck, waiting for their ack. Default is 10.
+func WithMaxInFlight(max int) Option {
+	return func(p *Poller) {
+		if max > 0 {
+			p.maxInFlight = max
+		}
+	}
+}
+
+// WithMaxConsecutiveFailures makes polling return the last error after max consecutive failures,
+// so that a supervising process can decide what to do, eg: on revoked credentials.
+// By default, polling retries forever.
+func WithMaxConsecutiveFailures(max int) Option {
+	return func(p *Poller) {
+		p.maxFailures = max
+	}
+}
+
+// WithMaxAge makes a consumer without a position, ie: polling from the beginning or feeding an empty sink,
+// start at the events created maxAge ago, instead of replaying the whole store.
+// The start is relative to when polling starts, and the events older than the cap are never seen by such a consumer.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(p *Poller) {
+		p.maxAge = maxAge
+	}
+}
+
+// WithGroupByAggregate makes Poll group the events of each fetched batch by aggregate, preserving their order,
+// and call handler with the events of each aggregate, instead of the event handler of Poll.
+// This is useful for projections that can process all the pending events of an aggregate at once, eg: a single upsert of the final state.
+// The position only advances to the last event of a batch after all its groups are successfully handled.
+func WithGroupByAggregate(handler player.BatchHandler) Option {
+	return func(p *Poller) {
+		p.batchHandler = handler
+	}
+}
+
 func WithAggregateTypes(at ...string) Option {
 	return func(f *Poller) {
 		f.aggregateTypes = at
@@ -87,12 +166,35 @@ func WithLabels(labels store.Labels) Option {
 	}
 }
 
+// WithExcludeLabels skips the events having any of the label values,
+// eg: a reactive handler ignoring the events produced by itself
+func WithExcludeLabels(labels store.Labels) Option {
+	return func(f *Poller) {
+		f.excludeLabels = labels
+	}
+}
+
+// WithUpperBound stops delivering events after eventID, even as new events arrive, eg: to build a projection of a consistent cut of the store
+func WithUpperBound(eventID string) Option {
+	return func(f *Poller) {
+		f.upperBound = eventID
+	}
+}
+
+// WithPauser stops querying the store while pauser is paused
+func WithPauser(pauser *store.Pauser) Option {
+	return func(f *Poller) {
+		f.pausers = append(f.pausers, pauser)
+	}
+}
+
 func New(repository player.Repository, options ...Option) Poller {
 	p := Poller{
 		pollInterval: 200 * time.Millisecond,
 		trailingLag:  player.TrailingLag,
 		limit:        20,
 		store:        repository,
+		maxInFlight:  10,
 	}
 
 	for _, o := range options {
@@ -105,31 +207,90 @@ func New(repository player.Repository, options ...Option) Poller {
 }
 
 func (p Poller) Poll(ctx context.Context, startOption player.StartOption, handler player.EventHandlerFunc) error {
-	var afterEventID string
-	var err error
+	afterEventID, err := p.startAt(ctx, startOption)
+	if err != nil {
+		return err
+	}
+	if p.batchHandler != nil {
+		batchHandler := p.recoveringBatch(p.batchHandler)
+		return p.poll(ctx, afterEventID, func(ctx context.Context, afterEventID string, filters ...store.FilterOption) (string, error) {
+			return p.play.ReplayByAggregate(ctx, batchHandler, afterEventID, filters...)
+		})
+	}
+	return p.forward(ctx, afterEventID, handler)
+}
+
+func (p Poller) startAt(ctx context.Context, startOption player.StartOption) (string, error) {
 	switch startOption.StartFrom() {
 	case player.END:
-		afterEventID, err = p.store.GetLastEventID(ctx, p.trailingLag, store.Filter{})
-		if err != nil {
-			return err
-		}
-	case player.BEGINNING:
+		return p.store.GetLastEventID(ctx, p.trailingLag, store.Filter{})
 	case player.SEQUENCE:
-		afterEventID = startOption.AfterEventID()
+		return startOption.AfterEventID(), nil
 	}
-	return p.forward(ctx, afterEventID, handler)
+	return p.beginning(), nil
+}
+
+// beginning returns the position to start at when there is none, capped by the max age
+func (p Poller) beginning() string {
+	if p.maxAge <= 0 {
+		return common.MinEventID
+	}
+	return common.MinEventIDAt(time.Now().UTC().Add(-p.maxAge))
 }
 
 func (p Poller) forward(ctx context.Context, afterEventID string, handler player.EventHandlerFunc) error {
+	handler = p.recovering(handler)
+	if p.guarantee == AtMostOnce {
+		return p.poll(ctx, afterEventID, func(ctx context.Context, afterEventID string, filters ...store.FilterOption) (string, error) {
+			delivered := afterEventID
+			eid, err := p.play.Replay(ctx, func(ctx context.Context, e eventstore.Event) error {
+				// advancing before handling, so that a failed event is never redelivered
+				delivered = store.EventPosition(e)
+				return handler(ctx, e)
+			}, afterEventID, filters...)
+			if err != nil {
+				return delivered, err
+			}
+			return eid, nil
+		})
+	}
+	return p.poll(ctx, afterEventID, func(ctx context.Context, afterEventID string, filters ...store.FilterOption) (string, error) {
+		return p.play.Replay(ctx, handler, afterEventID, filters...)
+	})
+}
+
+// poll calls replay until the context is done.
+// On failure, replay may return the position to resume from, or an empty string to resume from the last position.
+func (p Poller) poll(ctx context.Context, afterEventID string, replay func(ctx context.Context, afterEventID string, filters ...store.FilterOption) (string, error)) error {
 	wait := p.pollInterval
 	filters := []store.FilterOption{
 		store.WithAggregateTypes(p.aggregateTypes...),
 		store.WithLabels(p.labels),
+		store.WithExcludeLabels(p.excludeLabels),
+		store.WithUpperBound(p.upperBound),
 		store.WithPartitions(p.partitions, p.partitionsLow, p.partitionsHi),
 	}
+	filter := store.Filter{}
+	for _, f := range filters {
+		f(&filter)
+	}
+	failures := 0
 	for {
-		eid, err := p.play.Replay(ctx, handler, afterEventID, filters...)
+		for _, pauser := range p.pausers {
+			if err := pauser.Wait(ctx); err != nil {
+				// context done
+				return nil
+			}
+		}
+		eid, err := replay(ctx, afterEventID, filters...)
 		if err != nil {
+			if eid != "" {
+				afterEventID = eid
+			}
+			failures++
+			if p.maxFailures > 0 && failures >= p.maxFailures {
+				return faults.Errorf("Giving up polling after %d consecutive failures: %w", failures, err)
+			}
 			wait += 2 * wait
 			if wait > maxWait {
 				wait = maxWait
@@ -138,8 +299,16 @@ func (p Poller) forward(ctx context.Context, afterEventID string, handler player
 				WithError(err).
 				Error("Failure retrieving events. Backing off.")
 		} else {
+			progressed := eid != afterEventID
 			afterEventID = eid
 			wait = p.pollInterval
+			failures = 0
+			// A store applying the trailing lag may return a partial batch, ending the poll, while there are events after the position,
+			// so being caught up is decided by the tail and not by the batch.
+			// An idle poll, returning no events, does not ask for the tail, so that polling an idle store costs a single query.
+			if progressed && !p.caughtUp(ctx, afterEventID, filter) {
+				continue
+			}
 		}
 
 		t := time.NewTimer(wait)
@@ -152,23 +321,82 @@ func (p Poller) forward(ctx context.Context, afterEventID string, handler player
 	}
 }
 
+// caughtUp tells if there are no events after afterEventID, outside the trailing lag.
+// If the tail is unknown, it is assumed to be caught up.
+func (p Poller) caughtUp(ctx context.Context, afterEventID string, filter store.Filter) bool {
+	tail, err := p.store.GetLastEventID(ctx, p.trailingLag, filter)
+	if err != nil {
+		log.WithError(err).Warn("Unable to get the last event ID")
+		return true
+	}
+	return tail <= afterEventID
+}
+
+func (p Poller) ResumeTokenKind() string {
+	return store.ResumeTokenEventID
+}
+
+func (p Poller) CompareResumeTokens(a, b []byte) int {
+	return store.CompareResumeTokens(store.ParseEventIDPosition, a, b)
+}
+
 // Feed forwars the handling to a sink.
 // eg: a message queue
-func (p Poller) Feed(ctx context.Context, sinker sink.Sinker) error {
-	var afterEventID []byte
-	err := store.LastEventIDInSink(ctx, sinker, p.partitionsLow, p.partitionsHi, func(resumeToken []byte) error {
-		if bytes.Compare(resumeToken, afterEventID) > 0 {
-			afterEventID = resumeToken
-		}
-		return nil
-	})
+func (p Poller) Feed(ctx context.Context, sinker sink.Sinker) (err error) {
+	defer func(sinker sink.Sinker) {
+		err = store.FlushSink(sinker, err)
+	}(sinker)
+
+	pos, err := store.LastPositionInSink(ctx, sinker, p.partitionsLow, p.partitionsHi, store.ParseEventIDPosition)
 	if err != nil {
 		return err
 	}
+	afterEventID := p.beginning()
+	if pos != nil {
+		afterEventID = pos.String()
+	}
+
+	sinker = p.progress.Wrap(ctx, sinker, p.partitionsLow, p.partitionsHi)
 
 	log.Println("Starting to feed from event ID:", afterEventID)
-	return p.forward(ctx, string(afterEventID), func(ctx context.Context, e eventstore.Event) error {
-		e.ResumeToken = []byte(e.ID)
+	return p.forward(ctx, afterEventID, func(ctx context.Context, e eventstore.Event) error {
+		if len(e.ResumeToken) == 0 {
+			e.ResumeToken = []byte(e.ID)
+		}
 		return sinker.Sink(ctx, e)
 	})
 }
+
+// FeedGroup feeds the sinker with the partitions assigned to this member of the consumer group,
+// restarting the feed, from the positions in the sink, on every rebalance.
+// The partitions set with WithPartitions are replaced by the ones of the group.
+func (p Poller) FeedGroup(ctx context.Context, group *worker.ConsumerGroup, sinker sink.Sinker) error {
+	return group.Run(ctx, func(ctx context.Context, slot worker.PartitionSlot) error {
+		return p.forSlot(group, slot).Feed(ctx, sinker)
+	})
+}
+
+// PollGroup polls the partitions assigned to this member of the consumer group, restarting on every rebalance.
+// Since the poller does not keep positions, startAt is called with every new slot, eg: to resume from a checkpoint of the handler.
+// The partitions set with WithPartitions are replaced by the ones of the group.
+func (p Poller) PollGroup(
+	ctx context.Context,
+	group *worker.ConsumerGroup,
+	startAt func(ctx context.Context, slot worker.PartitionSlot) (player.StartOption, error),
+	handler player.EventHandlerFunc,
+) error {
+	return group.Run(ctx, func(ctx context.Context, slot worker.PartitionSlot) error {
+		startOption, err := startAt(ctx, slot)
+		if err != nil {
+			return err
+		}
+		return p.forSlot(group, slot).Poll(ctx, startOption, handler)
+	})
+}
+
+func (p Poller) forSlot(group *worker.ConsumerGroup, slot worker.PartitionSlot) Poller {
+	p.partitions = group.Partitions()
+	p.partitionsLow = slot.From
+	p.partitionsHi = slot.To
+	return p
+}
@@ -0,0 +1,367 @@
+package poller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryGuarantee(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		guarantee DeliveryGuarantee
+		expected  []string
+	}{
+		{guarantee: AtLeastOnce, expected: []string{"A", "B", "A", "B", "C", "D"}},
+		{guarantee: AtMostOnce, expected: []string{"A", "B", "C", "D"}},
+	}
+	for _, tc := range testCases {
+		r := NewMockRepo()
+		p := New(r, WithPollInterval(10*time.Millisecond), WithDeliveryGuarantee(tc.guarantee))
+
+		var mu sync.Mutex
+		ids := []string{}
+		failed := false
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err := p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ids = append(ids, e.ID)
+			if e.ID == "B" && !failed {
+				failed = true
+				return errors.New("failed")
+			}
+			return nil
+		})
+		cancel()
+		assert.NoError(t, err)
+
+		mu.Lock()
+		assert.Equal(t, tc.expected, ids, "guarantee %d", tc.guarantee)
+		mu.Unlock()
+	}
+}
+
+func TestGroupByAggregate(t *testing.T) {
+	t.Parallel()
+
+	r := &MockRepo{
+		events: []eventstore.Event{
+			{ID: "A", AggregateID: "1", AggregateType: "Test"},
+			{ID: "B", AggregateID: "2", AggregateType: "Test"},
+			{ID: "C", AggregateID: "1", AggregateType: "Test"},
+			{ID: "D", AggregateID: "2", AggregateType: "Test"},
+			{ID: "E", AggregateID: "1", AggregateType: "Test"},
+		},
+	}
+
+	var mu sync.Mutex
+	groups := [][]string{}
+	p := New(r, WithPollInterval(10*time.Millisecond), WithLimit(4), WithGroupByAggregate(func(ctx context.Context, aggregateID string, events []eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		group := []string{aggregateID}
+		for _, e := range events {
+			group = append(group, e.ID)
+		}
+		groups = append(groups, group)
+		return nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// the event handler is not called when grouping
+	err := p.Poll(ctx, player.StartBeginning(), nil)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, [][]string{{"1", "A", "C"}, {"2", "B", "D"}, {"1", "E"}}, groups)
+}
+
+func TestPollWithAck(t *testing.T) {
+	t.Parallel()
+
+	r := NewMockRepo()
+	p := New(r, WithPollInterval(10*time.Millisecond), WithMaxInFlight(2))
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	acked := map[string]int{}
+	failed := false
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := p.PollWithAck(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) Ack {
+		ack := make(chan error, 1)
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			inFlight--
+			if e.ID == "B" && !failed {
+				failed = true
+				ack <- errors.New("failed")
+				return
+			}
+			acked[e.ID]++
+			ack <- nil
+		}()
+		return ack
+	})
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, maxInFlight)
+	// the failed event is redelivered and nothing is lost
+	assert.Equal(t, 1, acked["A"])
+	assert.Equal(t, 1, acked["B"])
+	assert.GreaterOrEqual(t, acked["C"], 1)
+	assert.GreaterOrEqual(t, acked["D"], 1)
+}
+
+type failingRepo struct {
+	MockRepo
+	err error
+}
+
+func (r *failingRepo) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	return nil, r.err
+}
+
+func TestMaxConsecutiveFailures(t *testing.T) {
+	t.Parallel()
+
+	errFail := errors.New("auth revoked")
+	p := New(&failingRepo{err: errFail}, WithPollInterval(time.Millisecond), WithMaxConsecutiveFailures(3))
+
+	err := p.Poll(context.Background(), player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+		return nil
+	})
+	require.True(t, errors.Is(err, errFail), "expected the store error, got %v", err)
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTail(t *testing.T) {
+	t.Parallel()
+
+	r := NewMockRepo()
+	w := &syncBuffer{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := Tail(ctx, r, store.Filter{}, w,
+		WithTailStart(player.StartAt("B")),
+		WithTailKinds("Updated"),
+		WithTailBody(nil),
+		WithTailPollInterval(10*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.Contains(lines[0], "\tC\tTest\tUpdated\t1@0\t{\"message\":\"two\"}"), lines[0])
+	assert.True(t, strings.Contains(lines[1], "\tD\tTest\tUpdated\t1@0\t{\"message\":\"three\"}"), lines[1])
+}
+
+// lagTrimmingRepo returns partial batches, and an empty one after each of them,
+// as a store applying the trailing lag would, while more events exist.
+type lagTrimmingRepo struct {
+	*MockRepo
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *lagTrimmingRepo) GetEvents(ctx context.Context, afterEventID string, limit int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	r.mu.Lock()
+	r.calls++
+	trimmed := r.calls%2 == 0
+	r.mu.Unlock()
+	if trimmed {
+		return []eventstore.Event{}, nil
+	}
+	return r.MockRepo.GetEvents(ctx, afterEventID, 1, trailingLag, filter)
+}
+
+func TestPollUntilTail(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	p := New(&lagTrimmingRepo{MockRepo: NewMockRepo()}, WithPollInterval(time.Minute), WithLimit(3))
+
+	mu := sync.Mutex{}
+	ids := []string{}
+	go p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, e.ID)
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ids) == len(events1)
+	}, time.Second, 10*time.Millisecond, "the poller waited for the poll interval before reaching the tail")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"A", "B", "C", "D"}, ids)
+}
+
+func TestRecover(t *testing.T) {
+	t.Parallel()
+
+	handler := func(ctx context.Context, e eventstore.Event) error {
+		if e.ID == "B" {
+			var m map[string]int
+			m["boom"]++
+		}
+		return nil
+	}
+
+	p := New(NewMockRepo(), WithPollInterval(time.Millisecond), WithMaxConsecutiveFailures(2), WithRecover())
+	err := p.Poll(context.Background(), player.StartBeginning(), handler)
+	require.True(t, errors.Is(err, ErrHandlerPanic), "expected handler panic, got %v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	mu := sync.Mutex{}
+	handled := []string{}
+	deadLettered := []string{}
+	p = New(NewMockRepo(), WithPollInterval(time.Millisecond), WithRecover(), WithDeadLetter(func(ctx context.Context, e eventstore.Event, err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.True(t, errors.Is(err, ErrHandlerPanic), "expected handler panic, got %v", err)
+		deadLettered = append(deadLettered, e.ID)
+		return nil
+	}))
+	go p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+		err := handler(ctx, e)
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, e.ID)
+		return err
+	})
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 3
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"A", "C", "D"}, handled)
+	assert.Equal(t, []string{"B"}, deadLettered)
+}
+
+func TestMaxAge(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+	old := common.NewEventID(now.Add(-2*time.Hour), "old", 1)
+	recent := common.NewEventID(now.Add(-time.Minute), "recent", 1)
+	r := &MockRepo{events: []eventstore.Event{{ID: old}, {ID: recent}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	mu := sync.Mutex{}
+	ids := []string{}
+	p := New(r, WithPollInterval(time.Millisecond), WithMaxAge(time.Hour))
+	go p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, e.ID)
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(ids) == 1
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	// the events older than the max age are skipped
+	assert.Equal(t, []string{recent}, ids)
+}
+
+// tailCountingRepo counts the tail queries
+type tailCountingRepo struct {
+	*MockRepo
+	mu    sync.Mutex
+	tails int
+}
+
+func (r *tailCountingRepo) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	r.mu.Lock()
+	r.tails++
+	r.mu.Unlock()
+	return r.MockRepo.GetLastEventID(ctx, trailingLag, filter)
+}
+
+func (r *tailCountingRepo) Tails() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tails
+}
+
+func TestIdlePollSkipsTail(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &tailCountingRepo{MockRepo: NewMockRepo()}
+	p := New(r, WithPollInterval(10*time.Millisecond))
+
+	mu := sync.Mutex{}
+	ids := []string{}
+	go p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, e.ID)
+		return nil
+	})
+
+	// only the poll that returned the events asks for the tail
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, len(events1), len(ids))
+	mu.Unlock()
+	assert.Equal(t, 1, r.Tails())
+}
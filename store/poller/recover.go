@@ -0,0 +1,95 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrHandlerPanic is returned, when recovering (see WithRecover), for a handler that panicked
+var ErrHandlerPanic = errors.New("event handler panicked")
+
+// DeadLetterFunc receives an event whose handler panicked, and the ErrHandlerPanic error, eg: to store it for later inspection.
+type DeadLetterFunc func(ctx context.Context, e eventstore.Event, err error) error
+
+// WithRecover recovers from the panics of the handlers, converting them into ErrHandlerPanic errors, with the stack,
+// that are handled like any handler error, ie, retried with backoff.
+// By default the panics are not recovered, so that tests still see them.
+func WithRecover() Option {
+	return func(p *Poller) {
+		p.recover = true
+	}
+}
+
+// WithDeadLetter, when recovering (see WithRecover), hands the event whose handler panicked to deadLetter and moves on to the next event,
+// so that a buggy handler does not stop the poller on the same event forever.
+// If deadLetter fails, its error is handled like a handler error.
+func WithDeadLetter(deadLetter DeadLetterFunc) Option {
+	return func(p *Poller) {
+		p.deadLetter = deadLetter
+	}
+}
+
+// recovering converts the panics of the handler into errors, if recovering
+func (p Poller) recovering(handler player.EventHandlerFunc) player.EventHandlerFunc {
+	if !p.recover {
+		return handler
+	}
+	return func(ctx context.Context, e eventstore.Event) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = p.panicked(ctx, e, r)
+			}
+		}()
+		return handler(ctx, e)
+	}
+}
+
+// recoveringBatch converts the panics of the batch handler into errors, if recovering.
+// Since it is not known which event caused the panic, the batch is not dead lettered.
+func (p Poller) recoveringBatch(handler player.BatchHandler) player.BatchHandler {
+	if !p.recover {
+		return handler
+	}
+	return func(ctx context.Context, aggregateID string, events []eventstore.Event) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = faults.Errorf("Handler panicked on the events of aggregate '%s': %v\n%s: %w", aggregateID, r, debug.Stack(), ErrHandlerPanic)
+			}
+		}()
+		return handler(ctx, aggregateID, events)
+	}
+}
+
+// recoveringAck converts the panics of the ack handler into failed acks, if recovering
+func (p Poller) recoveringAck(handler AckHandlerFunc) AckHandlerFunc {
+	if !p.recover {
+		return handler
+	}
+	return func(ctx context.Context, e eventstore.Event) (ack Ack) {
+		defer func() {
+			if r := recover(); r != nil {
+				ack = Acked(p.panicked(ctx, e, r))
+			}
+		}()
+		return handler(ctx, e)
+	}
+}
+
+// panicked converts the recovered value into an error, or dead letters the event
+func (p Poller) panicked(ctx context.Context, e eventstore.Event, r interface{}) error {
+	err := faults.Errorf("Handler panicked on event '%s': %v\n%s: %w", e.ID, r, debug.Stack(), ErrHandlerPanic)
+	if p.deadLetter == nil {
+		return err
+	}
+	if er := p.deadLetter(ctx, e, err); er != nil {
+		return faults.Errorf("Unable to dead letter event '%s': %w", e.ID, er)
+	}
+	log.WithField("event", e.ID).WithError(err).Error("Dead lettered event")
+	return nil
+}
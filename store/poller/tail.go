@@ -0,0 +1,106 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+type tailer struct {
+	start    player.StartOption
+	kinds    map[string]bool
+	body     bool
+	decoder  eventstore.Decoder
+	interval time.Duration
+}
+
+type TailOption func(*tailer)
+
+// WithTailStart sets where Tail starts following the store. Default is player.StartEnd().
+func WithTailStart(start player.StartOption) TailOption {
+	return func(t *tailer) {
+		t.start = start
+	}
+}
+
+// WithTailKinds only prints the events of the given kinds
+func WithTailKinds(kinds ...string) TailOption {
+	return func(t *tailer) {
+		t.kinds = map[string]bool{}
+		for _, k := range kinds {
+			t.kinds[k] = true
+		}
+	}
+}
+
+// WithTailBody also prints the event body, decoded with decoder into a generic value.
+// If decoder is nil the raw body is printed, which is enough for text codecs like JSON.
+func WithTailBody(decoder eventstore.Decoder) TailOption {
+	return func(t *tailer) {
+		t.body = true
+		t.decoder = decoder
+	}
+}
+
+// WithTailPollInterval sets the interval between polls. Default is 200ms.
+func WithTailPollInterval(interval time.Duration) TailOption {
+	return func(t *tailer) {
+		t.interval = interval
+	}
+}
+
+// Tail follows the store, like 'tail -f', writing one line per event to w, until the context is done.
+// The events are filtered by aggregate type, labels and partitions of filter.
+func Tail(ctx context.Context, repo player.Repository, filter store.Filter, w io.Writer, options ...TailOption) error {
+	t := tailer{
+		start:    player.StartEnd(),
+		interval: 200 * time.Millisecond,
+	}
+	for _, o := range options {
+		o(&t)
+	}
+
+	p := New(
+		repo,
+		WithPollInterval(t.interval),
+		WithAggregateTypes(filter.AggregateTypes...),
+		WithLabels(filter.Labels),
+		WithPartitions(filter.Partitions, filter.PartitionLow, filter.PartitionHi),
+		WithDeliveryGuarantee(AtMostOnce),
+	)
+	return p.Poll(ctx, t.start, func(ctx context.Context, e eventstore.Event) error {
+		if t.kinds != nil && !t.kinds[e.Kind] {
+			return nil
+		}
+		return t.print(w, e)
+	})
+}
+
+func (t tailer) print(w io.Writer, e eventstore.Event) error {
+	line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s@%d",
+		e.CreatedAt.Format(time.RFC3339Nano), e.ID, e.AggregateType, e.Kind, e.AggregateID, e.AggregateVersion)
+	if t.body {
+		if t.decoder == nil {
+			line += "\t" + string(e.Body)
+		} else {
+			var body interface{}
+			err := t.decoder.Decode(e.Body, &body)
+			if err != nil {
+				line += fmt.Sprintf("\t<undecodable body: %v>", err)
+			} else {
+				line += fmt.Sprintf("\t%+v", body)
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, line)
+	if err != nil {
+		return faults.Errorf("Unable to write event '%s': %w", e.ID, err)
+	}
+	return nil
+}
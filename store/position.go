@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+	"github.com/quintans/faults"
+)
+
+// Position is an opaque and comparable position in the stream of events of a store.
+// It unifies the different ways the stores keep track of the position, like event IDs, resume tokens or binlog positions.
+type Position interface {
+	// Compare returns an integer comparing two positions. The result will be 0 if p == other, -1 if p < other, and +1 if p > other.
+	Compare(other Position) int
+	String() string
+	Bytes() []byte
+}
+
+// PositionParser converts a resume token into a Position
+type PositionParser func(token []byte) (Position, error)
+
+// Kinds of resume tokens
+const (
+	// ResumeTokenEventID is an event ID, ordered lexicographically
+	ResumeTokenEventID = "event_id"
+	// ResumeTokenLSN is a PostgreSQL log sequence number, eg: 16/B374D848
+	ResumeTokenLSN = "lsn"
+	// ResumeTokenBinlog is a MySQL binlog position, eg: mysql-bin.000001:1234
+	ResumeTokenBinlog = "binlog"
+	// ResumeTokenMongo is a MongoDB change stream resume token, compared byte by byte
+	ResumeTokenMongo = "mongo"
+)
+
+// ErrRewindAhead is returned when rewinding a consumer to a position after its current one
+var ErrRewindAhead = errors.New("rewind target is ahead of the current position")
+
+// ResumeTokener is implemented by the feeds, so that checkpoint stores and monitoring
+// can handle their resume tokens without knowing the backend.
+type ResumeTokener interface {
+	// ResumeTokenKind returns one of the ResumeToken* kinds
+	ResumeTokenKind() string
+	// CompareResumeTokens returns an integer comparing two resume tokens. The result will be 0 if a == b, -1 if a < b, and +1 if a > b.
+	CompareResumeTokens(a, b []byte) int
+}
+
+// CompareResumeTokens compares two resume tokens, after converting them with parse.
+// Tokens that cannot be parsed are compared byte by byte.
+func CompareResumeTokens(parse PositionParser, a, b []byte) int {
+	pa, err := parse(a)
+	if err != nil {
+		return bytes.Compare(a, b)
+	}
+	pb, err := parse(b)
+	if err != nil {
+		return bytes.Compare(a, b)
+	}
+	return pa.Compare(pb)
+}
+
+// EventPosition returns the position to read the events after e, with GetEvents: its resume token,
+// set by the repositories ordering the events by another column than the ID (see postgresql.WithOrderingColumn), or else its ID
+func EventPosition(e eventstore.Event) string {
+	if len(e.ResumeToken) > 0 {
+		return string(e.ResumeToken)
+	}
+	return e.ID
+}
+
+// EventIDPosition is a position based on the event ID
+type EventIDPosition string
+
+// ParseEventIDPosition is a PositionParser for event IDs
+func ParseEventIDPosition(token []byte) (Position, error) {
+	return EventIDPosition(token), nil
+}
+
+func (p EventIDPosition) Compare(other Position) int {
+	if o, ok := other.(EventIDPosition); ok {
+		return strings.Compare(string(p), string(o))
+	}
+	return bytes.Compare(p.Bytes(), other.Bytes())
+}
+
+func (p EventIDPosition) String() string {
+	return string(p)
+}
+
+func (p EventIDPosition) Bytes() []byte {
+	return []byte(p)
+}
+
+// BytesPosition is a position based on a binary token that is compared byte by byte
+type BytesPosition []byte
+
+// ParseBytesPosition is a PositionParser for binary tokens
+func ParseBytesPosition(token []byte) (Position, error) {
+	return BytesPosition(token), nil
+}
+
+func (p BytesPosition) Compare(other Position) int {
+	return bytes.Compare(p, other.Bytes())
+}
+
+func (p BytesPosition) String() string {
+	return string(p)
+}
+
+func (p BytesPosition) Bytes() []byte {
+	return p
+}
+
+// LastPositionInSink retrieves the highest position found in the partition range of the sink.
+// Returns nil if no position was found.
+func LastPositionInSink(ctx context.Context, sinker sink.Sinker, partitionLow, partitionHi uint32, parse PositionParser) (Position, error) {
+	var last Position
+	err := LastEventIDInSink(ctx, sinker, partitionLow, partitionHi, func(resumeToken []byte) error {
+		p, err := parse(resumeToken)
+		if err != nil {
+			return faults.Wrap(err)
+		}
+		if last == nil || p.Compare(last) > 0 {
+			last = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
@@ -0,0 +1,20 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/quintans/faults"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareResumeTokens(t *testing.T) {
+	assert.Equal(t, -1, CompareResumeTokens(ParseEventIDPosition, []byte("A"), []byte("B")))
+	assert.Equal(t, 0, CompareResumeTokens(ParseEventIDPosition, []byte("B"), []byte("B")))
+	assert.Equal(t, 1, CompareResumeTokens(ParseBytesPosition, []byte{2}, []byte{1}))
+
+	failing := func(token []byte) (Position, error) {
+		return nil, faults.New("unparsable")
+	}
+	// falls back to a byte comparison
+	assert.Equal(t, 1, CompareResumeTokens(failing, []byte("B"), []byte("A")))
+}
@@ -0,0 +1,86 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+// CheckpointSchema creates the table holding the resume tokens of the feeds (see store.CheckpointSinker)
+const CheckpointSchema = `
+CREATE TABLE IF NOT EXISTS feed_checkpoints(
+	feed_name VARCHAR (100) NOT NULL,
+	partition_low INTEGER NOT NULL,
+	partition_hi INTEGER NOT NULL,
+	resume_token bytea NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+	PRIMARY KEY (feed_name, partition_low, partition_hi)
+);
+`
+
+var _ store.TxCheckpointStore = (*CheckpointStore)(nil)
+
+// CheckpointStore keeps the feed checkpoints in the feed_checkpoints table
+type CheckpointStore struct {
+	db *sqlx.DB
+}
+
+func NewCheckpointStore(connString string) (*CheckpointStore, error) {
+	db, err := sqlx.Open(driverName, connString)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	return &CheckpointStore{
+		db: db,
+	}, nil
+}
+
+// InstallCheckpoints creates the checkpoints table
+func (c *CheckpointStore) InstallCheckpoints(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, CheckpointSchema)
+	if err != nil {
+		return faults.Errorf("Unable to install the checkpoints table: %w", err)
+	}
+	return nil
+}
+
+func (c *CheckpointStore) GetCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32) ([]byte, error) {
+	var token []byte
+	err := c.db.GetContext(ctx, &token, "SELECT resume_token FROM feed_checkpoints WHERE feed_name = $1 AND partition_low = $2 AND partition_hi = $3",
+		feedName, partitionLow, partitionHi)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, faults.Errorf("Unable to get checkpoint of feed '%s' [%d-%d]: %w", feedName, partitionLow, partitionHi, err)
+	}
+	return token, nil
+}
+
+// SaveCheckpoint upserts the checkpoint in a single statement, so that it is never partially written
+func (c *CheckpointStore) SaveCheckpoint(ctx context.Context, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error {
+	return saveCheckpoint(ctx, c.db, feedName, partitionLow, partitionHi, resumeToken)
+}
+
+// SaveCheckpointTx upserts the checkpoint in tx, eg: the transaction of a sinker writing a read model in the same database (see store.TxSinker)
+func (c *CheckpointStore) SaveCheckpointTx(ctx context.Context, tx *sql.Tx, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error {
+	return saveCheckpoint(ctx, tx, feedName, partitionLow, partitionHi, resumeToken)
+}
+
+func saveCheckpoint(ctx context.Context, db execer, feedName string, partitionLow, partitionHi uint32, resumeToken []byte) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO feed_checkpoints (feed_name, partition_low, partition_hi, resume_token) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (feed_name, partition_low, partition_hi) DO UPDATE SET resume_token = EXCLUDED.resume_token, updated_at = NOW()::TIMESTAMP`,
+		feedName, partitionLow, partitionHi, resumeToken)
+	if err != nil {
+		return faults.Errorf("Unable to save checkpoint of feed '%s' [%d-%d]: %w", feedName, partitionLow, partitionHi, err)
+	}
+	return nil
+}
+
+func (c *CheckpointStore) Close() error {
+	return c.db.Close()
+}
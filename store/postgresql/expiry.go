@@ -0,0 +1,149 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/faults"
+)
+
+// ExpirySchema adds the expiry column, required to save events with eventstore.WithTTL
+const ExpirySchema = `
+ALTER TABLE events ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS evt_expires_at_idx ON events (expires_at) WHERE expires_at IS NOT NULL;
+`
+
+const (
+	purgeBatchSize = 500
+	// tombstoneTTL is how long a tombstone is kept, giving time to the feeds to deliver it
+	tombstoneTTL = 24 * time.Hour
+)
+
+type expiredEvent struct {
+	ID               string
+	AggregateID      string
+	AggregateIDHash  int32
+	AggregateVersion uint32
+	AggregateType    string
+	Kind             string
+}
+
+// InstallExpiry adds the expiry column to the events table
+func (r *EsRepository) InstallExpiry(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, ExpirySchema)
+	if err != nil {
+		return faults.Errorf("Unable to install expiry: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpired deletes the expired events, and the snapshots referencing them, in batched transactions, returning the number of deleted events.
+// When all the events of an aggregate are deleted, a tombstone event (see eventstore.TombstoneKind) is inserted,
+// so that the feeds notify the projections. The tombstones expire themselves after a while.
+func (r *EsRepository) PurgeExpired(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		count, err := r.purgeExpiredBatch(ctx, time.Now().UTC())
+		if err != nil {
+			return total, err
+		}
+		total += count
+		if count < purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (r *EsRepository) purgeExpiredBatch(ctx context.Context, now time.Time) (int, error) {
+	var count int
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		expired, err := getExpired(c, tx, now)
+		if err != nil {
+			return err
+		}
+		count = len(expired)
+		if count == 0 {
+			return nil
+		}
+
+		labels, err := r.marshalLabels(nil)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, count)
+		// the last expired event of every aggregate that is not a tombstone
+		lasts := map[string]expiredEvent{}
+		for k, e := range expired {
+			ids[k] = e.ID
+			if e.Kind == eventstore.TombstoneKind {
+				continue
+			}
+			if last, ok := lasts[e.AggregateID]; !ok || e.AggregateVersion > last.AggregateVersion {
+				lasts[e.AggregateID] = e
+			}
+		}
+
+		// snapshots reference the events
+		_, err = tx.ExecContext(c, "DELETE FROM snapshots WHERE id = ANY($1)", pq.Array(ids))
+		if err != nil {
+			return faults.Errorf("Unable to delete snapshots of expired events: %w", err)
+		}
+		_, err = tx.ExecContext(c, "DELETE FROM events WHERE id = ANY($1)", pq.Array(ids))
+		if err != nil {
+			return faults.Errorf("Unable to delete expired events: %w", err)
+		}
+
+		for aggregateID, last := range lasts {
+			var exists bool
+			err = tx.QueryRowContext(c, "SELECT EXISTS(SELECT 1 FROM events WHERE aggregate_id = $1)", aggregateID).Scan(&exists)
+			if err != nil {
+				return faults.Errorf("Unable to check remaining events of aggregate '%s': %w", aggregateID, err)
+			}
+			if exists {
+				continue
+			}
+			version := last.AggregateVersion + 1
+			args := []interface{}{common.NewEventID(now, aggregateID, version), aggregateID, version, last.AggregateType, eventstore.TombstoneKind, []byte("{}"), now, last.AggregateIDHash, now.Add(tombstoneTTL)}
+			args = append(args, labels...)
+			_, err = tx.ExecContext(c,
+				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, created_at, aggregate_id_hash, expires_at, `+r.labelColumns()+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, `+labelParams(10, len(labels))+`)`,
+				args...)
+			if err != nil {
+				return faults.Errorf("Unable to insert tombstone for aggregate '%s': %w", aggregateID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func getExpired(ctx context.Context, tx *sql.Tx, now time.Time) ([]expiredEvent, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind FROM events
+		WHERE expires_at <= $1 ORDER BY id LIMIT $2 FOR UPDATE`, now, purgeBatchSize)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get expired events: %w", err)
+	}
+	defer rows.Close()
+	expired := []expiredEvent{}
+	for rows.Next() {
+		e := expiredEvent{}
+		err := rows.Scan(&e.ID, &e.AggregateID, &e.AggregateIDHash, &e.AggregateVersion, &e.AggregateType, &e.Kind)
+		if err != nil {
+			return nil, faults.Errorf("Unable to scan expired event: %w", err)
+		}
+		expired = append(expired, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, faults.Errorf("Unable to iterate expired events: %w", err)
+	}
+	return expired, nil
+}
@@ -0,0 +1,81 @@
+package postgresql
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/quintans/eventstore/worker"
+	"github.com/quintans/faults"
+)
+
+// ConsumerGroupSchema creates the table holding the leases of the consumer group members (see worker.ConsumerGroup)
+const ConsumerGroupSchema = `
+CREATE TABLE IF NOT EXISTS consumer_group_members(
+	group_name VARCHAR (100) NOT NULL,
+	member VARCHAR (100) NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (group_name, member)
+);
+`
+
+var _ worker.GroupMembership = (*GroupMembership)(nil)
+
+// GroupMembership keeps the leases of the consumer group members in the consumer_group_members table.
+// The expiry is decided by the database clock, so that the members do not depend on their clocks being in sync.
+type GroupMembership struct {
+	db *sqlx.DB
+}
+
+func NewGroupMembership(connString string) (*GroupMembership, error) {
+	db, err := sqlx.Open(driverName, connString)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	return &GroupMembership{
+		db: db,
+	}, nil
+}
+
+// InstallConsumerGroups creates the consumer group members table
+func (m *GroupMembership) InstallConsumerGroups(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, ConsumerGroupSchema)
+	if err != nil {
+		return faults.Errorf("Unable to install the consumer group members table: %w", err)
+	}
+	return nil
+}
+
+// Join upserts the lease of the member and returns the members with a live lease, deleting the expired ones
+func (m *GroupMembership) Join(ctx context.Context, group, member string, ttl time.Duration) ([]string, error) {
+	_, err := m.db.ExecContext(ctx,
+		`INSERT INTO consumer_group_members (group_name, member, expires_at) VALUES ($1, $2, NOW() AT TIME ZONE 'UTC' + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (group_name, member) DO UPDATE SET expires_at = EXCLUDED.expires_at`,
+		group, member, ttl.Milliseconds())
+	if err != nil {
+		return nil, faults.Errorf("Unable to renew the lease of member '%s' in the consumer group '%s': %w", member, group, err)
+	}
+	_, err = m.db.ExecContext(ctx, `DELETE FROM consumer_group_members WHERE group_name = $1 AND expires_at < NOW() AT TIME ZONE 'UTC'`, group)
+	if err != nil {
+		return nil, faults.Errorf("Unable to delete the expired members of the consumer group '%s': %w", group, err)
+	}
+
+	members := []string{}
+	err = m.db.SelectContext(ctx, &members, `SELECT member FROM consumer_group_members WHERE group_name = $1 ORDER BY member`, group)
+	if err != nil {
+		return nil, faults.Errorf("Unable to list the members of the consumer group '%s': %w", group, err)
+	}
+	return members, nil
+}
+
+func (m *GroupMembership) Leave(ctx context.Context, group, member string) error {
+	_, err := m.db.ExecContext(ctx, `DELETE FROM consumer_group_members WHERE group_name = $1 AND member = $2`, group, member)
+	if err != nil {
+		return faults.Errorf("Unable to remove member '%s' from the consumer group '%s': %w", member, group, err)
+	}
+	return nil
+}
+
+func (m *GroupMembership) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,124 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/faults"
+)
+
+// IdempotencySchema creates the table holding the idempotency keys (see eventstore.WithIdempotencyStore).
+// The key column is unbounded, so that it is never narrower than the key column of the events.
+const IdempotencySchema = `
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	aggregate_type VARCHAR (50) NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	expires_at TIMESTAMP NULL,
+	PRIMARY KEY (aggregate_type, idempotency_key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at) WHERE expires_at IS NOT NULL;
+`
+
+// execer executes statements, in or out of a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+var _ eventstore.IdempotencyStore = (*IdempotencyStore)(nil)
+
+// IdempotencyStore reads the idempotency keys of the idempotency_keys table, with an optional expiry.
+// The keys are recorded by EsRepository.SaveEvent, in the save transaction, so the table must be in the database of the events.
+type IdempotencyStore struct {
+	db *sqlx.DB
+}
+
+func NewIdempotencyStore(connString string) (*IdempotencyStore, error) {
+	db, err := sqlx.Open(driverName, connString)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	return &IdempotencyStore{
+		db: db,
+	}, nil
+}
+
+// InstallIdempotency creates the idempotency keys table
+func (s *IdempotencyStore) InstallIdempotency(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, IdempotencySchema)
+	if err != nil {
+		return faults.Errorf("Unable to install the idempotency keys table: %w", err)
+	}
+	return nil
+}
+
+// RecordIdempotencyKey records the key outside of a save, eg: to reserve it
+func (s *IdempotencyStore) RecordIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string, ttl time.Duration) error {
+	return recordIdempotencyKey(ctx, s.db, aggregateType, idempotencyKey, ttl)
+}
+
+// recordIdempotencyKey inserts the key, or replaces it if it expired, in a single statement,
+// so that concurrent saves with the same key are decided by the primary key.
+func recordIdempotencyKey(ctx context.Context, db execer, aggregateType, idempotencyKey string, ttl time.Duration) error {
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := time.Now().UTC().Add(ttl)
+		expiresAt = &t
+	}
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (aggregate_type, idempotency_key, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (aggregate_type, idempotency_key) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW() AT TIME ZONE 'UTC'`,
+		aggregateType, idempotencyKey, expiresAt)
+	if err != nil {
+		return faults.Errorf("Unable to record idempotency key '%s': %w", idempotencyKey, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	if n == 0 {
+		return faults.Errorf("Idempotency key '%s' of aggregate type '%s' is already recorded: %w", idempotencyKey, aggregateType, eventstore.ErrIdempotencyKeyConflict)
+	}
+	return nil
+}
+
+func (s *IdempotencyStore) HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error) {
+	var exists bool
+	err := s.db.GetContext(ctx, &exists,
+		`SELECT EXISTS(SELECT 1 FROM idempotency_keys WHERE aggregate_type = $1 AND idempotency_key = $2
+		AND (expires_at IS NULL OR expires_at >= NOW() AT TIME ZONE 'UTC')) AS "EXISTS"`,
+		aggregateType, idempotencyKey)
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key: %w", err)
+	}
+	return exists, nil
+}
+
+func (s *IdempotencyStore) ForgetIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE aggregate_type = $1 AND idempotency_key = $2", aggregateType, idempotencyKey)
+	if err != nil {
+		return faults.Errorf("Unable to forget idempotency key '%s': %w", idempotencyKey, err)
+	}
+	return nil
+}
+
+// PurgeExpiredIdempotencyKeys deletes the expired keys, returning how many were deleted.
+// It should be called periodically, since expired keys are only replaced when recorded again.
+func (s *IdempotencyStore) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < NOW() AT TIME ZONE 'UTC'")
+	if err != nil {
+		return 0, faults.Errorf("Unable to purge the expired idempotency keys: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, faults.Wrap(err)
+	}
+	return n, nil
+}
+
+func (s *IdempotencyStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,82 @@
+package postgresql
+
+import (
+	"context"
+
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+type (
+	IntegrityProblemKind = store.IntegrityProblemKind
+	IntegrityProblem     = store.IntegrityProblem
+	IntegrityReport      = store.IntegrityReport
+	IntegrityOption      = store.IntegrityOption
+)
+
+const (
+	OrphanSnapshot          = store.OrphanSnapshot
+	VersionGap              = store.VersionGap
+	DuplicateIdempotencyKey = store.DuplicateIdempotencyKey
+)
+
+// WithRepair deletes the orphan snapshots after checking (see store.WithRepair)
+func WithRepair() IntegrityOption {
+	return store.WithRepair()
+}
+
+// WithIntegrityProblemHandler calls fn for every problem found (see store.WithIntegrityProblemHandler)
+func WithIntegrityProblemHandler(fn func(IntegrityProblem)) IntegrityOption {
+	return store.WithIntegrityProblemHandler(fn)
+}
+
+// CheckIntegrity finds the snapshots referencing missing events, the aggregates with version gaps and the idempotency keys used by more than one aggregate.
+// It is an offline tool, for operators to run after incidents or migrations, since it scans the whole tables.
+// The problems are streamed from the database, instead of being loaded, so that the check runs on stores of any size.
+func (r *EsRepository) CheckIntegrity(ctx context.Context, options ...IntegrityOption) (IntegrityReport, error) {
+	check := store.NewIntegrityCheck(options...)
+
+	report := IntegrityReport{}
+	var err error
+	report.OrphanSnapshots, err = store.ScanIntegrityProblems(ctx, r.db.DB, check, OrphanSnapshot,
+		`SELECT s.aggregate_id, s.id FROM snapshots s
+		WHERE NOT EXISTS (SELECT 1 FROM events e WHERE e.id = s.id)`)
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+	// the events can only be purged with the optional expiry column (see ExpirySchema)
+	var expiry bool
+	err = r.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'events' AND column_name = 'expires_at')`).Scan(&expiry)
+	if err != nil {
+		return IntegrityReport{}, faults.Errorf("Unable to check the expiry column: %w", err)
+	}
+	expiring := "FALSE"
+	if expiry {
+		expiring = "expires_at IS NOT NULL"
+	}
+	report.VersionGaps, err = store.ScanIntegrityProblems(ctx, r.db.DB, check, VersionGap, store.VersionGapQuery(expiring))
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+	report.DuplicateIdempotencyKeys, err = store.ScanIntegrityProblems(ctx, r.db.DB, check, DuplicateIdempotencyKey,
+		`SELECT MIN(aggregate_id), idempotency_key FROM events
+		WHERE idempotency_key IS NOT NULL
+		GROUP BY aggregate_type, idempotency_key HAVING COUNT(DISTINCT aggregate_id) > 1`)
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+
+	if check.Repair && report.OrphanSnapshots > 0 {
+		res, err := r.db.ExecContext(ctx, `DELETE FROM snapshots s WHERE NOT EXISTS (SELECT 1 FROM events e WHERE e.id = s.id)`)
+		if err != nil {
+			return report, faults.Errorf("Unable to delete the orphan snapshots: %w", err)
+		}
+		report.RepairedSnapshots, err = res.RowsAffected()
+		if err != nil {
+			return report, faults.Wrap(err)
+		}
+	}
+
+	return report, nil
+}
@@ -1,10 +1,13 @@
 package postgresql
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -29,10 +32,51 @@ type FeedEvent struct {
 	Kind             string        `json:"kind,omitempty"`
 	Body             encoding.Json `json:"body,omitempty"`
 	IdempotencyKey   string        `json:"idempotency_key,omitempty"`
+	ExternalID       string        `json:"external_id,omitempty"`
 	Labels           encoding.Json `json:"labels,omitempty"`
-	CreatedAt        PgTime        `json:"created_at,omitempty"`
+	// CreatedAt is kept as notified, to be parsed with the time parser of the feed (see WithFeedTimeParser)
+	CreatedAt string `json:"created_at,omitempty"`
 }
 
+// NotifyBase64Trigger returns the trigger that notifies the channel of every inserted event, with the body base64 encoded.
+// Unlike a payload built with row_to_json, this works with bodies of any codec, eg: protobuf or compressed bodies.
+// It must be used with a feed created with the WithBase64Body option.
+// Keep in mind that the NOTIFY payload is limited to 8000 bytes.
+func NotifyBase64Trigger(channel string) string {
+	return fmt.Sprintf(`
+CREATE OR REPLACE FUNCTION notify_event() RETURNS TRIGGER AS $FN$
+	DECLARE
+		notification json;
+	BEGIN
+		notification = json_build_object(
+			'id', NEW.id,
+			'aggregate_id', NEW.aggregate_id,
+			'aggregate_id_hash', NEW.aggregate_id_hash,
+			'aggregate_version', NEW.aggregate_version,
+			'aggregate_type', NEW.aggregate_type,
+			'kind', NEW.kind,
+			'body', encode(NEW.body, 'base64'),
+			'idempotency_key', NEW.idempotency_key,
+			'labels', NEW.labels,
+			'created_at', NEW.created_at
+		);
+		PERFORM pg_notify('%s', notification::text);
+
+		-- Result is ignored since this is an AFTER trigger
+		RETURN NULL;
+	END;
+$FN$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS events_notify_event ON events;
+CREATE TRIGGER events_notify_event
+AFTER INSERT ON events
+	FOR EACH ROW EXECUTE PROCEDURE notify_event();
+`, escape(channel))
+}
+
+// PgTime is the creation time of the notified events.
+//
+// Deprecated: the feed parses the notified time with its time parser (see WithFeedTimeParser), use common.TimeParser instead.
 type PgTime time.Time
 
 func (pgt *PgTime) UnmarshalJSON(b []byte) error {
@@ -50,6 +94,23 @@ func (pgt *PgTime) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// OutOfOrderPolicy defines what the listen feed does with a notified event whose ID is not after the last forwarded event ID
+type OutOfOrderPolicy int
+
+const (
+	// OutOfOrderDrop silently drops the event
+	OutOfOrderDrop OutOfOrderPolicy = iota
+	// OutOfOrderLog logs the event and forwards it. The sinker must handle duplicates.
+	OutOfOrderLog
+	// OutOfOrderError stops the feed with ErrOutOfOrder
+	OutOfOrderError
+)
+
+var ErrOutOfOrder = errors.New("event out of order")
+
+// ErrOrderingColumnUnsupported is returned when feeding, with listen/notify, from a repository ordered by another column than the event ID (see WithOrderingColumn)
+var ErrOrderingColumnUnsupported = errors.New("ordering column not supported by the listen/notify feed")
+
 type Feed struct {
 	play           player.Player
 	repository     player.Repository
@@ -59,9 +120,18 @@ type Feed struct {
 	channel        string
 	aggregateTypes []string
 	labels         store.Labels
+	excludeLabels  store.Labels
 	partitions     uint32
 	partitionsLow  uint32
 	partitionsHi   uint32
+	progress       store.PartitionProgress
+	pauser         *store.Pauser
+	base64Body     bool
+	outOfOrder     OutOfOrderPolicy
+	outOfOrderHits *uint64
+	labelCodec     eventstore.Codec
+	batchWindow    time.Duration
+	timeParser     common.TimeParser
 }
 
 type FeedOption func(*Feed)
@@ -91,6 +161,60 @@ func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FeedOption {
 	}
 }
 
+// WithPartitionProgress reports, at every interval, the last event forwarded for the partition range
+func WithPartitionProgress(interval time.Duration, fn store.OnPartitionProgress) FeedOption {
+	return func(f *Feed) {
+		f.progress = store.PartitionProgress{Interval: interval, Callback: fn}
+	}
+}
+
+// WithBase64Body expects the body of the notified events to be base64 encoded, as done by the trigger of NotifyBase64Trigger
+func WithBase64Body() FeedOption {
+	return func(f *Feed) {
+		f.base64Body = true
+	}
+}
+
+// WithOutOfOrderPolicy sets what to do with notified events that arrive out of order. Default is OutOfOrderDrop.
+func WithOutOfOrderPolicy(policy OutOfOrderPolicy) FeedOption {
+	return func(f *Feed) {
+		f.outOfOrder = policy
+	}
+}
+
+// WithFeedLabelCodec sets the codec used to deserialize the labels of the notified events.
+// It must match the one used by the store. Defaults to eventstore.JSONCodec.
+func WithFeedLabelCodec(codec eventstore.Codec) FeedOption {
+	return func(f *Feed) {
+		f.labelCodec = codec
+	}
+}
+
+// WithFeedTimeParser sets how the creation time of the notified events is parsed,
+// eg: if the timestamps are not in UTC. Defaults to common.NewTimeParser().
+func WithFeedTimeParser(parser common.TimeParser) FeedOption {
+	return func(f *Feed) {
+		f.timeParser = parser
+	}
+}
+
+// WithNotifyBatching coalesces the notifications arriving within window of the first one,
+// forwarding the notified events with a single catch-up query, from the last forwarded event up to the latest notified event,
+// instead of forwarding the event of every notification, improving the throughput under bursts of writes.
+// When idle, an event is forwarded at most window after its notification.
+func WithNotifyBatching(window time.Duration) FeedOption {
+	return func(f *Feed) {
+		f.batchWindow = window
+	}
+}
+
+// WithFeedExcludeLabels skips the events having any of the label values, eg: a reactive handler ignoring the events produced by itself
+func WithFeedExcludeLabels(labels store.Labels) FeedOption {
+	return func(f *Feed) {
+		f.excludeLabels = labels
+	}
+}
+
 // NewFeedListenNotify instantiates a new PgListener.
 // important:repo should NOT implement lag
 func NewFeedListenNotify(connString string, repository player.Repository, channel string, options ...FeedOption) Feed {
@@ -100,6 +224,11 @@ func NewFeedListenNotify(connString string, repository player.Repository, channe
 		repository: repository,
 		dbURL:      connString,
 		channel:    channel,
+		pauser:     store.NewPauser(),
+		// shared by the copies of the feed
+		outOfOrderHits: new(uint64),
+		labelCodec:     eventstore.JSONCodec{},
+		timeParser:     common.NewTimeParser(),
 	}
 
 	for _, o := range options {
@@ -111,19 +240,37 @@ func NewFeedListenNotify(connString string, repository player.Repository, channe
 	return p
 }
 
+func (p Feed) ResumeTokenKind() string {
+	return store.ResumeTokenEventID
+}
+
+func (p Feed) CompareResumeTokens(a, b []byte) int {
+	return store.CompareResumeTokens(store.ParseEventIDPosition, a, b)
+}
+
 // Feed will forward messages to the sinker
 // important: sinker.LastMessage should implement lag
-func (p Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
-	afterEventID := []byte{}
-	err := store.LastEventIDInSink(ctx, sinker, p.partitionsLow, p.partitionsHi, func(resumeToken []byte) error {
-		if bytes.Compare(resumeToken, afterEventID) > 0 {
-			afterEventID = resumeToken
-		}
-		return nil
-	})
+func (p Feed) Feed(ctx context.Context, sinker sink.Sinker) (err error) {
+	defer func(sinker sink.Sinker) {
+		err = store.FlushSink(sinker, err)
+	}(sinker)
+
+	// the notifications only carry the event IDs, that cannot be compared with the positions of an ordering column
+	if r, ok := p.repository.(*EsRepository); ok && r.orderingColumn != "" {
+		return faults.Errorf("Unable to feed from a repository with the ordering column %s: %w", r.orderingColumn, ErrOrderingColumnUnsupported)
+	}
+
+	pos, err := store.LastPositionInSink(ctx, sinker, p.partitionsLow, p.partitionsHi, store.ParseEventIDPosition)
 	if err != nil {
 		return err
 	}
+	var afterEventID string
+	if pos != nil {
+		afterEventID = pos.String()
+	}
+
+	sinker = p.progress.Wrap(ctx, sinker, p.partitionsLow, p.partitionsHi)
+	sinker = p.pauser.Wrap(sinker)
 
 	pool, err := pgxpool.Connect(context.Background(), p.dbURL)
 	if err != nil {
@@ -132,7 +279,25 @@ func (p Feed) Feed(ctx context.Context, sinker sink.Sinker) error {
 	defer pool.Close()
 
 	log.Println("Starting to feed from event ID:", afterEventID)
-	return p.forward(ctx, pool, string(afterEventID), sinker.Sink)
+	return p.forward(ctx, pool, afterEventID, sinker.Sink)
+}
+
+// OutOfOrderCount returns the number of notified events that arrived out of order, whatever the policy.
+// Events committed while the feed was replaying, before listening, are notified and replayed, also counting as out of order,
+// but the notifications of the events forwarded by a batched catch-up (see WithNotifyBatching) are dropped without counting.
+func (p Feed) OutOfOrderCount() uint64 {
+	return atomic.LoadUint64(p.outOfOrderHits)
+}
+
+// Pause stops forwarding events to the sinker, keeping the connection and the position,
+// so that Resume continues instantly without replaying
+func (p Feed) Pause() {
+	p.pauser.Pause()
+}
+
+// Resume continues forwarding events to the sinker
+func (p Feed) Resume() {
+	p.pauser.Resume()
 }
 
 func (p Feed) forward(ctx context.Context, pool *pgxpool.Pool, afterEventID string, handler player.EventHandlerFunc) error {
@@ -157,11 +322,7 @@ func (p Feed) forward(ctx context.Context, pool *pgxpool.Pool, afterEventID stri
 		}
 
 		log.Infof("Replaying events from %s", lastID)
-		filters := []store.FilterOption{
-			store.WithAggregateTypes(p.aggregateTypes...),
-			store.WithLabels(p.labels),
-			store.WithPartitions(p.partitions, p.partitionsLow, p.partitionsHi),
-		}
+		filters := p.filters()
 		lastID, err = p.play.Replay(ctx, handler, lastID, filters...)
 		if err != nil {
 			return faults.Errorf("Error replaying events: %w", err)
@@ -196,10 +357,23 @@ func (p Feed) forward(ctx context.Context, pool *pgxpool.Pool, afterEventID stri
 	}
 }
 
-func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID string, handler player.EventHandlerFunc) (lastID string, retry bool, err error) {
+func (p Feed) filters() []store.FilterOption {
+	return []store.FilterOption{
+		store.WithAggregateTypes(p.aggregateTypes...),
+		store.WithLabels(p.labels),
+		store.WithExcludeLabels(p.excludeLabels),
+		store.WithPartitions(p.partitions, p.partitionsLow, p.partitionsHi),
+	}
+}
+
+func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, afterEventID string, handler player.EventHandlerFunc) (lastID string, retry bool, err error) {
 	defer conn.Release()
 
-	log.Infof("Listening for PostgreSQL notifications on channel %s starting at %s", p.channel, thresholdID)
+	log.Infof("Listening for PostgreSQL notifications on channel %s starting at %s", p.channel, afterEventID)
+	// the notified events are checked against the last forwarded event
+	lastID = afterEventID
+	// the events up to caughtUpID were forwarded by a catch-up query, so their queued notifications are dropped
+	var caughtUpID string
 	for {
 		msg, err := conn.Conn().WaitForNotification(ctx)
 		select {
@@ -217,12 +391,46 @@ func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID string
 		if err != nil {
 			return "", false, faults.Errorf("Error unmarshalling Postgresql Event: %w", err)
 		}
-		lastID = pgEvent.ID
 
-		if pgEvent.ID <= thresholdID {
-			// ignore events already handled
+		if pgEvent.ID == lastID || pgEvent.ID <= caughtUpID {
+			// a duplicated notification of a forwarded event
 			continue
 		}
+		if pgEvent.ID < lastID {
+			atomic.AddUint64(p.outOfOrderHits, 1)
+			switch p.outOfOrder {
+			case OutOfOrderError:
+				return lastID, false, faults.Errorf("Event ID '%s' is not after '%s': %w", pgEvent.ID, lastID, ErrOutOfOrder)
+			case OutOfOrderLog:
+				log.WithField("eventID", pgEvent.ID).
+					WithField("lastID", lastID).
+					Warn("Forwarding event received out of order")
+			default:
+				// ignore events already handled
+				continue
+			}
+		}
+
+		if p.batchWindow > 0 && pgEvent.ID > lastID {
+			var upToID string
+			upToID, retry, err = p.coalesce(ctx, conn, pgEvent.ID)
+			if err != nil {
+				// resume after the last forwarded event
+				return lastID, retry, err
+			}
+			if ctx.Err() != nil {
+				return lastID, false, nil
+			}
+			lastID, err = p.catchUp(ctx, lastID, upToID, handler)
+			if err != nil {
+				return "", false, err
+			}
+			caughtUpID = lastID
+			continue
+		}
+		if pgEvent.ID > lastID {
+			lastID = pgEvent.ID
+		}
 
 		// check if the event is to be forwarded to the sinker
 		part := common.WhichPartition(pgEvent.AggregateIDHash, p.partitions)
@@ -231,10 +439,21 @@ func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID string
 		}
 
 		labels := map[string]interface{}{}
-		err = json.Unmarshal(pgEvent.Labels, &labels)
+		err = eventstore.DecodeLabels(p.labelCodec, pgEvent.Labels, labels)
 		if err != nil {
 			return "", false, faults.Errorf("Unable unmarshal labels to map: %w", err)
 		}
+		if p.excluded(labels) {
+			continue
+		}
+		body, err := p.decodeBody(pgEvent.Body)
+		if err != nil {
+			return "", false, faults.Errorf("Unable to decode body of event '%s': %w", pgEvent.ID, err)
+		}
+		createdAt, err := p.timeParser.Parse(pgEvent.CreatedAt)
+		if err != nil {
+			return "", false, faults.Errorf("Unable to parse the creation time of event '%s': %w", pgEvent.ID, err)
+		}
 		event := eventstore.Event{
 			ID:               pgEvent.ID,
 			ResumeToken:      []byte(pgEvent.ID),
@@ -243,10 +462,11 @@ func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID string
 			AggregateVersion: pgEvent.AggregateVersion,
 			AggregateType:    pgEvent.AggregateType,
 			Kind:             pgEvent.Kind,
-			Body:             []byte(pgEvent.Body),
+			Body:             body,
 			IdempotencyKey:   pgEvent.IdempotencyKey,
+			ExternalID:       pgEvent.ExternalID,
 			Labels:           labels,
-			CreatedAt:        time.Time(pgEvent.CreatedAt),
+			CreatedAt:        createdAt,
 		}
 		err = handler(ctx, event)
 		if err != nil {
@@ -254,3 +474,88 @@ func (p Feed) listen(ctx context.Context, conn *pgxpool.Conn, thresholdID string
 		}
 	}
 }
+
+// coalesce waits for the notifications arriving within the batch window, returning the highest notified event ID
+func (p Feed) coalesce(ctx context.Context, conn *pgxpool.Conn, upToID string) (string, bool, error) {
+	ctx2, cancel := context.WithTimeout(ctx, p.batchWindow)
+	defer cancel()
+	for {
+		msg, err := conn.Conn().WaitForNotification(ctx2)
+		if err != nil {
+			if ctx.Err() != nil {
+				return upToID, false, nil
+			}
+			if ctx2.Err() != nil {
+				// the batch window is over
+				return upToID, false, nil
+			}
+			return upToID, true, faults.Errorf("Error waiting for notification: %w", err)
+		}
+		pgEvent := FeedEvent{}
+		err = json.Unmarshal([]byte(msg.Payload), &pgEvent)
+		if err != nil {
+			return "", false, faults.Errorf("Error unmarshalling Postgresql Event: %w", err)
+		}
+		if pgEvent.ID > upToID {
+			upToID = pgEvent.ID
+		}
+	}
+}
+
+// catchUp forwards, in pages, the events after afterEventID up to upToID, returning the last forwarded event ID
+func (p Feed) catchUp(ctx context.Context, afterEventID, upToID string, handler player.EventHandlerFunc) (string, error) {
+	filter := store.Filter{}
+	for _, f := range append(p.filters(), store.WithUpperBound(upToID)) {
+		f(&filter)
+	}
+	for {
+		events, err := p.repository.GetEvents(ctx, afterEventID, p.limit, 0, filter)
+		if err != nil {
+			return "", faults.Errorf("Error getting the notified events after '%s': %w", afterEventID, err)
+		}
+		for _, event := range events {
+			err = handler(ctx, event)
+			if err != nil {
+				return "", faults.Errorf("Error handling event %+v: %w", event, err)
+			}
+			afterEventID = event.ID
+		}
+		// a partial batch does not mean that all the notified events were read, only an empty one or reaching the notified event does
+		if len(events) == 0 || afterEventID >= upToID {
+			return upToID, nil
+		}
+	}
+}
+
+// excluded tells if the labels have any of the excluded label values
+func (p Feed) excluded(labels map[string]interface{}) bool {
+	for k, values := range p.excludeLabels {
+		v, ok := labels[k]
+		if !ok {
+			continue
+		}
+		for _, value := range values {
+			if fmt.Sprint(v) == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p Feed) decodeBody(body encoding.Json) ([]byte, error) {
+	if !p.base64Body || len(body) == 0 {
+		return []byte(body), nil
+	}
+	var encoded string
+	err := json.Unmarshal(body, &encoded)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	// the newlines added by the postgres encoding are ignored
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	return b, nil
+}
@@ -2,7 +2,6 @@ package postgresql
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -35,6 +34,13 @@ func WithLogRepPartitions(partitions, partitionsLow, partitionsHi uint32) FeedLo
 	}
 }
 
+// WithLogRepPartitionProgress reports, at every interval, the last event forwarded for the partition range
+func WithLogRepPartitionProgress(interval time.Duration, fn store.OnPartitionProgress) FeedLogreplOption {
+	return func(p *FeedLogrepl) {
+		p.progress = store.PartitionProgress{Interval: interval, Callback: fn}
+	}
+}
+
 func WithPublication(publicationName string) FeedLogreplOption {
 	return func(p *FeedLogrepl) {
 		p.slotName = publicationName
@@ -47,12 +53,23 @@ type FeedLogrepl struct {
 	partitionsLow uint32
 	partitionsHi  uint32
 	slotName      string
+	progress      store.PartitionProgress
+	labelCodec    eventstore.Codec
+}
+
+// WithLogRepLabelCodec sets the codec used to deserialize the labels of the replicated events.
+// It must match the one used by the store. Defaults to eventstore.JSONCodec.
+func WithLogRepLabelCodec(codec eventstore.Codec) FeedLogreplOption {
+	return func(f *FeedLogrepl) {
+		f.labelCodec = codec
+	}
 }
 
 func NewFeed(connString string, options ...FeedLogreplOption) FeedLogrepl {
 	f := FeedLogrepl{
-		dburl:    connString,
-		slotName: "events_pub",
+		dburl:      connString,
+		slotName:   "events_pub",
+		labelCodec: eventstore.JSONCodec{},
 	}
 
 	for _, o := range options {
@@ -62,21 +79,29 @@ func NewFeed(connString string, options ...FeedLogreplOption) FeedLogrepl {
 	return f
 }
 
-func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) error {
-	var lastResumeToken pglogrepl.LSN
-	err := store.LastEventIDInSink(ctx, sinker, f.partitionsLow, f.partitionsHi, func(resumeToken []byte) error {
-		xLogPos, err := pglogrepl.ParseLSN(string(resumeToken))
-		if err != nil {
-			return faults.Errorf("IdentifySystem failed: %w", err)
-		}
-		if xLogPos > lastResumeToken {
-			lastResumeToken = xLogPos
-		}
-		return nil
-	})
+func (f FeedLogrepl) ResumeTokenKind() string {
+	return store.ResumeTokenLSN
+}
+
+func (f FeedLogrepl) CompareResumeTokens(a, b []byte) int {
+	return store.CompareResumeTokens(ParseLSNPosition, a, b)
+}
+
+func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) (err error) {
+	defer func(sinker sink.Sinker) {
+		err = store.FlushSink(sinker, err)
+	}(sinker)
+
+	pos, err := store.LastPositionInSink(ctx, sinker, f.partitionsLow, f.partitionsHi, ParseLSNPosition)
 	if err != nil {
 		return err
 	}
+	var lastResumeToken pglogrepl.LSN
+	if pos != nil {
+		lastResumeToken = pglogrepl.LSN(pos.(LSNPosition))
+	}
+
+	sinker = f.progress.Wrap(ctx, sinker, f.partitionsLow, f.partitionsHi)
 
 	conn, err := pgconn.Connect(ctx, f.dburl)
 	if err != nil {
@@ -166,6 +191,44 @@ func (f FeedLogrepl) Feed(ctx context.Context, sinker sink.Sinker) error {
 	}
 }
 
+// LSNPosition is a store.Position based on the PostgreSQL log sequence number
+type LSNPosition pglogrepl.LSN
+
+// ParseLSNPosition is a store.PositionParser for log sequence numbers
+func ParseLSNPosition(token []byte) (store.Position, error) {
+	xLogPos, err := pglogrepl.ParseLSN(string(token))
+	if err != nil {
+		return nil, faults.Errorf("Unable to parse LSN '%s': %w", string(token), err)
+	}
+	return LSNPosition(xLogPos), nil
+}
+
+func (p LSNPosition) Compare(other store.Position) int {
+	o, ok := other.(LSNPosition)
+	if !ok {
+		o2, err := ParseLSNPosition(other.Bytes())
+		if err != nil {
+			return 1
+		}
+		o = o2.(LSNPosition)
+	}
+	switch {
+	case p < o:
+		return -1
+	case p > o:
+		return 1
+	}
+	return 0
+}
+
+func (p LSNPosition) String() string {
+	return pglogrepl.LSN(p).String()
+}
+
+func (p LSNPosition) Bytes() []byte {
+	return []byte(p.String())
+}
+
 func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte) (*eventstore.Event, error) {
 	m, err := pgoutput.Parse(WALData)
 	if err != nil {
@@ -212,6 +275,7 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte) (*eventsto
 			"kind":              &e.Kind,
 			"body":              &body,
 			"idempotency_key":   &e.IdempotencyKey,
+			"external_id":       &e.ExternalID,
 			"labels":            &labels,
 			"created_at":        &e.CreatedAt,
 		})
@@ -221,7 +285,7 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte) (*eventsto
 
 		if labels != "" {
 			e.Labels = map[string]interface{}{}
-			err = json.Unmarshal([]byte(labels), &e.Labels)
+			err = eventstore.DecodeLabels(f.labelCodec, []byte(labels), e.Labels)
 			if err != nil {
 				return nil, faults.Errorf("failed to unmarshal labels %s: %s", labels, err)
 			}
@@ -237,8 +301,9 @@ func (f FeedLogrepl) parse(set *pgoutput.RelationSet, WALData []byte) (*eventsto
 
 func extract(values map[string]pgtype.Value, targets map[string]interface{}) error {
 	for k, v := range targets {
-		val := values[k]
-		if val.Get() == nil {
+		// optional columns, eg: external_id, may not exist
+		val, ok := values[k]
+		if !ok || val.Get() == nil {
 			continue
 		}
 		err := val.AssignTo(v)
@@ -0,0 +1,125 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/worker"
+	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ worker.Locker = (*AdvisoryLock)(nil)
+
+// AdvisoryLock is a lock backed by a postgres session advisory lock.
+// The lock is held by a dedicated connection, so it is released by the database if the process dies.
+// The connection is checked at every heartbeat and, if lost, the release channel is closed.
+type AdvisoryLock struct {
+	db        *sql.DB
+	key       int64
+	heartbeat time.Duration
+
+	mu   sync.Mutex
+	conn *sql.Conn
+	done chan struct{}
+}
+
+// NewAdvisoryLock creates a lock with the given name, eg: store.FeedLockName("accounts", 1, 2)
+func NewAdvisoryLock(connString, name string, heartbeat time.Duration) (*AdvisoryLock, error) {
+	db, err := sql.Open(driverName, connString)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	// connections are not reused, so that a session never keeps a lock after being returned to the pool
+	db.SetMaxIdleConns(0)
+	return &AdvisoryLock{
+		db:        db,
+		key:       int64(common.Hash(name)),
+		heartbeat: heartbeat,
+	}, nil
+}
+
+// Lock tries to acquire the lock, returning a nil channel if it is held by someone else.
+// The returned channel is closed when the lock is released or lost.
+func (l *AdvisoryLock) Lock(ctx context.Context) (chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		return l.done, nil
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get connection for advisory lock: %w", err)
+	}
+	var acquired bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		return nil, faults.Errorf("Unable to acquire advisory lock %d: %w", l.key, err)
+	}
+	if !acquired {
+		conn.Close()
+		return nil, nil
+	}
+
+	l.conn = conn
+	l.done = make(chan struct{})
+	go l.watch(conn, l.done)
+	return l.done, nil
+}
+
+func (l *AdvisoryLock) watch(conn *sql.Conn, done chan struct{}) {
+	ticker := time.NewTicker(l.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), l.heartbeat)
+		err := conn.PingContext(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Warnf("Lost connection holding advisory lock %d", l.key)
+			l.release(conn)
+			return
+		}
+	}
+}
+
+// Unlock releases the lock, if held
+func (l *AdvisoryLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	l.release(conn)
+	if err != nil {
+		return faults.Errorf("Unable to release advisory lock %d: %w", l.key, err)
+	}
+	return nil
+}
+
+func (l *AdvisoryLock) release(conn *sql.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != conn {
+		return
+	}
+	conn.Close()
+	close(l.done)
+	l.conn = nil
+}
+
+func (l *AdvisoryLock) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,198 @@
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/sink"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+// OutboxSchema creates the outbox table and the trigger that, on every insert into the events table,
+// writes a copy of the event into the outbox, in the same transaction.
+// This is an alternative to CDC (listen/notify or logical replication) for environments where it is not available.
+const OutboxSchema = `
+CREATE TABLE IF NOT EXISTS outbox(
+	id VARCHAR (50) PRIMARY KEY,
+	aggregate_id VARCHAR (50) NOT NULL,
+	aggregate_id_hash INTEGER NOT NULL,
+	aggregate_version INTEGER NOT NULL,
+	aggregate_type VARCHAR (50) NOT NULL,
+	kind VARCHAR (50) NOT NULL,
+	body bytea NOT NULL,
+	idempotency_key VARCHAR (50),
+	labels JSONB,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+	published_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_published_at_idx ON outbox (published_at);
+
+CREATE OR REPLACE FUNCTION outbox_event() RETURNS TRIGGER AS $FN$
+	BEGIN
+		INSERT INTO outbox (id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at)
+		VALUES (NEW.id, NEW.aggregate_id, NEW.aggregate_id_hash, NEW.aggregate_version, NEW.aggregate_type, NEW.kind, NEW.body, NEW.idempotency_key, NEW.labels, NEW.created_at);
+
+		-- Result is ignored since this is an AFTER trigger
+		RETURN NULL;
+	END;
+$FN$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS events_outbox_event ON events;
+CREATE TRIGGER events_outbox_event
+AFTER INSERT ON events
+	FOR EACH ROW EXECUTE PROCEDURE outbox_event();
+`
+
+const outboxColumns = "id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at"
+
+var _ player.Repository = (*OutboxRepository)(nil)
+
+// OutboxRepository reads the events, not yet published, from the outbox table (see OutboxSchema).
+// It is meant to be used by the poller, with the sinker wrapped by WrapSinker so that the outbox rows are marked as published after sinking.
+// Since only unpublished rows are read, marking a row as published is what advances the position of the feed.
+// Published rows can be removed with PurgePublished, bounding the growth of the outbox table.
+type OutboxRepository struct {
+	db         *sqlx.DB
+	labelCodec eventstore.Codec
+}
+
+type OutboxOption func(*OutboxRepository)
+
+// WithOutboxLabelCodec sets the codec used to deserialize the event labels. Defaults to eventstore.JSONCodec.
+// It must match the one used by the store.
+func WithOutboxLabelCodec(codec eventstore.Codec) OutboxOption {
+	return func(r *OutboxRepository) {
+		r.labelCodec = codec
+	}
+}
+
+func NewOutboxRepository(connString string, options ...OutboxOption) (*OutboxRepository, error) {
+	db, err := sqlx.Open(driverName, connString)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	r := &OutboxRepository{
+		db:         db,
+		labelCodec: eventstore.JSONCodec{},
+	}
+	for _, o := range options {
+		o(r)
+	}
+	return r, nil
+}
+
+// InstallOutbox creates the outbox table and trigger
+func (r *OutboxRepository) InstallOutbox(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, OutboxSchema)
+	if err != nil {
+		return faults.Errorf("Unable to install the outbox: %w", err)
+	}
+	return nil
+}
+
+func (r *OutboxRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT id FROM outbox WHERE published_at IS NULL ")
+	args := []interface{}{}
+	if trailingLag != time.Duration(0) {
+		safetyMargin := time.Now().UTC().Add(-trailingLag)
+		args = append(args, safetyMargin)
+		query.WriteString("AND created_at <= $1 ")
+	}
+	args = buildFilter(filter, "labels", &query, args)
+	query.WriteString(" ORDER BY id DESC LIMIT 1")
+	var eventID string
+	if err := r.db.GetContext(ctx, &eventID, query.String(), args...); err != nil {
+		if err != sql.ErrNoRows {
+			return "", faults.Errorf("Unable to get the last outbox event ID: %w", err)
+		}
+	}
+	return eventID, nil
+}
+
+// GetEvents returns the events, not yet published, after afterEventID
+func (r *OutboxRepository) GetEvents(ctx context.Context, afterEventID string, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	columns := outboxColumns
+	if filter.Projection == store.MinimalProjection {
+		columns = minimalColumns
+	}
+	var query bytes.Buffer
+	query.WriteString("SELECT " + columns + " FROM outbox WHERE published_at IS NULL AND id > $1 ")
+	args := []interface{}{afterEventID}
+	if trailingLag != time.Duration(0) {
+		safetyMargin := time.Now().UTC().Add(-trailingLag)
+		args = append(args, safetyMargin)
+		query.WriteString("AND created_at <= $2 ")
+	}
+	args = buildFilter(filter, "labels", &query, args)
+	query.WriteString(" ORDER BY id ASC")
+	if batchSize > 0 {
+		query.WriteString(" LIMIT ")
+		query.WriteString(strconv.Itoa(batchSize))
+	}
+
+	events, err := queryEvents(ctx, r.db, r.labelCodec, query.String(), args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get outbox events after '%s' for filter %+v: %w", afterEventID, filter, err)
+	}
+	return events, nil
+}
+
+// MarkPublished sets the publishing time of the outbox rows
+func (r *OutboxRepository) MarkPublished(ctx context.Context, eventIDs ...string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	_, err := r.db.ExecContext(ctx, "UPDATE outbox SET published_at = $1 WHERE id = ANY($2) AND published_at IS NULL", time.Now().UTC(), pq.Array(eventIDs))
+	if err != nil {
+		return faults.Errorf("Unable to mark outbox events %v as published: %w", eventIDs, err)
+	}
+	return nil
+}
+
+// PurgePublished deletes the outbox rows published before olderThan
+func (r *OutboxRepository) PurgePublished(ctx context.Context, olderThan time.Time) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM outbox WHERE published_at < $1", olderThan.UTC())
+	if err != nil {
+		return faults.Errorf("Unable to purge outbox events published before %s: %w", olderThan, err)
+	}
+	return nil
+}
+
+// WrapSinker returns a sinker that marks the outbox row as published after successfully sinking the event
+func (r *OutboxRepository) WrapSinker(sinker sink.Sinker) sink.Sinker {
+	return outboxSinker{
+		Sinker: sinker,
+		outbox: r,
+	}
+}
+
+func (r *OutboxRepository) Close() error {
+	return r.db.Close()
+}
+
+type outboxSinker struct {
+	sink.Sinker
+	outbox *OutboxRepository
+}
+
+func (s outboxSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	err := s.Sinker.Sink(ctx, e)
+	if err != nil {
+		return err
+	}
+	return s.outbox.MarkPublished(ctx, e.ID)
+}
+
+func (s outboxSinker) Flush(ctx context.Context) error {
+	return sink.Flush(ctx, s.Sinker)
+}
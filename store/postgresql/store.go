@@ -4,37 +4,46 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/quintans/eventstore"
 	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/eventid"
 	"github.com/quintans/eventstore/store"
 	"github.com/quintans/faults"
 )
 
 const (
-	driverName        = "postgres"
-	pgUniqueViolation = "23505"
+	driverName            = "postgres"
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
 )
 
 // Event is the event data stored in the database
 type Event struct {
-	ID               string    `db:"id"`
-	AggregateID      string    `db:"aggregate_id"`
-	AggregateIDHash  int32     `db:"aggregate_id_hash"`
-	AggregateVersion uint32    `db:"aggregate_version"`
-	AggregateType    string    `db:"aggregate_type"`
-	Kind             string    `db:"kind"`
-	Body             []byte    `db:"body"`
-	IdempotencyKey   NilString `db:"idempotency_key"`
-	Labels           []byte    `db:"labels"`
-	CreatedAt        time.Time `db:"created_at"`
+	ID               string     `db:"id"`
+	AggregateID      string     `db:"aggregate_id"`
+	AggregateIDHash  int32      `db:"aggregate_id_hash"`
+	AggregateVersion uint32     `db:"aggregate_version"`
+	AggregateType    string     `db:"aggregate_type"`
+	Kind             string     `db:"kind"`
+	Body             []byte     `db:"body"`
+	IdempotencyKey   NilString  `db:"idempotency_key"`
+	ExternalID       NilString  `db:"external_id"`
+	Labels           []byte     `db:"labels"`
+	MetadataLabels   []byte     `db:"metadata_labels"`
+	CreatedAt        time.Time  `db:"created_at"`
+	ExpiresAt        *time.Time `db:"expires_at"`
+	Epoch            uint32     `db:"epoch"`
+	// Position is the value of the ordering column (see WithOrderingColumn)
+	Position sql.NullInt64 `db:"position"`
 }
 
 // NilString converts nil to empty string
@@ -65,7 +74,10 @@ type Snapshot struct {
 	CreatedAt        time.Time `db:"created_at,omitempty"`
 }
 
-var _ eventstore.EsRepository = (*EsRepository)(nil)
+var (
+	_ eventstore.EsRepository     = (*EsRepository)(nil)
+	_ eventstore.ConsistentReader = (*EsRepository)(nil)
+)
 
 type StoreOption func(*EsRepository)
 
@@ -77,9 +89,110 @@ func ProjectorFactoryOption(fn ProjectorFactory) StoreOption {
 	}
 }
 
+// WithConnectRetry makes the store ping the database on creation, retrying up to attempts times,
+// doubling the backoff between each attempt, before giving up.
+func WithConnectRetry(attempts int, backoff time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.connectAttempts = attempts
+		r.connectBackoff = backoff
+	}
+}
+
+// WithUniqueViolation sets how the errors of the database driver are recognized as unique violations.
+// Defaults to recognizing the errors of lib/pq and pgx.
+func WithUniqueViolation(detector store.UniqueViolationDetector) StoreOption {
+	return func(r *EsRepository) {
+		r.uniqueViolation = detector
+	}
+}
+
+// WithReadIsolation reads the snapshot and the events of an aggregate in one read only transaction with the isolation level,
+// eg: sql.LevelRepeatableRead, so that both reads see the same point in time.
+// By default there is no transaction: since events are only appended and a snapshot never changes,
+// the events read after the snapshot version always complete it, at most with saves committed after the snapshot read.
+func WithReadIsolation(level sql.IsolationLevel) StoreOption {
+	return func(r *EsRepository) {
+		r.readIsolation = level
+	}
+}
+
+// QueryLogger receives the SQL, and its arguments, of the queries built from filters
+type QueryLogger func(sql string, args []interface{})
+
+// WithQueryLogger calls logger with the SQL and arguments of GetEvents and GetLastEventID, before executing them,
+// to help diagnosing filters. It is disabled by default, since the arguments may hold sensitive data.
+func WithQueryLogger(logger QueryLogger) StoreOption {
+	return func(r *EsRepository) {
+		r.queryLogger = logger
+	}
+}
+
+// WithLabelCodec sets the codec used to serialize the event labels. Defaults to eventstore.JSONCodec.
+// Since the labels are stored in JSONB columns, the codec must still produce JSON,
+// eg: to control how numbers or dates are represented.
+// The feeds reading these events must be configured with the same codec.
+func WithLabelCodec(codec eventstore.Codec) StoreOption {
+	return func(r *EsRepository) {
+		r.labelCodec = codec
+	}
+}
+
+// WithLabelColumns splits the labels between two columns:
+// the labels with the indexedKeys are stored in indexedColumn, the one used by the filters, and the remaining labels are stored in metadataColumn.
+// This keeps the GIN index of the indexed column small when there are high cardinality labels that are never filtered on.
+// If metadataColumn is empty, all labels are stored in indexedColumn.
+// The event feeds only read the labels from the column named "labels".
+// The events are then read by listing the columns, so the events table must have the optional external_id and expires_at columns (see ExpirySchema).
+// Use MigrateLabelColumns to migrate an existing events table.
+func WithLabelColumns(indexedColumn, metadataColumn string, indexedKeys ...string) StoreOption {
+	return func(r *EsRepository) {
+		r.labelsColumn = indexedColumn
+		r.metadataColumn = metadataColumn
+		r.indexedKeys = indexedKeys
+	}
+}
+
+// WithOrderingColumn orders the events by column, eg: a BIGSERIAL seq column, instead of by the event ID.
+// GetEvents and GetLastEventID then read the events after a position in column,
+// the value of column zero padded to 20 digits (see FormatPosition), so that the positions still sort as strings.
+// GetEvents returns the position of each event as its resume token, keeping the stored event ID,
+// and the players, the pollers and the checkpoints keep these positions (see store.EventPosition).
+// Event IDs are still accepted as positions, eg: the ones of a poller max age, and read the events after the last one up to that event ID.
+// The listen/notify feed only knows the event IDs, so it is not supported with an ordering column.
+// As with WithLabelColumns, the events table must have the optional external_id and expires_at columns.
+// Like the event IDs, the sequence values are not committed in order, so a trailing lag is still required.
+func WithOrderingColumn(column string) StoreOption {
+	return func(r *EsRepository) {
+		r.orderingColumn = column
+	}
+}
+
+// WithCommitOrder makes the event IDs follow the commit order, even with concurrent writers,
+// so that the feeds never read an ID lower than one already read, without relying on the trailing lag.
+// The writers are serialized by a transaction advisory lock, held until commit, and, once it is acquired,
+// the IDs are generated in a millisecond after the one of the last committed ID,
+// which may move the creation time of the events a few milliseconds ahead.
+// This trades write throughput for ordering.
+func WithCommitOrder() StoreOption {
+	return func(r *EsRepository) {
+		r.commitOrder = true
+	}
+}
+
 type EsRepository struct {
 	db               *sqlx.DB
 	projectorFactory ProjectorFactory
+	connectAttempts  int
+	connectBackoff   time.Duration
+	readIsolation    sql.IsolationLevel
+	labelsColumn     string
+	metadataColumn   string
+	indexedKeys      []string
+	labelCodec       eventstore.Codec
+	queryLogger      QueryLogger
+	commitOrder      bool
+	orderingColumn   string
+	uniqueViolation  store.UniqueViolationDetector
 }
 
 func NewStore(connString string, options ...StoreOption) (*EsRepository, error) {
@@ -90,73 +203,208 @@ func NewStore(connString string, options ...StoreOption) (*EsRepository, error)
 
 	dbx := sqlx.NewDb(db, driverName)
 	r := &EsRepository{
-		db: dbx,
+		db:           dbx,
+		labelsColumn: "labels",
+		labelCodec:   eventstore.JSONCodec{},
+		uniqueViolation: func(err error) bool {
+			return IsPqUniqueViolation(err) || IsPgxUniqueViolation(err)
+		},
 	}
 
 	for _, o := range options {
 		o(r)
 	}
 
+	if r.connectAttempts > 0 {
+		err = common.Retry(context.Background(), r.connectAttempts, r.connectBackoff, func() error {
+			return db.Ping()
+		})
+		if err != nil {
+			return nil, faults.Errorf("Unable to connect to the database: %w", err)
+		}
+	}
+
 	return r, nil
 }
 
-func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, uint32, error) {
-	labels, err := json.Marshal(eRec.Labels)
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, []eventstore.Event, error) {
+	labels, err := r.marshalLabels(eRec.Labels)
 	if err != nil {
-		return "", 0, faults.Wrap(err)
+		return "", nil, err
 	}
 
+	// the key is either kept with the events or in the idempotency keys table (see eventstore.WithIdempotencyStore)
 	var idempotencyKey *string
-	if eRec.IdempotencyKey != "" {
+	if eRec.IdempotencyKey != "" && eRec.IdempotencyTTL == nil {
 		idempotencyKey = &eRec.IdempotencyKey
 	}
 
-	version := eRec.Version
-	var id string
+	// the expiry column is only required when expiring events
+	columns := r.labelColumns()
+	extra := labels
+	if !eRec.ExpiresAt.IsZero() {
+		columns += ", expires_at"
+		extra = append(extra, eRec.ExpiresAt)
+	}
+	// and the external ID column only when saving external IDs
+	withExternalIDs := hasExternalIDs(eRec)
+	if withExternalIDs {
+		columns += ", external_id"
+	}
+
+	var events []eventstore.Event
 	err = r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		version := eRec.Version
+		createdAt := eRec.CreatedAt
+		events = make([]eventstore.Event, 0, len(eRec.Details))
+		if r.commitOrder {
+			createdAt, err = lockCommitOrder(ctx, tx, createdAt)
+			if err != nil {
+				return err
+			}
+		}
+		if eRec.ExpectedVersion != nil {
+			err = checkExpectedVersion(c, tx, eRec.AggregateID, *eRec.ExpectedVersion)
+			if err != nil {
+				return err
+			}
+		}
+		if eRec.IdempotencyKey != "" && eRec.IdempotencyTTL != nil {
+			err = recordIdempotencyKey(c, tx, eRec.AggregateType, eRec.IdempotencyKey, *eRec.IdempotencyTTL)
+			if err != nil {
+				return err
+			}
+		}
 		var projector store.Projector
 		if r.projectorFactory != nil {
 			projector = r.projectorFactory(tx)
 		}
 		for _, e := range eRec.Details {
 			version++
-			id = common.NewEventID(eRec.CreatedAt, eRec.AggregateID, version)
+			id := common.NewEventIDWithNode(createdAt, eRec.AggregateID, version, eRec.NodeID)
 			hash := common.Hash(eRec.AggregateID)
+			values := append([]interface{}{id, eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, createdAt, int32ring(hash), eRec.Epoch}, extra...)
+			if withExternalIDs {
+				values = append(values, nilIfEmpty(e.ExternalID))
+			}
 			_, err = tx.ExecContext(ctx,
-				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at, aggregate_id_hash)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-				id, eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, labels, eRec.CreatedAt, int32ring(hash))
+				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, created_at, aggregate_id_hash, epoch, `+columns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, `+labelParams(11, len(values)-10)+`)`,
+				values...)
 
 			if err != nil {
-				if isDup(err) {
-					return eventstore.ErrConcurrentModification
+				if r.uniqueViolation(err) {
+					return r.dupError(ctx, eRec)
 				}
 				return faults.Errorf("Unable to insert event: %w", err)
 			}
 
+			evt := eventstore.Event{
+				ID:               id,
+				AggregateID:      eRec.AggregateID,
+				AggregateIDHash:  hash,
+				AggregateVersion: version,
+				AggregateType:    eRec.AggregateType,
+				Kind:             e.Kind,
+				Body:             e.Body,
+				IdempotencyKey:   eRec.IdempotencyKey,
+				ExternalID:       e.ExternalID,
+				Labels:           eRec.Labels,
+				CreatedAt:        createdAt,
+				Epoch:            eRec.Epoch,
+			}
 			if projector != nil {
-				evt := eventstore.Event{
-					ID:               id,
-					AggregateID:      eRec.AggregateID,
-					AggregateIDHash:  hash,
-					AggregateVersion: version,
-					AggregateType:    eRec.AggregateType,
-					Kind:             e.Kind,
-					Body:             e.Body,
-					Labels:           eRec.Labels,
-					CreatedAt:        eRec.CreatedAt,
-				}
 				projector.Project(evt)
 			}
+			events = append(events, evt)
 		}
 
 		return nil
 	})
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
 
-	return id, version, nil
+	return events[len(events)-1].ID, events, nil
+}
+
+// commitOrderLockName is the name of the transaction advisory lock serializing the writers (see WithCommitOrder)
+const commitOrderLockName = "eventstore:commit_order"
+
+// snapshotLockPrefix prefixes the aggregate ID in the name of the transaction advisory lock serializing the snapshot writers
+const snapshotLockPrefix = "eventstore:snapshot:"
+
+// lockCommitOrder waits for the previous writers to commit and returns the creation time for the new events,
+// in a millisecond after the one of the last committed event ID.
+// Only a later millisecond guarantees a greater ID, since IDs of the same millisecond are ordered by aggregate ID.
+func lockCommitOrder(ctx context.Context, tx *sql.Tx, createdAt time.Time) (time.Time, error) {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", int64(common.Hash(commitOrderLockName)))
+	if err != nil {
+		return time.Time{}, faults.Errorf("Unable to acquire the commit order lock: %w", err)
+	}
+
+	var lastID string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM events ORDER BY id DESC LIMIT 1").Scan(&lastID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return createdAt, nil
+	}
+	if err != nil {
+		return time.Time{}, faults.Errorf("Unable to get the last event ID: %w", err)
+	}
+	eid, err := eventid.Parse(lastID)
+	if err != nil {
+		return time.Time{}, faults.Errorf("Unable to parse the last event ID '%s': %w", lastID, err)
+	}
+	last := eid.Time()
+	if !createdAt.Truncate(time.Millisecond).After(last) {
+		createdAt = last.Add(time.Millisecond)
+	}
+	return createdAt, nil
+}
+
+// ImportEvents inserts the events verbatim, preserving their IDs, versions and creation times.
+// Events that already exist, with the same ID, are ignored, so that an interrupted import can be safely repeated.
+// Since every event has its own version, events from stores that share a version between events,
+// like MongoDB when saving more than one event at once, will fail with ErrConcurrentModification.
+func (r *EsRepository) ImportEvents(ctx context.Context, events []eventstore.Event) error {
+	return r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		for _, e := range events {
+			labels, err := r.marshalLabels(e.Labels)
+			if err != nil {
+				return err
+			}
+			var idempotencyKey *string
+			if e.IdempotencyKey != "" {
+				idempotencyKey = &e.IdempotencyKey
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, created_at, aggregate_id_hash, epoch, `+r.labelColumns()+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, `+labelParams(11, len(labels))+`)
+			ON CONFLICT (id) DO NOTHING`,
+				append([]interface{}{e.ID, e.AggregateID, e.AggregateVersion, e.AggregateType, e.Kind, []byte(e.Body), idempotencyKey, e.CreatedAt, int32ring(common.Hash(e.AggregateID)), e.Epoch}, labels...)...)
+			if err != nil {
+				if r.uniqueViolation(err) {
+					return faults.Errorf("Unable to import event '%s': %w", e.ID, eventstore.ErrConcurrentModification)
+				}
+				return faults.Errorf("Unable to import event '%s': %w", e.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// checkExpectedVersion fails with eventstore.ErrConcurrentModification if the stored version of the aggregate is not expected.
+// A concurrent save committed after the check is still caught by the unique index on the aggregate version.
+func checkExpectedVersion(ctx context.Context, tx *sql.Tx, aggregateID string, expected uint32) error {
+	var version uint32
+	err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(aggregate_version), 0) FROM events WHERE aggregate_id = $1", aggregateID).Scan(&version)
+	if err != nil {
+		return faults.Errorf("Unable to get the version of aggregate '%s': %w", aggregateID, err)
+	}
+	if version != expected {
+		return faults.Errorf("Unable to save aggregate '%s' at version %d, expecting version %d: %w", aggregateID, version, expected, eventstore.ErrConcurrentModification)
+	}
+	return nil
 }
 
 func int32ring(x uint32) int32 {
@@ -170,14 +418,80 @@ func int32ring(x uint32) int32 {
 	return h
 }
 
-func isDup(err error) bool {
+// IsPqUniqueViolation tells if err is a unique violation reported by the lib/pq driver
+func IsPqUniqueViolation(err error) bool {
+	var pgerr *pq.Error
+	return errors.As(err, &pgerr) && pgerr.Code == pgUniqueViolation
+}
+
+// IsPgxUniqueViolation tells if err is a unique violation reported by the pgx driver
+func IsPgxUniqueViolation(err error) bool {
+	var pgerr *pgconn.PgError
+	return errors.As(err, &pgerr) && pgerr.Code == pgUniqueViolation
+}
+
+func isFKViolation(err error) bool {
 	pgerr, ok := err.(*pq.Error)
-	return ok && pgerr.Code == pgUniqueViolation
+	return ok && pgerr.Code == pgForeignKeyViolation
+}
+
+// dupError tells apart which unique index the save violated:
+// if the idempotency key is already taken the save is a duplicate request, otherwise it is a version conflict.
+// The check is done after the failed insert, so that concurrent saves with the same key are detected atomically by the unique index.
+func (r *EsRepository) dupError(ctx context.Context, eRec eventstore.EventRecord) error {
+	if eRec.IdempotencyKey != "" {
+		found, err := r.HasIdempotencyKey(ctx, eRec.AggregateType, eRec.IdempotencyKey)
+		if err == nil && found {
+			return faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyKeyConflict)
+		}
+	}
+	for _, e := range eRec.Details {
+		if e.ExternalID == "" {
+			continue
+		}
+		_, err := r.GetByExternalID(ctx, e.ExternalID)
+		if err == nil {
+			return faults.Errorf("Unable to save aggregate '%s' with external ID '%s': %w", eRec.AggregateID, e.ExternalID, eventstore.ErrExternalIDConflict)
+		}
+	}
+	return eventstore.ErrConcurrentModification
+}
+
+// hasExternalIDs tells if any of the events of the record has an external ID
+func hasExternalIDs(eRec eventstore.EventRecord) bool {
+	for _, e := range eRec.Details {
+		if e.ExternalID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (r *EsRepository) GetByExternalID(ctx context.Context, externalID string) (eventstore.Event, error) {
+	events, err := queryEvents(ctx, r.db, r.labelCodec, "SELECT "+r.selectColumns(store.FullProjection)+" FROM events WHERE external_id = $1", externalID)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, eventstore.ErrEventNotFound)
+	}
+	return events[0], nil
 }
 
 func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventstore.Snapshot, error) {
+	return r.getSnapshot(ctx, r.db, aggregateID)
+}
+
+func (r *EsRepository) getSnapshot(ctx context.Context, q sqlx.QueryerContext, aggregateID string) (eventstore.Snapshot, error) {
 	snap := Snapshot{}
-	if err := r.db.GetContext(ctx, &snap, "SELECT * FROM snapshots WHERE aggregate_id = $1 ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
+	if err := sqlx.GetContext(ctx, q, &snap, "SELECT * FROM snapshots WHERE aggregate_id = $1 ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
 		if err == sql.ErrNoRows {
 			return eventstore.Snapshot{}, nil
 		}
@@ -193,6 +507,23 @@ func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eve
 	}, nil
 }
 
+func (r *EsRepository) GetSnapshotMeta(ctx context.Context, aggregateID string) (eventstore.SnapshotMeta, error) {
+	snap := Snapshot{}
+	if err := r.db.GetContext(ctx, &snap, "SELECT aggregate_version, created_at FROM snapshots WHERE aggregate_id = $1 ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return eventstore.SnapshotMeta{}, nil
+		}
+		return eventstore.SnapshotMeta{}, faults.Errorf("Unable to get snapshot metadata for aggregate '%s': %w", aggregateID, err)
+	}
+	return eventstore.SnapshotMeta{
+		Exists:           true,
+		AggregateVersion: snap.AggregateVersion,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+// SaveSnapshot persists the snapshot unless the aggregate already has a snapshot at the same or at a newer version,
+// making the snapshot writes monotonic. Saving the same snapshot again replaces it.
 func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Snapshot) error {
 	s := Snapshot{
 		ID:               snapshot.ID,
@@ -202,16 +533,93 @@ func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Sna
 		Body:             snapshot.Body,
 		CreatedAt:        snapshot.CreatedAt,
 	}
-	_, err := r.db.NamedExecContext(ctx,
-		`INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
-	     VALUES (:id, :aggregate_id, :aggregate_version, :aggregate_type, :body, :created_at)`, s)
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		// serialize the snapshot writers of the same aggregate
+		_, err := tx.ExecContext(c, "SELECT pg_advisory_xact_lock($1)", int64(common.Hash(snapshotLockPrefix+s.AggregateID)))
+		if err != nil {
+			return faults.Errorf("Unable to lock snapshots of aggregate '%s': %w", s.AggregateID, err)
+		}
+		var newer bool
+		err = tx.QueryRowContext(c,
+			`SELECT EXISTS(SELECT 1 FROM snapshots WHERE aggregate_id = $1 AND id <> $2 AND aggregate_version >= $3)`,
+			s.AggregateID, s.ID, s.AggregateVersion,
+		).Scan(&newer)
+		if err != nil {
+			return faults.Errorf("Unable to check the snapshots of aggregate '%s': %w", s.AggregateID, err)
+		}
+		if newer {
+			return nil
+		}
+		_, err = tx.ExecContext(c,
+			`INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO UPDATE SET body = EXCLUDED.body, created_at = EXCLUDED.created_at`,
+			s.ID, s.AggregateID, s.AggregateVersion, s.AggregateType, s.Body, s.CreatedAt,
+		)
+		return err
+	})
+	if err != nil {
+		if isFKViolation(err) {
+			return faults.Errorf("Unable to save snapshot '%s' of aggregate '%s': %w", s.ID, s.AggregateID, eventstore.ErrSnapshotEventMissing)
+		}
+		return faults.Wrap(err)
+	}
+	return nil
+}
 
-	return faults.Wrap(err)
+// DropSnapshotForeignKey drops the foreign keys from the snapshots table to the events table.
+// Use it on deployments that compact the events, where the event referenced by a snapshot may be gone.
+func (r *EsRepository) DropSnapshotForeignKey(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `DO $$
+	DECLARE c text;
+	BEGIN
+		FOR c IN SELECT conname FROM pg_constraint WHERE conrelid = 'snapshots'::regclass AND contype = 'f' LOOP
+			EXECUTE 'ALTER TABLE snapshots DROP CONSTRAINT ' || quote_ident(c);
+		END LOOP;
+	END $$;`)
+	if err != nil {
+		return faults.Errorf("Unable to drop the snapshot foreign keys: %w", err)
+	}
+	return nil
 }
 
 func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventstore.Event, error) {
+	return r.getAggregateEvents(ctx, r.db, aggregateID, snapVersion)
+}
+
+// GetSnapshotAndEvents reads the latest snapshot and the events after it,
+// in the same transaction if a read isolation level was set with WithReadIsolation.
+func (r *EsRepository) GetSnapshotAndEvents(ctx context.Context, aggregateID string) (eventstore.Snapshot, []eventstore.Event, error) {
+	var q sqlx.QueryerContext = r.db
+	if r.readIsolation != sql.LevelDefault {
+		tx, err := r.db.BeginTxx(ctx, &sql.TxOptions{Isolation: r.readIsolation, ReadOnly: true})
+		if err != nil {
+			return eventstore.Snapshot{}, nil, faults.Wrap(err)
+		}
+		defer tx.Rollback()
+		q = tx
+	}
+
+	snap, err := r.getSnapshot(ctx, q, aggregateID)
+	if err != nil {
+		return eventstore.Snapshot{}, nil, err
+	}
+
+	snapVersion := -1
+	if snap.AggregateID != "" {
+		snapVersion = int(snap.AggregateVersion)
+	}
+	events, err := r.getAggregateEvents(ctx, q, aggregateID, snapVersion)
+	if err != nil {
+		return eventstore.Snapshot{}, nil, err
+	}
+
+	return snap, events, nil
+}
+
+func (r *EsRepository) getAggregateEvents(ctx context.Context, q sqlx.QueryerContext, aggregateID string, snapVersion int) ([]eventstore.Event, error) {
 	var query bytes.Buffer
-	query.WriteString("SELECT * FROM events e WHERE e.aggregate_id = $1")
+	query.WriteString("SELECT " + r.selectColumns(store.FullProjection) + " FROM events e WHERE e.aggregate_id = $1")
 	args := []interface{}{aggregateID}
 	if snapVersion > -1 {
 		query.WriteString(" AND e.aggregate_version > $2")
@@ -219,7 +627,7 @@ func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID strin
 	}
 	query.WriteString(" ORDER BY aggregate_version ASC")
 
-	events, err := r.queryEvents(ctx, query.String(), args...)
+	events, err := queryEvents(ctx, q, r.labelCodec, query.String(), args...)
 	if err != nil {
 		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
 	}
@@ -227,6 +635,27 @@ func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID strin
 	return events, nil
 }
 
+func (r *EsRepository) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	var version uint32
+	err := r.db.GetContext(ctx, &version, "SELECT COALESCE(MAX(aggregate_version), 0) FROM events WHERE aggregate_id = $1", aggregateID)
+	if err != nil {
+		return 0, faults.Errorf("Unable to get the current version of aggregate '%s': %w", aggregateID, err)
+	}
+	return version, nil
+}
+
+func (r *EsRepository) GetCreationEvent(ctx context.Context, aggregateID string) (eventstore.Event, error) {
+	events, err := queryEvents(ctx, r.db, r.labelCodec,
+		"SELECT "+r.selectColumns(store.FullProjection)+" FROM events e WHERE e.aggregate_id = $1 AND e.aggregate_version = 1", aggregateID)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, eventstore.ErrAggregateNotFound)
+	}
+	return events[0], nil
+}
+
 func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) (err error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -261,7 +690,7 @@ func (r *EsRepository) Forget(ctx context.Context, request eventstore.ForgetRequ
 	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
 
 	// Forget events
-	events, err := r.queryEvents(ctx, "SELECT * FROM events WHERE aggregate_id = $1 AND kind = $2", request.AggregateID, request.EventKind)
+	events, err := queryEvents(ctx, r.db, r.labelCodec, "SELECT "+r.selectColumns(store.FullProjection)+" FROM events WHERE aggregate_id = $1 AND kind = $2", request.AggregateID, request.EventKind)
 	if err != nil {
 		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
 	}
@@ -302,15 +731,30 @@ func (r *EsRepository) Forget(ctx context.Context, request eventstore.ForgetRequ
 
 func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
 	var query bytes.Buffer
-	query.WriteString("SELECT * FROM events ")
+	column := r.positionColumn()
+	query.WriteString("SELECT " + column + " FROM events WHERE 1 = 1 ")
 	args := []interface{}{}
 	if trailingLag != time.Duration(0) {
 		safetyMargin := time.Now().UTC().Add(-trailingLag)
 		args = append(args, safetyMargin)
-		query.WriteString("created_at <= $1 ")
+		query.WriteString("AND created_at <= $1 ")
+	}
+	args, err := r.buildPositionFilter(ctx, filter, &query, args)
+	if err != nil {
+		return "", err
+	}
+	query.WriteString(" ORDER BY " + column + " DESC LIMIT 1")
+	r.logQuery(query.String(), args)
+	if r.orderingColumn != "" {
+		var position int64
+		if err := r.db.GetContext(ctx, &position, query.String(), args...); err != nil {
+			if err != sql.ErrNoRows {
+				return "", faults.Errorf("Unable to get the last event position: %w", err)
+			}
+			return "", nil
+		}
+		return FormatPosition(position), nil
 	}
-	args = buildFilter(filter, &query, args)
-	query.WriteString(" ORDER BY id DESC LIMIT 1")
 	var eventID string
 	if err := r.db.GetContext(ctx, &eventID, query.String(), args...); err != nil {
 		if err != sql.ErrNoRows {
@@ -322,37 +766,173 @@ func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Dura
 
 func (r *EsRepository) GetEvents(ctx context.Context, afterEventID string, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
 	var records []eventstore.Event
-	for len(records) < batchSize {
+	// with no batch size, all the events are read in a single pass
+	for batchSize <= 0 || len(records) < batchSize {
 		var query bytes.Buffer
-		query.WriteString("SELECT * FROM events WHERE id > $1 ")
-		args := []interface{}{afterEventID}
+		column := r.positionColumn()
+		after, err := r.position(ctx, afterEventID)
+		if err != nil {
+			return nil, err
+		}
+		query.WriteString("SELECT " + r.positionColumns(filter.Projection) + " FROM events WHERE " + column + " > $1 ")
+		args := []interface{}{after}
 		if trailingLag != time.Duration(0) {
 			safetyMargin := time.Now().UTC().Add(-trailingLag)
 			args = append(args, safetyMargin)
 			query.WriteString("AND created_at <= $2 ")
 		}
-		args = buildFilter(filter, &query, args)
-		query.WriteString(" ORDER BY id ASC")
+		args, err = r.buildPositionFilter(ctx, filter, &query, args)
+		if err != nil {
+			return nil, err
+		}
+		query.WriteString(" ORDER BY " + column + " ASC")
 		if batchSize > 0 {
 			query.WriteString(" LIMIT ")
-			query.WriteString(strconv.Itoa(batchSize))
+			query.WriteString(strconv.Itoa(batchSize - len(records)))
 		}
 
-		rows, err := r.queryEvents(ctx, query.String(), args...)
+		r.logQuery(query.String(), args)
+		rows, err := queryEvents(ctx, r.db, r.labelCodec, query.String(), args...)
 		if err != nil {
-			return nil, faults.Errorf("Unable to get events after '%s' for filter %+v: %w", afterEventID, filter, err)
+			err = faults.Errorf("Unable to get events after '%s' for filter %+v: %w", afterEventID, filter, err)
+			// the events of the previous passes were read, so they are returned too
+			records = append(records, rows...)
+			if filter.PartialResults && len(records) > 0 {
+				return records, err
+			}
+			return nil, err
 		}
 		if len(rows) == 0 {
 			return records, nil
 		}
 
-		afterEventID = rows[len(rows)-1].ID
-		records = append(rows)
+		afterEventID = store.EventPosition(rows[len(rows)-1])
+		records = append(records, rows...)
+		if batchSize <= 0 {
+			break
+		}
 	}
 	return records, nil
 }
 
-func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) []interface{} {
+// positionColumn returns the column ordering the events (see WithOrderingColumn)
+func (r *EsRepository) positionColumn() string {
+	if r.orderingColumn != "" {
+		return r.orderingColumn
+	}
+	return "id"
+}
+
+// position converts a position into the value of the ordering column.
+// An event ID, eg: from a max age, is converted into the position of the last event up to it
+func (r *EsRepository) position(ctx context.Context, eventID string) (interface{}, error) {
+	if r.orderingColumn == "" {
+		return eventID, nil
+	}
+	if eventID == "" {
+		return int64(0), nil
+	}
+	if len(eventID) != positionLen {
+		var position int64
+		query := "SELECT COALESCE(MAX(" + r.orderingColumn + "), 0) FROM events WHERE id <= $1"
+		r.logQuery(query, []interface{}{eventID})
+		if err := r.db.GetContext(ctx, &position, query, eventID); err != nil {
+			return nil, faults.Errorf("Unable to get the position of the event ID '%s': %w", eventID, err)
+		}
+		return position, nil
+	}
+	position, err := strconv.ParseInt(eventID, 10, 64)
+	if err != nil {
+		return nil, faults.Errorf("Invalid position '%s' for the ordering column %s: %w", eventID, r.orderingColumn, err)
+	}
+	return position, nil
+}
+
+// buildPositionFilter builds the filter, with the upper bound applied to the ordering column
+func (r *EsRepository) buildPositionFilter(ctx context.Context, filter store.Filter, query *bytes.Buffer, args []interface{}) ([]interface{}, error) {
+	if r.orderingColumn == "" || filter.UpperBound == "" {
+		return buildFilter(filter, r.labelsColumn, query, args), nil
+	}
+	upper, err := r.position(ctx, filter.UpperBound)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, upper)
+	query.WriteString(fmt.Sprintf(" AND %s <= $%d", r.orderingColumn, len(args)))
+	filter.UpperBound = ""
+	return buildFilter(filter, r.labelsColumn, query, args), nil
+}
+
+// positionLen is the length of a formatted position, that never collides with the length of an event ID
+const positionLen = 20
+
+// FormatPosition formats the value of the ordering column as a position that sorts as a string (see WithOrderingColumn)
+func FormatPosition(position int64) string {
+	return fmt.Sprintf("%0*d", positionLen, position)
+}
+
+// CountEvents counts the events matching the filter.
+// With filter.ApproximateCount and no conditions, the estimate of the table statistics is returned instead.
+func (r *EsRepository) CountEvents(ctx context.Context, filter store.Filter) (int64, error) {
+	var count int64
+	if filter.ApproximateCount && !filter.HasConditions() {
+		err := r.db.GetContext(ctx, &count, "SELECT GREATEST(reltuples::bigint, 0) FROM pg_class WHERE relname = 'events'")
+		if err != nil {
+			return 0, faults.Errorf("Unable to estimate the number of events: %w", err)
+		}
+		return count, nil
+	}
+
+	var query bytes.Buffer
+	query.WriteString("SELECT count(*) FROM events WHERE 1 = 1 ")
+	args := buildFilter(filter, r.labelsColumn, &query, []interface{}{})
+	r.logQuery(query.String(), args)
+	if err := r.db.GetContext(ctx, &count, query.String(), args...); err != nil {
+		return 0, faults.Errorf("Unable to count events for filter %+v: %w", filter, err)
+	}
+	return count, nil
+}
+
+func (r *EsRepository) ChangedAggregates(ctx context.Context, since time.Time, filter store.Filter) ([]store.AggregateRef, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT aggregate_id, aggregate_type, MAX(aggregate_version) AS version FROM events WHERE created_at >= $1 ")
+	args := buildFilter(filter, r.labelsColumn, &query, []interface{}{since.UTC()})
+	query.WriteString(" GROUP BY aggregate_id, aggregate_type ORDER BY aggregate_id")
+	r.logQuery(query.String(), args)
+
+	refs := []aggregateRef{}
+	if err := r.db.SelectContext(ctx, &refs, query.String(), args...); err != nil {
+		return nil, faults.Errorf("Unable to get the aggregates changed since %s for filter %+v: %w", since, filter, err)
+	}
+	return toAggregateRefs(refs), nil
+}
+
+type aggregateRef struct {
+	AggregateID   string `db:"aggregate_id"`
+	AggregateType string `db:"aggregate_type"`
+	Version       uint32 `db:"version"`
+}
+
+func toAggregateRefs(refs []aggregateRef) []store.AggregateRef {
+	result := make([]store.AggregateRef, len(refs))
+	for k, v := range refs {
+		result[k] = store.AggregateRef(v)
+	}
+	return result
+}
+
+func (r *EsRepository) logQuery(query string, args []interface{}) {
+	if r.queryLogger != nil {
+		r.queryLogger(query, args)
+	}
+}
+
+func buildFilter(filter store.Filter, labelsColumn string, query *bytes.Buffer, args []interface{}) []interface{} {
+	if filter.UpperBound != "" {
+		args = append(args, filter.UpperBound)
+		query.WriteString(fmt.Sprintf(" AND id <= $%d", len(args)))
+	}
+
 	if len(filter.AggregateTypes) > 0 {
 		query.WriteString(" AND (")
 		for k, v := range filter.AggregateTypes {
@@ -365,6 +945,11 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 		query.WriteString(")")
 	}
 
+	if len(filter.ExternalIDs) > 0 {
+		args = append(args, pq.Array(filter.ExternalIDs))
+		query.WriteString(fmt.Sprintf(" AND external_id = ANY($%d)", len(args)))
+	}
+
 	if filter.Partitions > 1 {
 		size := len(args)
 		if filter.PartitionLow == filter.PartitionHi {
@@ -385,50 +970,206 @@ func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) [
 					query.WriteString(" OR ")
 				}
 				v = escape(v)
-				query.WriteString(fmt.Sprintf(`labels  @> '{"%s": "%s"}'`, k, v))
+				query.WriteString(fmt.Sprintf(`%s  @> '{"%s": "%s"}'`, labelsColumn, k, v))
 				query.WriteString(")")
 			}
 		}
 	}
+
+	for k, values := range filter.ExcludeLabels {
+		k = escape(k)
+		for _, v := range values {
+			v = escape(v)
+			// events without labels are kept
+			query.WriteString(fmt.Sprintf(` AND NOT COALESCE(%s @> '{"%s": "%s"}', false)`, labelsColumn, k, v))
+		}
+	}
 	return args
 }
 
+const minimalColumns = "id, aggregate_id, aggregate_version, kind, body, created_at"
+
+// selectColumns returns the columns to select for the projection
+func (r *EsRepository) selectColumns(p store.Projection) string {
+	if p == store.MinimalProjection {
+		return minimalColumns
+	}
+	if r.labelsColumn == "labels" && r.metadataColumn == "" && r.orderingColumn == "" {
+		return "*"
+	}
+	// the columns are listed to alias the label columns, so the optional columns are listed too
+	columns := "id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, idempotency_key, external_id, created_at, expires_at, epoch, " + r.labelsColumn + " AS labels"
+	if r.metadataColumn != "" {
+		columns += ", " + r.metadataColumn + " AS metadata_labels"
+	}
+	return columns
+}
+
+// positionColumns returns the columns to select for the projection, with the ordering column as position (see WithOrderingColumn)
+func (r *EsRepository) positionColumns(p store.Projection) string {
+	if r.orderingColumn == "" {
+		return r.selectColumns(p)
+	}
+	return r.selectColumns(p) + ", " + r.orderingColumn + " AS position"
+}
+
+// labelColumns returns the label columns, in the same order as the values returned by marshalLabels
+func (r *EsRepository) labelColumns() string {
+	if r.metadataColumn == "" {
+		return r.labelsColumn
+	}
+	return r.labelsColumn + ", " + r.metadataColumn
+}
+
+// marshalLabels splits the labels between the indexed and the metadata columns
+func (r *EsRepository) marshalLabels(labels map[string]interface{}) ([]interface{}, error) {
+	if r.metadataColumn == "" {
+		b, err := eventstore.EncodeLabels(r.labelCodec, labels)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{b}, nil
+	}
+
+	indexed := map[string]interface{}{}
+	metadata := map[string]interface{}{}
+	for k, v := range labels {
+		if r.isIndexed(k) {
+			indexed[k] = v
+		} else {
+			metadata[k] = v
+		}
+	}
+	i, err := eventstore.EncodeLabels(r.labelCodec, indexed)
+	if err != nil {
+		return nil, err
+	}
+	m, err := eventstore.EncodeLabels(r.labelCodec, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{i, m}, nil
+}
+
+func (r *EsRepository) isIndexed(key string) bool {
+	for _, k := range r.indexedKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func labelParams(from, count int) string {
+	params := make([]string, count)
+	for k := range params {
+		params[k] = "$" + strconv.Itoa(from+k)
+	}
+	return strings.Join(params, ", ")
+}
+
+// MigrateLabelColumns migrates the events table to the label columns set by WithLabelColumns,
+// creating the missing columns and the GIN index for the indexed column, and moving the labels from the "labels" column
+// to the indexed and metadata columns, according to the indexed keys.
+// It is safe to run more than once.
+func (r *EsRepository) MigrateLabelColumns(ctx context.Context) error {
+	stmts := []string{
+		fmt.Sprintf("ALTER TABLE events ADD COLUMN IF NOT EXISTS %s JSONB NOT NULL DEFAULT '{}'", r.labelsColumn),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS evt_%s_idx ON events USING GIN (%s jsonb_path_ops)", r.labelsColumn, r.labelsColumn),
+	}
+	if r.metadataColumn != "" {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE events ADD COLUMN IF NOT EXISTS %s JSONB NOT NULL DEFAULT '{}'", r.metadataColumn))
+	}
+
+	var source string
+	if r.labelsColumn != "labels" {
+		source = "labels"
+		// the labels column is no longer written
+		stmts = append(stmts, "ALTER TABLE events ALTER COLUMN labels DROP NOT NULL")
+	} else if r.metadataColumn != "" {
+		source = r.labelsColumn
+	}
+	if source != "" {
+		if r.metadataColumn == "" {
+			stmts = append(stmts, fmt.Sprintf("UPDATE events SET %s = labels WHERE labels IS NOT NULL", r.labelsColumn))
+		} else {
+			// the metadata is set first, since the indexed column can be the source
+			stmts = append(stmts,
+				fmt.Sprintf("UPDATE events SET %s = %s || (%s - $1::TEXT[]) WHERE %s IS NOT NULL", r.metadataColumn, r.metadataColumn, source, source),
+				fmt.Sprintf(`UPDATE events SET %s = (SELECT COALESCE(jsonb_object_agg(key, value), '{}') FROM jsonb_each(%s) WHERE key = ANY($1::TEXT[])) WHERE %s IS NOT NULL`, r.labelsColumn, source, source),
+			)
+		}
+	}
+
+	return r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			var err error
+			if strings.Contains(stmt, "$1") {
+				_, err = tx.ExecContext(c, stmt, pq.Array(r.indexedKeys))
+			} else {
+				_, err = tx.ExecContext(c, stmt)
+			}
+			if err != nil {
+				return faults.Errorf("Unable to migrate label columns with '%s': %w", stmt, err)
+			}
+		}
+		return nil
+	})
+}
+
 func escape(s string) string {
 	return strings.ReplaceAll(s, "'", "''")
 }
 
-func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...interface{}) ([]eventstore.Event, error) {
-	rows, err := r.db.QueryxContext(ctx, query, args...)
+func queryEvents(ctx context.Context, q sqlx.QueryerContext, labelCodec eventstore.Decoder, query string, args ...interface{}) ([]eventstore.Event, error) {
+	rows, err := q.QueryxContext(ctx, query, args...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return []eventstore.Event{}, nil
 		}
 		return nil, faults.Errorf("Unable to query events: %w", err)
 	}
+	defer rows.Close()
+	// on failure, the events read so far are also returned
 	events := []eventstore.Event{}
 	for rows.Next() {
 		pg := Event{}
 		err := rows.StructScan(&pg)
 		if err != nil {
-			return nil, faults.Errorf("Unable to scan to struct: %w", err)
+			return events, faults.Errorf("Unable to scan to struct: %w", err)
 		}
 		labels := map[string]interface{}{}
-		err = json.Unmarshal(pg.Labels, &labels)
+		err = eventstore.DecodeLabels(labelCodec, pg.Labels, labels)
 		if err != nil {
-			return nil, faults.Errorf("Unable to unmarshal labels to map: %w", err)
+			return events, faults.Errorf("Unable to unmarshal labels of event '%s' to map: %w", pg.ID, err)
+		}
+		err = eventstore.DecodeLabels(labelCodec, pg.MetadataLabels, labels)
+		if err != nil {
+			return events, faults.Errorf("Unable to unmarshal metadata labels of event '%s' to map: %w", pg.ID, err)
 		}
 
+		var resumeToken []byte
+		if pg.Position.Valid {
+			resumeToken = []byte(FormatPosition(pg.Position.Int64))
+		}
 		events = append(events, eventstore.Event{
 			ID:               pg.ID,
+			ResumeToken:      resumeToken,
 			AggregateID:      pg.AggregateID,
 			AggregateIDHash:  uint32(pg.AggregateIDHash),
 			AggregateVersion: pg.AggregateVersion,
 			AggregateType:    pg.AggregateType,
 			Kind:             pg.Kind,
 			Body:             pg.Body,
+			IdempotencyKey:   string(pg.IdempotencyKey),
+			ExternalID:       string(pg.ExternalID),
 			Labels:           labels,
 			CreatedAt:        pg.CreatedAt,
+			Epoch:            pg.Epoch,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		return events, faults.Errorf("Unable to iterate events: %w", err)
+	}
 	return events, nil
 }
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/sink"
+)
+
+// OnPartitionProgress is called periodically with the last event seen by a feed for a partition range.
+// lastID is empty and at is zero if no event was seen yet.
+// By comparing at with the current time, it is possible to distinguish an idle partition from a stuck feed.
+type OnPartitionProgress func(low, hi uint32, lastID string, at time.Time)
+
+// ProgressSinker decorates a sinker, recording the last event that went through it
+type ProgressSinker struct {
+	sink.Sinker
+	partitionsLow uint32
+	partitionsHi  uint32
+
+	mu     sync.RWMutex
+	lastID string
+	at     time.Time
+}
+
+// NewProgressSinker wraps the sinker and, until the context is done, calls fn at every interval with the last event seen.
+func NewProgressSinker(ctx context.Context, sinker sink.Sinker, partitionsLow, partitionsHi uint32, interval time.Duration, fn OnPartitionProgress) *ProgressSinker {
+	p := &ProgressSinker{
+		Sinker:        sinker,
+		partitionsLow: partitionsLow,
+		partitionsHi:  partitionsHi,
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				lastID, at := p.LastSeen()
+				fn(p.partitionsLow, p.partitionsHi, lastID, at)
+			}
+		}
+	}()
+
+	return p
+}
+
+func (p *ProgressSinker) Sink(ctx context.Context, e eventstore.Event) error {
+	err := p.Sinker.Sink(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.lastID = e.ID
+	p.at = time.Now().UTC()
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Flush flushes the decorated sinker
+func (p *ProgressSinker) Flush(ctx context.Context) error {
+	return sink.Flush(ctx, p.Sinker)
+}
+
+// LastSeen returns the ID of the last event sunk and when it happened
+func (p *ProgressSinker) LastSeen() (string, time.Time) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastID, p.at
+}
+
+// PartitionProgress holds the configuration for progress reporting of a feed
+type PartitionProgress struct {
+	Interval time.Duration
+	Callback OnPartitionProgress
+}
+
+// Wrap decorates the sinker with progress reporting, if a callback is defined.
+func (pp PartitionProgress) Wrap(ctx context.Context, sinker sink.Sinker, partitionsLow, partitionsHi uint32) sink.Sinker {
+	if pp.Callback == nil {
+		return sinker
+	}
+	interval := pp.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return NewProgressSinker(ctx, sinker, partitionsLow, partitionsHi, interval, pp.Callback)
+}
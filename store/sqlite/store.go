@@ -0,0 +1,879 @@
+// Package sqlite keeps the events in an embedded SQLite database file.
+//
+// The labels are filtered with the JSON1 functions of SQLite, that the mattn/go-sqlite3 driver only compiles
+// with the sqlite_json build tag, eg: go build -tags sqlite_json
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/eventid"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/faults"
+)
+
+const driverName = "sqlite3"
+
+// Schema creates the events and snapshots tables.
+// It mirrors the schema of the other SQL stores, with the labels kept as JSON in a TEXT column.
+const Schema = `
+CREATE TABLE IF NOT EXISTS events(
+	id VARCHAR (50) PRIMARY KEY,
+	aggregate_id VARCHAR (50) NOT NULL,
+	aggregate_id_hash INTEGER NOT NULL,
+	aggregate_version INTEGER NOT NULL,
+	aggregate_type VARCHAR (50) NOT NULL,
+	kind VARCHAR (50) NOT NULL,
+	body BLOB NOT NULL,
+	idempotency_key VARCHAR (50),
+	labels TEXT NOT NULL DEFAULT '{}',
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	external_id VARCHAR (100),
+	epoch INTEGER NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS evt_agg_id_ver_uk ON events(aggregate_id, aggregate_version);
+CREATE UNIQUE INDEX IF NOT EXISTS evt_agg_idempot_uk ON events(aggregate_type, idempotency_key);
+CREATE UNIQUE INDEX IF NOT EXISTS evt_external_id_uk ON events(external_id);
+CREATE INDEX IF NOT EXISTS evt_created_at_idx ON events(created_at);
+
+CREATE TABLE IF NOT EXISTS snapshots(
+	id VARCHAR (50) PRIMARY KEY,
+	aggregate_id VARCHAR (50) NOT NULL,
+	aggregate_version INTEGER NOT NULL,
+	aggregate_type VARCHAR (50) NOT NULL,
+	body BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (id) REFERENCES events (id)
+);
+CREATE INDEX IF NOT EXISTS snap_agg_id_idx ON snapshots(aggregate_id);
+`
+
+// Event is the event data stored in the database
+type Event struct {
+	ID               string    `db:"id"`
+	AggregateID      string    `db:"aggregate_id"`
+	AggregateIDHash  int32     `db:"aggregate_id_hash"`
+	AggregateVersion uint32    `db:"aggregate_version"`
+	AggregateType    string    `db:"aggregate_type"`
+	Kind             string    `db:"kind"`
+	Body             []byte    `db:"body"`
+	IdempotencyKey   NilString `db:"idempotency_key"`
+	Labels           []byte    `db:"labels"`
+	CreatedAt        time.Time `db:"created_at"`
+	ExternalID       NilString `db:"external_id"`
+	Epoch            uint32    `db:"epoch"`
+	// Position is the value of the ordering column (see WithOrderingColumn)
+	Position sql.NullInt64 `db:"position"`
+}
+
+// NilString converts nil to empty string
+type NilString string
+
+// Scan implements the Scanner interface.
+func (ns *NilString) Scan(value interface{}) error {
+	if value == nil {
+		*ns = ""
+		return nil
+	}
+
+	switch s := value.(type) {
+	case string:
+		*ns = NilString(s)
+	case []byte:
+		*ns = NilString(s)
+	}
+	return nil
+}
+
+type Snapshot struct {
+	ID               string    `db:"id,omitempty"`
+	AggregateID      string    `db:"aggregate_id,omitempty"`
+	AggregateVersion uint32    `db:"aggregate_version,omitempty"`
+	AggregateType    string    `db:"aggregate_type,omitempty"`
+	Body             []byte    `db:"body,omitempty"`
+	CreatedAt        time.Time `db:"created_at,omitempty"`
+}
+
+var (
+	_ eventstore.EsRepository  = (*EsRepository)(nil)
+	_ eventstore.VersionReader = (*EsRepository)(nil)
+	_ player.Repository        = (*EsRepository)(nil)
+	_ store.Counter            = (*EsRepository)(nil)
+	_ store.ChangeLister       = (*EsRepository)(nil)
+	_ store.CreationReader     = (*EsRepository)(nil)
+	_ store.ExternalIDReader   = (*EsRepository)(nil)
+)
+
+type StoreOption func(*EsRepository)
+
+type ProjectorFactory func(*sql.Tx) store.Projector
+
+func ProjectorFactoryOption(fn ProjectorFactory) StoreOption {
+	return func(r *EsRepository) {
+		r.projectorFactory = fn
+	}
+}
+
+// WithUniqueViolation sets how the errors of the database driver are recognized as unique violations.
+// Defaults to recognizing the errors of the mattn/go-sqlite3 driver.
+func WithUniqueViolation(detector store.UniqueViolationDetector) StoreOption {
+	return func(r *EsRepository) {
+		r.uniqueViolation = detector
+	}
+}
+
+// QueryLogger receives the SQL, and its arguments, of the queries built from filters
+type QueryLogger func(sql string, args []interface{})
+
+// WithQueryLogger calls logger with the SQL and arguments of GetEvents and GetLastEventID, before executing them,
+// to help diagnosing filters. It is disabled by default, since the arguments may hold sensitive data.
+func WithQueryLogger(logger QueryLogger) StoreOption {
+	return func(r *EsRepository) {
+		r.queryLogger = logger
+	}
+}
+
+// WithLabelCodec sets the codec used to serialize the event labels. Defaults to eventstore.JSONCodec.
+// Since the labels are filtered with the JSON functions of SQLite, the codec must still produce JSON.
+func WithLabelCodec(codec eventstore.Codec) StoreOption {
+	return func(r *EsRepository) {
+		r.labelCodec = codec
+	}
+}
+
+// WithBusyTimeout sets how long a statement waits for a lock held by another process sharing the database file. Default is 5s.
+func WithBusyTimeout(timeout time.Duration) StoreOption {
+	return func(r *EsRepository) {
+		r.busyTimeout = timeout
+	}
+}
+
+// WithOrderingColumn orders the events by column, eg: rowid, instead of by the event ID.
+// GetEvents and GetLastEventID then read the events after a position in column,
+// the value of column zero padded to 20 digits (see FormatPosition), so that the positions still sort as strings.
+// GetEvents returns the position of each event as its resume token, keeping the stored event ID,
+// and the players, the pollers and the checkpoints keep these positions (see store.EventPosition).
+// Event IDs are still accepted as positions, eg: the ones of a poller max age, and read the events after the last one up to that event ID.
+func WithOrderingColumn(column string) StoreOption {
+	return func(r *EsRepository) {
+		r.orderingColumn = column
+	}
+}
+
+// WithCommitOrder makes the event IDs follow the commit order,
+// so that the feeds never read an ID lower than one already read, without relying on the trailing lag.
+// The IDs are generated in a millisecond after the one of the last committed ID,
+// which may move the creation time of the events a few milliseconds ahead.
+// The writes of the process are already serialized by the single connection,
+// and a process committing in between the read of the last ID and the insert fails the save with SQLITE_BUSY.
+func WithCommitOrder() StoreOption {
+	return func(r *EsRepository) {
+		r.commitOrder = true
+	}
+}
+
+// EsRepository keeps the events in an embedded SQLite database, for small deployments where a database server is overkill.
+//
+// SQLite has a single writer, so the repository uses a single connection,
+// serializing the writes of the process instead of failing them with SQLITE_BUSY.
+type EsRepository struct {
+	db               *sqlx.DB
+	projectorFactory ProjectorFactory
+	labelCodec       eventstore.Codec
+	queryLogger      QueryLogger
+	uniqueViolation  store.UniqueViolationDetector
+	busyTimeout      time.Duration
+	commitOrder      bool
+	orderingColumn   string
+}
+
+// NewStore opens, or creates, the SQLite database file at path, eg: "/var/lib/app/events.db".
+// The tables are not created (see InstallSchema).
+func NewStore(path string, options ...StoreOption) (*EsRepository, error) {
+	r := &EsRepository{
+		labelCodec:      eventstore.JSONCodec{},
+		uniqueViolation: IsUniqueViolation,
+		busyTimeout:     5 * time.Second,
+	}
+
+	for _, o := range options {
+		o(r)
+	}
+
+	dsn := "file:" + path + "?_foreign_keys=1&_busy_timeout=" + strconv.FormatInt(r.busyTimeout.Milliseconds(), 10)
+	db, err := sqlx.Open(driverName, dsn)
+	if err != nil {
+		return nil, faults.Wrap(err)
+	}
+	db.SetMaxOpenConns(1)
+	r.db = db
+
+	return r, nil
+}
+
+// InstallSchema creates the events and snapshots tables, if they do not exist
+func (r *EsRepository) InstallSchema(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, Schema)
+	if err != nil {
+		return faults.Errorf("Unable to install the events schema: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (r *EsRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *EsRepository) SaveEvent(ctx context.Context, eRec eventstore.EventRecord) (string, []eventstore.Event, error) {
+	if eRec.IdempotencyTTL != nil {
+		return "", nil, faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyStoreUnsupported)
+	}
+	labels, err := eventstore.EncodeLabels(r.labelCodec, eRec.Labels)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var idempotencyKey *string
+	if eRec.IdempotencyKey != "" {
+		idempotencyKey = &eRec.IdempotencyKey
+	}
+
+	var events []eventstore.Event
+	var conflict bool
+	err = r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		version := eRec.Version
+		createdAt := eRec.CreatedAt.UTC()
+		events = make([]eventstore.Event, 0, len(eRec.Details))
+		if r.commitOrder {
+			createdAt, err = nextCommitTime(c, tx, createdAt)
+			if err != nil {
+				return err
+			}
+		}
+		var projector store.Projector
+		if r.projectorFactory != nil {
+			projector = r.projectorFactory(tx)
+		}
+		for _, e := range eRec.Details {
+			version++
+			id := common.NewEventIDWithNode(createdAt, eRec.AggregateID, version, eRec.NodeID)
+			hash := common.Hash(eRec.AggregateID)
+			_, err = tx.ExecContext(c,
+				`INSERT INTO events (id, aggregate_id, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at, aggregate_id_hash, external_id, epoch)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, eRec.AggregateID, version, eRec.AggregateType, e.Kind, e.Body, idempotencyKey, string(labels), createdAt, int32ring(hash), nilIfEmpty(e.ExternalID), eRec.Epoch)
+
+			if err != nil {
+				if r.uniqueViolation(err) {
+					conflict = true
+					return err
+				}
+				return faults.Errorf("Unable to insert event: %w", err)
+			}
+
+			evt := eventstore.Event{
+				ID:               id,
+				AggregateID:      eRec.AggregateID,
+				AggregateIDHash:  hash,
+				AggregateVersion: version,
+				AggregateType:    eRec.AggregateType,
+				Kind:             e.Kind,
+				Body:             e.Body,
+				IdempotencyKey:   eRec.IdempotencyKey,
+				ExternalID:       e.ExternalID,
+				Labels:           eRec.Labels,
+				CreatedAt:        createdAt,
+				Epoch:            eRec.Epoch,
+			}
+			if projector != nil {
+				projector.Project(evt)
+			}
+			events = append(events, evt)
+		}
+
+		return nil
+	})
+	if conflict {
+		// the single connection is only free to tell apart the violated index after the rollback
+		return "", nil, r.dupError(ctx, eRec)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return events[len(events)-1].ID, events, nil
+}
+
+// nextCommitTime returns the creation time for the new events, in a millisecond after the one of the last committed event ID (see WithCommitOrder).
+// Only a later millisecond guarantees a greater ID, since IDs of the same millisecond are ordered by aggregate ID.
+func nextCommitTime(ctx context.Context, tx *sql.Tx, createdAt time.Time) (time.Time, error) {
+	var lastID string
+	err := tx.QueryRowContext(ctx, "SELECT id FROM events ORDER BY id DESC LIMIT 1").Scan(&lastID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return createdAt, nil
+	}
+	if err != nil {
+		return time.Time{}, faults.Errorf("Unable to get the last event ID: %w", err)
+	}
+	eid, err := eventid.Parse(lastID)
+	if err != nil {
+		return time.Time{}, faults.Errorf("Unable to parse the last event ID '%s': %w", lastID, err)
+	}
+	last := eid.Time()
+	if !createdAt.Truncate(time.Millisecond).After(last) {
+		createdAt = last.Add(time.Millisecond).UTC()
+	}
+	return createdAt, nil
+}
+
+func int32ring(x uint32) int32 {
+	h := int32(x)
+	// we want a positive value so that partitioning (mod) results in a positive value.
+	// if h overflows, becoming negative, setting sign bit to zero will make the overflow start from zero
+	if h < 0 {
+		// setting sign bit to zero
+		h &= 0x7fffffff
+	}
+	return h
+}
+
+// IsUniqueViolation tells if err is a unique violation reported by the mattn/go-sqlite3 driver
+func IsUniqueViolation(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && (se.ExtendedCode == sqlite3.ErrConstraintUnique || se.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+func isFKViolation(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+// dupError tells apart which unique index the save violated:
+// if the idempotency key is already taken the save is a duplicate request, otherwise it is a version conflict.
+func (r *EsRepository) dupError(ctx context.Context, eRec eventstore.EventRecord) error {
+	if eRec.IdempotencyKey != "" {
+		found, err := r.HasIdempotencyKey(ctx, eRec.AggregateType, eRec.IdempotencyKey)
+		if err == nil && found {
+			return faults.Errorf("Unable to save aggregate '%s' with idempotency key '%s': %w", eRec.AggregateID, eRec.IdempotencyKey, eventstore.ErrIdempotencyKeyConflict)
+		}
+	}
+	for _, e := range eRec.Details {
+		if e.ExternalID == "" {
+			continue
+		}
+		_, err := r.GetByExternalID(ctx, e.ExternalID)
+		if err == nil {
+			return faults.Errorf("Unable to save aggregate '%s' with external ID '%s': %w", eRec.AggregateID, e.ExternalID, eventstore.ErrExternalIDConflict)
+		}
+	}
+	return eventstore.ErrConcurrentModification
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (r *EsRepository) GetByExternalID(ctx context.Context, externalID string) (eventstore.Event, error) {
+	events, err := r.queryEvents(ctx, "SELECT * FROM events WHERE external_id = ?", externalID)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the event with external ID '%s': %w", externalID, eventstore.ErrEventNotFound)
+	}
+	return events[0], nil
+}
+
+func (r *EsRepository) GetSnapshot(ctx context.Context, aggregateID string) (eventstore.Snapshot, error) {
+	snap := Snapshot{}
+	if err := r.db.GetContext(ctx, &snap, "SELECT * FROM snapshots WHERE aggregate_id = ? ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return eventstore.Snapshot{}, nil
+		}
+		return eventstore.Snapshot{}, faults.Errorf("Unable to get snapshot for aggregate '%s': %w", aggregateID, err)
+	}
+	return eventstore.Snapshot{
+		ID:               snap.ID,
+		AggregateID:      snap.AggregateID,
+		AggregateVersion: snap.AggregateVersion,
+		AggregateType:    snap.AggregateType,
+		Body:             snap.Body,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+func (r *EsRepository) GetSnapshotMeta(ctx context.Context, aggregateID string) (eventstore.SnapshotMeta, error) {
+	snap := Snapshot{}
+	if err := r.db.GetContext(ctx, &snap, "SELECT aggregate_version, created_at FROM snapshots WHERE aggregate_id = ? ORDER BY id DESC LIMIT 1", aggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return eventstore.SnapshotMeta{}, nil
+		}
+		return eventstore.SnapshotMeta{}, faults.Errorf("Unable to get snapshot metadata for aggregate '%s': %w", aggregateID, err)
+	}
+	return eventstore.SnapshotMeta{
+		Exists:           true,
+		AggregateVersion: snap.AggregateVersion,
+		CreatedAt:        snap.CreatedAt,
+	}, nil
+}
+
+// SaveSnapshot persists the snapshot unless the aggregate already has a snapshot at the same or at a newer version,
+// making the snapshot writes monotonic. Saving the same snapshot again replaces it.
+// The check and the write need no lock, since the writes are serialized by the single connection.
+func (r *EsRepository) SaveSnapshot(ctx context.Context, snapshot eventstore.Snapshot) error {
+	s := Snapshot{
+		ID:               snapshot.ID,
+		AggregateID:      snapshot.AggregateID,
+		AggregateVersion: snapshot.AggregateVersion,
+		AggregateType:    snapshot.AggregateType,
+		Body:             snapshot.Body,
+		CreatedAt:        snapshot.CreatedAt.UTC(),
+	}
+	err := r.withTx(ctx, func(c context.Context, tx *sql.Tx) error {
+		var newer bool
+		err := tx.QueryRowContext(c,
+			`SELECT EXISTS(SELECT 1 FROM snapshots WHERE aggregate_id = ? AND id <> ? AND aggregate_version >= ?)`,
+			s.AggregateID, s.ID, s.AggregateVersion,
+		).Scan(&newer)
+		if err != nil {
+			return faults.Errorf("Unable to check the snapshots of aggregate '%s': %w", s.AggregateID, err)
+		}
+		if newer {
+			return nil
+		}
+		_, err = tx.ExecContext(c,
+			`INSERT INTO snapshots (id, aggregate_id, aggregate_version, aggregate_type, body, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET body = excluded.body, created_at = excluded.created_at`,
+			s.ID, s.AggregateID, s.AggregateVersion, s.AggregateType, s.Body, s.CreatedAt,
+		)
+		return err
+	})
+	if err != nil {
+		if isFKViolation(err) {
+			return faults.Errorf("Unable to save snapshot '%s' of aggregate '%s': %w", s.ID, s.AggregateID, eventstore.ErrSnapshotEventMissing)
+		}
+		return faults.Wrap(err)
+	}
+	return nil
+}
+
+func (r *EsRepository) GetAggregateEvents(ctx context.Context, aggregateID string, snapVersion int) ([]eventstore.Event, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT * FROM events e WHERE e.aggregate_id = ?")
+	args := []interface{}{aggregateID}
+	if snapVersion > -1 {
+		query.WriteString(" AND e.aggregate_version > ?")
+		args = append(args, snapVersion)
+	}
+	query.WriteString(" ORDER BY aggregate_version ASC")
+
+	events, err := r.queryEvents(ctx, query.String(), args...)
+	if err != nil {
+		return nil, faults.Errorf("Unable to get events for Aggregate '%s': %w", aggregateID, err)
+	}
+
+	return events, nil
+}
+
+func (r *EsRepository) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	var version uint32
+	err := r.db.GetContext(ctx, &version, "SELECT COALESCE(MAX(aggregate_version), 0) FROM events WHERE aggregate_id = ?", aggregateID)
+	if err != nil {
+		return 0, faults.Errorf("Unable to get the current version of aggregate '%s': %w", aggregateID, err)
+	}
+	return version, nil
+}
+
+func (r *EsRepository) GetCreationEvent(ctx context.Context, aggregateID string) (eventstore.Event, error) {
+	events, err := r.queryEvents(ctx, "SELECT * FROM events e WHERE e.aggregate_id = ? AND e.aggregate_version = 1", aggregateID)
+	if err != nil {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, err)
+	}
+	if len(events) == 0 {
+		return eventstore.Event{}, faults.Errorf("Unable to get the creation event of aggregate '%s': %w", aggregateID, eventstore.ErrAggregateNotFound)
+	}
+	return events[0], nil
+}
+
+func (r *EsRepository) withTx(ctx context.Context, fn func(context.Context, *sql.Tx) error) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return faults.Wrap(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *EsRepository) HasIdempotencyKey(ctx context.Context, aggregateType, idempotencyKey string) (bool, error) {
+	var exists bool
+	err := r.db.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM events WHERE aggregate_type=? AND idempotency_key=?) AS "EXISTS"`, aggregateType, idempotencyKey)
+	if err != nil {
+		return false, faults.Errorf("Unable to verify the existence of the idempotency key: %w", err)
+	}
+	return exists, nil
+}
+
+func (r *EsRepository) Forget(ctx context.Context, request eventstore.ForgetRequest, forget func(kind string, body []byte) ([]byte, error)) error {
+	// When Forget() is called, the aggregate is no longer used, therefore if it fails, it can be called again.
+
+	// Forget events
+	events, err := r.queryEvents(ctx, "SELECT * FROM events WHERE aggregate_id = ? AND kind = ?", request.AggregateID, request.EventKind)
+	if err != nil {
+		return faults.Errorf("Unable to get events for Aggregate '%s' and event kind '%s': %w", request.AggregateID, request.EventKind, err)
+	}
+
+	for _, evt := range events {
+		body, err := forget(evt.Kind, evt.Body)
+		if err != nil {
+			return err
+		}
+		_, err = r.db.ExecContext(ctx, "UPDATE events SET body = ? WHERE id = ?", body, evt.ID)
+		if err != nil {
+			return faults.Errorf("Unable to forget event ID %s: %w", evt.ID, err)
+		}
+	}
+
+	// forget snapshots
+	snaps := []Snapshot{}
+	if err := r.db.SelectContext(ctx, &snaps, "SELECT * FROM snapshots WHERE aggregate_id = ?", request.AggregateID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return faults.Errorf("Unable to get snapshot for aggregate '%s': %w", request.AggregateID, err)
+	}
+
+	for _, snap := range snaps {
+		body, err := forget(snap.AggregateType, snap.Body)
+		if err != nil {
+			return err
+		}
+		_, err = r.db.ExecContext(ctx, "UPDATE snapshots SET body = ? WHERE id = ?", body, snap.ID)
+		if err != nil {
+			return faults.Errorf("Unable to forget snapshot ID %s: %w", snap.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *EsRepository) GetLastEventID(ctx context.Context, trailingLag time.Duration, filter store.Filter) (string, error) {
+	var query bytes.Buffer
+	column := r.positionColumn()
+	query.WriteString("SELECT " + column + " FROM events WHERE 1 = 1 ")
+	args := []interface{}{}
+	if trailingLag != time.Duration(0) {
+		safetyMargin := time.Now().UTC().Add(-trailingLag)
+		args = append(args, safetyMargin)
+		query.WriteString("AND created_at <= ? ")
+	}
+	args, err := r.buildPositionFilter(ctx, filter, &query, args)
+	if err != nil {
+		return "", err
+	}
+	query.WriteString(" ORDER BY " + column + " DESC LIMIT 1")
+	r.logQuery(query.String(), args)
+	if r.orderingColumn != "" {
+		var position int64
+		if err := r.db.GetContext(ctx, &position, query.String(), args...); err != nil {
+			if err != sql.ErrNoRows {
+				return "", faults.Errorf("Unable to get the last event position: %w", err)
+			}
+			return "", nil
+		}
+		return FormatPosition(position), nil
+	}
+	var eventID string
+	if err := r.db.GetContext(ctx, &eventID, query.String(), args...); err != nil {
+		if err != sql.ErrNoRows {
+			return "", faults.Errorf("Unable to get the last event ID: %w", err)
+		}
+	}
+	return eventID, nil
+}
+
+func (r *EsRepository) GetEvents(ctx context.Context, afterEventID string, batchSize int, trailingLag time.Duration, filter store.Filter) ([]eventstore.Event, error) {
+	var query bytes.Buffer
+	column := r.positionColumn()
+	after, err := r.position(ctx, afterEventID)
+	if err != nil {
+		return nil, err
+	}
+	query.WriteString("SELECT " + r.positionColumns(filter.Projection) + " FROM events WHERE " + column + " > ? ")
+	args := []interface{}{after}
+	if trailingLag != time.Duration(0) {
+		safetyMargin := time.Now().UTC().Add(-trailingLag)
+		args = append(args, safetyMargin)
+		query.WriteString("AND created_at <= ? ")
+	}
+	args, err = r.buildPositionFilter(ctx, filter, &query, args)
+	if err != nil {
+		return nil, err
+	}
+	query.WriteString(" ORDER BY " + column + " ASC")
+	if batchSize > 0 {
+		query.WriteString(" LIMIT ")
+		query.WriteString(strconv.Itoa(batchSize))
+	}
+
+	r.logQuery(query.String(), args)
+	rows, err := r.queryEvents(ctx, query.String(), args...)
+	if err != nil {
+		err = faults.Errorf("Unable to get events after '%s' for filter %+v: %w", afterEventID, filter, err)
+		if filter.PartialResults && len(rows) > 0 {
+			return rows, err
+		}
+		return nil, err
+	}
+	return rows, nil
+}
+
+// CountEvents counts the events matching the filter.
+// SQLite keeps no row estimate, so filter.ApproximateCount is ignored.
+func (r *EsRepository) CountEvents(ctx context.Context, filter store.Filter) (int64, error) {
+	var count int64
+	var query bytes.Buffer
+	query.WriteString("SELECT count(*) FROM events WHERE 1 = 1 ")
+	args := buildFilter(filter, &query, []interface{}{})
+	r.logQuery(query.String(), args)
+	if err := r.db.GetContext(ctx, &count, query.String(), args...); err != nil {
+		return 0, faults.Errorf("Unable to count events for filter %+v: %w", filter, err)
+	}
+	return count, nil
+}
+
+func (r *EsRepository) ChangedAggregates(ctx context.Context, since time.Time, filter store.Filter) ([]store.AggregateRef, error) {
+	var query bytes.Buffer
+	query.WriteString("SELECT aggregate_id, aggregate_type, MAX(aggregate_version) AS version FROM events WHERE created_at >= ? ")
+	args := buildFilter(filter, &query, []interface{}{since.UTC()})
+	query.WriteString(" GROUP BY aggregate_id, aggregate_type ORDER BY aggregate_id")
+	r.logQuery(query.String(), args)
+
+	refs := []aggregateRef{}
+	if err := r.db.SelectContext(ctx, &refs, query.String(), args...); err != nil {
+		return nil, faults.Errorf("Unable to get the aggregates changed since %s for filter %+v: %w", since, filter, err)
+	}
+	return toAggregateRefs(refs), nil
+}
+
+type aggregateRef struct {
+	AggregateID   string `db:"aggregate_id"`
+	AggregateType string `db:"aggregate_type"`
+	Version       uint32 `db:"version"`
+}
+
+func toAggregateRefs(refs []aggregateRef) []store.AggregateRef {
+	result := make([]store.AggregateRef, len(refs))
+	for k, v := range refs {
+		result[k] = store.AggregateRef(v)
+	}
+	return result
+}
+
+func (r *EsRepository) logQuery(query string, args []interface{}) {
+	if r.queryLogger != nil {
+		r.queryLogger(query, args)
+	}
+}
+
+func buildFilter(filter store.Filter, query *bytes.Buffer, args []interface{}) []interface{} {
+	if filter.UpperBound != "" {
+		args = append(args, filter.UpperBound)
+		query.WriteString(" AND id <= ?")
+	}
+
+	if len(filter.AggregateTypes) > 0 {
+		query.WriteString(" AND aggregate_type IN (?" + strings.Repeat(", ?", len(filter.AggregateTypes)-1) + ")")
+		for _, v := range filter.AggregateTypes {
+			args = append(args, v)
+		}
+	}
+
+	if len(filter.ExternalIDs) > 0 {
+		query.WriteString(" AND external_id IN (?" + strings.Repeat(", ?", len(filter.ExternalIDs)-1) + ")")
+		for _, v := range filter.ExternalIDs {
+			args = append(args, v)
+		}
+	}
+
+	if filter.Partitions > 1 {
+		if filter.PartitionLow == filter.PartitionHi {
+			args = append(args, filter.Partitions, filter.PartitionLow-1)
+			query.WriteString(" AND (aggregate_id_hash % ?) = ?")
+		} else {
+			args = append(args, filter.Partitions, filter.PartitionLow-1, filter.PartitionHi-1)
+			query.WriteString(" AND (aggregate_id_hash % ?) BETWEEN ? AND ?")
+		}
+	}
+
+	for k, values := range filter.Labels {
+		query.WriteString(" AND json_extract(labels, ?) IN (?" + strings.Repeat(", ?", len(values)-1) + ")")
+		args = append(args, labelPath(k))
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+
+	for k, values := range filter.ExcludeLabels {
+		for _, v := range values {
+			args = append(args, labelPath(k), v)
+			// events without labels are kept
+			query.WriteString(" AND NOT COALESCE(json_extract(labels, ?) = ?, 0)")
+		}
+	}
+	return args
+}
+
+// labelPath is the JSON path of the label key, quoted so that the key may have dots
+func labelPath(key string) string {
+	return `$."` + strings.ReplaceAll(key, `"`, `\"`) + `"`
+}
+
+// positionColumn returns the column ordering the events (see WithOrderingColumn)
+func (r *EsRepository) positionColumn() string {
+	if r.orderingColumn != "" {
+		return r.orderingColumn
+	}
+	return "id"
+}
+
+// positionColumns returns the columns to select for the projection, with the ordering column as position (see WithOrderingColumn)
+func (r *EsRepository) positionColumns(p store.Projection) string {
+	if r.orderingColumn == "" {
+		return selectColumns(p)
+	}
+	return selectColumns(p) + ", " + r.orderingColumn + " AS position"
+}
+
+// position converts a position into the value of the ordering column.
+// An event ID, eg: from a max age, is converted into the position of the last event up to it
+func (r *EsRepository) position(ctx context.Context, eventID string) (interface{}, error) {
+	if r.orderingColumn == "" {
+		return eventID, nil
+	}
+	if eventID == "" {
+		return int64(0), nil
+	}
+	if len(eventID) != positionLen {
+		var position int64
+		query := "SELECT COALESCE(MAX(" + r.orderingColumn + "), 0) FROM events WHERE id <= ?"
+		r.logQuery(query, []interface{}{eventID})
+		if err := r.db.GetContext(ctx, &position, query, eventID); err != nil {
+			return nil, faults.Errorf("Unable to get the position of the event ID '%s': %w", eventID, err)
+		}
+		return position, nil
+	}
+	position, err := strconv.ParseInt(eventID, 10, 64)
+	if err != nil {
+		return nil, faults.Errorf("Invalid position '%s' for the ordering column %s: %w", eventID, r.orderingColumn, err)
+	}
+	return position, nil
+}
+
+// buildPositionFilter builds the filter, with the upper bound applied to the ordering column
+func (r *EsRepository) buildPositionFilter(ctx context.Context, filter store.Filter, query *bytes.Buffer, args []interface{}) ([]interface{}, error) {
+	if r.orderingColumn == "" || filter.UpperBound == "" {
+		return buildFilter(filter, query, args), nil
+	}
+	upper, err := r.position(ctx, filter.UpperBound)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, upper)
+	query.WriteString(" AND " + r.orderingColumn + " <= ?")
+	filter.UpperBound = ""
+	return buildFilter(filter, query, args), nil
+}
+
+// positionLen is the length of a formatted position, that never collides with the length of an event ID
+const positionLen = 20
+
+// FormatPosition formats the value of the ordering column as a position that sorts as a string (see WithOrderingColumn)
+func FormatPosition(position int64) string {
+	return fmt.Sprintf("%0*d", positionLen, position)
+}
+
+// selectColumns returns the columns to select for the projection
+func selectColumns(p store.Projection) string {
+	if p == store.MinimalProjection {
+		return "id, aggregate_id, aggregate_version, kind, body, created_at"
+	}
+	return "*"
+}
+
+func (r *EsRepository) queryEvents(ctx context.Context, query string, args ...interface{}) ([]eventstore.Event, error) {
+	rows, err := r.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []eventstore.Event{}, nil
+		}
+		return nil, faults.Errorf("Unable to query events: %w", err)
+	}
+	defer rows.Close()
+	// on failure, the events read so far are also returned
+	events := []eventstore.Event{}
+	for rows.Next() {
+		lite := Event{}
+		err := rows.StructScan(&lite)
+		if err != nil {
+			return events, faults.Errorf("Unable to scan to struct: %w", err)
+		}
+		labels := map[string]interface{}{}
+		err = eventstore.DecodeLabels(r.labelCodec, lite.Labels, labels)
+		if err != nil {
+			return events, faults.Errorf("Unable to unmarshal labels of event '%s' to map: %w", lite.ID, err)
+		}
+
+		var resumeToken []byte
+		if lite.Position.Valid {
+			resumeToken = []byte(FormatPosition(lite.Position.Int64))
+		}
+		events = append(events, eventstore.Event{
+			ID:               lite.ID,
+			ResumeToken:      resumeToken,
+			AggregateID:      lite.AggregateID,
+			AggregateIDHash:  uint32(lite.AggregateIDHash),
+			AggregateVersion: lite.AggregateVersion,
+			AggregateType:    lite.AggregateType,
+			Kind:             lite.Kind,
+			Body:             lite.Body,
+			IdempotencyKey:   string(lite.IdempotencyKey),
+			ExternalID:       string(lite.ExternalID),
+			Labels:           labels,
+			CreatedAt:        lite.CreatedAt,
+			Epoch:            lite.Epoch,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return events, faults.Errorf("Unable to iterate events: %w", err)
+	}
+	return events, nil
+}
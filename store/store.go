@@ -1,17 +1,90 @@
 package store
 
-import "github.com/quintans/eventstore"
+import (
+	"context"
+	"time"
+
+	"github.com/quintans/eventstore"
+)
 
 type Filter struct {
 	AggregateTypes []string
 	// Labels filters on top of labels. Every key of the map is ANDed with every OR of the values
 	// eg: [{"geo": "EU"}, {"geo": "USA"}, {"membership": "prime"}] equals to:  geo IN ("EU", "USA") AND membership = "prime"
-	Labels       Labels
-	Partitions   uint32
-	PartitionLow uint32
-	PartitionHi  uint32
+	Labels Labels
+	// ExcludeLabels discards the events having any of the label values, eg: a reactive handler excluding
+	// the events tagged with its own source, to not react to what it produced.
+	// Events without the label key are kept.
+	ExcludeLabels Labels
+	Partitions    uint32
+	PartitionLow  uint32
+	PartitionHi   uint32
+	// UpperBound, if not empty, is the highest event ID returned, so that a replay reads a consistent cut of the store,
+	// ignoring the events saved afterwards
+	UpperBound string
+	// Projection selects which fields of the events are hydrated
+	Projection Projection
+	// PartialResults makes GetEvents return the events read before a failure, eg: a malformed row, together with the error,
+	// so that a best effort consumer can handle them and retry after the last good event ID.
+	PartialResults bool
+	// ApproximateCount makes CountEvents use the table statistics, instead of counting, if there are no conditions.
+	ApproximateCount bool
+	// ExternalIDs filters the events by their external ID (see eventstore.WithExternalIDs)
+	ExternalIDs []string
+}
+
+// HasConditions returns true if the filter restricts the events, by aggregate type, labels, partitions, upper bound or external IDs
+func (f Filter) HasConditions() bool {
+	return len(f.AggregateTypes) > 0 || len(f.Labels) > 0 || len(f.ExcludeLabels) > 0 || f.Partitions > 1 || f.UpperBound != "" || len(f.ExternalIDs) > 0
+}
+
+// Counter counts the events matching a filter, eg: for the progress of a projection rebuild
+type Counter interface {
+	CountEvents(ctx context.Context, filter Filter) (int64, error)
+}
+
+// CreationReader reads the first event of an aggregate, eg: to show when it was created, without loading all its events
+type CreationReader interface {
+	// GetCreationEvent returns the first event of the aggregate, or eventstore.ErrAggregateNotFound if there is none
+	GetCreationEvent(ctx context.Context, aggregateID string) (eventstore.Event, error)
+}
+
+// ExternalIDReader reads an event by the ID it has in an external system (see eventstore.WithExternalIDs)
+type ExternalIDReader interface {
+	// GetByExternalID returns the event with the external ID, or eventstore.ErrEventNotFound if there is none
+	GetByExternalID(ctx context.Context, externalID string) (eventstore.Event, error)
+}
+
+// AggregateRef identifies an aggregate and its latest version
+type AggregateRef struct {
+	AggregateID   string
+	AggregateType string
+	Version       uint32
+}
+
+// ChangeLister lists the aggregates changed since a point in time, eg: for a cache refresh job to only visit the changed aggregates
+type ChangeLister interface {
+	// ChangedAggregates returns, once per aggregate, the aggregates with events created at or after since and matching the filter,
+	// with the latest version among those events
+	ChangedAggregates(ctx context.Context, since time.Time, filter Filter) ([]AggregateRef, error)
 }
 
+// UniqueViolationDetector tells if an error returned by a database driver is the violation of a unique index.
+// The stores use it to report conflicting saves as eventstore.ErrConcurrentModification,
+// and it can be replaced when the store runs on top of a different driver.
+type UniqueViolationDetector func(err error) bool
+
+// Projection selects which fields of an event are read from the store
+type Projection int
+
+const (
+	// FullProjection hydrates every field of the event
+	FullProjection Projection = iota
+	// MinimalProjection only hydrates the ID, aggregate ID, aggregate version, kind, body and creation time,
+	// reducing the payload for high volume replays
+	MinimalProjection
+)
+
 type FilterOption func(*Filter)
 
 func WithFilter(filter Filter) FilterOption {
@@ -41,6 +114,34 @@ func WithLabel(key, value string) FilterOption {
 	}
 }
 
+func WithProjection(p Projection) FilterOption {
+	return func(f *Filter) {
+		f.Projection = p
+	}
+}
+
+// WithPartialResults returns the events read before a failure alongside the error
+func WithPartialResults() FilterOption {
+	return func(f *Filter) {
+		f.PartialResults = true
+	}
+}
+
+// WithApproximateCount makes CountEvents use the table statistics, if there are no conditions.
+// The estimate is faster for huge tables but may be off, eg: after bulk inserts.
+func WithApproximateCount() FilterOption {
+	return func(f *Filter) {
+		f.ApproximateCount = true
+	}
+}
+
+// WithExternalIDs only returns the events with one of the external IDs
+func WithExternalIDs(ids ...string) FilterOption {
+	return func(f *Filter) {
+		f.ExternalIDs = ids
+	}
+}
+
 type Labels map[string][]string
 
 func WithLabels(labels Labels) FilterOption {
@@ -49,6 +150,22 @@ func WithLabels(labels Labels) FilterOption {
 	}
 }
 
+// WithExcludeLabels discards the events having any of the label values
+func WithExcludeLabels(labels Labels) FilterOption {
+	return func(f *Filter) {
+		f.ExcludeLabels = labels
+	}
+}
+
+// WithUpperBound only returns the events with an ID lower or equal to eventID, comparing the IDs: id <= eventID.
+// Unlike player.Player.ReplayUntil, that stops after handling eventID, the bound is applied to every query.
+// It bounds the IDs, not the time of the saves: an event committed later, with an ID lower than eventID, is still returned.
+func WithUpperBound(eventID string) FilterOption {
+	return func(f *Filter) {
+		f.UpperBound = eventID
+	}
+}
+
 func WithPartitions(partitions, partitionsLow, partitionsHi uint32) FilterOption {
 	return func(f *Filter) {
 		if partitions <= 1 {
@@ -0,0 +1,119 @@
+package cassandra
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/store/cassandra"
+	"github.com/quintans/eventstore/test"
+	"github.com/quintans/eventstore/test/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const keyspace = "eventstore"
+
+func setup(t *testing.T) (*gocql.Session, func()) {
+	ctx := context.Background()
+	natPort := nat.Port("9042/tcp")
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "scylladb/scylla:4.4.0",
+			ExposedPorts: []string{string(natPort)},
+			Cmd:          []string{"--smp", "1", "--developer-mode", "1"},
+			WaitingFor:   wait.ForListeningPort(natPort).WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	require.NoError(t, err)
+	tearDown := func() {
+		container.Terminate(ctx)
+	}
+
+	ip, err := container.Host(ctx)
+	require.NoError(t, err)
+	port, err := container.MappedPort(ctx, natPort)
+	require.NoError(t, err)
+
+	cluster := gocql.NewCluster(ip)
+	cluster.Port = port.Int()
+	cluster.Consistency = gocql.Quorum
+	cluster.Timeout = 10 * time.Second
+	var session *gocql.Session
+	// the port is open before the node accepts CQL connections
+	require.Eventually(t, func() bool {
+		session, err = cluster.CreateSession()
+		return err == nil
+	}, time.Minute, time.Second)
+
+	err = session.Query(`CREATE KEYSPACE IF NOT EXISTS ` + keyspace + ` WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}`).Exec()
+	require.NoError(t, err)
+
+	return session, func() {
+		session.Close()
+		tearDown()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	session, tearDown := setup(t)
+	defer tearDown()
+
+	r := cassandra.NewStore(session, keyspace)
+	require.NoError(t, r.InstallSchema(context.Background()))
+
+	storetest.RunAggregateConformance(t, func() storetest.AggregateRepository {
+		return r
+	})
+}
+
+func TestStore(t *testing.T) {
+	session, tearDown := setup(t)
+	defer tearDown()
+
+	ctx := context.Background()
+	r := cassandra.NewStore(session, keyspace)
+	require.NoError(t, r.InstallSchema(ctx))
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{})
+
+	t.Run("FailedSaveKeys", func(t *testing.T) {
+		id := uuid.New().String()
+		acc := test.CreateAccount("Paulo", id, 100)
+		require.NoError(t, es.Save(ctx, acc))
+
+		// the idempotency key and the external IDs of a failed save are removed
+		retry := test.CreateAccount("Paulo", id, 100)
+		external := uuid.New().String()
+		err := es.Save(ctx, retry, eventstore.WithIdempotencyKey("retry-"+id), eventstore.WithExternalIDs(external))
+		require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+		found, err := es.HasIdempotencyKey(ctx, acc.GetType(), "retry-"+id)
+		require.NoError(t, err)
+		assert.False(t, found)
+
+		other := test.CreateAccount("Pereira", uuid.New().String(), 50)
+		require.NoError(t, es.Save(ctx, other, eventstore.WithExternalIDs(external)))
+		e, err := r.GetByExternalID(ctx, external)
+		require.NoError(t, err)
+		assert.Equal(t, other.GetID(), e.AggregateID)
+	})
+
+	t.Run("SnapshotEventMissing", func(t *testing.T) {
+		err := r.SaveSnapshot(ctx, eventstore.Snapshot{
+			ID:               "missing",
+			AggregateID:      uuid.New().String(),
+			AggregateVersion: 1,
+			AggregateType:    "Account",
+			Body:             []byte("{}"),
+			CreatedAt:        time.Now().UTC(),
+		})
+		require.True(t, errors.Is(err, eventstore.ErrSnapshotEventMissing), "expected snapshot event missing, got %v", err)
+	})
+}
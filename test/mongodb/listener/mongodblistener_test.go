@@ -17,6 +17,8 @@ import (
 	"github.com/quintans/eventstore/test"
 	tmg "github.com/quintans/eventstore/test/mongodb"
 	"github.com/quintans/faults"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -192,3 +194,29 @@ func feeding(ctx context.Context, t *testing.T, dbConfig tmg.DBConfig, partition
 	}
 	wg.Wait()
 }
+
+func TestFeedConnectRetry(t *testing.T) {
+	// nothing listens on this port
+	listener, err := mongodb.NewFeed("mongodb://localhost:1/?serverSelectionTimeoutMS=200", "eventstore",
+		mongodb.WithFeedConnectTimeout(time.Second),
+		mongodb.WithFeedConnectRetry(2, 10*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	// the feed logs a warning on every failed attempt
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	start := time.Now()
+	err = listener.Feed(context.Background(), test.NewMockSink(1))
+	require.Error(t, err)
+	// two attempts, each failing the server selection, and not hanging
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	attempts := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel && entry.Message == "Unable to open the change stream" {
+			attempts++
+		}
+	}
+	assert.Equal(t, 2, attempts)
+}
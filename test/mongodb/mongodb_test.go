@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/quintans/eventstore/store/mongodb"
 	"github.com/quintans/eventstore/store/poller"
 	"github.com/quintans/eventstore/test"
+	"github.com/quintans/eventstore/test/storetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
@@ -112,6 +114,82 @@ func TestSaveAndGet(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestConformance(t *testing.T) {
+	dbConfig, tearDown, err := Setup("./docker-compose.yaml")
+	require.NoError(t, err)
+	defer tearDown()
+
+	storetest.RunConformance(t, func() storetest.Repository {
+		r, err := mongodb.NewStore(dbConfig.Url(), dbConfig.Database)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.Close(context.Background())
+		})
+		return r
+	})
+}
+
+func TestSnapshotConcurrentWriters(t *testing.T) {
+	dbConfig, tearDown, err := Setup("./docker-compose.yaml")
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := mongodb.NewStore(dbConfig.Url(), dbConfig.Database)
+	require.NoError(t, err)
+	defer r.Close(context.Background())
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	require.NoError(t, es.Save(ctx, acc))
+	acc.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc))
+	evts, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+
+	snapshotAt := func(e eventstore.Event) eventstore.Snapshot {
+		return eventstore.Snapshot{
+			ID:               e.ID,
+			AggregateID:      id,
+			AggregateVersion: e.AggregateVersion,
+			AggregateType:    "Account",
+			Body:             []byte(`{}`),
+			CreatedAt:        time.Now().UTC(),
+		}
+	}
+
+	// two writers repeatedly racing the upsert of the same snapshot and of an older one
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		for _, e := range evts {
+			wg.Add(1)
+			go func(snap eventstore.Snapshot) {
+				defer wg.Done()
+				errs <- r.SaveSnapshot(ctx, snap)
+			}(snapshotAt(e))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	snap, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, evts[1].ID, snap.ID)
+	assert.Equal(t, evts[1].AggregateVersion, snap.AggregateVersion)
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	count, err := db.Collection(CollSnapshots).CountDocuments(ctx, bson.D{{"_id", evts[1].ID}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
 func TestPollListener(t *testing.T) {
 	dbConfig, tearDown, err := Setup("./docker-compose.yaml")
 	require.NoError(t, err)
@@ -132,6 +132,27 @@ func dbSchema(cli *mongo.Client) error {
 					}},
 					{"background", true},
 				},
+				{
+					{"key", bson.D{
+						{"details.external_id", 1},
+					}},
+					{"name", "unique_external_id"},
+					{"unique", true},
+					{"partialFilterExpression", bson.D{
+						{"details.external_id", bson.D{
+							{"$gt", ""},
+						},
+						},
+					}},
+					{"background", true},
+				},
+				{
+					{"key", bson.D{
+						{"created_at", 1},
+					}},
+					{"name", "idx_created_at"},
+					{"background", true},
+				},
 			}},
 		},
 		{
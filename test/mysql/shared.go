@@ -102,11 +102,15 @@ func dbSchema(dbURL string) error {
 			body VARBINARY(60000) NOT NULL,
 			idempotency_key VARCHAR (50),
 			labels JSON NOT NULL,
-			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			external_id VARCHAR (100),
+			epoch INTEGER NOT NULL DEFAULT 0
 		)ENGINE=innodb;`,
 		`CREATE UNIQUE INDEX agg_id_ver_idx ON events(aggregate_id, aggregate_version);`,
+		`CREATE UNIQUE INDEX external_id_idx ON events(external_id);`,
 		`CREATE UNIQUE INDEX agg_idempot_idx ON events(aggregate_type, idempotency_key);`,
 		`CREATE INDEX agg_id_idx ON events(aggregate_id);`,
+		`CREATE INDEX created_at_idx ON events(created_at);`,
 
 		`CREATE TABLE IF NOT EXISTS snapshots(
 			id VARCHAR (50) PRIMARY KEY,
@@ -0,0 +1,169 @@
+package mysql
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/eventstore/store/mysql"
+	"github.com/quintans/eventstore/test/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	storetest.RunConformance(t, func() storetest.Repository {
+		r, err := mysql.NewStore(dbConfig.Url())
+		require.NoError(t, err)
+		return r
+	})
+}
+
+func TestSnapshotConcurrentWritersAfterCompaction(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := mysql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	// the events of the aggregate are compacted away, so there are no events to lock
+	require.NoError(t, r.DropSnapshotForeignKey(ctx))
+
+	id := uuid.New().String()
+	snapshotAt := func(version uint32) eventstore.Snapshot {
+		return eventstore.Snapshot{
+			ID:               uuid.New().String(),
+			AggregateID:      id,
+			AggregateVersion: version,
+			AggregateType:    "Account",
+			Body:             []byte(`{}`),
+			CreatedAt:        time.Now().UTC(),
+		}
+	}
+
+	// writers racing the snapshot of the latest version and of an older one
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		for _, version := range []uint32{1, 2} {
+			wg.Add(1)
+			go func(snap eventstore.Snapshot) {
+				defer wg.Done()
+				errs <- r.SaveSnapshot(ctx, snap)
+			}(snapshotAt(version))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	snap, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), snap.AggregateVersion)
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := mysql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	require.NoError(t, r.DropSnapshotForeignKey(ctx))
+
+	db, err := sqlx.Connect("mysql", dbConfig.Url())
+	require.NoError(t, err)
+	defer db.Close()
+	// the same key in two aggregates, as if saved before the unique index was created
+	_, err = db.Exec("DROP INDEX agg_idempot_idx ON events")
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	insert := func(aggregateID string, version uint32, kind, idempotencyKey string) string {
+		id := common.NewEventID(now, aggregateID, version)
+		var key *string
+		if idempotencyKey != "" {
+			key = &idempotencyKey
+		}
+		_, err := db.Exec(`INSERT INTO events (id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, aggregateID, int32(common.Hash(aggregateID)), version, "Account", kind, []byte(`{}`), key, `{}`, now)
+		require.NoError(t, err)
+		return id
+	}
+	snapshot := func(id, aggregateID string, version uint32) {
+		require.NoError(t, r.SaveSnapshot(ctx, eventstore.Snapshot{
+			ID:               id,
+			AggregateID:      aggregateID,
+			AggregateVersion: version,
+			AggregateType:    "Account",
+			Body:             []byte(`{}`),
+			CreatedAt:        now,
+		}))
+	}
+
+	// a snapshot of a compacted event
+	orphanID := uuid.New().String()
+	orphan := common.NewEventID(now, orphanID, 1)
+	snapshot(orphan, orphanID, 1)
+
+	// version 2 is missing
+	gapID := uuid.New().String()
+	insert(gapID, 1, "MoneyDeposited", "")
+	gap := insert(gapID, 3, "MoneyDeposited", "")
+
+	// version 1 is missing
+	leadingID := uuid.New().String()
+	leading := insert(leadingID, 2, "MoneyDeposited", "")
+
+	// versions 1 and 2 were compacted into the snapshot at version 2
+	compactedID := uuid.New().String()
+	snapshot(insert(compactedID, 2, "MoneyDeposited", ""), compactedID, 2)
+	insert(compactedID, 3, "MoneyDeposited", "")
+
+	// the tombstone of purged events
+	insert(uuid.New().String(), 3, eventstore.TombstoneKind, "")
+
+	key := uuid.New().String()
+	dupID := "a-" + uuid.New().String()
+	insert(dupID, 1, "AccountCreated", key)
+	insert("b-"+uuid.New().String(), 1, "AccountCreated", key)
+
+	problems := []store.IntegrityProblem{}
+	report, err := r.CheckIntegrity(ctx, store.WithIntegrityProblemHandler(func(p store.IntegrityProblem) {
+		problems = append(problems, p)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.OrphanSnapshots)
+	assert.Equal(t, 2, report.VersionGaps)
+	assert.Equal(t, 1, report.DuplicateIdempotencyKeys)
+	assert.ElementsMatch(t, []store.IntegrityProblem{
+		{Kind: store.OrphanSnapshot, AggregateID: orphanID, ID: orphan},
+		{Kind: store.VersionGap, AggregateID: gapID, ID: gap},
+		{Kind: store.VersionGap, AggregateID: leadingID, ID: leading},
+		{Kind: store.DuplicateIdempotencyKey, AggregateID: dupID, ID: key},
+	}, problems)
+
+	// only the orphan snapshots are repaired
+	report, err = r.CheckIntegrity(ctx, store.WithRepair())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), report.RepairedSnapshots)
+	report, err = r.CheckIntegrity(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.OrphanSnapshots)
+	assert.Equal(t, 2, report.VersionGaps)
+}
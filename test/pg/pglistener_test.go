@@ -2,9 +2,11 @@ package pg
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -61,3 +63,251 @@ func TestPgListener(t *testing.T) {
 
 	cancel()
 }
+
+func TestPgListenerNotifyBatching(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	listener := postgresql.NewFeedListenNotify(dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithNotifyBatching(50*time.Millisecond),
+		postgresql.WithLimit(2),
+	)
+
+	s := test.NewMockSink(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := listener.Feed(ctx, s)
+		if err != nil {
+			log.Fatalf("Error feeding: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	es := eventstore.NewEventStore(repository, 100, test.AggregateFactory{})
+	// a burst of writes
+	for i := 0; i < 5; i++ {
+		acc := test.CreateAccount("Paulo", uuid.New().String(), 100)
+		acc.Deposit(10)
+		require.NoError(t, es.Save(ctx, acc))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	events := s.GetEvents()
+	require.Equal(t, 10, len(events), "event size")
+	for i := 1; i < len(events); i++ {
+		assert.True(t, events[i].ID > events[i-1].ID, "event %d is out of order", i)
+	}
+}
+
+func TestPgListenerBase64Body(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(postgresql.NotifyBase64Trigger("events_channel"))
+	require.NoError(t, err)
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	listener := postgresql.NewFeedListenNotify(dbConfig.ReplicationUrl(), repository, "events_channel", postgresql.WithBase64Body())
+
+	s := test.NewMockSink(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := listener.Feed(ctx, s)
+		if err != nil {
+			log.Fatalf("Error feeding: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// a body that is not valid JSON, eg: protobuf
+	body := []byte{0x0a, 0x05, 'P', 'a', 'u', 'l', 'o', 0x10, 0x64, 0x00, 0xff}
+	_, _, err = repository.SaveEvent(ctx, eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: "Account",
+		CreatedAt:     time.Now().UTC(),
+		Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: body}},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	events := s.GetEvents()
+	require.Equal(t, 1, len(events), "event size")
+	assert.Equal(t, body, []byte(events[0].Body))
+}
+
+func TestPgListenerOutOfOrder(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es := eventstore.NewEventStore(repository, 3, test.AggregateFactory{})
+	acc := test.CreateAccount("Paulo", uuid.New().String(), 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	listener := postgresql.NewFeedListenNotify(dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithOutOfOrderPolicy(postgresql.OutOfOrderError),
+	)
+	s := test.NewMockSink(1)
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Feed(ctx, s)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// an event with an ID lower than the one already forwarded
+	_, _, err = repository.SaveEvent(ctx, eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: "Account",
+		CreatedAt:     time.Now().UTC().Add(-time.Hour),
+		Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+	})
+	require.NoError(t, err)
+
+	select {
+	case err = <-done:
+		require.True(t, errors.Is(err, postgresql.ErrOutOfOrder), "expected out of order, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("feed did not stop on an out of order event")
+	}
+	assert.Equal(t, uint64(1), listener.OutOfOrderCount())
+	assert.Equal(t, 1, len(s.GetEvents()))
+}
+
+func TestPgListenerOutOfOrderAfterForwarded(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	repository, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := postgresql.NewFeedListenNotify(dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithOutOfOrderPolicy(postgresql.OutOfOrderError),
+	)
+	s := test.NewMockSink(1)
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Feed(ctx, s)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	id, _, err := repository.SaveEvent(ctx, eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: "Account",
+		CreatedAt:     time.Now().UTC(),
+		Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, len(s.GetEvents()))
+
+	// a duplicated notification of the forwarded event is not out of order
+	_, err = db.Exec("SELECT pg_notify('events_channel', $1)", `{"id":"`+id+`"}`)
+	require.NoError(t, err)
+
+	// an event after the replay, but with an ID lower than the one forwarded from a notification
+	_, _, err = repository.SaveEvent(ctx, eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: "Account",
+		CreatedAt:     time.Now().UTC().Add(-time.Minute),
+		Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+	})
+	require.NoError(t, err)
+
+	select {
+	case err = <-done:
+		require.True(t, errors.Is(err, postgresql.ErrOutOfOrder), "expected out of order, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("feed did not stop on an out of order event")
+	}
+	assert.Equal(t, uint64(1), listener.OutOfOrderCount())
+	assert.Equal(t, 1, len(s.GetEvents()))
+}
+
+func TestPgListenerBatchingDropsCaughtUpNotifications(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// once armed, an event is committed right before the catch-up query, so that the query reads it before its notification arrives
+	var armed int32
+	var repository *postgresql.EsRepository
+	var late string
+	repository, err = postgresql.NewStore(dbConfig.Url(), postgresql.WithQueryLogger(func(query string, args []interface{}) {
+		if !atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			return
+		}
+		id, _, err := repository.SaveEvent(ctx, eventstore.EventRecord{
+			AggregateID:   uuid.New().String(),
+			AggregateType: "Account",
+			CreatedAt:     time.Now().UTC().Add(-time.Second),
+			Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+		})
+		require.NoError(t, err)
+		late = id
+	}))
+	require.NoError(t, err)
+
+	listener := postgresql.NewFeedListenNotify(dbConfig.ReplicationUrl(), repository, "events_channel",
+		postgresql.WithNotifyBatching(50*time.Millisecond),
+		postgresql.WithOutOfOrderPolicy(postgresql.OutOfOrderError),
+	)
+	s := test.NewMockSink(1)
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Feed(ctx, s)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	atomic.StoreInt32(&armed, 1)
+
+	_, _, err = repository.SaveEvent(ctx, eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: "Account",
+		CreatedAt:     time.Now().UTC(),
+		Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+	})
+	require.NoError(t, err)
+
+	select {
+	case err = <-done:
+		t.Fatalf("feed stopped: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Equal(t, uint64(0), listener.OutOfOrderCount())
+	events := s.GetEvents()
+	require.Equal(t, 2, len(events))
+	assert.Equal(t, late, events[0].ID)
+}
@@ -1,22 +1,31 @@
 package pg
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/common"
 	"github.com/quintans/eventstore/encoding"
 	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/projection"
+	"github.com/quintans/eventstore/store"
 	"github.com/quintans/eventstore/store/poller"
 	"github.com/quintans/eventstore/store/postgresql"
 	"github.com/quintans/eventstore/test"
+	"github.com/quintans/eventstore/test/storetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -100,6 +109,319 @@ func TestSaveAndGet(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestGetEventsWithNullColumns(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// simulates events inserted by an external process or an older schema
+	_, err = db.Exec("ALTER TABLE events ALTER COLUMN labels DROP NOT NULL")
+	require.NoError(t, err)
+	id := uuid.New().String()
+	eventID := common.NewEventID(time.Now(), id, 1)
+	_, err = db.Exec(`INSERT INTO events (id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, idempotency_key, labels, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, NULL, NULL, $8)`,
+		eventID, id, int32(common.Hash(id)), 1, aggregateType, "AccountCreated", []byte(`{"id":"`+id+`","money":100,"owner":"Paulo"}`), time.Now().UTC())
+	require.NoError(t, err)
+
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	evts, err := r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, eventID, evts[0].ID)
+	assert.Empty(t, evts[0].IdempotencyKey)
+	assert.Empty(t, evts[0].Labels)
+}
+
+func TestGetEventsPartialResults(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// a malformed row, with a version that can not be scanned
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	badID := uuid.New().String()
+	_, err = db.Exec(`INSERT INTO events (id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, labels, created_at)
+	VALUES ($1, $2, $3, -1, $4, $5, $6, '{}', $7)`,
+		common.NewEventID(time.Now().Add(time.Second), badID, 1), badID, int32(common.Hash(badID)), aggregateType, "AccountCreated", []byte(`{}`), time.Now().UTC())
+	require.NoError(t, err)
+
+	evts, err := r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{})
+	require.Error(t, err)
+	assert.Empty(t, evts)
+
+	evts, err = r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{PartialResults: true})
+	require.Error(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, id, evts[0].AggregateID)
+}
+
+func TestGetEventsPartialResultsSecondPass(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the malformed row is inserted after the first pass, that returned less than the batch size, read the good event
+	passes := 0
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithQueryLogger(func(query string, args []interface{}) {
+		passes++
+		if passes != 2 {
+			return
+		}
+		badID := uuid.New().String()
+		_, err := db.Exec(`INSERT INTO events (id, aggregate_id, aggregate_id_hash, aggregate_version, aggregate_type, kind, body, labels, created_at)
+		VALUES ($1, $2, $3, -1, $4, $5, $6, '{}', $7)`,
+			common.NewEventID(time.Now().Add(time.Second), badID, 1), badID, int32(common.Hash(badID)), aggregateType, "AccountCreated", []byte(`{}`), time.Now().UTC())
+		require.NoError(t, err)
+	}))
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	evts, err := r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{PartialResults: true})
+	require.Error(t, err)
+	assert.Equal(t, 2, passes)
+	require.Len(t, evts, 1)
+	assert.Equal(t, id, evts[0].AggregateID)
+}
+
+func TestLabelColumns(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	// saved before the migration
+	id1 := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id1, 100)
+	err = es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"geo": "EU", "trace": "t1"}))
+	require.NoError(t, err)
+
+	r, err = postgresql.NewStore(dbConfig.Url(), postgresql.WithLabelColumns("labels", "metadata", "geo"))
+	require.NoError(t, err)
+	err = r.MigrateLabelColumns(ctx)
+	require.NoError(t, err)
+	es = eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id2 := uuid.New().String()
+	acc = test.CreateAccount("Pereira", id2, 50)
+	err = es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"geo": "US", "trace": "t2"}))
+	require.NoError(t, err)
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	var labels, metadata string
+	err = db.QueryRow("SELECT labels, metadata FROM events WHERE aggregate_id = $1", id1).Scan(&labels, &metadata)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"geo": "EU"}`, labels)
+	assert.JSONEq(t, `{"trace": "t1"}`, metadata)
+
+	evts, err := r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{Labels: store.Labels{"geo": []string{"US"}}})
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, id2, evts[0].AggregateID)
+	assert.Equal(t, map[string]interface{}{"geo": "US", "trace": "t2"}, evts[0].Labels)
+}
+
+// numberCodec keeps the label numbers as json.Number
+type numberCodec struct {
+	eventstore.JSONCodec
+}
+
+func (numberCodec) Decode(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func TestLabelCodec(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithLabelCodec(numberCodec{}))
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err = es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"geo": "EU", "tier": 3}))
+	require.NoError(t, err)
+
+	evts, err := r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{Labels: store.Labels{"geo": []string{"EU"}}})
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, map[string]interface{}{"geo": "EU", "tier": json.Number("3")}, evts[0].Labels)
+}
+
+func TestConformance(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	storetest.RunConformance(t, func() storetest.Repository {
+		r, err := postgresql.NewStore(dbConfig.Url())
+		require.NoError(t, err)
+		return r
+	})
+}
+
+func TestConformanceWithColumns(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("ALTER TABLE events ADD COLUMN seq BIGSERIAL")
+	require.NoError(t, err)
+
+	options := []postgresql.StoreOption{
+		// the labels filtered by the conformance assertions are indexed
+		postgresql.WithLabelColumns("labels", "metadata", "marker", "geo", "source"),
+		postgresql.WithOrderingColumn("seq"),
+	}
+	r, err := postgresql.NewStore(dbConfig.Url(), options...)
+	require.NoError(t, err)
+	err = r.MigrateLabelColumns(context.Background())
+	require.NoError(t, err)
+
+	storetest.RunConformance(t, func() storetest.Repository {
+		r, err := postgresql.NewStore(dbConfig.Url(), options...)
+		require.NoError(t, err)
+		return r
+	})
+}
+
+// interleavingRepo calls between after reading the snapshot, before the events are read
+type interleavingRepo struct {
+	eventstore.EsRepository
+	between func()
+}
+
+func (r interleavingRepo) GetSnapshot(ctx context.Context, aggregateID string) (eventstore.Snapshot, error) {
+	snap, err := r.EsRepository.GetSnapshot(ctx, aggregateID)
+	if err == nil && r.between != nil {
+		r.between()
+	}
+	return snap, err
+}
+
+func TestGetByIDWithSaveBetweenReads(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	// reaching the threshold, a snapshot is saved at version 3
+	require.NoError(t, es.Save(ctx, acc))
+
+	var saveErr error
+	reader := eventstore.NewEventStore(interleavingRepo{
+		EsRepository: r,
+		between: func() {
+			// saves the next events, and snapshot, after the snapshot was read
+			acc.Deposit(5)
+			acc.Deposit(5)
+			acc.Deposit(5)
+			saveErr = es.Save(ctx, acc)
+		},
+	}, 3, test.AggregateFactory{})
+
+	a, err := reader.GetByID(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, saveErr)
+	acc2 := a.(*test.Account)
+	// the events read after the snapshot include the interleaved save
+	assert.Equal(t, uint32(6), acc2.Version)
+	assert.Equal(t, int64(145), acc2.Balance)
+}
+
+func TestGetByIDWithReadIsolation(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithReadIsolation(sql.LevelRepeatableRead))
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// keep saving while we read
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			acc.Deposit(10)
+			if err := es.Save(ctx, acc); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for loop := true; loop; {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			loop = false
+		default:
+		}
+		a, err := es.GetByID(ctx, id)
+		require.NoError(t, err)
+		acc2 := a.(*test.Account)
+		// every deposit adds one version, so the balance must always agree with the version
+		require.Equal(t, int64(100+10*(acc2.Version-1)), acc2.Balance)
+	}
+}
+
 func TestPollListener(t *testing.T) {
 	dbConfig, tearDown, err := setup()
 	require.NoError(t, err)
@@ -160,6 +482,60 @@ func TestPollListener(t *testing.T) {
 	assert.Equal(t, test.OPEN, acc2.Status)
 }
 
+func TestOutboxPoller(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	outbox, err := postgresql.NewOutboxRepository(dbConfig.Url())
+	require.NoError(t, err)
+	defer outbox.Close()
+	err = outbox.InstallOutbox(ctx)
+	require.NoError(t, err)
+
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	mockSink := test.NewMockSink(0)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	p := poller.New(outbox, poller.WithTrailingLag(0))
+	go p.Feed(ctx, outbox.WrapSinker(mockSink))
+
+	require.Eventually(t, func() bool {
+		return len(mockSink.GetEvents()) == 3
+	}, time.Second, 50*time.Millisecond)
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Eventually(t, func() bool {
+		count := 0
+		err = db.Get(&count, "SELECT count(*) FROM outbox WHERE published_at IS NOT NULL AND aggregate_id = $1", id)
+		return err == nil && count == 3
+	}, time.Second, 50*time.Millisecond)
+
+	evts, err := outbox.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, evts)
+
+	err = outbox.PurgePublished(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	count := 0
+	err = db.Get(&count, "SELECT count(*) FROM outbox WHERE aggregate_id = $1", id)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
 func TestListenerWithAggregateType(t *testing.T) {
 	dbConfig, tearDown, err := setup()
 	require.NoError(t, err)
@@ -382,3 +758,535 @@ func BenchmarkDepositAndSave2(b *testing.B) {
 		}
 	})
 }
+
+func TestAdvisoryLock(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	name := store.FeedLockName("accounts", 1, 2)
+	lock1, err := postgresql.NewAdvisoryLock(dbConfig.Url(), name, time.Second)
+	require.NoError(t, err)
+	defer lock1.Close()
+	lock2, err := postgresql.NewAdvisoryLock(dbConfig.Url(), name, time.Second)
+	require.NoError(t, err)
+	defer lock2.Close()
+
+	release1, err := lock1.Lock(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, release1)
+
+	release2, err := lock2.Lock(ctx)
+	require.NoError(t, err)
+	require.Nil(t, release2)
+
+	err = lock1.Unlock(ctx)
+	require.NoError(t, err)
+	_, ok := <-release1
+	assert.False(t, ok)
+
+	release2, err = lock2.Lock(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, release2)
+	require.NoError(t, lock2.Unlock(ctx))
+}
+
+func TestPurgeExpired(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 2, test.AggregateFactory{})
+
+	ephemeral := uuid.New().String()
+	acc := test.CreateAccount("Paulo", ephemeral, 100)
+	acc.Deposit(10)
+	err = es.Save(ctx, acc, eventstore.WithTTL(time.Millisecond))
+	require.NoError(t, err)
+
+	durable := uuid.New().String()
+	acc = test.CreateAccount("Pereira", durable, 100)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	count, err := r.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = es.GetByID(ctx, ephemeral)
+	require.True(t, errors.Is(err, eventstore.ErrAggregateNotFound), "expected aggregate not found, got %v", err)
+	snap, err := r.GetSnapshot(ctx, ephemeral)
+	require.NoError(t, err)
+	assert.Empty(t, snap.AggregateID)
+
+	// the tombstone is delivered to the feeds
+	evts, err := r.GetAggregateEvents(ctx, ephemeral, -1)
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, eventstore.TombstoneKind, evts[0].Kind)
+	assert.Equal(t, uint32(3), evts[0].AggregateVersion)
+
+	_, err = es.GetByID(ctx, durable)
+	require.NoError(t, err)
+}
+
+func TestCheckpointStore(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	checkpoints, err := postgresql.NewCheckpointStore(dbConfig.Url())
+	require.NoError(t, err)
+	defer checkpoints.Close()
+	require.NoError(t, checkpoints.InstallCheckpoints(ctx))
+
+	token, err := checkpoints.GetCheckpoint(ctx, "accounts", 1, 2)
+	require.NoError(t, err)
+	assert.Nil(t, token)
+
+	require.NoError(t, checkpoints.SaveCheckpoint(ctx, "accounts", 1, 2, []byte("A")))
+	require.NoError(t, checkpoints.SaveCheckpoint(ctx, "accounts", 1, 2, []byte("B")))
+	require.NoError(t, checkpoints.SaveCheckpoint(ctx, "accounts", 3, 4, []byte("C")))
+
+	token, err = checkpoints.GetCheckpoint(ctx, "accounts", 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("B"), token)
+	token, err = checkpoints.GetCheckpoint(ctx, "accounts", 3, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("C"), token)
+
+	// a checkpoint saved in a rolled back transaction, eg: of a failed sink, is discarded
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, checkpoints.SaveCheckpointTx(ctx, tx, "accounts", 1, 2, []byte("D")))
+	require.NoError(t, tx.Rollback())
+	token, err = checkpoints.GetCheckpoint(ctx, "accounts", 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("B"), token)
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	keys, err := postgresql.NewIdempotencyStore(dbConfig.Url())
+	require.NoError(t, err)
+	defer keys.Close()
+	require.NoError(t, keys.InstallIdempotency(ctx))
+
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{}, eventstore.WithIdempotencyStore(keys, time.Hour))
+
+	acc := test.CreateAccount("Paulo", uuid.New().String(), 100)
+	require.NoError(t, es.Save(ctx, acc, eventstore.WithIdempotencyKey("K1")))
+	ok, err := es.HasIdempotencyKey(ctx, aggregateType, "K1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	// the key is not in the events table
+	ok, err = r.HasIdempotencyKey(ctx, aggregateType, "K1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	acc2 := test.CreateAccount("Pedro", uuid.New().String(), 100)
+	err = es.Save(ctx, acc2, eventstore.WithIdempotencyKey("K1"))
+	require.True(t, errors.Is(err, eventstore.ErrIdempotencyKeyConflict), "expected idempotency key conflict, got %v", err)
+
+	// expired keys can be recorded again and are purged
+	require.NoError(t, keys.RecordIdempotencyKey(ctx, aggregateType, "K2", time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	ok, err = keys.HasIdempotencyKey(ctx, aggregateType, "K2")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	require.NoError(t, keys.RecordIdempotencyKey(ctx, aggregateType, "K2", time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	n, err := keys.PurgeExpiredIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestSnapshotForeignKey(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	id := uuid.New().String()
+	snap := eventstore.Snapshot{
+		ID:               common.NewEventID(time.Now(), id, 1),
+		AggregateID:      id,
+		AggregateVersion: 1,
+		AggregateType:    aggregateType,
+		Body:             []byte(`{}`),
+		CreatedAt:        time.Now().UTC(),
+	}
+	err = r.SaveSnapshot(ctx, snap)
+	require.True(t, errors.Is(err, eventstore.ErrSnapshotEventMissing), "expected snapshot event missing, got %v", err)
+
+	err = r.DropSnapshotForeignKey(ctx)
+	require.NoError(t, err)
+	err = r.SaveSnapshot(ctx, snap)
+	require.NoError(t, err)
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+	err = r.DropSnapshotForeignKey(ctx)
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	event := func(aggregateID string, version uint32, idempotencyKey string) eventstore.Event {
+		return eventstore.Event{
+			ID:               common.NewEventID(now, aggregateID, version),
+			AggregateID:      aggregateID,
+			AggregateVersion: version,
+			AggregateType:    aggregateType,
+			Kind:             "MoneyDeposited",
+			Body:             []byte(`{}`),
+			IdempotencyKey:   idempotencyKey,
+			CreatedAt:        now,
+		}
+	}
+	snapshot := func(e eventstore.Event) eventstore.Snapshot {
+		return eventstore.Snapshot{
+			ID:               e.ID,
+			AggregateID:      e.AggregateID,
+			AggregateVersion: e.AggregateVersion,
+			AggregateType:    aggregateType,
+			Body:             []byte(`{}`),
+			CreatedAt:        now,
+		}
+	}
+
+	// a snapshot of a compacted event
+	orphanID := uuid.New().String()
+	orphan := snapshot(event(orphanID, 1, ""))
+	require.NoError(t, r.SaveSnapshot(ctx, orphan))
+
+	// version 2 is missing
+	gapID := uuid.New().String()
+	gap := event(gapID, 3, "")
+	require.NoError(t, r.ImportEvents(ctx, []eventstore.Event{event(gapID, 1, ""), gap}))
+
+	// version 1 is missing
+	leadingID := uuid.New().String()
+	leading := event(leadingID, 2, "")
+	require.NoError(t, r.ImportEvents(ctx, []eventstore.Event{leading}))
+
+	// versions 1 and 2 were compacted into the snapshot at version 2
+	compactedID := uuid.New().String()
+	compacted := event(compactedID, 2, "")
+	require.NoError(t, r.ImportEvents(ctx, []eventstore.Event{compacted, event(compactedID, 3, "")}))
+	require.NoError(t, r.SaveSnapshot(ctx, snapshot(compacted)))
+
+	// the tombstone of purged events
+	tombstone := event(uuid.New().String(), 3, "")
+	tombstone.Kind = eventstore.TombstoneKind
+	require.NoError(t, r.ImportEvents(ctx, []eventstore.Event{tombstone}))
+
+	// the same key in two aggregates, as if saved before the unique index was created
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("DROP INDEX evt_agg_idempot_uk")
+	require.NoError(t, err)
+	key := uuid.New().String()
+	dupID := "a-" + uuid.New().String()
+	err = r.ImportEvents(ctx, []eventstore.Event{event(dupID, 1, key), event("b-"+uuid.New().String(), 1, key)})
+	require.NoError(t, err)
+
+	problems := []postgresql.IntegrityProblem{}
+	report, err := r.CheckIntegrity(ctx, postgresql.WithIntegrityProblemHandler(func(p postgresql.IntegrityProblem) {
+		problems = append(problems, p)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.OrphanSnapshots)
+	assert.Equal(t, 2, report.VersionGaps)
+	assert.Equal(t, 1, report.DuplicateIdempotencyKeys)
+	assert.ElementsMatch(t, []postgresql.IntegrityProblem{
+		{Kind: postgresql.OrphanSnapshot, AggregateID: orphanID, ID: orphan.ID},
+		{Kind: postgresql.VersionGap, AggregateID: gapID, ID: gap.ID},
+		{Kind: postgresql.VersionGap, AggregateID: leadingID, ID: leading.ID},
+		{Kind: postgresql.DuplicateIdempotencyKey, AggregateID: dupID, ID: key},
+	}, problems)
+
+	// only the orphan snapshots are repaired
+	report, err = r.CheckIntegrity(ctx, postgresql.WithRepair())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), report.RepairedSnapshots)
+	report, err = r.CheckIntegrity(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.OrphanSnapshots)
+	assert.Equal(t, 2, report.VersionGaps)
+	assert.Equal(t, 1, report.DuplicateIdempotencyKeys)
+}
+
+func TestQueryLogger(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	var logged string
+	var loggedArgs []interface{}
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithQueryLogger(func(sql string, args []interface{}) {
+		logged = sql
+		loggedArgs = args
+	}))
+	require.NoError(t, err)
+
+	_, err = r.GetEvents(context.Background(), "", 10, time.Duration(0), store.Filter{AggregateTypes: []string{aggregateType}})
+	require.NoError(t, err)
+	assert.Contains(t, logged, "aggregate_type")
+	assert.Contains(t, loggedArgs, aggregateType)
+}
+
+func TestCommitOrder(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithCommitOrder())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	// same creation time for every writer
+	createdAt := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := r.SaveEvent(ctx, eventstore.EventRecord{
+				AggregateID:   uuid.New().String(),
+				AggregateType: aggregateType,
+				CreatedAt:     createdAt,
+				Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	events, err := r.GetEvents(ctx, "", 100, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 10)
+	// every commit has its own millisecond, so the order of the IDs is the commit order
+	for i := 1; i < len(events); i++ {
+		assert.True(t, events[i].CreatedAt.After(events[i-1].CreatedAt), "event %d was not created after the previous one", i)
+	}
+}
+
+func TestUniqueViolation(t *testing.T) {
+	assert.True(t, postgresql.IsPqUniqueViolation(fmt.Errorf("wrapped: %w", &pq.Error{Code: "23505"})))
+	assert.False(t, postgresql.IsPqUniqueViolation(&pq.Error{Code: "23503"}))
+	assert.True(t, postgresql.IsPgxUniqueViolation(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "23505"})))
+	assert.False(t, postgresql.IsPgxUniqueViolation(errors.New("boom")))
+
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	var detected bool
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithUniqueViolation(func(err error) bool {
+		detected = postgresql.IsPqUniqueViolation(err)
+		return detected
+	}))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	rec := eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: aggregateType,
+		CreatedAt:     time.Now().UTC(),
+		Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+	}
+	_, _, err = r.SaveEvent(ctx, rec)
+	require.NoError(t, err)
+	_, _, err = r.SaveEvent(ctx, rec)
+	require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+	assert.True(t, detected)
+}
+
+func TestOrderingColumn(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("ALTER TABLE events ADD COLUMN seq BIGSERIAL")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url(), postgresql.WithOrderingColumn("seq"))
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Withdraw(5)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	evts, err := r.GetEvents(ctx, "", 2, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+	assert.Equal(t, postgresql.FormatPosition(1), string(evts[0].ResumeToken))
+	assert.Equal(t, postgresql.FormatPosition(2), string(evts[1].ResumeToken))
+	// the event ID is the stored one
+	assert.NotEqual(t, postgresql.FormatPosition(1), evts[0].ID)
+	firstID := evts[0].ID
+
+	evts, err = r.GetEvents(ctx, store.EventPosition(evts[1]), 10, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, postgresql.FormatPosition(3), string(evts[0].ResumeToken))
+
+	// an event ID, eg: from a max age, reads after the position of that event
+	evts, err = r.GetEvents(ctx, firstID, 10, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+	assert.Equal(t, postgresql.FormatPosition(2), string(evts[0].ResumeToken))
+
+	evts, err = r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{UpperBound: postgresql.FormatPosition(2)})
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+
+	last, err := r.GetLastEventID(ctx, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	assert.Equal(t, postgresql.FormatPosition(3), last)
+
+	// the other reads keep the stored event ID
+	agg, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), agg.GetVersion())
+
+	// the notifications only carry event IDs
+	listener := postgresql.NewFeedListenNotify(dbConfig.ReplicationUrl(), r, "events_channel")
+	err = listener.Feed(ctx, test.NewMockSink(1))
+	require.True(t, errors.Is(err, postgresql.ErrOrderingColumnUnsupported), "expected ordering column unsupported, got %v", err)
+}
+
+func TestExpectedVersion(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	ctx := context.Background()
+	r, err := postgresql.NewStore(dbConfig.Url())
+	require.NoError(t, err)
+
+	id := uuid.New().String()
+	expected := uint32(1)
+	rec := eventstore.EventRecord{
+		AggregateID:     id,
+		AggregateType:   aggregateType,
+		CreatedAt:       time.Now().UTC(),
+		ExpectedVersion: &expected,
+		Details:         []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+	}
+	// no events exist yet
+	_, _, err = r.SaveEvent(ctx, rec)
+	require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+
+	expected = 0
+	_, saved, err := r.SaveEvent(ctx, rec)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), saved[len(saved)-1].AggregateVersion)
+
+	rec.Version = 1
+	expected = 1
+	rec.CreatedAt = time.Now().UTC()
+	_, saved, err = r.SaveEvent(ctx, rec)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), saved[len(saved)-1].AggregateVersion)
+
+	// the stored aggregate advanced beyond the expected version, even if the versions to save are free
+	rec.Version = 2
+	_, _, err = r.SaveEvent(ctx, rec)
+	require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+}
+
+func TestGuard(t *testing.T) {
+	dbConfig, tearDown, err := setup()
+	require.NoError(t, err)
+	defer tearDown()
+
+	db, err := connect(dbConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	db.MustExec(`CREATE TABLE IF NOT EXISTS projection_offsets(
+		name VARCHAR (100) PRIMARY KEY,
+		last_event_id VARCHAR (50) NOT NULL
+	)`)
+
+	guard := func(eventID string) bool {
+		tx, err := db.Begin()
+		require.NoError(t, err)
+		apply, err := projection.Guard(tx, "accounts", eventID)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+		return apply
+	}
+
+	assert.True(t, guard("B"))
+	// duplicated delivery
+	assert.False(t, guard("B"))
+	// out of order delivery does not move the offset backwards
+	assert.False(t, guard("A"))
+	var lastEventID string
+	require.NoError(t, db.Get(&lastEventID, "SELECT last_event_id FROM projection_offsets WHERE name = 'accounts'"))
+	assert.Equal(t, "B", lastEventID)
+	assert.True(t, guard("C"))
+
+	// the same event delivered twice, concurrently, before there is an offset
+	tx1, err := db.Begin()
+	require.NoError(t, err)
+	apply, err := projection.Guard(tx1, "balances", "A")
+	require.NoError(t, err)
+	assert.True(t, apply)
+
+	applied := make(chan bool, 1)
+	go func() {
+		tx2, err := db.Begin()
+		if !assert.NoError(t, err) {
+			applied <- true
+			return
+		}
+		defer tx2.Rollback()
+		apply, err := projection.Guard(tx2, "balances", "A")
+		assert.NoError(t, err)
+		applied <- apply
+	}()
+	// the second guard waits for the first transaction
+	select {
+	case <-applied:
+		t.Fatal("the second guard did not wait for the first transaction")
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.NoError(t, tx1.Commit())
+	assert.False(t, <-applied)
+}
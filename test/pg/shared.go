@@ -106,12 +106,18 @@ func dbSchema(dbConfig DBConfig) error {
 		body bytea NOT NULL,
 		idempotency_key VARCHAR (50),
 		labels JSONB NOT NULL,
-		created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+		expires_at TIMESTAMP,
+		external_id VARCHAR (100),
+		epoch INTEGER NOT NULL DEFAULT 0
 	);
 	CREATE INDEX evt_agg_id_idx ON events (aggregate_id);
 	CREATE UNIQUE INDEX evt_agg_id_ver_uk ON events (aggregate_id, aggregate_version);
 	CREATE UNIQUE INDEX evt_agg_idempot_uk ON events (aggregate_type, idempotency_key);
 	CREATE INDEX evt_labels_idx ON events USING GIN (labels jsonb_path_ops);
+	CREATE INDEX evt_created_at_idx ON events (created_at);
+	CREATE INDEX evt_expires_at_idx ON events (expires_at) WHERE expires_at IS NOT NULL;
+	CREATE UNIQUE INDEX evt_external_id_uk ON events (external_id) WHERE external_id IS NOT NULL;
 
 	CREATE TABLE IF NOT EXISTS snapshots(
 		id VARCHAR (50) PRIMARY KEY,
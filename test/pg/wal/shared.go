@@ -97,7 +97,8 @@ func dbSchema(config tpg.DBConfig) error {
 			body bytea NOT NULL,
 			idempotency_key VARCHAR (50),
 			labels JSONB NOT NULL,
-			created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()::TIMESTAMP,
+			epoch INTEGER NOT NULL DEFAULT 0
 		);`,
 		`CREATE INDEX evt_agg_id_idx ON events (aggregate_id);`,
 		`CREATE UNIQUE INDEX evt_agg_id_ver_uk ON events (aggregate_id, aggregate_version);`,
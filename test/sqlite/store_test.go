@@ -0,0 +1,202 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/eventstore/store/poller"
+	"github.com/quintans/eventstore/store/sqlite"
+	"github.com/quintans/eventstore/test"
+	"github.com/quintans/eventstore/test/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T, path string, options ...sqlite.StoreOption) *sqlite.EsRepository {
+	r, err := sqlite.NewStore(path, options...)
+	require.NoError(t, err)
+	require.NoError(t, r.InstallSchema(context.Background()))
+	t.Cleanup(func() {
+		r.Close()
+	})
+	return r
+}
+
+// jsonSupported tells if the driver was built with the JSON1 functions, used by the label filters (see the sqlite_json build tag)
+func jsonSupported(t *testing.T) bool {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("SELECT json('{}')")
+	return err == nil
+}
+
+func TestConformance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+
+	opts := []storetest.Option{}
+	if !jsonSupported(t) {
+		opts = append(opts, storetest.WithoutLabelFilters())
+	}
+	storetest.RunConformance(t, func() storetest.Repository {
+		return newStore(t, path)
+	}, opts...)
+}
+
+func TestBridgeConformance(t *testing.T) {
+	for name, options := range map[string][]sqlite.StoreOption{
+		"ID":             nil,
+		"OrderingColumn": {sqlite.WithOrderingColumn("rowid")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := newStore(t, filepath.Join(t.TempDir(), "events.db"), options...)
+			bridge := player.NewStoreClientRepository(player.NewLocalStoreClient(player.NewStoreServer(r)))
+			storetest.RunBridgeConformance(t, r, bridge)
+		})
+	}
+}
+
+// TestPoller filters by aggregate type, and not by labels, so that it also runs without the sqlite_json build tag
+func TestPoller(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newStore(t, filepath.Join(t.TempDir(), "events.db"))
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Deposit(5)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// events of another aggregate type
+	_, _, err = r.SaveEvent(ctx, eventstore.EventRecord{
+		AggregateID:   uuid.New().String(),
+		AggregateType: "Other",
+		CreatedAt:     time.Now().UTC(),
+		Details:       []eventstore.EventRecordDetail{{Kind: "OtherCreated", Body: []byte(`{}`)}},
+	})
+	require.NoError(t, err)
+
+	acc2 := test.NewAccount()
+	counter := 0
+
+	p := poller.New(r, poller.WithAggregateTypes("Account"), poller.WithTrailingLag(0))
+
+	done := make(chan struct{})
+	go p.Poll(ctx, player.StartBeginning(), func(ctx context.Context, e eventstore.Event) error {
+		if e.AggregateType != "Account" {
+			return fmt.Errorf("unexpected aggregate type %s", e.AggregateType)
+		}
+		if err := test.ApplyChangeFromHistory(es, acc2, e); err != nil {
+			return err
+		}
+		counter++
+		if counter == 4 {
+			close(done)
+		}
+		return nil
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the polled events")
+	}
+	assert.Equal(t, 4, counter)
+	assert.Equal(t, id, acc2.ID)
+	assert.Equal(t, uint32(4), acc2.Version)
+	assert.Equal(t, int64(135), acc2.Balance)
+	assert.Equal(t, test.OPEN, acc2.Status)
+}
+
+func TestCommitOrder(t *testing.T) {
+	r := newStore(t, filepath.Join(t.TempDir(), "events.db"), sqlite.WithCommitOrder())
+
+	ctx := context.Background()
+	// same creation time for every writer
+	createdAt := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := r.SaveEvent(ctx, eventstore.EventRecord{
+				AggregateID:   uuid.New().String(),
+				AggregateType: "Account",
+				CreatedAt:     createdAt,
+				Details:       []eventstore.EventRecordDetail{{Kind: "AccountCreated", Body: []byte(`{}`)}},
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	events, err := r.GetEvents(ctx, "", 100, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 10)
+	// every commit has its own millisecond, so the order of the IDs is the commit order
+	for i := 1; i < len(events); i++ {
+		assert.True(t, events[i].CreatedAt.After(events[i-1].CreatedAt), "event %d was not created after the previous one", i)
+	}
+}
+
+func TestOrderingColumn(t *testing.T) {
+	ctx := context.Background()
+	r := newStore(t, filepath.Join(t.TempDir(), "events.db"), sqlite.WithOrderingColumn("rowid"))
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Withdraw(5)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	evts, err := r.GetEvents(ctx, "", 2, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+	assert.Equal(t, sqlite.FormatPosition(1), string(evts[0].ResumeToken))
+	assert.Equal(t, sqlite.FormatPosition(2), string(evts[1].ResumeToken))
+	// the event ID is the stored one
+	assert.NotEqual(t, sqlite.FormatPosition(1), evts[0].ID)
+	firstID := evts[0].ID
+
+	evts, err = r.GetEvents(ctx, store.EventPosition(evts[1]), 10, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, sqlite.FormatPosition(3), string(evts[0].ResumeToken))
+
+	// an event ID, eg: from a max age, reads after the position of that event
+	evts, err = r.GetEvents(ctx, firstID, 10, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+	assert.Equal(t, sqlite.FormatPosition(2), string(evts[0].ResumeToken))
+
+	evts, err = r.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{UpperBound: sqlite.FormatPosition(2)})
+	require.NoError(t, err)
+	require.Len(t, evts, 2)
+
+	last, err := r.GetLastEventID(ctx, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	assert.Equal(t, sqlite.FormatPosition(3), last)
+
+	// the other reads keep the stored event ID
+	agg, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), agg.GetVersion())
+}
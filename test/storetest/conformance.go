@@ -0,0 +1,1010 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quintans/eventstore"
+	"github.com/quintans/eventstore/player"
+	"github.com/quintans/eventstore/store"
+	"github.com/quintans/eventstore/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const aggregateType = "Account"
+
+// AggregateRepository is the surface of the store backends without a global order of the events, eg: Cassandra
+type AggregateRepository interface {
+	eventstore.EsRepository
+	store.CreationReader
+	eventstore.VersionReader
+	store.ExternalIDReader
+}
+
+// Repository is the surface that every store backend must provide
+type Repository interface {
+	AggregateRepository
+	player.Repository
+	store.Counter
+	store.ChangeLister
+}
+
+type options struct {
+	withoutLabelFilters bool
+}
+
+type Option func(*options)
+
+// WithoutLabelFilters skips the assertions filtering the events by labels,
+// for backends built without label filters, eg: SQLite without the JSON1 functions
+func WithoutLabelFilters() Option {
+	return func(o *options) {
+		o.withoutLabelFilters = true
+	}
+}
+
+// RunConformance runs the same behavioural assertions against a store backend.
+// The factory is called for every sub test and every repository may share the same database,
+// since every sub test works on its own aggregates.
+func RunConformance(t *testing.T, factory func() Repository, opts ...Option) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	skipLabelFilters := func(t *testing.T) {
+		if o.withoutLabelFilters {
+			t.Skip("label filters are not supported")
+		}
+	}
+
+	RunAggregateConformance(t, func() AggregateRepository {
+		return factory()
+	})
+	t.Run("FilteredGetEvents", func(t *testing.T) {
+		skipLabelFilters(t)
+		testFilteredGetEvents(t, factory())
+	})
+	t.Run("ChangedAggregates", func(t *testing.T) {
+		testChangedAggregates(t, factory())
+	})
+	t.Run("MinimalProjection", func(t *testing.T) {
+		skipLabelFilters(t)
+		testMinimalProjection(t, factory())
+	})
+}
+
+// RunAggregateConformance runs the assertions of RunConformance that only read the events by aggregate.
+// The assertions on the events of all the aggregates are skipped if the repository is not a player.Repository.
+func RunAggregateConformance(t *testing.T, factory func() AggregateRepository) {
+	t.Run("SaveAndGet", func(t *testing.T) {
+		testSaveAndGet(t, factory())
+	})
+	t.Run("ConcurrentModification", func(t *testing.T) {
+		testConcurrentModification(t, factory())
+	})
+	t.Run("SaveWithRetry", func(t *testing.T) {
+		testSaveWithRetry(t, factory())
+	})
+	t.Run("Snapshot", func(t *testing.T) {
+		testSnapshot(t, factory())
+	})
+	t.Run("MonotonicSnapshot", func(t *testing.T) {
+		testMonotonicSnapshot(t, factory())
+	})
+	t.Run("Idempotency", func(t *testing.T) {
+		testIdempotency(t, factory())
+	})
+	t.Run("IdempotencyRace", func(t *testing.T) {
+		testIdempotencyRace(t, factory())
+	})
+	t.Run("GetCreationEvent", func(t *testing.T) {
+		testGetCreationEvent(t, factory())
+	})
+	t.Run("WaitForVersion", func(t *testing.T) {
+		testWaitForVersion(t, factory())
+	})
+	t.Run("ExternalIDs", func(t *testing.T) {
+		testExternalIDs(t, factory())
+	})
+	t.Run("Forget", func(t *testing.T) {
+		testForget(t, factory())
+	})
+	t.Run("NamespacedKinds", func(t *testing.T) {
+		testNamespacedKinds(t, factory())
+	})
+	t.Run("SnapshotOnly", func(t *testing.T) {
+		testSnapshotOnly(t, factory())
+	})
+	t.Run("AggregateNotFound", func(t *testing.T) {
+		testAggregateNotFound(t, factory())
+	})
+	t.Run("SaveOrdering", func(t *testing.T) {
+		testSaveOrdering(t, factory())
+	})
+	t.Run("Validator", func(t *testing.T) {
+		testValidator(t, factory())
+	})
+	t.Run("CloseStream", func(t *testing.T) {
+		testCloseStream(t, factory())
+	})
+	t.Run("GetByIDFromSnapshot", func(t *testing.T) {
+		testGetByIDFromSnapshot(t, factory())
+	})
+	t.Run("DiffVersions", func(t *testing.T) {
+		testDiffVersions(t, factory())
+	})
+}
+
+// RunBridgeConformance asserts that a bridge to the repository, eg: the gRPC client of a player.GrpcServer,
+// returns every field of the events, as the repository does
+func RunBridgeConformance(t *testing.T, r Repository, bridge player.Repository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc,
+		eventstore.WithExternalIDs(uuid.New().String(), uuid.New().String()),
+		eventstore.WithLabels(map[string]interface{}{"geo": "EU"}),
+	)
+	require.NoError(t, err)
+	acc.Deposit(5)
+	err = es.Save(ctx, acc, eventstore.WithIdempotencyKey(uuid.New().String()))
+	require.NoError(t, err)
+	// the events of the new epoch have a non zero epoch
+	_, err = es.CloseStream(ctx, id)
+	require.NoError(t, err)
+
+	filter := store.Filter{AggregateTypes: []string{aggregateType}}
+	expected, err := r.GetEvents(ctx, "", 100, time.Duration(0), filter)
+	require.NoError(t, err)
+	require.NotEmpty(t, expected)
+	events, err := bridge.GetEvents(ctx, "", 100, time.Duration(0), filter)
+	require.NoError(t, err)
+	require.Len(t, events, len(expected))
+	for k := range expected {
+		// the instants are the same, but not the locations
+		assert.True(t, expected[k].CreatedAt.Equal(events[k].CreatedAt), "created at %s, got %s", expected[k].CreatedAt, events[k].CreatedAt)
+		expected[k].CreatedAt, events[k].CreatedAt = time.Time{}, time.Time{}
+	}
+	assert.Equal(t, expected, events)
+
+	last, err := r.GetLastEventID(ctx, time.Duration(0), filter)
+	require.NoError(t, err)
+	bridged, err := bridge.GetLastEventID(ctx, time.Duration(0), filter)
+	require.NoError(t, err)
+	assert.Equal(t, last, bridged)
+}
+
+func testSaveAndGet(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Deposit(5)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, id, acc2.ID)
+	assert.Equal(t, acc.Version, acc2.Version)
+	assert.Equal(t, int64(135), acc2.Balance)
+	assert.Equal(t, test.OPEN, acc2.Status)
+	assert.Equal(t, uint32(4), acc2.GetEventsCounter())
+
+	// typed IDs
+	a, err = es.GetByAggregateID(ctx, uuid.MustParse(id))
+	require.NoError(t, err)
+	assert.Equal(t, id, a.GetID())
+	a, err = es.GetByAggregateID(ctx, eventstore.StringID(id))
+	require.NoError(t, err)
+	assert.Equal(t, id, a.GetID())
+
+	// the consistency token is the ID of the last saved event
+	acc.Withdraw(5)
+	token, err := es.SaveWithToken(ctx, acc)
+	require.NoError(t, err)
+	evts, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	// the stores keeping many events per document, eg: MongoDB, return the document ID
+	assert.Equal(t, store.Boundary(evts[len(evts)-1].ID), token)
+	token, err = es.SaveWithToken(ctx, acc)
+	require.NoError(t, err)
+	assert.Empty(t, token)
+}
+
+func testConcurrentModification(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	conflicts := map[string]int{}
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{},
+		eventstore.WithConcurrencyConflictHandler(func(ctx context.Context, aggregateType, aggregateID string) {
+			conflicts[aggregateType+"/"+aggregateID]++
+		}),
+	)
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc1 := a.(*test.Account)
+	a, err = es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+
+	acc1.Deposit(10)
+	err = es.Save(ctx, acc1)
+	require.NoError(t, err)
+
+	acc2.Deposit(20)
+	err = es.Save(ctx, acc2)
+	require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+	assert.Equal(t, map[string]int{aggregateType + "/" + id: 1}, conflicts)
+}
+
+func testSaveWithRetry(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	// a concurrent deposit happens between the first load and save
+	loads := 0
+	err = es.SaveWithRetry(ctx, id,
+		func(a eventstore.Aggregater) error {
+			loads++
+			if loads > 1 {
+				return nil
+			}
+			other, err := es.GetByID(ctx, id)
+			if err != nil {
+				return err
+			}
+			other.(*test.Account).Deposit(10)
+			return es.Save(ctx, other)
+		},
+		func(a eventstore.Aggregater) error {
+			a.(*test.Account).Deposit(20)
+			return nil
+		},
+		3,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 2, loads)
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(130), a.(*test.Account).Balance)
+
+	// other errors are not retried
+	errFail := errors.New("fail")
+	mutations := 0
+	err = es.SaveWithRetry(ctx, id, nil, func(a eventstore.Aggregater) error {
+		mutations++
+		return errFail
+	}, 3)
+	require.True(t, errors.Is(err, errFail), "expected fail, got %v", err)
+	assert.Equal(t, 1, mutations)
+
+	// gives up after the retries
+	err = es.SaveWithRetry(ctx, id,
+		func(a eventstore.Aggregater) error {
+			other, err := es.GetByID(ctx, id)
+			if err != nil {
+				return err
+			}
+			other.(*test.Account).Deposit(1)
+			return es.Save(ctx, other)
+		},
+		func(a eventstore.Aggregater) error {
+			a.(*test.Account).Deposit(1)
+			return nil
+		},
+		1,
+	)
+	require.True(t, errors.Is(err, eventstore.ErrConcurrentModification), "expected concurrent modification, got %v", err)
+}
+
+func testSnapshot(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	replayed := []int{}
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{},
+		eventstore.WithOnReplay(func(aggregateType string, eventsReplayed int) {
+			replayed = append(replayed, eventsReplayed)
+		}),
+	)
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	snap, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, id, snap.AggregateID)
+	assert.Equal(t, aggregateType, snap.AggregateType)
+	assert.Equal(t, acc.Version, snap.AggregateVersion)
+	assert.NotEmpty(t, snap.Body)
+
+	meta, err := r.GetSnapshotMeta(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, meta.Exists)
+	assert.Equal(t, snap.AggregateVersion, meta.AggregateVersion)
+	assert.Equal(t, snap.CreatedAt.Unix(), meta.CreatedAt.Unix())
+
+	meta, err = r.GetSnapshotMeta(ctx, uuid.New().String())
+	require.NoError(t, err)
+	assert.False(t, meta.Exists)
+
+	acc.Deposit(5)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc2 := a.(*test.Account)
+	assert.Equal(t, int64(135), acc2.Balance)
+	assert.Equal(t, uint32(4), acc2.GetEventsCounter())
+	// only the event saved after the snapshot was replayed
+	assert.Equal(t, []int{1}, replayed)
+}
+
+func testMonotonicSnapshot(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	acc.Deposit(20)
+	require.NoError(t, es.Save(ctx, acc))
+
+	evts, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.Len(t, evts, 3)
+	snapshotAt := func(e eventstore.Event) eventstore.Snapshot {
+		return eventstore.Snapshot{
+			ID:               e.ID,
+			AggregateID:      id,
+			AggregateVersion: e.AggregateVersion,
+			AggregateType:    aggregateType,
+			Body:             []byte(`{}`),
+			CreatedAt:        time.Now().UTC(),
+		}
+	}
+	older := snapshotAt(evts[1])
+	newer := snapshotAt(evts[2])
+
+	// two writers racing at different versions
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, snap := range []eventstore.Snapshot{newer, older} {
+		wg.Add(1)
+		go func(i int, snap eventstore.Snapshot) {
+			defer wg.Done()
+			errs[i] = r.SaveSnapshot(ctx, snap)
+		}(i, snap)
+	}
+	wg.Wait()
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	snap, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, newer.ID, snap.ID)
+	assert.Equal(t, newer.AggregateVersion, snap.AggregateVersion)
+
+	// a late older snapshot is a no-op
+	require.NoError(t, r.SaveSnapshot(ctx, snapshotAt(evts[0])))
+	snap, err = r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, newer.ID, snap.ID)
+
+	// saving the same snapshot again is allowed
+	require.NoError(t, r.SaveSnapshot(ctx, newer))
+}
+
+func testIdempotency(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	key := uuid.New().String()
+	found, err := es.HasIdempotencyKey(ctx, aggregateType, key)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	acc := test.CreateAccount("Paulo", uuid.New().String(), 100)
+	err = es.Save(ctx, acc, eventstore.WithIdempotencyKey(key))
+	require.NoError(t, err)
+
+	found, err = es.HasIdempotencyKey(ctx, aggregateType, key)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	acc.Deposit(5)
+	err = es.Save(ctx, acc, eventstore.WithIdempotencyKey(key))
+	require.True(t, errors.Is(err, eventstore.ErrIdempotencyKeyConflict), "expected idempotency key conflict, got %v", err)
+}
+
+func testIdempotencyRace(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	key := uuid.New().String()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			acc := test.CreateAccount("Paulo", uuid.New().String(), 100)
+			errs <- es.Save(ctx, acc, eventstore.WithIdempotencyKey(key))
+		}()
+	}
+
+	saved, conflicts := 0, 0
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			saved++
+		case errors.Is(err, eventstore.ErrIdempotencyKeyConflict):
+			conflicts++
+		default:
+			t.Fatalf("expected idempotency key conflict, got %v", err)
+		}
+	}
+	assert.Equal(t, 1, saved)
+	assert.Equal(t, 1, conflicts)
+}
+
+func testFilteredGetEvents(t *testing.T, r Repository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	marker := uuid.New().String()
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"marker": marker, "geo": "EU"}))
+	require.NoError(t, err)
+	acc.Deposit(20)
+	err = es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"marker": marker, "geo": "US"}))
+	require.NoError(t, err)
+	acc.Deposit(30)
+	err = es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"marker": marker, "geo": "AS"}))
+	require.NoError(t, err)
+
+	count := func(filters ...store.FilterOption) int {
+		filter := store.Filter{}
+		for _, f := range filters {
+			f(&filter)
+		}
+		events, err := r.GetEvents(ctx, "", 100, time.Duration(0), filter)
+		require.NoError(t, err)
+		c := 0
+		for _, e := range events {
+			if e.AggregateID == id {
+				c++
+			}
+		}
+		return c
+	}
+
+	assert.Equal(t, 4, count(store.WithLabel("marker", marker)))
+	assert.Equal(t, 4, count(store.WithAggregateTypes(aggregateType), store.WithLabel("marker", marker)))
+	assert.Equal(t, 0, count(store.WithAggregateTypes("Unknown"), store.WithLabel("marker", marker)))
+	assert.Equal(t, 2, count(store.WithLabel("marker", marker), store.WithLabel("geo", "EU")))
+	assert.Equal(t, 3, count(store.WithLabel("marker", marker), store.WithLabel("geo", "EU"), store.WithLabel("geo", "US")))
+
+	assert.Equal(t, 2, count(store.WithLabel("marker", marker), store.WithExcludeLabels(store.Labels{"geo": {"EU"}})))
+	assert.Equal(t, 1, count(store.WithLabel("marker", marker), store.WithExcludeLabels(store.Labels{"geo": {"EU", "US"}})))
+	// events without the excluded label key are kept
+	assert.Equal(t, 4, count(store.WithLabel("marker", marker), store.WithExcludeLabels(store.Labels{"source": {"self"}})))
+
+	events, err := r.GetEvents(ctx, "", 100, time.Duration(0), store.Filter{Labels: store.Labels{"marker": {marker}}})
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, 2, count(store.WithLabel("marker", marker), store.WithUpperBound(store.EventPosition(events[1]))))
+	assert.Equal(t, 4, count(store.WithLabel("marker", marker), store.WithUpperBound(store.EventPosition(events[3]))))
+
+	n, err := r.CountEvents(ctx, store.Filter{Labels: store.Labels{"marker": {marker}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	n, err = r.CountEvents(ctx, store.Filter{Labels: store.Labels{"marker": {marker}, "geo": {"EU", "US"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	n, err = r.CountEvents(ctx, store.Filter{ApproximateCount: true})
+	require.NoError(t, err)
+	assert.True(t, n >= 0)
+}
+
+func testChangedAggregates(t *testing.T, r Repository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	old := uuid.New().String()
+	acc := test.CreateAccount("Paulo", old, 100)
+	require.NoError(t, es.Save(ctx, acc))
+
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+
+	id1 := uuid.New().String()
+	acc1 := test.CreateAccount("Paulo", id1, 100)
+	acc1.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc1))
+	acc1.Deposit(20)
+	require.NoError(t, es.Save(ctx, acc1))
+	id2 := uuid.New().String()
+	acc2 := test.CreateAccount("Pedro", id2, 50)
+	require.NoError(t, es.Save(ctx, acc2))
+	// the old aggregate changed after since
+	acc.Deposit(5)
+	require.NoError(t, es.Save(ctx, acc))
+
+	refs, err := r.ChangedAggregates(ctx, since, store.Filter{AggregateTypes: []string{aggregateType}})
+	require.NoError(t, err)
+	changed := map[string]store.AggregateRef{}
+	for _, ref := range refs {
+		_, dup := changed[ref.AggregateID]
+		assert.False(t, dup, "aggregate '%s' is repeated", ref.AggregateID)
+		changed[ref.AggregateID] = ref
+	}
+	assert.Equal(t, store.AggregateRef{AggregateID: id1, AggregateType: aggregateType, Version: acc1.GetVersion()}, changed[id1])
+	assert.Equal(t, acc2.GetVersion(), changed[id2].Version)
+	assert.Equal(t, acc.GetVersion(), changed[old].Version)
+
+	refs, err = r.ChangedAggregates(ctx, time.Now().UTC().Add(time.Hour), store.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+
+	refs, err = r.ChangedAggregates(ctx, since, store.Filter{AggregateTypes: []string{"Unknown"}})
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+}
+
+func testGetCreationEvent(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc))
+	acc.Deposit(20)
+	require.NoError(t, es.Save(ctx, acc))
+
+	e, err := r.GetCreationEvent(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, id, e.AggregateID)
+	assert.Equal(t, aggregateType, e.AggregateType)
+	assert.Equal(t, "AccountCreated", e.Kind)
+	assert.Equal(t, uint32(1), e.AggregateVersion)
+	assert.NotEmpty(t, e.Body)
+
+	_, err = r.GetCreationEvent(ctx, uuid.New().String())
+	require.True(t, errors.Is(err, eventstore.ErrAggregateNotFound), "expected aggregate not found, got %v", err)
+}
+
+func testWaitForVersion(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	version, err := r.CurrentVersion(ctx, uuid.New().String())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), version)
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	require.NoError(t, es.Save(ctx, acc))
+	version, err = r.CurrentVersion(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, acc.GetVersion(), version)
+
+	err = es.WaitForVersion(ctx, id, version+1, 100*time.Millisecond)
+	require.True(t, errors.Is(err, eventstore.ErrVersionTimeout), "expected version timeout, got %v", err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		acc.Deposit(10)
+		es.Save(ctx, acc)
+	}()
+	err = es.WaitForVersion(ctx, id, version+1, 5*time.Second)
+	require.NoError(t, err)
+}
+
+func testExternalIDs(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	created, deposited := uuid.New().String(), uuid.New().String()
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc, eventstore.WithExternalIDs(created, deposited)))
+
+	e, err := r.GetByExternalID(ctx, deposited)
+	require.NoError(t, err)
+	assert.Equal(t, id, e.AggregateID)
+	assert.Equal(t, "MoneyDeposited", e.Kind)
+	assert.Equal(t, deposited, e.ExternalID)
+
+	_, err = r.GetByExternalID(ctx, uuid.New().String())
+	require.True(t, errors.Is(err, eventstore.ErrEventNotFound), "expected event not found, got %v", err)
+
+	if p, ok := r.(player.Repository); ok {
+		events, err := p.GetEvents(ctx, "", 10, time.Duration(0), store.Filter{ExternalIDs: []string{created}})
+		require.NoError(t, err)
+		require.NotEmpty(t, events)
+		assert.Equal(t, created, events[0].ExternalID)
+		for _, e := range events {
+			assert.Equal(t, id, e.AggregateID)
+		}
+	}
+
+	// ingesting the same external event again
+	other := test.CreateAccount("Pereira", uuid.New().String(), 50)
+	err = es.Save(ctx, other, eventstore.WithExternalIDs(created))
+	require.True(t, errors.Is(err, eventstore.ErrExternalIDConflict), "expected external ID conflict, got %v", err)
+}
+
+func testForget(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 3, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.UpdateOwner("Paulo Quintans")
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	err = es.Forget(ctx,
+		eventstore.ForgetRequest{
+			AggregateID: id,
+			EventKind:   "OwnerUpdated",
+		},
+		func(i interface{}) interface{} {
+			switch t := i.(type) {
+			case test.OwnerUpdated:
+				t.Owner = ""
+				return t
+			case test.Account:
+				t.Owner = ""
+				return t
+			}
+			return i
+		},
+	)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	forgotten := 0
+	for _, e := range events {
+		if e.Kind != "OwnerUpdated" {
+			continue
+		}
+		evt, err := es.RehydrateEvent(e.Kind, e.Body)
+		require.NoError(t, err)
+		assert.Empty(t, evt.(test.OwnerUpdated).Owner)
+		forgotten++
+	}
+	assert.Equal(t, 1, forgotten)
+
+	snap, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	a, err := es.RehydrateAggregate(snap.AggregateType, snap.Body)
+	require.NoError(t, err)
+	assert.Empty(t, a.(*test.Account).Owner)
+}
+
+func testMinimalProjection(t *testing.T, r Repository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	marker := uuid.New().String()
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc, eventstore.WithLabels(map[string]interface{}{"marker": marker}))
+	require.NoError(t, err)
+
+	filter := store.Filter{}
+	store.WithLabel("marker", marker)(&filter)
+	store.WithProjection(store.MinimalProjection)(&filter)
+	events, err := r.GetEvents(ctx, "", 100, time.Duration(0), filter)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for k, e := range events {
+		assert.NotEmpty(t, e.ID)
+		assert.Equal(t, id, e.AggregateID)
+		assert.NotEmpty(t, e.Kind)
+		assert.NotEmpty(t, e.Body)
+		assert.False(t, e.CreatedAt.IsZero())
+		assert.Empty(t, e.AggregateType)
+		assert.Empty(t, e.Labels)
+		if k > 0 {
+			assert.True(t, store.EventPosition(e) > store.EventPosition(events[k-1]))
+		}
+	}
+}
+
+func testNamespacedKinds(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, eventstore.NewNamespacedFactory("account", test.AggregateFactory{}),
+		eventstore.WithKindNamer(eventstore.NamespaceKinds("account")),
+	)
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	assert.Equal(t, "account.AccountCreated", events[0].Kind)
+
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+}
+
+func testSnapshotOnly(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{}, eventstore.WithSnapshotOnly(aggregateType))
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+	acc.Deposit(10)
+	err = es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	snap, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, id, snap.AggregateID)
+	assert.Equal(t, acc.Version, snap.AggregateVersion)
+
+	events, err := r.GetAggregateEvents(ctx, id, int(snap.AggregateVersion))
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(110), a.(*test.Account).Balance)
+}
+
+func testAggregateNotFound(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	_, err := es.GetByID(ctx, id)
+	require.True(t, errors.Is(err, eventstore.ErrAggregateNotFound), "expected aggregate not found, got %v", err)
+
+	err = es.Exec(ctx, id, func(a eventstore.Aggregater) (eventstore.Aggregater, error) {
+		return a, nil
+	})
+	require.True(t, errors.Is(err, eventstore.ErrAggregateNotFound), "expected aggregate not found, got %v", err)
+}
+
+func testSaveOrdering(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{})
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	for i := 0; i < 10; i++ {
+		acc.Deposit(int64(i))
+	}
+	err := es.Save(ctx, acc)
+	require.NoError(t, err)
+
+	events, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 11)
+	for i := 1; i < len(events); i++ {
+		assert.Less(t, events[i-1].ID, events[i].ID)
+		// stores that save all the events of a save in one record, like MongoDB, share the version
+		assert.LessOrEqual(t, events[i-1].AggregateVersion, events[i].AggregateVersion)
+	}
+
+	p, ok := r.(player.Repository)
+	if !ok {
+		return
+	}
+	// with no batch size, all the events are read
+	events, err = p.GetEvents(ctx, "", 0, time.Duration(0), store.Filter{})
+	require.NoError(t, err)
+	var last eventstore.Event
+	count := 0
+	for _, e := range events {
+		if e.AggregateID != id {
+			continue
+		}
+		if last.ID != "" {
+			assert.Less(t, last.ID, e.ID)
+			assert.LessOrEqual(t, last.AggregateVersion, e.AggregateVersion)
+		}
+		last = e
+		count++
+	}
+	assert.Equal(t, 11, count)
+}
+
+func testValidator(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	validator := eventstore.NewJSONSchemaValidator()
+	err := validator.Register("MoneyDeposited", []byte(`{"type": "object", "properties": {"money": {"type": "integer", "minimum": 0}}}`))
+	require.NoError(t, err)
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{}, eventstore.WithValidator(validator))
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(-5)
+	err = es.Save(ctx, acc)
+	require.True(t, errors.Is(err, eventstore.ErrInvalidEvent), "expected invalid event, got %v", err)
+
+	// none of the events of the save was inserted
+	_, err = es.GetByID(ctx, id)
+	require.True(t, errors.Is(err, eventstore.ErrAggregateNotFound), "expected aggregate not found, got %v", err)
+}
+
+func testCloseStream(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	replayed := []int{}
+	es := eventstore.NewEventStore(r, 100, test.AggregateFactory{}, eventstore.WithOnReplay(func(aggregateType string, eventsReplayed int) {
+		replayed = append(replayed, eventsReplayed)
+	}))
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc))
+
+	epoch, err := es.CloseStream(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), epoch)
+
+	a, err := es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc = a.(*test.Account)
+	assert.Equal(t, uint32(1), acc.GetEpoch())
+	acc.Deposit(5)
+	require.NoError(t, es.Save(ctx, acc))
+
+	a, err = es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc = a.(*test.Account)
+	assert.Equal(t, int64(115), acc.Balance)
+	assert.Equal(t, uint32(1), acc.GetEpoch())
+	// only the events of the new epoch were replayed
+	assert.Equal(t, []int{0, 1}, replayed[len(replayed)-2:])
+
+	// the events of the closed epoch are kept, and the epoch is stored with each event
+	evts, err := r.GetAggregateEvents(ctx, id, -1)
+	require.NoError(t, err)
+	require.Len(t, evts, 4)
+	assert.Equal(t, uint32(0), evts[0].Epoch)
+	assert.Equal(t, eventstore.StreamClosedKind, evts[2].Kind)
+	assert.Equal(t, uint32(1), evts[2].Epoch)
+	assert.Equal(t, uint32(1), evts[3].Epoch)
+
+	// without snapshots, eg: pruned, the epoch is read back from the events
+	// and the events of the closed epoch are still not replayed
+	es = eventstore.NewEventStore(r, 100, test.AggregateFactory{}, eventstore.WithSnapshotStore(noSnapshots{}), eventstore.WithOnReplay(func(aggregateType string, eventsReplayed int) {
+		replayed = append(replayed, eventsReplayed)
+	}))
+	a, err = es.GetByID(ctx, id)
+	require.NoError(t, err)
+	acc = a.(*test.Account)
+	assert.Equal(t, int64(5), acc.Balance)
+	assert.Equal(t, uint32(1), acc.GetEpoch())
+	assert.Equal(t, uint32(4), acc.GetVersion())
+	assert.Equal(t, 2, replayed[len(replayed)-1])
+}
+
+// noSnapshots is a snapshot store without snapshots
+type noSnapshots struct{}
+
+func (noSnapshots) GetSnapshot(ctx context.Context, aggregateID string) (eventstore.Snapshot, error) {
+	return eventstore.Snapshot{}, nil
+}
+
+func (noSnapshots) SaveSnapshot(ctx context.Context, snapshot eventstore.Snapshot) error {
+	return nil
+}
+
+func testGetByIDFromSnapshot(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	replayed := []int{}
+	es := eventstore.NewEventStore(r, 2, test.AggregateFactory{}, eventstore.WithOnReplay(func(aggregateType string, eventsReplayed int) {
+		replayed = append(replayed, eventsReplayed)
+	}))
+
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	acc.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc))
+	cached, err := r.GetSnapshot(ctx, id)
+	require.NoError(t, err)
+	require.NotEmpty(t, cached.Body)
+
+	acc.Deposit(5)
+	require.NoError(t, es.Save(ctx, acc))
+
+	a, err := es.GetByIDFromSnapshot(ctx, id, cached, test.NewAccount())
+	require.NoError(t, err)
+	assert.Equal(t, int64(115), a.(*test.Account).Balance)
+	assert.Equal(t, []int{1}, replayed)
+
+	// rehydrated by the factory
+	a, err = es.GetByIDFromSnapshot(ctx, id, cached, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(115), a.(*test.Account).Balance)
+
+	// without snapshot, all the events are replayed
+	a, err = es.GetByIDFromSnapshot(ctx, id, eventstore.Snapshot{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(115), a.(*test.Account).Balance)
+	assert.Equal(t, acc.GetVersion(), a.GetVersion())
+
+	// the snapshot of another aggregate
+	_, err = es.GetByIDFromSnapshot(ctx, uuid.New().String(), cached, nil)
+	require.True(t, errors.Is(err, eventstore.ErrSnapshotAggregateMismatch), "expected snapshot aggregate mismatch, got %v", err)
+}
+
+func testDiffVersions(t *testing.T, r AggregateRepository) {
+	ctx := context.Background()
+	es := eventstore.NewEventStore(r, 10, test.AggregateFactory{})
+
+	// one event per save, so that every event has its own version in all stores
+	id := uuid.New().String()
+	acc := test.CreateAccount("Paulo", id, 100)
+	require.NoError(t, es.Save(ctx, acc))
+	acc.Deposit(10)
+	require.NoError(t, es.Save(ctx, acc))
+	acc.UpdateOwner("Pereira")
+	require.NoError(t, es.Save(ctx, acc))
+
+	changes, err := es.DiffVersions(ctx, id, 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []eventstore.FieldChange{{Path: "balance", From: float64(100), To: float64(110)}}, changes)
+
+	changes, err = es.DiffVersions(ctx, id, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []eventstore.FieldChange{
+		{Path: "balance", From: float64(100), To: float64(110)},
+		// AccountCreated does not set the owner
+		{Path: "owner", From: nil, To: "Pereira"},
+	}, changes)
+
+	changes, err = es.DiffVersions(ctx, id, 2, 2)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	_, err = es.DiffVersions(ctx, id, 1, 4)
+	require.True(t, errors.Is(err, eventstore.ErrVersionNotFound), "expected version not found, got %v", err)
+}
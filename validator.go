@@ -0,0 +1,218 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/quintans/faults"
+)
+
+// ErrInvalidEvent is wrapped by the errors of a Validator
+var ErrInvalidEvent = errors.New("invalid event")
+
+// Validator validates the encoded body of an event, of a given kind, before it is saved
+type Validator interface {
+	Validate(kind string, body []byte) error
+}
+
+// ValidationError describes the first constraint that an event body failed
+type ValidationError struct {
+	Kind string
+	// Field is the path of the offending field, eg: $.owner.name
+	Field string
+	// Constraint is the schema keyword that failed, eg: required
+	Constraint string
+	Message    string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("event %s: field %s violates '%s': %s", e.Kind, e.Field, e.Constraint, e.Message)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidEvent
+}
+
+// jsonSchema is the subset of JSON Schema supported by JSONSchemaValidator
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	pattern              *regexp.Regexp
+}
+
+func (s *jsonSchema) compile() error {
+	if s.Pattern != "" {
+		p, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return faults.Errorf("Invalid pattern '%s': %w", s.Pattern, err)
+		}
+		s.pattern = p
+	}
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// JSONSchemaValidator validates JSON encoded event bodies against a JSON Schema registered per kind.
+// Only the keywords type, required, properties, additionalProperties, items, enum, minimum, maximum,
+// minLength, maxLength and pattern are supported.
+// Events of kinds without a registered schema are considered valid.
+type JSONSchemaValidator struct {
+	mu      sync.RWMutex
+	schemas map[string]*jsonSchema
+}
+
+func NewJSONSchemaValidator() *JSONSchemaValidator {
+	return &JSONSchemaValidator{
+		schemas: map[string]*jsonSchema{},
+	}
+}
+
+// Register sets the JSON Schema used to validate the events of the given kind
+func (v *JSONSchemaValidator) Register(kind string, schema []byte) error {
+	s := &jsonSchema{}
+	err := json.Unmarshal(schema, s)
+	if err != nil {
+		return faults.Errorf("Unable to parse the schema of kind '%s': %w", kind, err)
+	}
+	err = s.compile()
+	if err != nil {
+		return faults.Errorf("Unable to compile the schema of kind '%s': %w", kind, err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.schemas[kind] = s
+	return nil
+}
+
+func (v *JSONSchemaValidator) Validate(kind string, body []byte) error {
+	v.mu.RLock()
+	s := v.schemas[kind]
+	v.mu.RUnlock()
+	if s == nil {
+		return nil
+	}
+
+	var doc interface{}
+	err := json.Unmarshal(body, &doc)
+	if err != nil {
+		return &ValidationError{Kind: kind, Field: "$", Constraint: "type", Message: "body is not valid JSON"}
+	}
+	return s.validate(kind, "$", doc)
+}
+
+func (s *jsonSchema) validate(kind, path string, value interface{}) error {
+	fail := func(constraint, format string, args ...interface{}) error {
+		return &ValidationError{Kind: kind, Field: path, Constraint: constraint, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if s.Type != "" && !isJSONType(s.Type, value) {
+		return fail("type", "expected %s", s.Type)
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		return fail("enum", "value %v is not one of %v", value, s.Enum)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := v[r]; !ok {
+				return fail("required", "missing field %s", r)
+			}
+		}
+		// sorted, to always report the same error
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fail("additionalProperties", "unexpected field %s", k)
+				}
+				continue
+			}
+			if err := p.validate(kind, path+"."+k, v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(kind, fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fail("minimum", "%v is less than %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fail("maximum", "%v is greater than %v", v, *s.Maximum)
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fail("minLength", "length %d is less than %d", length, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fail("maxLength", "length %d is greater than %d", length, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("pattern", "%q does not match %s", v, s.Pattern)
+		}
+	}
+	return nil
+}
+
+func isJSONType(t string, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case float64:
+		return t == "number" || (t == "integer" && v == float64(int64(v)))
+	case string:
+		return t == "string"
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	}
+	return false
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	b, _ := json.Marshal(value)
+	for _, e := range enum {
+		eb, _ := json.Marshal(e)
+		if string(b) == string(eb) {
+			return true
+		}
+	}
+	return false
+}
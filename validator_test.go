@@ -0,0 +1,56 @@
+package eventstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONSchemaValidator(t *testing.T) {
+	v := NewJSONSchemaValidator()
+	err := v.Register("AccountCreated", []byte(`{
+		"type": "object",
+		"required": ["id", "owner"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "string", "pattern": "^[a-z0-9-]+$"},
+			"owner": {"type": "string", "minLength": 1, "maxLength": 10},
+			"money": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["gold", "silver"]}}
+		}
+	}`))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		body       string
+		field      string
+		constraint string
+	}{
+		{body: `{"id": "a-1", "owner": "Paulo", "money": 10, "tags": ["gold"]}`},
+		{body: `{"id": "a-1"}`, field: "$", constraint: "required"},
+		{body: `{"id": "A 1", "owner": "Paulo"}`, field: "$.id", constraint: "pattern"},
+		{body: `{"id": "a-1", "owner": ""}`, field: "$.owner", constraint: "minLength"},
+		{body: `{"id": "a-1", "owner": "Paulo", "money": 1.5}`, field: "$.money", constraint: "type"},
+		{body: `{"id": "a-1", "owner": "Paulo", "money": -1}`, field: "$.money", constraint: "minimum"},
+		{body: `{"id": "a-1", "owner": "Paulo", "tags": ["gold", "iron"]}`, field: "$.tags[1]", constraint: "enum"},
+		{body: `{"id": "a-1", "owner": "Paulo", "other": 1}`, field: "$", constraint: "additionalProperties"},
+		{body: `[]`, field: "$", constraint: "type"},
+	}
+	for _, tc := range testCases {
+		err := v.Validate("AccountCreated", []byte(tc.body))
+		if tc.constraint == "" {
+			assert.NoError(t, err, tc.body)
+			continue
+		}
+		require.True(t, errors.Is(err, ErrInvalidEvent), "expected invalid event for %s, got %v", tc.body, err)
+		var verr *ValidationError
+		require.True(t, errors.As(err, &verr))
+		assert.Equal(t, tc.field, verr.Field, tc.body)
+		assert.Equal(t, tc.constraint, verr.Constraint, tc.body)
+	}
+
+	// kinds without schema are valid
+	assert.NoError(t, v.Validate("MoneyDeposited", []byte(`{"money": -1}`)))
+}
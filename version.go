@@ -0,0 +1,76 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quintans/faults"
+)
+
+// ErrVersionTimeout is returned when the aggregate did not reach the awaited version in time
+var ErrVersionTimeout = errors.New("timed out waiting for the aggregate version")
+
+// versionPollInterval is the interval between the reads of the current version by WaitForVersion
+const versionPollInterval = 50 * time.Millisecond
+
+// VersionReader is implemented by repositories able to read the current version of an aggregate,
+// without reading its snapshot or events.
+type VersionReader interface {
+	// CurrentVersion returns the version of the last event of the aggregate, zero if there is none.
+	CurrentVersion(ctx context.Context, aggregateID string) (uint32, error)
+}
+
+// CurrentVersion returns the current version of the aggregate, zero if it does not exist.
+// If the repository is not a VersionReader, the version is read from the latest snapshot and the events after it.
+func (es EventStore) CurrentVersion(ctx context.Context, aggregateID string) (uint32, error) {
+	if vr, ok := es.store.(VersionReader); ok {
+		return vr.CurrentVersion(ctx, aggregateID)
+	}
+
+	snap, err := es.snapshotStore().GetSnapshot(ctx, aggregateID)
+	if err != nil {
+		return 0, err
+	}
+	snapVersion := -1
+	version := uint32(0)
+	if len(snap.Body) != 0 {
+		snapVersion = int(snap.AggregateVersion)
+		version = snap.AggregateVersion
+	}
+	events, err := es.store.GetAggregateEvents(ctx, aggregateID, snapVersion)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) > 0 {
+		version = events[len(events)-1].AggregateVersion
+	}
+	return version, nil
+}
+
+// WaitForVersion polls the current version of the aggregate until it reaches at least minVersion,
+// eg: for a command handler to wait for the effect of a command dispatched to another aggregate.
+// It returns ErrVersionTimeout if that does not happen within timeout, or the context error if the context is done.
+func (es EventStore) WaitForVersion(ctx context.Context, aggregateID string, minVersion uint32, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(versionPollInterval)
+	defer ticker.Stop()
+	for {
+		version, err := es.CurrentVersion(ctx, aggregateID)
+		if err != nil {
+			return faults.Errorf("Unable to get the current version of aggregate '%s': %w", aggregateID, err)
+		}
+		if version >= minVersion {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return faults.Errorf("Unable to reach version %d of aggregate '%s' (at %d): %w", minVersion, aggregateID, version, ErrVersionTimeout)
+		case <-ctx.Done():
+			return faults.Wrap(ctx.Err())
+		}
+	}
+}
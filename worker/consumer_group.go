@@ -0,0 +1,192 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quintans/faults"
+	log "github.com/sirupsen/logrus"
+)
+
+// GroupMembership keeps the leases of the members of the consumer groups, eg: in a database table
+type GroupMembership interface {
+	// Join registers, or renews, the lease of member in group for ttl, returning the members of the group with a live lease
+	Join(ctx context.Context, group, member string, ttl time.Duration) ([]string, error)
+	// Leave removes the lease of member from group
+	Leave(ctx context.Context, group, member string) error
+}
+
+// AssignPartitions splits the partitions, 1 to partitions, in contiguous slots, one for each of the members sorted by name,
+// returning the slot of member.
+// Since every member computes the same split from the same list, no coordination other than the membership is needed.
+// If there are more members than partitions, the last members are left without a slot and false is returned.
+func AssignPartitions(partitions uint32, members []string, member string) (PartitionSlot, bool) {
+	sorted := make([]string, len(members))
+	copy(sorted, members)
+	sort.Strings(sorted)
+
+	count := uint32(len(sorted))
+	from := uint32(1)
+	for k, v := range sorted {
+		size := partitions / count
+		if uint32(k) < partitions%count {
+			size++
+		}
+		if v == member {
+			if size == 0 {
+				return PartitionSlot{}, false
+			}
+			return PartitionSlot{From: from, To: from + size - 1}, true
+		}
+		from += size
+	}
+	return PartitionSlot{}, false
+}
+
+type ConsumerGroupOption func(*ConsumerGroup)
+
+// WithGroupHeartbeat sets the interval at which the lease is renewed and the assignment is checked. Default is 5s.
+func WithGroupHeartbeat(heartbeat time.Duration) ConsumerGroupOption {
+	return func(g *ConsumerGroup) {
+		g.heartbeat = heartbeat
+	}
+}
+
+// WithGroupLeaseTTL sets how long a member is considered live without renewing its lease. Default is 3 heartbeats.
+func WithGroupLeaseTTL(ttl time.Duration) ConsumerGroupOption {
+	return func(g *ConsumerGroup) {
+		g.ttl = ttl
+	}
+}
+
+// WithGroupMemberName sets the name of the member. Default is a random UUID.
+func WithGroupMemberName(name string) ConsumerGroupOption {
+	return func(g *ConsumerGroup) {
+		g.member = name
+	}
+}
+
+// ConsumerGroup assigns the partitions among the live members of a group, rebalancing when members join or leave,
+// so that consumers scale by starting or stopping instances, without assigning the partition ranges by hand.
+type ConsumerGroup struct {
+	membership GroupMembership
+	name       string
+	member     string
+	partitions uint32
+	heartbeat  time.Duration
+	ttl        time.Duration
+}
+
+func NewConsumerGroup(membership GroupMembership, name string, partitions uint32, options ...ConsumerGroupOption) *ConsumerGroup {
+	g := &ConsumerGroup{
+		membership: membership,
+		name:       name,
+		member:     uuid.New().String(),
+		partitions: partitions,
+		heartbeat:  5 * time.Second,
+	}
+	for _, o := range options {
+		o(g)
+	}
+	if g.ttl <= 0 {
+		g.ttl = 3 * g.heartbeat
+	}
+	return g
+}
+
+func (g *ConsumerGroup) Name() string {
+	return g.name
+}
+
+func (g *ConsumerGroup) Member() string {
+	return g.member
+}
+
+func (g *ConsumerGroup) Partitions() uint32 {
+	return g.partitions
+}
+
+// Run joins the group and calls consume with the slot assigned to this member, until the context is done.
+// On every rebalance, the context of the running consume is cancelled and, after it returns, consume is called again with the new slot.
+// While the slot changes hands, the previous and the new owner may briefly consume the same partitions,
+// so consumers must handle redeliveries, as with any at least once delivery.
+// An error returned by consume stops Run, leaving the group, so that a supervising process can decide what to do.
+// A member failing to renew its lease stops consuming after the lease TTL, when its slot goes to the others.
+func (g *ConsumerGroup) Run(ctx context.Context, consume func(ctx context.Context, slot PartitionSlot) error) error {
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), g.heartbeat)
+		defer cancel()
+		if err := g.membership.Leave(ctx, g.name, g.member); err != nil {
+			log.WithError(err).Warnf("Unable to leave the consumer group '%s'", g.name)
+		}
+	}()
+
+	var (
+		current  PartitionSlot
+		assigned bool
+		cancel   context.CancelFunc = func() {}
+		done     chan error
+	)
+	stop := func() error {
+		cancel()
+		if done == nil {
+			return nil
+		}
+		err := <-done
+		done = nil
+		return err
+	}
+	defer stop()
+
+	renewed := time.Now()
+	ticker := time.NewTicker(g.heartbeat)
+	defer ticker.Stop()
+	for {
+		members, err := g.membership.Join(ctx, g.name, g.member, g.ttl)
+		if err != nil {
+			log.WithError(err).Warnf("Unable to renew the lease in the consumer group '%s'", g.name)
+			// keeps consuming the current slot until the lease expires, since by then the others will have taken it
+			if assigned && time.Since(renewed) > g.ttl {
+				log.Warnf("Lease of member '%s' in the consumer group '%s' expired. Stopping consuming.", g.member, g.name)
+				stop()
+				assigned = false
+			}
+		} else {
+			renewed = time.Now()
+			slot, ok := AssignPartitions(g.partitions, members, g.member)
+			if ok != assigned || slot != current {
+				// the revoked consume is expected to return a context error, if any
+				if err := stop(); err != nil && !errors.Is(err, context.Canceled) {
+					return faults.Errorf("Consuming partitions [%d-%d] of the consumer group '%s': %w", current.From, current.To, g.name, err)
+				}
+				current, assigned = slot, ok
+				if assigned {
+					log.Infof("Member '%s' of the consumer group '%s' assigned to partitions [%d-%d]", g.member, g.name, slot.From, slot.To)
+					cctx, cancelConsume := context.WithCancel(ctx)
+					cancel = cancelConsume
+					done = make(chan error, 1)
+					go func(ch chan error) {
+						ch <- consume(cctx, slot)
+					}(done)
+				} else {
+					log.Infof("Member '%s' of the consumer group '%s' without partitions", g.member, g.name)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-done:
+			done = nil
+			if err != nil {
+				return faults.Errorf("Consuming partitions [%d-%d] of the consumer group '%s': %w", current.From, current.To, g.name, err)
+			}
+			// consume returned without failing, eg: reached an upper bound, so it is not restarted until the next rebalance
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package worker_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quintans/eventstore/worker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignPartitions(t *testing.T) {
+	members := []string{"c", "a", "b"}
+
+	slot, ok := worker.AssignPartitions(10, members, "a")
+	require.True(t, ok)
+	assert.Equal(t, worker.PartitionSlot{From: 1, To: 4}, slot)
+	slot, ok = worker.AssignPartitions(10, members, "b")
+	require.True(t, ok)
+	assert.Equal(t, worker.PartitionSlot{From: 5, To: 7}, slot)
+	slot, ok = worker.AssignPartitions(10, members, "c")
+	require.True(t, ok)
+	assert.Equal(t, worker.PartitionSlot{From: 8, To: 10}, slot)
+
+	// more members than partitions
+	slot, ok = worker.AssignPartitions(2, members, "b")
+	require.True(t, ok)
+	assert.Equal(t, worker.PartitionSlot{From: 2, To: 2}, slot)
+	_, ok = worker.AssignPartitions(2, members, "c")
+	require.False(t, ok)
+
+	_, ok = worker.AssignPartitions(10, members, "d")
+	require.False(t, ok)
+}
+
+func TestConsumerGroup(t *testing.T) {
+	membership := NewInMemGroupMembership()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slots := &sync.Map{}
+	run := func(ctx context.Context, member string) {
+		g := worker.NewConsumerGroup(membership, "accounts", 4, worker.WithGroupMemberName(member), worker.WithGroupHeartbeat(50*time.Millisecond))
+		go g.Run(ctx, func(ctx context.Context, slot worker.PartitionSlot) error {
+			slots.Store(member, slot)
+			<-ctx.Done()
+			slots.Delete(member)
+			return nil
+		})
+	}
+	slotOf := func(member string) worker.PartitionSlot {
+		v, ok := slots.Load(member)
+		if !ok {
+			return worker.PartitionSlot{}
+		}
+		return v.(worker.PartitionSlot)
+	}
+
+	run(ctx, "a")
+	require.Eventually(t, func() bool {
+		return slotOf("a") == worker.PartitionSlot{From: 1, To: 4}
+	}, time.Second, 10*time.Millisecond)
+
+	// scaling up
+	ctxB, cancelB := context.WithCancel(ctx)
+	run(ctxB, "b")
+	require.Eventually(t, func() bool {
+		return slotOf("a") == worker.PartitionSlot{From: 1, To: 2} && slotOf("b") == worker.PartitionSlot{From: 3, To: 4}
+	}, time.Second, 10*time.Millisecond)
+
+	// scaling down
+	cancelB()
+	require.Eventually(t, func() bool {
+		return slotOf("a") == worker.PartitionSlot{From: 1, To: 4} && slotOf("b") == worker.PartitionSlot{}
+	}, time.Second, 10*time.Millisecond)
+}
+
+type InMemGroupMembership struct {
+	mu      sync.Mutex
+	members map[string]time.Time
+}
+
+func NewInMemGroupMembership() *InMemGroupMembership {
+	return &InMemGroupMembership{
+		members: map[string]time.Time{},
+	}
+}
+
+func (m *InMemGroupMembership) Join(_ context.Context, group, member string, ttl time.Duration) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.members[member] = now.Add(ttl)
+	live := []string{}
+	for k, v := range m.members {
+		if v.After(now) {
+			live = append(live, k)
+		}
+	}
+	return live, nil
+}
+
+func (m *InMemGroupMembership) Leave(_ context.Context, group, member string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.members, member)
+	return nil
+}